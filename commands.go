@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/api"
+	"github.com/MWismeck/marca-tempo/src/oidc/oidctest"
+)
+
+// parseCommand parses the flags of a command. Missing required flags print the
+// command usage and exit with status 2.
+func parseCommand(fs *flag.FlagSet, args []string, required ...string) {
+	fs.Parse(args)
+
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for _, name := range required {
+		if !set[name] {
+			fmt.Fprintf(os.Stderr, "missing required flag -%s\n", name)
+			fs.Usage()
+			os.Exit(2)
+		}
+	}
+}
+
+// parseDate parses a YYYY-MM-DD flag value.
+func parseDate(name, value string) time.Time {
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		log.Fatalf("Invalid -%s date %q, expected YYYY-MM-DD", name, value)
+	}
+	return date
+}
+
+// branchFlag returns nil for the default 0, meaning the whole company.
+func branchFlag(id uint) *uint {
+	if id == 0 {
+		return nil
+	}
+	return &id
+}
+
+// interruptible returns a context cancelled on Ctrl+C, so long running
+// commands stop where the API allows resuming them.
+func interruptible() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt)
+}
+
+func runCreateAdmin(server *api.API, args []string) {
+	fs := flag.NewFlagSet("create-admin", flag.ExitOnError)
+	name := fs.String("name", "", "Nome do administrador")
+	email := fs.String("email", "", "Email de login")
+	password := fs.String("password", os.Getenv("ADMIN_PASSWORD"), "Senha (padrão: ADMIN_PASSWORD)")
+	company := fs.String("company", "", "CNPJ da empresa")
+	companyName := fs.String("company-name", "", "Nome da empresa, para criá-la se ainda não existir")
+	parseCommand(fs, args, "name", "email", "company")
+
+	admin, err := server.CreateAdmin(api.AdminRequest{
+		Name:        *name,
+		Email:       *email,
+		Password:    *password,
+		CompanyCNPJ: *company,
+		CompanyName: *companyName,
+		RequestedBy: "cli",
+	})
+	if err != nil {
+		log.Fatal("Failed to create administrator: ", err)
+	}
+	fmt.Printf("created administrator %s (id %d)\n", admin.Email, admin.ID)
+}
+
+func runRecalculate(server *api.API, args []string) {
+	fs := flag.NewFlagSet("recalculate", flag.ExitOnError)
+	company := fs.String("company", "", "CNPJ da empresa")
+	branch := fs.Uint("branch", 0, "ID da filial (padrão: empresa inteira)")
+	employee := fs.String("employee", "", "Email de um funcionário (padrão: todos)")
+	from := fs.String("from", "", "Data inicial YYYY-MM-DD (padrão: hoje)")
+	to := fs.String("to", "", "Data final YYYY-MM-DD (padrão: sem limite)")
+	reason := fs.String("reason", "Recálculo pela linha de comando", "Motivo registrado na auditoria")
+	parseCommand(fs, args, "company")
+
+	ctx, stop := interruptible()
+	defer stop()
+
+	task, err := server.Recalculate(ctx, api.RecalculationRequest{
+		CompanyCNPJ:   *company,
+		BranchID:      branchFlag(*branch),
+		EmployeeEmail: *employee,
+		FromDate:      *from,
+		ToDate:        *to,
+		Reason:        *reason,
+		RequestedBy:   "cli",
+	})
+	if err != nil {
+		log.Fatal("Recalculation failed: ", err)
+	}
+	fmt.Printf("recalculation #%d: %d time logs processed, %d changed\n", task.ID, task.Processed, task.Changed)
+}
+
+func runExport(server *api.API, args []string) {
+	fs := flag.NewFlagSet("export", flag.ExitOnError)
+	format := fs.String("format", api.ExportAFD, "Formato: afd, xlsx ou csv")
+	company := fs.String("company", "", "CNPJ da empresa")
+	branch := fs.Uint("branch", 0, "ID da filial (padrão: empresa inteira)")
+	from := fs.String("from", "", "Data inicial YYYY-MM-DD")
+	to := fs.String("to", "", "Data final YYYY-MM-DD")
+	output := fs.String("output", "", `Arquivo de saída, "-" para a saída padrão (padrão: nome gerado no diretório atual)`)
+	parseCommand(fs, args, "company", "from", "to")
+
+	start, end := parseDate("from", *from), parseDate("to", *to)
+	if end.Before(start) {
+		log.Fatal("The -to date is before the -from date")
+	}
+
+	export, err := server.Export(*format, *company, branchFlag(*branch), start, end.AddDate(0, 0, 1))
+	if err != nil {
+		log.Fatal("Export failed: ", err)
+	}
+
+	if *output == "-" {
+		os.Stdout.Write(export.Content)
+		return
+	}
+	path := *output
+	if path == "" {
+		path = filepath.Base(export.Filename)
+	}
+	if err := os.WriteFile(path, export.Content, 0o644); err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("written", path)
+}
+
+func runImport(server *api.API, args []string) {
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, `usage: marca-tempo import <employees.csv | ->
+
+The first line names the columns: name, email, cpf, rg, age, company_cnpj and
+password are required; workload and active are optional.`)
+	}
+	fs.Parse(args)
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var in io.Reader = os.Stdin
+	if path := fs.Arg(0); path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	result, err := server.ImportEmployees(in)
+	if err != nil {
+		log.Fatal("Import failed: ", err)
+	}
+	for _, e := range result.Errors {
+		fmt.Fprintf(os.Stderr, "line %d %s: %s\n", e.Line, e.Email, e.Error)
+	}
+	fmt.Printf("%d employees imported, %d lines rejected\n", result.Created, len(result.Errors))
+	if len(result.Errors) > 0 {
+		os.Exit(1)
+	}
+}
+
+func runCloseMonth(server *api.API, args []string) {
+	fs := flag.NewFlagSet("close-month", flag.ExitOnError)
+	company := fs.String("company", "", "CNPJ da empresa")
+	month := fs.String("month", "", "Mês YYYY-MM (padrão: mês anterior)")
+	parseCommand(fs, args, "company")
+
+	now := server.Clock.Now()
+	first := time.Date(now.Year(), now.Month()-1, 1, 0, 0, 0, 0, time.UTC)
+	if *month != "" {
+		var err error
+		if first, err = time.Parse("2006-01", *month); err != nil {
+			log.Fatalf("Invalid -month %q, expected YYYY-MM", *month)
+		}
+	}
+
+	ctx, stop := interruptible()
+	defer stop()
+
+	summaries, err := server.CloseMonth(ctx, *company, first)
+	if err != nil {
+		log.Fatal("Failed to close month: ", err)
+	}
+
+	fmt.Printf("%-30s %-30s %5s %9s %9s %9s %9s\n", "NAME", "EMAIL", "DAYS", "COMPLETE", "EXTRA", "MISSING", "BALANCE")
+	for _, s := range summaries {
+		fmt.Printf("%-30s %-30s %5d %9d %9.2f %9.2f %9.2f\n", s.Name, s.Email, s.Days, s.CompletedDays, s.ExtraHours, s.MissingHours, s.Balance)
+	}
+}
+
+func runMockOIDC(args []string) {
+	fs := flag.NewFlagSet("mock-oidc", flag.ExitOnError)
+	addr := fs.String("addr", "localhost:9000", "Endereço em que o provedor escuta")
+	clientID := fs.String("client-id", "marca-tempo", "Client ID aceito")
+	clientSecret := fs.String("client-secret", "", "Client secret exigido (padrão: nenhum, apenas PKCE)")
+	subject := fs.String("sub", "mock-user", "Identificador (sub) do usuário logado")
+	email := fs.String("email", "", "Email do usuário logado")
+	claim := fs.String("claim", "email", "Claim que recebe o email")
+	parseCommand(fs, args, "email")
+
+	provider := oidctest.New(*clientID)
+	provider.ClientSecret = *clientSecret
+	provider.Issuer = "http://" + *addr
+	provider.SetClaims(map[string]interface{}{"sub": *subject, *claim: *email, "name": *email})
+
+	fmt.Printf("mock OpenID Connect provider at %s, logging in %s as %s\n", provider.Issuer, *subject, *email)
+	fmt.Printf("configure the company with sso_issuer %q and sso_client_id %q\n", provider.Issuer, *clientID)
+	log.Fatal(http.ListenAndServe(*addr, provider))
+}
@@ -1,29 +1,138 @@
 package main
 
 import (
-	"github.com/MWismeck/marca-tempo/src/api"
-	"github.com/MWismeck/marca-tempo/src/db"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 	"time"
+
+	"github.com/MWismeck/marca-tempo/src/api"
+	"github.com/MWismeck/marca-tempo/src/clock"
+	"github.com/MWismeck/marca-tempo/src/config"
+	"github.com/MWismeck/marca-tempo/src/db"
 )
 
+const usage = `usage: marca-tempo [flags] [command] [command flags]
+
+commands:
+  serve          start the server (default when no command is given)
+  migrate        manage database migrations, see "migrate" without arguments
+  print-config   print the effective configuration
+  create-admin   create an administrator of a company
+  recalculate    recalculate the hours of a company, branch or employee now
+  export         export the time logs of a company or branch (afd, xlsx, csv)
+  import         import employees from a CSV file
+  close-month    close the days of a month and print its summary
+  mock-oidc      run a mock OpenID Connect provider to try single sign-on locally
+
+Run "marca-tempo <command> -h" for the flags of each command.
+
+flags:`
+
 func main() {
-	// Initialize the database
-	database := db.Init()
+	configFile := flag.String("config", "", "Arquivo de configuração YAML (padrão: CONFIG_FILE ou config.yaml, se existir)")
+	fakeNow := flag.String("fake-now", "", "Simula a data/hora inicial do servidor (RFC3339), apenas para desenvolvimento")
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, usage)
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	// Create and configure the server
-	server := api.NewServer(database)
+	cfg, err := config.Load(*configFile)
 
-	// Start the server in a goroutine
-	go func() {
-		if err := server.Start(); err != nil {
-			log.Fatal("Failed to start server:", err)
+	command, args := flag.Arg(0), flag.Args()
+	if len(args) > 0 {
+		args = args[1:]
+	}
+
+	switch command {
+	case "print-config":
+		printConfig(cfg, err)
+		return
+	case "mock-oidc":
+		runMockOIDC(args)
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// Real clock unless a simulated start date was requested
+	clk := clock.New()
+	if *fakeNow != "" {
+		start, err := time.Parse(time.RFC3339, *fakeNow)
+		if err != nil {
+			log.Fatal("Invalid -fake-now value:", err)
 		}
+		log.Println("Using simulated clock starting at", start.Format(time.RFC3339))
+		clk = clock.NewOffset(start)
+	}
+
+	switch command {
+	case "", "serve":
+		runServe(cfg, clk)
+	case "migrate":
+		runMigrate(cfg, args)
+	case "create-admin":
+		runCreateAdmin(newServer(cfg, clk), args)
+	case "recalculate":
+		runRecalculate(newServer(cfg, clk), args)
+	case "export":
+		runExport(newServer(cfg, clk), args)
+	case "import":
+		runImport(newServer(cfg, clk), args)
+	case "close-month":
+		runCloseMonth(newServer(cfg, clk), args)
+	default:
+		flag.Usage()
+		os.Exit(2)
+	}
+}
+
+// newServer connects to the database and builds the API the commands run
+// against; the HTTP server and the scheduler are not started.
+func newServer(cfg config.Config, clk clock.Clock) *api.API {
+	return api.NewServer(cfg, db.Init(cfg.Database), clk)
+}
+
+// runServe serves until SIGINT or SIGTERM and exits with status 1 when the
+// server fails or does not shut down cleanly. A second signal during the
+// shutdown stops the process right away.
+func runServe(cfg config.Config, clk clock.Clock) {
+	database := db.Init(cfg.Database)
+	server := api.NewServer(cfg, database, clk)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
 	}()
 
-	// Wait a moment for the server to start
-	time.Sleep(1 * time.Second)
+	err := server.Run(ctx)
+	if closeErr := db.Close(database); closeErr != nil {
+		err = errors.Join(err, fmt.Errorf("close database: %w", closeErr))
+	}
+	if err != nil {
+		log.Println(err)
+		os.Exit(1)
+	}
+}
 
-	// Keep the main goroutine running
-	select {}
+// printConfig writes the effective configuration as YAML. An invalid
+// configuration is printed as well, followed by what is wrong with it.
+func printConfig(cfg config.Config, loadErr error) {
+	out, err := cfg.YAML()
+	if err != nil {
+		log.Fatal(err)
+	}
+	os.Stdout.Write(out)
+	if loadErr != nil {
+		fmt.Fprintln(os.Stderr, loadErr)
+		os.Exit(1)
+	}
 }
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/config"
+	"github.com/MWismeck/marca-tempo/src/db"
+)
+
+const migrateUsage = `usage: marca-tempo migrate <command>
+
+commands:
+  up          apply all pending migrations
+  down [n]    roll back the last n migrations (default 1)
+  status      list migrations and when they were applied`
+
+// runMigrate implements the migrate command against the configured database.
+func runMigrate(cfg config.Config, args []string) {
+	if len(args) == 0 {
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+
+	database, err := db.Open(cfg.Database.Driver, cfg.Database.DSN)
+	if err != nil {
+		log.Fatal("Failed to connect to database: ", err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := db.Migrate(database)
+		for _, id := range applied {
+			fmt.Println("applied", id)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("schema already up to date")
+		}
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			if steps, err = strconv.Atoi(args[1]); err != nil || steps < 1 {
+				log.Fatal("Invalid number of migrations to roll back: ", args[1])
+			}
+		}
+		reverted, err := db.Rollback(database, steps)
+		for _, id := range reverted {
+			fmt.Println("rolled back", id)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+
+	case "status":
+		statuses, err := db.Status(database)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, s := range statuses {
+			applied := "pending"
+			if s.AppliedAt != nil {
+				applied = s.AppliedAt.Format("2006-01-02 15:04:05")
+			}
+			fmt.Printf("%-30s %-20s %s\n", s.ID, applied, s.Description)
+		}
+
+	default:
+		fmt.Fprintln(os.Stderr, migrateUsage)
+		os.Exit(2)
+	}
+}
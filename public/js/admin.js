@@ -1,4 +1,7 @@
 document.addEventListener("DOMContentLoaded", () => {
+  // As rotas de administração são autorizadas pela sessão aberta no login
+  axios.defaults.headers.common["Authorization"] = `Bearer ${localStorage.getItem("session_token")}`;
+
   // Cadastrar Empresa
   const formCompany = document.getElementById("form-company");
   formCompany.addEventListener("submit", async (e) => {
@@ -74,10 +77,78 @@ document.addEventListener("DOMContentLoaded", () => {
     }
   });
 
+  // Terminais de ponto: a chave aparece uma única vez, ao cadastrar ou trocar
+  const kioskKey = document.getElementById("kiosk-key");
+  function showKioskKey(data) {
+    kioskKey.innerHTML = `<div class="alert alert-warning">Chave do terminal <strong>${data.device.name}</strong>
+      (anote, ela não será exibida novamente):<br><code>${data.key}</code></div>`;
+  }
+
+  async function loadKiosks() {
+    try {
+      const res = await axios.get("http://localhost:8080/admin/kiosk_devices");
+      let html = `<table class="table table-sm"><thead><tr><th>Terminal</th><th>CNPJ</th><th>Último uso</th><th>Situação</th><th></th></tr></thead><tbody>`;
+      res.data.forEach((device) => {
+        const lastSeen = device.last_seen_at && device.last_seen_at !== "0001-01-01T00:00:00Z"
+          ? new Date(device.last_seen_at).toLocaleString("pt-BR") : "-";
+        html += `<tr>
+          <td>${device.name}</td><td>${device.company_cnpj}</td><td>${lastSeen}</td>
+          <td>${device.active ? "Ativo" : "Inativo"}</td>
+          <td class="text-end">
+            <button class="btn btn-sm btn-outline-secondary" data-kiosk-rotate="${device.ID}">Trocar chave</button>
+            <button class="btn btn-sm btn-outline-${device.active ? "danger" : "success"}" data-kiosk-active="${device.ID}" data-active="${!device.active}">
+              ${device.active ? "Desativar" : "Reativar"}</button>
+          </td></tr>`;
+      });
+      html += `</tbody></table>`;
+      document.getElementById("list-kiosks").innerHTML = html;
+    } catch (err) {
+      console.error("Erro ao carregar terminais:", err);
+      alert("Erro ao carregar terminais.");
+    }
+  }
+
+  document.getElementById("form-kiosk").addEventListener("submit", async (e) => {
+    e.preventDefault();
+    try {
+      const res = await axios.post("http://localhost:8080/admin/kiosk_devices", {
+        name: document.getElementById("kiosk-name").value,
+        company_cnpj: document.getElementById("kiosk-cnpj").value,
+      });
+      showKioskKey(res.data);
+      e.target.reset();
+      loadKiosks();
+    } catch (err) {
+      console.error("Erro ao cadastrar terminal:", err);
+      alert("Erro ao cadastrar terminal: " + (err.response?.data?.error || err.message));
+    }
+  });
+  document.getElementById("btn-load-kiosks").addEventListener("click", loadKiosks);
+  document.getElementById("list-kiosks").addEventListener("click", async (e) => {
+    const button = e.target.closest("button");
+    if (!button) return;
+    try {
+      if (button.dataset.kioskRotate) {
+        if (!confirm("Trocar a chave? O terminal precisará ser configurado novamente.")) return;
+        const res = await axios.post(`http://localhost:8080/admin/kiosk_devices/${button.dataset.kioskRotate}/rotate_key`);
+        showKioskKey(res.data);
+      } else if (button.dataset.kioskActive) {
+        await axios.put(`http://localhost:8080/admin/kiosk_devices/${button.dataset.kioskActive}`, {
+          active: button.dataset.active === "true",
+        });
+      }
+      loadKiosks();
+    } catch (err) {
+      console.error("Erro ao alterar terminal:", err);
+      alert("Erro ao alterar terminal: " + (err.response?.data?.error || err.message));
+    }
+  });
+
   // Logout
   const logoutBtn = document.getElementById("btn-logout");
   if (logoutBtn) {
-    logoutBtn.addEventListener("click", () => {
+    logoutBtn.addEventListener("click", async () => {
+      await axios.post("http://localhost:8080/logout").catch(() => {});
       localStorage.clear();
       window.location.href = "index.html";
     });
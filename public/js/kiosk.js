@@ -0,0 +1,93 @@
+document.addEventListener("DOMContentLoaded", () => {
+    const setupForm = document.getElementById("kiosk-setup");
+    const punchForm = document.getElementById("kiosk-punch");
+    const identification = document.getElementById("kiosk-identification");
+    const pin = document.getElementById("kiosk-pin");
+    const message = document.getElementById("kiosk-message");
+    const punchNames = {
+        entrada: "Entrada",
+        saida_almoco: "Saída para almoço",
+        retorno_almoco: "Retorno do almoço",
+        saida: "Saída",
+    };
+    let clearTimer;
+
+    function showMessage(type, html) {
+        clearTimeout(clearTimer);
+        message.className = `alert alert-${type} mt-3`;
+        message.innerHTML = html;
+        // O comprovante some sozinho para o próximo funcionário
+        clearTimer = setTimeout(() => { message.className = ""; message.innerHTML = ""; }, 8000);
+    }
+
+    function deviceHeaders() {
+        return { headers: { "X-Device-Key": localStorage.getItem("kiosk_key") } };
+    }
+
+    async function start() {
+        if (!localStorage.getItem("kiosk_key")) {
+            setupForm.classList.remove("d-none");
+            return;
+        }
+        try {
+            const res = await axios.get("http://localhost:8080/kiosk/device", deviceHeaders());
+            document.getElementById("kiosk-title").textContent = `${res.data.company_name} - ${res.data.name}`;
+            setupForm.classList.add("d-none");
+            punchForm.classList.remove("d-none");
+            identification.focus();
+        } catch (err) {
+            localStorage.removeItem("kiosk_key");
+            setupForm.classList.remove("d-none");
+            showMessage("danger", err.response?.data?.error || "Não foi possível conectar ao servidor.");
+        }
+    }
+
+    setupForm.addEventListener("submit", (e) => {
+        e.preventDefault();
+        localStorage.setItem("kiosk_key", document.getElementById("kiosk-key").value.trim());
+        setupForm.reset();
+        start();
+    });
+
+    // Pelo PIN o funcionário se identifica sem crachá nem matrícula
+    document.querySelectorAll("input[name='kiosk-method']").forEach((radio) => {
+        radio.addEventListener("change", () => {
+            const byPIN = radio.value === "pin";
+            document.getElementById("kiosk-identification-field").classList.toggle("d-none", byPIN);
+            identification.required = !byPIN;
+            pin.required = byPIN;
+        });
+    });
+
+    punchForm.addEventListener("submit", async (e) => {
+        e.preventDefault();
+        const method = document.querySelector("input[name='kiosk-method']:checked").value;
+        const body = method === "pin"
+            ? { pin: pin.value.trim() }
+            : { [method]: identification.value.trim(), pin: pin.value.trim() };
+        identification.value = "";
+        pin.value = "";
+        try {
+            const res = await axios.post("http://localhost:8080/kiosk/punch", body, deviceHeaders());
+            const receipt = res.data;
+            showMessage("success", `
+                <h5 class="mb-1">Ponto registrado: ${punchNames[receipt.punch] || receipt.punch}</h5>
+                <div>${receipt.employee_name}${receipt.matricula ? ` (matrícula ${receipt.matricula})` : ""}</div>
+                <div class="fs-4 fw-bold">${receipt.local_time}</div>
+                <small class="text-muted">Terminal ${receipt.device}</small>`);
+        } catch (err) {
+            if (err.response?.status === 401) {
+                localStorage.removeItem("kiosk_key");
+                punchForm.classList.add("d-none");
+                setupForm.classList.remove("d-none");
+            }
+            showMessage("danger", err.response?.data?.error || "Erro ao registrar ponto. Tente novamente.");
+        }
+        identification.focus();
+    });
+
+    setInterval(() => {
+        document.getElementById("kiosk-clock").textContent = new Date().toLocaleString("pt-BR");
+    }, 1000);
+    start();
+});
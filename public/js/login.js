@@ -5,7 +5,16 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
     const password = document.getElementById('login-password').value;
 
     try {
-        const response = await axios.post('http://localhost:8080/login', { email, password });
+        let response = await axios.post('http://localhost:8080/login', { email, password });
+
+        // Contas com autenticação em dois fatores confirmam o login com o código do aplicativo
+        if (response.data.two_factor_required) {
+            const code = prompt("Digite o código do aplicativo autenticador ou um código de recuperação:");
+            if (!code) {
+                return;
+            }
+            response = await axios.post('http://localhost:8080/login/2fa', { challenge: response.data.challenge, code });
+        }
 
         if (response.status === 200) {
             const data = response.data;
@@ -13,6 +22,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
             localStorage.setItem('employee_id', data.employee_id || "");
             localStorage.setItem('employee_name', data.employee_name || "");
             localStorage.setItem('role', data.role || "");
+            localStorage.setItem('session_token', data.token || "");
             localStorage.setItem('session_active', "true");
 
             const messageElement = document.createElement('div');
@@ -33,7 +43,7 @@ document.getElementById('login-form').addEventListener('submit', async (event) =
     } catch (err) {
         const messageElement = document.createElement('div');
         messageElement.className = 'alert alert-danger mt-3';
-        messageElement.textContent = err.response?.data || 'Erro ao realizar login. Verifique suas credenciais.';
+        messageElement.textContent = err.response?.data?.error || err.response?.data || 'Erro ao realizar login. Verifique suas credenciais.';
 
         const previousMessage = document.querySelector('#login-form .alert');
         if (previousMessage) {
@@ -4,12 +4,17 @@ document.addEventListener("DOMContentLoaded", () => {
   const modal = new bootstrap.Modal(document.getElementById("editModal"));
   const exportModal = new bootstrap.Modal(document.getElementById("exportModal"));
   const processModal = new bootstrap.Modal(document.getElementById("processRequestModal"));
+  const punchesModal = new bootstrap.Modal(document.getElementById("punchesModal"));
   
   let logsCache = [];
   let currentEmail = "";
   let currentRequestId = null;
+  let editRequestId = null;
   const managerName = localStorage.getItem("employee_name");
 
+  // As rotas do gerente são autorizadas pela sessão aberta no login
+  axios.defaults.headers.common["Authorization"] = `Bearer ${localStorage.getItem("session_token")}`;
+
   function formatInput(label, value, name) {
     const val = value ? new Date(value).toISOString().slice(0, 16) : "";
     return `
@@ -31,7 +36,7 @@ document.addEventListener("DOMContentLoaded", () => {
       }
 
       console.log("Buscando funcionários da empresa do gerente:", managerEmail);
-      const res = await axios.get(`http://localhost:8080/employees/?active=true&manager_email=${encodeURIComponent(managerEmail)}`);
+      const res = await axios.get("http://localhost:8080/employees/?active=true");
       console.log("Resposta da API:", res.data);
       
       const employees = res.data["employees:"] || [];
@@ -46,7 +51,10 @@ document.addEventListener("DOMContentLoaded", () => {
         <tr>
           <td>${emp.name}</td>
           <td>${emp.email}</td>
-          <td><button class="btn btn-sm btn-primary" onclick="editLogs('${emp.email}')">Editar</button></td>
+          <td>
+            <button class="btn btn-sm btn-primary" onclick="editLogs('${emp.email}')">Editar</button>
+            <button class="btn btn-sm btn-outline-secondary" onclick="showPunches('${emp.email}')">Marcações</button>
+          </td>
         </tr>
       `).join("");
       
@@ -74,7 +82,7 @@ document.addEventListener("DOMContentLoaded", () => {
       }
 
       console.log("Carregando solicitações para gerente:", managerEmail);
-      const res = await axios.get(`http://localhost:8080/manager/requests?manager_email=${encodeURIComponent(managerEmail)}`);
+      const res = await axios.get("http://localhost:8080/manager/requests");
       
       // Verificação de segurança para evitar erros
       const responseData = res.data || {};
@@ -191,8 +199,7 @@ document.addEventListener("DOMContentLoaded", () => {
       currentRequestId = requestId;
       
       // Buscar detalhes da solicitação
-      const managerEmail = localStorage.getItem("employee_email");
-      const res = await axios.get(`http://localhost:8080/manager/requests?manager_email=${encodeURIComponent(managerEmail)}`);
+      const res = await axios.get("http://localhost:8080/manager/requests");
       const { pending } = res.data;
       
       const request = pending.find(req => req.ID === requestId);
@@ -355,12 +362,9 @@ document.addEventListener("DOMContentLoaded", () => {
     }
 
     try {
-      const managerEmail = localStorage.getItem("employee_email");
-      
       const body = {
         status: status,
-        comentario_gerente: comentario,
-        gerente_email: managerEmail
+        comentario_gerente: comentario
       };
 
       console.log("Processando solicitação:", { requestId: currentRequestId, body });
@@ -380,8 +384,7 @@ document.addEventListener("DOMContentLoaded", () => {
         
         if (autoEdit) {
           // Buscar detalhes da solicitação para obter o email do funcionário
-          const managerEmail = localStorage.getItem("employee_email");
-          const res = await axios.get(`http://localhost:8080/manager/requests?manager_email=${encodeURIComponent(managerEmail)}`);
+          const res = await axios.get("http://localhost:8080/manager/requests");
           const allRequests = [...res.data.pending, ...res.data.processed];
           const request = allRequests.find(req => req.ID === currentRequestId);
           
@@ -390,7 +393,7 @@ document.addEventListener("DOMContentLoaded", () => {
             const suggestedValues = extractSuggestedValues(request.motivo);
             
             setTimeout(() => {
-              editLogs(request.funcionario_email, suggestedValues, request.data_solicitada);
+              editLogs(request.funcionario_email, suggestedValues, request.data_solicitada, request.ID);
             }, 500);
           }
         }
@@ -403,9 +406,59 @@ document.addEventListener("DOMContentLoaded", () => {
     }
   }
 
+  // Marcações dos últimos dias com o local de trabalho, a localização e a origem
+  const geofenceBadges = {
+    dentro: '<span class="badge bg-success">Dentro da cerca</span>',
+    fora: '<span class="badge bg-danger">Fora da cerca</span>',
+    sem_localizacao: '<span class="badge bg-warning text-dark">Sem localização</span>',
+  };
+  const punchSources = {
+    web: "Web",
+    mobile: "Celular",
+    quiosque: "Quiosque",
+    edicao_manual: "Edição manual",
+    importacao: "Importação",
+    solicitacao_aprovada: "Solicitação aprovada",
+  };
+  window.showPunches = async function(email) {
+    const body = document.getElementById("punches-list");
+    body.innerHTML = "<tr><td colspan='5' class='text-center'>Carregando...</td></tr>";
+    punchesModal.show();
+    try {
+      const res = await axios.get(`http://localhost:8080/manager/punches?employee_email=${encodeURIComponent(email)}`);
+      const punches = res.data || [];
+      if (punches.length === 0) {
+        body.innerHTML = "<tr><td colspan='5' class='text-center'>Nenhuma marcação nos últimos dias.</td></tr>";
+        return;
+      }
+      body.innerHTML = punches.map(p => {
+        const location = p.latitude != null
+          ? `<a href="https://www.openstreetmap.org/?mlat=${p.latitude}&mlon=${p.longitude}#map=18/${p.latitude}/${p.longitude}" target="_blank">${p.latitude.toFixed(5)}, ${p.longitude.toFixed(5)}</a>${p.accuracy ? ` (±${Math.round(p.accuracy)} m)` : ""}`
+          : "-";
+        return `
+          <tr>
+            <td>${p.local_time}</td>
+            <td>${p.punch}</td>
+            <td>${p.workplace || "-"}</td>
+            <td>${location} ${geofenceBadges[p.geofence_status] || ""}</td>
+            <td title="${p.user_agent || ""}">
+              ${punchSources[p.source] || p.source || "-"}
+              <br><small class="text-muted">${[p.client_ip, p.device_id].filter(Boolean).join(" · ")}</small>
+            </td>
+          </tr>
+        `;
+      }).join("");
+    } catch (err) {
+      console.error("Erro ao carregar marcações:", err);
+      const errorMsg = err.response?.data?.error || "Erro ao carregar marcações.";
+      body.innerHTML = `<tr><td colspan='5' class='text-center text-danger'>${errorMsg}</td></tr>`;
+    }
+  };
+
   // Torna a função editLogs global para ser acessível pelo HTML
-  window.editLogs = async function(email, suggestedValues = null, requestDate = null) {
+  window.editLogs = async function(email, suggestedValues = null, requestDate = null, requestId = null) {
     currentEmail = email;
+    editRequestId = requestId; // a edição atende a uma solicitação aprovada
     try {
       const res = await axios.get(`http://localhost:8080/time_logs?employee_email=${email}`);
       logsCache = res.data;
@@ -488,7 +541,6 @@ document.addEventListener("DOMContentLoaded", () => {
   document.getElementById("edit-form").addEventListener("submit", async (e) => {
     e.preventDefault();
     const inputs = e.target.elements;
-    const managerEmail = localStorage.getItem("employee_email");
     
     // Validação do motivo
     const motivo = inputs.motivo_edicao.value.trim();
@@ -502,9 +554,9 @@ document.addEventListener("DOMContentLoaded", () => {
       lunch_exit_time: inputs.lunch_exit_time.value,
       lunch_return_time: inputs.lunch_return_time.value,
       exit_time: inputs.exit_time.value,
-      motivo_edicao: motivo,
-      manager_email: managerEmail
+      motivo_edicao: motivo
     };
+    if (editRequestId) body.request_id = editRequestId;
 
     try {
       const id = logsCache[0].ID || logsCache[0].id;
@@ -534,7 +586,7 @@ document.addEventListener("DOMContentLoaded", () => {
   // Formulário de exportação por período
   const formExport = document.getElementById("form-export");
   if (formExport) {
-    formExport.addEventListener("submit", (e) => {
+    formExport.addEventListener("submit", async (e) => {
       e.preventDefault();
       const email = document.getElementById("export-email").value;
       const start = document.getElementById("export-start").value;
@@ -545,17 +597,29 @@ document.addEventListener("DOMContentLoaded", () => {
         return;
       }
 
+      // Baixado pelo axios, que envia o token da sessão
       const url = `http://localhost:8080/time_logs/export_range?employee_email=${encodeURIComponent(email)}&start=${start}&end=${end}`;
-      window.open(url, "_blank");
-      exportModal.hide();
+      try {
+        const res = await axios.get(url, { responseType: "blob" });
+        const link = document.createElement("a");
+        link.href = URL.createObjectURL(res.data);
+        link.download = `Relatorio_${email}_${start}_${end}.xlsx`;
+        link.click();
+        URL.revokeObjectURL(link.href);
+        exportModal.hide();
+      } catch (err) {
+        console.error("Erro ao exportar:", err);
+        alert(err.response?.status === 404 ? "Nenhum registro no período selecionado." : "Erro ao exportar registros.");
+      }
     });
   }
 
   // Logout
   const logoutBtn = document.getElementById("btn-logout");
   if (logoutBtn) {
-    logoutBtn.addEventListener("click", () => {
+    logoutBtn.addEventListener("click", async () => {
       if (confirm("Deseja realmente sair?")) {
+        await axios.post("http://localhost:8080/logout").catch(() => {});
         localStorage.clear();
         window.location.href = "index.html";
       }
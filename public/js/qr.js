@@ -0,0 +1,42 @@
+document.addEventListener("DOMContentLoaded", () => {
+    const workplaceId = new URLSearchParams(window.location.search).get("local");
+    const key = localStorage.getItem("kiosk_key");
+    const message = document.getElementById("qr-message");
+    const expires = document.getElementById("qr-expires");
+    const qrcode = new QRCode(document.getElementById("qr-code"), { width: 320, height: 320 });
+    let expiresAt = 0;
+
+    if (!key || !workplaceId) {
+        message.className = "alert alert-warning mt-3";
+        message.innerHTML = 'Configure o terminal em <a href="kiosk.html">kiosk.html</a> e abra esta página com <code>?local=ID</code> do local de trabalho.';
+        return;
+    }
+
+    async function refresh() {
+        try {
+            const res = await axios.get(`http://localhost:8080/kiosk/workplaces/${workplaceId}/qr_code`, {
+                headers: { "X-Device-Key": key },
+            });
+            // O celular abre a página de registro de ponto com o código no fragmento
+            qrcode.makeCode(`${window.location.origin}/time-registration.html#qr=${encodeURIComponent(res.data.code)}`);
+            document.getElementById("qr-workplace").textContent = res.data.workplace;
+            expiresAt = new Date(res.data.expires_at).getTime();
+            message.className = "";
+            message.textContent = "";
+        } catch (err) {
+            message.className = "alert alert-danger mt-3";
+            message.textContent = err.response?.data?.error || "Não foi possível obter o QR code.";
+            expiresAt = Date.now() + 5000;
+        }
+    }
+
+    setInterval(() => {
+        const seconds = Math.ceil((expiresAt - Date.now()) / 1000);
+        if (seconds <= 0) {
+            refresh();
+        } else {
+            expires.textContent = `Novo código em ${seconds}s`;
+        }
+    }, 1000);
+    refresh();
+});
@@ -36,26 +36,20 @@ document.addEventListener("DOMContentLoaded", function () {
                 registerForm.appendChild(messageElement);
 
                 // Cria o funcionário
-                const employeeResponse = await axios.post('http://localhost:8080/employee/', employee);
+                // Apenas administradores cadastram funcionários
+                const employeeResponse = await axios.post('http://localhost:8080/employee/', employee, {
+                    headers: { Authorization: `Bearer ${localStorage.getItem("session_token")}` }
+                });
 
+                // O cadastro do funcionário já grava o login com a senha informada
                 if (employeeResponse.status === 200 || employeeResponse.status === 201) {
-                    // Cria ou atualiza a senha
-                    const passwordResponse = await axios.post('http://localhost:8080/login/password', {
-                        email: employee.email,
-                        password: password
-                    });
+                    messageElement.className = 'alert alert-success mt-3';
+                    messageElement.textContent = 'Funcionário e senha cadastrados com sucesso! Redirecionando...';
 
-                    if (passwordResponse.status === 200) {
-                        messageElement.className = 'alert alert-success mt-3';
-                        messageElement.textContent = 'Funcionário e senha cadastrados com sucesso! Redirecionando para o login...';
-                        
-                        // Redireciona para o login após um breve delay
-                        setTimeout(() => {
-                            window.location.href = "index.html"; // Redirecionando para a página de login
-                        }, 2000);
-                    } else {
-                        throw new Error('Falha ao registrar senha');
-                    }
+                    // Redireciona para o login após um breve delay
+                    setTimeout(() => {
+                        window.location.href = "admin.html"; // Volta ao painel do administrador
+                    }, 2000);
                 } else {
                     throw new Error('Falha ao criar funcionário');
                 }
@@ -65,7 +59,7 @@ document.addEventListener("DOMContentLoaded", function () {
                 messageElement.className = 'alert alert-danger mt-3';
                 
                 if (error.response && error.response.data) {
-                    messageElement.textContent = error.response.data;
+                    messageElement.textContent = error.response.data.error || error.response.data;
                 } else {
                     messageElement.textContent = 'Erro ao registrar o funcionário. Verifique os dados e tente novamente.';
                 }
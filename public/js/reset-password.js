@@ -0,0 +1,50 @@
+document.addEventListener("DOMContentLoaded", function () {
+    const token = new URLSearchParams(window.location.search).get('token');
+    const forgotForm = document.getElementById('forgot-form');
+    const resetForm = document.getElementById('reset-form');
+    const message = document.getElementById('reset-message');
+
+    function showMessage(type, text) {
+        message.className = `alert alert-${type} mt-3`;
+        message.textContent = text;
+    }
+
+    if (!token) {
+        forgotForm.classList.remove('d-none');
+        forgotForm.addEventListener('submit', async (e) => {
+            e.preventDefault();
+            try {
+                const response = await axios.post('http://localhost:8080/login/password/forgot', {
+                    email: document.getElementById('forgot-email').value
+                });
+                showMessage('success', response.data.message);
+            } catch (error) {
+                showMessage('danger', error.response?.data?.error || 'Erro ao solicitar a redefinição de senha.');
+                console.error(error);
+            }
+        });
+        return;
+    }
+
+    resetForm.classList.remove('d-none');
+    resetForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
+
+        const password = document.getElementById('reset-password').value;
+        if (password !== document.getElementById('reset-confirm').value) {
+            showMessage('danger', 'As senhas não conferem.');
+            return;
+        }
+
+        try {
+            await axios.post('http://localhost:8080/login/password/reset', { token, password });
+            showMessage('success', 'Senha redefinida com sucesso! Redirecionando para o login...');
+            setTimeout(() => {
+                window.location.href = "index.html";
+            }, 2000);
+        } catch (error) {
+            showMessage('danger', error.response?.data?.error || 'Erro ao redefinir a senha.');
+            console.error(error);
+        }
+    });
+});
@@ -0,0 +1,66 @@
+document.addEventListener("DOMContentLoaded", function () {
+    // O retorno do login único chega no fragmento da URL
+    const result = new URLSearchParams(window.location.hash.substring(1));
+    const form = document.getElementById('sso-form');
+    const message = document.getElementById('sso-message');
+
+    function showMessage(type, text) {
+        message.className = `alert alert-${type} mt-3`;
+        message.textContent = text;
+    }
+
+    function signIn(data) {
+        localStorage.setItem('employee_email', data.employee_email);
+        localStorage.setItem('employee_id', data.employee_id || "");
+        localStorage.setItem('employee_name', data.employee_name || "");
+        localStorage.setItem('role', data.role || "");
+        localStorage.setItem('session_token', data.token || "");
+        localStorage.setItem('session_active', "true");
+
+        showMessage('success', 'Login realizado com sucesso! Redirecionando...');
+        if (data.role === "manager") {
+            const escolha = confirm("Você deseja acessar o painel do gerente?\nClique em 'Cancelar' para registrar ponto como funcionário.");
+            window.location.href = escolha ? "manager.html" : "time-registration.html";
+        } else if (data.role === "admin") {
+            window.location.href = "admin.html";
+        } else {
+            window.location.href = "time-registration.html";
+        }
+    }
+
+    if (result.get('employee_email')) {
+        history.replaceState(null, "", window.location.pathname);
+        signIn(Object.fromEntries(result));
+        return;
+    }
+
+    // Contas com autenticação em dois fatores confirmam o login com o código do aplicativo
+    if (result.get('two_factor_required')) {
+        history.replaceState(null, "", window.location.pathname);
+        const code = prompt("Digite o código do aplicativo autenticador ou um código de recuperação:");
+        if (code) {
+            fetch('http://localhost:8080/login/2fa', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({ challenge: result.get('challenge'), code }),
+            }).then(async (response) => {
+                const data = await response.json().catch(() => ({}));
+                if (!response.ok) {
+                    throw new Error(data.error || 'Código de verificação inválido');
+                }
+                signIn(data);
+            }).catch((err) => showMessage('danger', err.message));
+            return;
+        }
+    }
+
+    if (result.get('error')) {
+        showMessage('danger', result.get('error'));
+    }
+    form.classList.remove('d-none');
+    form.addEventListener('submit', (e) => {
+        e.preventDefault();
+        const cnpj = document.getElementById('sso-cnpj').value.replace(/\D/g, '');
+        window.location.href = `http://localhost:8080/login/sso/${cnpj}`;
+    });
+});
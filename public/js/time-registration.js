@@ -1,4 +1,12 @@
 document.addEventListener("DOMContentLoaded", () => {
+    // QR code do local de trabalho lido com a câmera do celular; guardado na
+    // sessão para sobreviver ao login, caso ele seja necessário
+    const scanned = new URLSearchParams(window.location.hash.substring(1)).get("qr");
+    if (scanned) {
+        sessionStorage.setItem("qr_code", scanned);
+        history.replaceState(null, "", window.location.pathname);
+    }
+
     const employeeEmail = localStorage.getItem("employee_email");
     const employeeName = localStorage.getItem("employee_name");
     const role = localStorage.getItem("role");
@@ -93,30 +101,168 @@ document.addEventListener("DOMContentLoaded", () => {
         }
     }
 
+    // Localização do dispositivo para as cercas virtuais da empresa; sem
+    // permissão ou sem GPS o ponto segue sem localização
+    function obterLocalizacao() {
+        return new Promise(resolve => {
+            if (!navigator.geolocation) return resolve(null);
+            navigator.geolocation.getCurrentPosition(
+                pos => resolve({ latitude: pos.coords.latitude, longitude: pos.coords.longitude, accuracy: Math.round(pos.coords.accuracy) }),
+                () => resolve(null),
+                { enableHighAccuracy: true, timeout: 10000, maximumAge: 60000 }
+            );
+        });
+    }
+
+    // Identificador deste navegador no histórico de marcações, criado no
+    // primeiro ponto e mantido entre as sessões
+    function identificadorDispositivo() {
+        let id = localStorage.getItem("device_id");
+        if (!id) {
+            id = novoIdentificador();
+            localStorage.setItem("device_id", id);
+        }
+        return id;
+    }
+
+    function novoIdentificador() {
+        return crypto.randomUUID ? crypto.randomUUID() : `${Date.now()}-${Math.random().toString(16).slice(2)}`;
+    }
+
+    // Próxima marcação sugerida pelo servidor; o funcionário pode escolher
+    // outra, e as etapas puladas ficam avisadas
+    const punchTypeSelect = document.getElementById("punch-type-select");
+    async function carregarProximaMarcacao() {
+        const hint = document.getElementById("next-punch-hint");
+        try {
+            const res = await axios.get(`http://localhost:8080/time_logs/next_punch?employee_email=${encodeURIComponent(email)}`);
+            if (res.data.day_complete) {
+                punchTypeSelect.style.display = "none";
+                hint.innerText = "Todas as marcações de hoje já foram registradas.";
+                return;
+            }
+            punchTypeSelect.innerHTML = res.data.options
+                .map(o => `<option value="${o.punch}">${o.label}${o.punch === res.data.punch ? " (sugerida)" : ""}</option>`)
+                .join("");
+            punchTypeSelect.style.display = "";
+            hint.innerText = res.data.skipped?.length
+                ? `Atenção: há marcações de hoje não registradas antes de ${res.data.label}.` : "";
+        } catch (err) {
+            // sem a sugestão o servidor escolhe a marcação seguinte
+            console.error("Erro ao buscar a próxima marcação:", err);
+            punchTypeSelect.style.display = "none";
+            hint.innerText = "";
+        }
+    }
+
+    // Pontos feitos sem conexão ficam guardados no navegador, com o horário do
+    // aparelho e uma chave que evita registrá-los duas vezes, até a sincronização
+    const OFFLINE_KEY = "offline_punches";
+    const pontosOffline = () => JSON.parse(localStorage.getItem(OFFLINE_KEY) || "[]");
+
+    function guardarPontoOffline(key, qrCode, location) {
+        const punches = pontosOffline();
+        punches.push({
+            idempotency_key: key,
+            device_time: new Date().toISOString(),
+            location: location || undefined,
+            qr_code: qrCode || undefined,
+        });
+        localStorage.setItem(OFFLINE_KEY, JSON.stringify(punches));
+    }
+
+    async function sincronizarPontosOffline() {
+        const punches = pontosOffline();
+        if (punches.length === 0 || !navigator.onLine) return;
+        try {
+            const res = await axios.post("http://localhost:8080/time_logs/sync", {
+                sent_at: new Date().toISOString(),
+                punches,
+            }, {
+                headers: {
+                    Authorization: `Bearer ${localStorage.getItem("session_token")}`,
+                    "X-Device-ID": identificadorDispositivo(),
+                },
+            });
+
+            // registrados, duplicados e rejeitados saem da fila; só um erro
+            // de rede ou do servidor mantém as marcações para a próxima vez
+            const sent = new Set(res.data.results.map(r => r.idempotency_key));
+            localStorage.setItem(OFFLINE_KEY, JSON.stringify(pontosOffline().filter(p => !sent.has(p.idempotency_key))));
+            const rejected = res.data.results.filter(r => r.status === "rejeitada");
+            const statusDiv = document.getElementById("status-message");
+            if (rejected.length > 0) {
+                statusDiv.innerHTML = `<div class="alert alert-warning">Pontos offline não registrados:<br>${rejected.map(r => r.error).join("<br>")}</div>`;
+            } else {
+                statusDiv.innerHTML = '<div class="alert alert-success">Pontos feitos sem conexão sincronizados!</div>';
+                setTimeout(() => { statusDiv.innerHTML = ''; }, 3000);
+            }
+            carregarPontos();
+            carregarProximaMarcacao();
+        } catch (err) {
+            console.error("Erro ao sincronizar pontos offline:", err);
+            // relógio do aparelho fora do limite: o servidor explica o que fazer
+            if (err.response?.status === 400 && err.response.data?.error) {
+                document.getElementById("status-message").innerHTML = `<div class="alert alert-danger">${err.response.data.error}</div>`;
+            }
+        }
+    }
+    window.addEventListener("online", sincronizarPontosOffline);
+
     // Registrar ponto
     const registerBtn = document.getElementById("register-time-btn");
     if (registerBtn) {
         registerBtn.addEventListener("click", async () => {
+            const qrCode = sessionStorage.getItem("qr_code");
+            sessionStorage.removeItem("qr_code"); // cada leitura vale para uma tentativa
+            // a mesma chave acompanha o ponto se ele precisar ir pela fila
+            // offline, e o servidor não o registra duas vezes
+            const key = novoIdentificador();
+            let location = null;
+            registerBtn.disabled = true;
             try {
                 const statusDiv = document.getElementById("status-message");
                 statusDiv.innerHTML = '<div class="alert alert-info">Registrando ponto...</div>';
                 
-                const res = await axios.put(`http://localhost:8080/time_logs/1?employee_email=${encodeURIComponent(email)}`);
+                const qrParam = qrCode ? `&qr_code=${encodeURIComponent(qrCode)}` : "";
+                const typeParam = punchTypeSelect.style.display !== "none" && punchTypeSelect.value
+                    ? `&punch_type=${punchTypeSelect.value}` : "";
+                location = await obterLocalizacao();
+                const locationParam = location
+                    ? `&latitude=${location.latitude}&longitude=${location.longitude}&accuracy=${location.accuracy}` : "";
+                const res = await axios.put(`http://localhost:8080/time_logs/1?employee_email=${encodeURIComponent(email)}${typeParam}${qrParam}${locationParam}`, null, {
+                    headers: { "X-Device-ID": identificadorDispositivo(), "Idempotency-Key": key },
+                });
                 
                 if (res.status === 200 || res.status === 201) {
-                    statusDiv.innerHTML = '<div class="alert alert-success">Ponto registrado com sucesso!</div>';
+                    // marcação que pulou etapas do dia: registrada, com aviso
+                    statusDiv.innerHTML = res.data.warning
+                        ? `<div class="alert alert-warning">Ponto registrado. ${res.data.warning}</div>`
+                        : '<div class="alert alert-success">Ponto registrado com sucesso!</div>';
                     setTimeout(() => {
                         statusDiv.innerHTML = '';
-                    }, 3000);
+                    }, res.data.warning ? 6000 : 3000);
                     carregarPontos(); // Recarrega a tabela
+                    carregarProximaMarcacao();
                 }
             } catch (err) {
                 console.error("Erro ao registrar ponto:", err);
                 const statusDiv = document.getElementById("status-message");
-                statusDiv.innerHTML = '<div class="alert alert-danger">Erro ao registrar ponto. Tente novamente.</div>';
+                if (!err.response) {
+                    // sem conexão: o ponto é guardado e enviado quando a rede voltar
+                    guardarPontoOffline(key, qrCode, location);
+                    statusDiv.innerHTML = '<div class="alert alert-warning">Sem conexão. O ponto foi guardado neste aparelho e será enviado quando a conexão voltar.</div>';
+                    return;
+                }
+                // QR code ausente, expirado ou inválido, ou fora da cerca: o servidor explica o motivo
+                const reason = typeof err.response?.data === "string" && err.response.status < 500
+                    ? err.response.data : "Erro ao registrar ponto. Tente novamente.";
+                statusDiv.innerHTML = `<div class="alert alert-danger">${reason}</div>`;
                 setTimeout(() => {
                     statusDiv.innerHTML = '';
                 }, 5000);
+            } finally {
+                registerBtn.disabled = false; // evita o clique duplo durante o envio
             }
         });
     }
@@ -141,9 +287,14 @@ document.addEventListener("DOMContentLoaded", () => {
     // Botão sair
     const exitBtn = document.getElementById("exit-btn");
     if (exitBtn) {
-        exitBtn.addEventListener("click", () => {
+        exitBtn.addEventListener("click", async () => {
             if (confirm("Deseja realmente sair do sistema?")) {
+                await axios.post("http://localhost:8080/logout", null, {
+                    headers: { Authorization: `Bearer ${localStorage.getItem("session_token")}` }
+                }).catch(() => {});
+                const deviceId = localStorage.getItem("device_id");
                 localStorage.clear();
+                if (deviceId) localStorage.setItem("device_id", deviceId); // o dispositivo continua o mesmo
                 window.location.href = "index.html";
             }
         });
@@ -301,4 +452,6 @@ document.addEventListener("DOMContentLoaded", () => {
 
     // Carrega pontos ao inicializar
     carregarPontos();
+    carregarProximaMarcacao();
+    sincronizarPontosOffline();
 });
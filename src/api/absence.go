@@ -0,0 +1,263 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// Classificação de um dia já encerrado, gravada em TimeLog.Status
+const (
+	dayComplete   = "completo"
+	dayIncomplete = "incompleto"
+	dayAbsent     = "falta"
+	dayOff        = "folga"
+	dayHoliday    = "feriado"
+
+	defaultWorkDays = "1,2,3,4,5"
+
+	// closeDaysLookback limits how far back closeDays looks for days left
+	// open, which covers the server being down for a while without touching
+	// the history recorded before absences were detected.
+	closeDaysLookback = 7
+)
+
+// Inconsistency is a closed day that still needs the manager's attention.
+type Inconsistency struct {
+	TimeLogID      uint      `json:"time_log_id"`
+	EmployeeName   string    `json:"employee_name"`
+	EmployeeEmail  string    `json:"employee_email"`
+	LogDate        time.Time `json:"log_date"`
+	Status         string    `json:"status"`
+	MissingPunches []string  `json:"missing_punches"`
+	MissingHours   float32   `json:"missing_hours"`
+}
+
+// missingPunches names the punches not registered in the time log.
+func missingPunches(timeLog schemas.TimeLog) []string {
+	var missing []string
+	for _, p := range []struct {
+		name string
+		at   time.Time
+	}{
+		{"entrada", timeLog.EntryTime},
+		{"saida_almoco", timeLog.LunchExitTime},
+		{"retorno_almoco", timeLog.LunchReturnTime},
+		{"saida", timeLog.ExitTime},
+	} {
+		if p.at.IsZero() {
+			missing = append(missing, p.name)
+		}
+	}
+	return missing
+}
+
+// isWorkDay reports whether the weekday is in workDays, a comma separated list
+// of weekday numbers (0 = Sunday).
+func isWorkDay(workDays string, date time.Time) bool {
+	for _, d := range strings.Split(workDays, ",") {
+		if n, err := strconv.Atoi(strings.TrimSpace(d)); err == nil && time.Weekday(n) == date.Weekday() {
+			return true
+		}
+	}
+	return false
+}
+
+// scheduledHours returns the hours the employee is expected to work in a day:
+// the branch schedule when it is fully configured, otherwise a fifth of the
+// weekly workload.
+func scheduledHours(workload float32, branch *schemas.Branch) float32 {
+	if branch != nil {
+		var parsed []time.Time
+		for _, v := range []string{branch.ScheduleEntry, branch.ScheduleLunchExit, branch.ScheduleLunchReturn, branch.ScheduleExit} {
+			t, err := time.Parse("15:04", v)
+			if err != nil {
+				break
+			}
+			parsed = append(parsed, t)
+		}
+		if len(parsed) == 4 {
+			worked := parsed[3].Sub(parsed[0]) - parsed[2].Sub(parsed[1])
+			if worked > 0 {
+				return float32(worked.Hours())
+			}
+		}
+	}
+
+	return workload / 5
+}
+
+// classifyDay sets the status of a finished day. Days without any punch are
+// holidays, days off or absences; absences are charged the scheduled hours.
+func classifyDay(timeLog *schemas.TimeLog, workload float32, branch *schemas.Branch, holiday bool) {
+	workDays := defaultWorkDays
+	if branch != nil && branch.WorkDays != "" {
+		workDays = branch.WorkDays
+	}
+
+	missing := len(missingPunches(*timeLog))
+	switch {
+	case missing == 0:
+		timeLog.Status = dayComplete
+	case missing < 4:
+		timeLog.Status = dayIncomplete
+	case holiday:
+		timeLog.Status = dayHoliday
+	case !isWorkDay(workDays, timeLog.LogDate):
+		timeLog.Status = dayOff
+	default:
+		timeLog.Status = dayAbsent
+		chargeAbsence(timeLog, workload, branch)
+	}
+}
+
+// chargeAbsence charges the scheduled hours of the day to an absence.
+func chargeAbsence(timeLog *schemas.TimeLog, workload float32, branch *schemas.Branch) {
+	timeLog.ExtraHours = 0
+	timeLog.MissingHours = scheduledHours(workload, branch)
+	timeLog.Balance = -timeLog.MissingHours
+}
+
+// closeDays classifies the days already over, in each employee's timezone,
+// that were not closed yet. A day with no time log at all gets one, so an
+// absence is detected even when setupNewDay did not run that day.
+func (api *API) closeDays(ctx context.Context) error {
+	now := api.Clock.Now().UTC()
+
+	active := true
+	employees, err := api.Repos.Employees.List(db.EmployeeFilter{Active: &active})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve employees to close days")
+		return err
+	}
+
+	branches := map[uint]*schemas.Branch{}
+	location := api.employeeLocations()
+	closed := 0
+	for _, employee := range employees {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		today := localDate(now, location(employee))
+		closed += api.closeEmployeeDays(employee, api.cachedBranch(employee, branches), today.AddDate(0, 0, -closeDaysLookback), today)
+	}
+
+	log.Info().Int("closedDays", closed).Msg("Finished closing days")
+	return nil
+}
+
+// CloseMonth closes every day of the month (any date within it) that is
+// already over for the active employees of the company, regardless of how
+// long ago it was, and returns the month's summary per employee.
+func (api *API) CloseMonth(ctx context.Context, companyCNPJ string, month time.Time) ([]EmployeeSummary, error) {
+	company, _, employees, err := api.ReportScope(companyCNPJ, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	first := time.Date(month.Year(), month.Month(), 1, 0, 0, 0, 0, time.UTC)
+	end := first.AddDate(0, 1, 0)
+	now := api.Clock.Now().UTC()
+
+	branches := map[uint]*schemas.Branch{}
+	location := api.employeeLocations()
+	closed := 0
+	for _, employee := range employees {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		if !employee.Active {
+			continue
+		}
+
+		last := end
+		if today := localDate(now, location(employee)); today.Before(last) {
+			last = today
+		}
+		closed += api.closeEmployeeDays(employee, api.cachedBranch(employee, branches), first, last)
+	}
+	log.Info().Str("company", company.CNPJ).Str("month", first.Format("2006-01")).Int("closedDays", closed).Msg("Finished closing month")
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: employeeEmails(employees), From: first, To: end})
+	if err != nil {
+		return nil, err
+	}
+	return summarize(employees, timeLogs), nil
+}
+
+// cachedBranch returns the employee's branch, nil for the headquarters, loading
+// each branch only once per run.
+func (api *API) cachedBranch(employee schemas.Employee, branches map[uint]*schemas.Branch) *schemas.Branch {
+	if employee.BranchID == nil {
+		return nil
+	}
+	if branches[*employee.BranchID] == nil {
+		if b, err := api.Repos.Branches.Get(*employee.BranchID); err == nil {
+			branches[*employee.BranchID] = &b
+		}
+	}
+	return branches[*employee.BranchID]
+}
+
+// closeEmployeeDays classifies the employee's open days from first up to end
+// (exclusive), never before the hiring date, and returns how many it closed.
+func (api *API) closeEmployeeDays(employee schemas.Employee, branch *schemas.Branch, first, end time.Time) int {
+	if hired := localDate(employee.CreatedAt, api.employeeLocation(employee)); hired.After(first) {
+		first = hired
+	}
+
+	closed := 0
+	for day := first; day.Before(end); day = day.AddDate(0, 0, 1) {
+		done, err := api.closeEmployeeDay(employee, branch, day)
+		if errors.Is(err, db.ErrDuplicate) {
+			// a punch created the log of the day meanwhile: close that one
+			done, err = api.closeEmployeeDay(employee, branch, day)
+		}
+		if err != nil {
+			log.Error().Err(err).Str("employee", employee.Email).Msg("Failed to close day")
+			continue
+		}
+		if done {
+			closed++
+		}
+	}
+	return closed
+}
+
+// closeEmployeeDay classifies the employee's day unless it was already
+// closed, creating its log when there is none, and reports whether it did.
+func (api *API) closeEmployeeDay(employee schemas.Employee, branch *schemas.Branch, day time.Time) (bool, error) {
+	timeLog, err := api.Repos.TimeLogs.GetByDate(employee.Email, day)
+	if errors.Is(err, db.ErrNotFound) {
+		timeLog, err = schemas.TimeLog{EmployeeEmail: employee.Email, LogDate: day}, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("retrieve time log: %w", err)
+	}
+	if timeLog.Status != "" {
+		return false, nil
+	}
+
+	holiday := false
+	holidays, _ := api.Repos.Holidays.List(db.HolidayFilter{CompanyCNPJ: employee.CompanyCNPJ, BranchID: employee.BranchID, Date: day})
+	for _, h := range holidays {
+		// the holidays of a branch do not apply to the headquarters
+		if h.BranchID == nil || employee.BranchID != nil {
+			holiday = true
+		}
+	}
+
+	classifyDay(&timeLog, api.weeklyWorkload(employee, day), branch, holiday)
+	if err := api.Repos.TimeLogs.Update(&timeLog); err != nil {
+		return false, err
+	}
+	return true, nil
+}
@@ -0,0 +1,78 @@
+package api
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// getManagerInconsistencies godoc
+//
+//	@Summary		Inconsistências da equipe
+//	@Description	Lista os dias encerrados com falta ou marcações incompletas dos funcionários da equipe do gerente
+//	@Tags			manager
+//	@Produce		json
+//	@Param			Authorization	header		string	true	"Bearer <token> da sessão do gerente"
+//	@Param			start			query		string	false	"Data de início (YYYY-MM-DD, padrão 30 dias atrás)"
+//	@Param			end				query		string	false	"Data de fim (YYYY-MM-DD, padrão hoje)"
+//	@Success		200				{array}		Inconsistency
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		403				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/manager/inconsistencies [get]
+func (api *API) getManagerInconsistencies(c echo.Context) error {
+	manager := currentEmployee(c)
+	end := localDate(api.Clock.Now(), api.employeeLocation(manager)).Add(24 * time.Hour)
+	start := end.AddDate(0, 0, -31)
+	if c.QueryParam("start") != "" || c.QueryParam("end") != "" {
+		var err error
+		if start, end, err = parseReportPeriod(c); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	emails, err := api.managedEmployeeEmails(manager)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da equipe")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar funcionários"})
+	}
+
+	inconsistencies := []Inconsistency{}
+	if len(emails) == 0 {
+		return c.JSON(http.StatusOK, inconsistencies)
+	}
+
+	employees, _ := api.Repos.Employees.List(db.EmployeeFilter{Emails: emails})
+	names := map[string]string{}
+	for _, e := range employees {
+		names[e.Email] = e.Name
+	}
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{
+		Emails:   emails,
+		From:     start,
+		To:       end,
+		Statuses: []string{dayIncomplete, dayAbsent},
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar inconsistências")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar inconsistências"})
+	}
+
+	for _, tl := range timeLogs {
+		inconsistencies = append(inconsistencies, Inconsistency{
+			TimeLogID:      tl.ID,
+			EmployeeName:   names[tl.EmployeeEmail],
+			EmployeeEmail:  tl.EmployeeEmail,
+			LogDate:        tl.LogDate,
+			Status:         tl.Status,
+			MissingPunches: missingPunches(tl),
+			MissingHours:   tl.MissingHours,
+		})
+	}
+	return c.JSON(http.StatusOK, inconsistencies)
+}
@@ -0,0 +1,163 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrSetupDone is returned by Bootstrap once an administrator exists.
+	ErrSetupDone = errors.New("Configuração inicial já realizada")
+	// ErrLastAdmin prevents removing the only remaining administrator.
+	ErrLastAdmin = errors.New("Não é possível remover o último administrador")
+)
+
+// AdminRequest holds the data of a new administrator. Unlike employees,
+// administrators do not need CPF, RG or age. When the company does not exist
+// yet and CompanyName is informed, it is created together with the admin,
+// which is how the very first account is set up.
+type AdminRequest struct {
+	Name        string `json:"name"`
+	Email       string `json:"email"`
+	Password    string `json:"password"`
+	CompanyCNPJ string `json:"company_cnpj"`
+	CompanyName string `json:"company_name"`
+	// RequestedBy is who creates the admin, for the audit history: "setup"
+	// or "cli" for the first one
+	RequestedBy string `json:"-"`
+}
+
+// CreateAdmin registers an administrator of the company together with its
+// login.
+func (api *API) CreateAdmin(req AdminRequest) (schemas.Employee, error) {
+	if req.Name == "" {
+		return schemas.Employee{}, errParamRequired("name", "string")
+	}
+	if req.Email == "" {
+		return schemas.Employee{}, errParamRequired("email", "string")
+	}
+	if req.CompanyCNPJ == "" {
+		return schemas.Employee{}, errParamRequired("company_cnpj", "string")
+	}
+	if err := validatePassword(req.Password); err != nil {
+		return schemas.Employee{}, err
+	}
+
+	var company *schemas.Company
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ); errors.Is(err, db.ErrNotFound) && req.CompanyName != "" {
+		company = &schemas.Company{Name: req.CompanyName, CNPJ: req.CompanyCNPJ, Active: true}
+	} else if err != nil {
+		return schemas.Employee{}, fmt.Errorf("Empresa com este CNPJ não existe")
+	}
+	if _, err := api.Repos.Employees.GetByEmail(req.Email); err == nil {
+		return schemas.Employee{}, fmt.Errorf("Email já cadastrado")
+	} else if !errors.Is(err, db.ErrNotFound) {
+		return schemas.Employee{}, err
+	}
+
+	hashedPassword, err := HashPassword(req.Password)
+	if err != nil {
+		return schemas.Employee{}, fmt.Errorf("Erro ao gerar hash da senha")
+	}
+
+	admin := schemas.Employee{
+		Name:        req.Name,
+		Email:       req.Email,
+		Active:      true,
+		Workload:    api.Config.Work.DefaultWorkload,
+		IsAdmin:     true,
+		CompanyCNPJ: req.CompanyCNPJ,
+	}
+	err = api.Repos.Transaction(func(repos db.Repositories) error {
+		if company != nil {
+			if err := repos.Companies.Create(company); err != nil {
+				return err
+			}
+		}
+		if err := repos.Employees.Create(&admin); err != nil {
+			return err
+		}
+		return repos.Logins.Create(&schemas.Login{Email: admin.Email, Password: hashedPassword})
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao cadastrar administrador")
+		return schemas.Employee{}, err
+	}
+
+	api.audit("employee", admin.ID, "criar_admin", req.RequestedBy, "Administrador "+admin.Email)
+	return admin, nil
+}
+
+// SetupRequired reports whether no administrator exists yet, the only state in
+// which Bootstrap is allowed.
+func (api *API) SetupRequired() (bool, error) {
+	isAdmin := true
+	admins, err := api.Repos.Employees.List(db.EmployeeFilter{IsAdmin: &isAdmin})
+	return len(admins) == 0, err
+}
+
+// Bootstrap creates the first administrator. It fails with ErrSetupDone as
+// soon as any administrator exists, so it can only be used once.
+func (api *API) Bootstrap(req AdminRequest) (schemas.Employee, error) {
+	api.setupMu.Lock()
+	defer api.setupMu.Unlock()
+
+	required, err := api.SetupRequired()
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	if !required {
+		return schemas.Employee{}, ErrSetupDone
+	}
+
+	if req.RequestedBy == "" {
+		req.RequestedBy = "setup"
+	}
+	admin, err := api.CreateAdmin(req)
+	if err == nil {
+		log.Info().Str("email", admin.Email).Msg("[api] Administrador inicial cadastrado")
+	}
+	return admin, err
+}
+
+// SetAdmin promotes the employee to administrator or demotes it. The last
+// active administrator cannot be demoted.
+func (api *API) SetAdmin(id uint, isAdmin bool, requestedBy string) (schemas.Employee, error) {
+	api.setupMu.Lock()
+	defer api.setupMu.Unlock()
+
+	employee, err := api.Repos.Employees.Get(id)
+	if err != nil {
+		return employee, err
+	}
+	if employee.IsAdmin == isAdmin {
+		return employee, nil
+	}
+
+	if !isAdmin {
+		active := true
+		admins, err := api.Repos.Employees.List(db.EmployeeFilter{IsAdmin: &active, Active: &active})
+		if err != nil {
+			return employee, err
+		}
+		if len(admins) == 1 && admins[0].ID == employee.ID {
+			return employee, ErrLastAdmin
+		}
+	}
+
+	employee.IsAdmin = isAdmin
+	if err := api.Repos.Employees.Update(&employee); err != nil {
+		return employee, err
+	}
+
+	action := "promover_admin"
+	if !isAdmin {
+		action = "remover_admin"
+	}
+	api.audit("employee", employee.ID, action, requestedBy, "Administrador "+employee.Email)
+	return employee, nil
+}
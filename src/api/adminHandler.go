@@ -0,0 +1,174 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type AdminRoleRequest struct {
+	IsAdmin bool `json:"is_admin"`
+}
+
+// getSetup godoc
+//
+//	@Summary		Situação da configuração inicial
+//	@Description	Informa se ainda é preciso cadastrar o administrador inicial
+//	@Tags			setup
+//	@Produce		json
+//	@Success		200	{object}	map[string]bool
+//	@Failure		500	{object}	map[string]string
+//	@Router			/setup [get]
+func (api *API) getSetup(c echo.Context) error {
+	required, err := api.SetupRequired()
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao verificar configuração inicial")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao verificar configuração inicial"})
+	}
+	return c.JSON(http.StatusOK, map[string]bool{"setup_required": required})
+}
+
+// createInitialAdmin godoc
+//
+//	@Summary		Cadastrar administrador inicial
+//	@Description	Cria o primeiro administrador, e a empresa se ainda não existir. Disponível apenas enquanto não houver nenhum administrador
+//	@Tags			setup
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		AdminRequest	true	"Dados do administrador"
+//	@Success		201		{object}	schemas.Employee
+//	@Failure		400		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Router			/setup [post]
+func (api *API) createInitialAdmin(c echo.Context) error {
+	var req AdminRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	admin, err := api.Bootstrap(req)
+	if errors.Is(err, ErrSetupDone) {
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, admin)
+}
+
+// setEmployeeAdmin godoc
+//
+//	@Summary		Promover ou remover administrador
+//	@Description	Concede ou retira o perfil de administrador de um funcionário; o último administrador ativo não pode ser removido
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"ID do funcionário"
+//	@Param			body	body		AdminRoleRequest	true	"Novo perfil"
+//	@Success		200		{object}	schemas.Employee
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/employees/{id}/admin [put]
+func (api *API) setEmployeeAdmin(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	var req AdminRoleRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	employee, err := api.SetAdmin(uint(id), req.IsAdmin, currentEmployee(c).Email)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Funcionário não encontrado"})
+	case errors.Is(err, ErrLastAdmin):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case err != nil:
+		log.Error().Err(err).Msg("[api] Erro ao alterar perfil de administrador")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao alterar perfil de administrador"})
+	}
+	return c.JSON(http.StatusOK, employee)
+}
+
+// unlockEmployeeLogin godoc
+//
+//	@Summary		Desbloquear login
+//	@Description	Zera as tentativas falhas e encerra o bloqueio do login do funcionário
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id				path		int		true	"ID do funcionário"
+//	@Success		200				{object}	map[string]string
+//	@Failure		400				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/employees/{id}/unlock [post]
+func (api *API) unlockEmployeeLogin(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	err = api.UnlockLogin(uint(id), currentEmployee(c).Email)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Login não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao desbloquear login")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao desbloquear login"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Login desbloqueado"})
+}
+
+// listLoginAttempts godoc
+//
+//	@Summary		Tentativas de login
+//	@Description	Retorna as tentativas de login mais recentes, com IP, navegador e motivo das falhas
+//	@Tags			admin
+//	@Produce		json
+//	@Param			email	query		string	false	"Email informado no login"
+//	@Param			ip		query		string	false	"IP do cliente"
+//	@Param			success	query		bool	false	"Apenas bem-sucedidas (true) ou falhas (false)"
+//	@Param			since	query		string	false	"A partir de (RFC 3339)"
+//	@Param			until	query		string	false	"Até (RFC 3339)"
+//	@Param			limit	query		int		false	"Quantidade máxima (padrão 100)"
+//	@Success		200		{array}		schemas.LoginAttempt
+//	@Failure		400		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/login_attempts [get]
+func (api *API) listLoginAttempts(c echo.Context) error {
+	limit := 100
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	filter := db.LoginAttemptFilter{Email: c.QueryParam("email"), IP: c.QueryParam("ip"), Limit: limit}
+	if success, err := strconv.ParseBool(c.QueryParam("success")); err == nil {
+		filter.Success = &success
+	}
+	for param, target := range map[string]*time.Time{"since": &filter.Since, "until": &filter.Until} {
+		value := c.QueryParam(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Data inválida em " + param + ", use RFC 3339"})
+		}
+		*target = t.UTC()
+	}
+
+	attempts, err := api.Repos.LoginAttempts.List(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar tentativas de login")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar tentativas de login"})
+	}
+	return c.JSON(http.StatusOK, attempts)
+}
@@ -0,0 +1,115 @@
+package api
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// AFD (Arquivo Fonte de Dados) no leiaute da Portaria MTP 671/2021.
+// São gerados o cabeçalho (tipo 1), um registro de marcação por ponto
+// batido (tipo 3) e o trailer (tipo 9).
+const (
+	afdLayoutVersion = "003"
+	afdDateTime      = "2006-01-02T15:04:00-0700"
+	afdVendorCNPJ    = "00000000000000"
+	afdModel         = "MARCA TEMPO"
+)
+
+type afdPunch struct {
+	at  time.Time
+	cpf string
+}
+
+// buildAFD renders the AFD file for the employer identified by cnpj and name,
+// covering the punches of the given time logs between start and end. Punch
+// times are written in the timezone of each employee, taken from locations.
+func buildAFD(cnpj, name string, employees []schemas.Employee, locations map[string]*time.Location, timeLogs []schemas.TimeLog, start, end, generatedAt time.Time) string {
+	cpfByEmail := map[string]string{}
+	for _, e := range employees {
+		cpfByEmail[e.Email] = nonDigitRegex.ReplaceAllString(e.CPF, "")
+	}
+
+	var punches []afdPunch
+	for _, tl := range timeLogs {
+		cpf := cpfByEmail[tl.EmployeeEmail]
+		loc := locations[tl.EmployeeEmail]
+		if loc == nil {
+			loc = time.UTC
+		}
+		for _, t := range []time.Time{tl.EntryTime, tl.LunchExitTime, tl.LunchReturnTime, tl.ExitTime} {
+			if !t.IsZero() {
+				punches = append(punches, afdPunch{at: t.In(loc), cpf: cpf})
+			}
+		}
+	}
+	sort.SliceStable(punches, func(i, j int) bool { return punches[i].at.Before(punches[j].at) })
+
+	var lines []string
+
+	header := "000000000" + "1" + "1" +
+		afdNumber(nonDigitRegex.ReplaceAllString(cnpj, ""), 14) +
+		afdText("", 14) +
+		afdText(name, 150) +
+		afdText("", 17) +
+		start.Format("2006-01-02") +
+		end.Format("2006-01-02") +
+		generatedAt.Format(afdDateTime) +
+		afdLayoutVersion +
+		"1" + afdVendorCNPJ +
+		afdText(afdModel, 30)
+	lines = append(lines, header+afdCRC16(header))
+
+	for i, p := range punches {
+		record := fmt.Sprintf("%09d", i+1) + "3" + p.at.Format(afdDateTime) + afdNumber(p.cpf, 12)
+		lines = append(lines, record+afdCRC16(record))
+	}
+
+	trailer := "999999999" +
+		fmt.Sprintf("%09d", 0) +
+		fmt.Sprintf("%09d", len(punches)) +
+		fmt.Sprintf("%09d", 0) +
+		fmt.Sprintf("%09d", 0) +
+		fmt.Sprintf("%09d", 0) +
+		fmt.Sprintf("%09d", 0) +
+		"9"
+	lines = append(lines, trailer)
+
+	return strings.Join(lines, "\r\n") + "\r\n"
+}
+
+// afdText pads or truncates s to exactly n characters, left aligned.
+func afdText(s string, n int) string {
+	if utf8.RuneCountInString(s) > n {
+		return string([]rune(s)[:n])
+	}
+	return s + strings.Repeat(" ", n-utf8.RuneCountInString(s))
+}
+
+// afdNumber pads a numeric string with zeros on the left to n digits.
+func afdNumber(s string, n int) string {
+	if len(s) > n {
+		return s[len(s)-n:]
+	}
+	return strings.Repeat("0", n-len(s)) + s
+}
+
+// afdCRC16 computes the CRC-16/KERMIT checksum of a record as 4 hex digits.
+func afdCRC16(record string) string {
+	var crc uint16
+	for _, b := range []byte(record) {
+		crc ^= uint16(b)
+		for i := 0; i < 8; i++ {
+			if crc&1 != 0 {
+				crc = (crc >> 1) ^ 0x8408
+			} else {
+				crc >>= 1
+			}
+		}
+	}
+	return fmt.Sprintf("%04X", crc)
+}
@@ -2,9 +2,16 @@ package api
 
 import (
 	"context"
-	"time"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
 
+	"github.com/MWismeck/marca-tempo/src/clock"
+	"github.com/MWismeck/marca-tempo/src/config"
 	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/mail"
+	"github.com/MWismeck/marca-tempo/src/scheduler"
 	"github.com/MWismeck/marca-tempo/src/schemas"
 	"github.com/labstack/echo/v4"
 	"github.com/labstack/echo/v4/middleware"
@@ -14,8 +21,20 @@ import (
 )
 
 type API struct {
-	Echo *echo.Echo
-	DB   *db.EmployeeHandler
+	Echo   *echo.Echo
+	Config config.Config
+	// Repos is the data access of every handler, so the handlers also run on
+	// db.NewMemoryRepositories
+	Repos     db.Repositories
+	Clock     clock.Clock
+	Scheduler *scheduler.Scheduler
+	Mailer    mail.Mailer
+
+	stopScheduler context.CancelFunc
+	schedulerDone <-chan struct{}
+	// setupMu serializes the checks on the number of administrators
+	setupMu sync.Mutex
+	sso     ssoProviders
 }
 
 // @title Marca Tempo
@@ -24,194 +43,323 @@ type API struct {
 // @host localhost:8080
 // @BasePath /
 // @schemes http
-func NewServer(database *gorm.DB) *API {
+func NewServer(cfg config.Config, database *gorm.DB, clk clock.Clock) *API {
+	return NewServerWithRepositories(cfg, db.NewRepositories(database), database, clk)
+}
+
+// NewServerWithRepositories creates the server with the given repositories,
+// e.g. db.NewMemoryRepositories in unit tests.
+func NewServerWithRepositories(cfg config.Config, repos db.Repositories, database *gorm.DB, clk clock.Clock) *API {
 
 	e := echo.New()
+	// The client IP limits failed logins, so proxy headers are only trusted
+	// when configured
+	e.IPExtractor = echo.ExtractIPDirect()
+	if cfg.Server.TrustProxy {
+		e.IPExtractor = echo.ExtractIPFromXFFHeader()
+	}
 	e.Use(middleware.Logger())
 	e.Use(middleware.Recover())
 	e.Use(middleware.CORSWithConfig(middleware.CORSConfig{
-		AllowOrigins: []string{"*"},
+		AllowOrigins: cfg.Server.AllowOrigins,
 		AllowMethods: []string{echo.GET, echo.POST, echo.PUT, echo.DELETE},
-		AllowHeaders: []string{echo.HeaderAuthorization, echo.HeaderContentType},
+		AllowHeaders: []string{echo.HeaderAuthorization, echo.HeaderContentType, kioskKeyHeader, punchSourceHeader, deviceIDHeader, idempotencyKeyHeader},
 	}))
 
-	e.Static("/", "public")
-	e.File("/", "public/index.html")
-	employDB := db.NewEmployeeHandler(database)
+	e.Static("/", cfg.Server.StaticDir)
+	e.File("/", filepath.Join(cfg.Server.StaticDir, "index.html"))
+
+	if clk == nil {
+		clk = clock.New()
+	}
 
 	api := &API{
-		Echo: e,
-		DB:   employDB,
+		Echo:   e,
+		Config: cfg,
+		Repos:  repos,
+		Clock:  clk,
+		Scheduler: scheduler.NewWithOptions(database, clk, scheduler.Options{
+			Interval: cfg.Scheduler.Interval,
+			Lease:    cfg.Scheduler.Lease,
+		}),
+		Mailer: mail.New(cfg.Mail),
 	}
 	api.ConfigureRoutes()
-
-	go api.startPeriodicTasks()
+	api.registerJobs()
 
 	log.Info().Msg("Server initialized successfully")
 	return api
 }
 
-func (api *API) Start() error {
+// Run serves HTTP requests and runs the scheduler until ctx is cancelled or
+// the server fails, then shuts down within Config.Server.ShutdownTimeout. It
+// returns nil only when the server stopped because ctx was cancelled and the
+// shutdown completed in time.
+func (api *API) Run(ctx context.Context) error {
 	log.Info().Msg("Starting server...")
-	return api.Echo.Start(":8080")
-}
 
-func (api *API) Shutdown() error {
-	log.Info().Msg("Shutting down server...")
-	return api.Echo.Shutdown(context.Background())
-}
+	// The scheduler has its own context: it is stopped only after the
+	// in-flight requests, which may queue jobs, have finished.
+	schedulerCtx, stopScheduler := context.WithCancel(context.Background())
+	api.stopScheduler = stopScheduler
+	api.schedulerDone = api.Scheduler.Start(schedulerCtx)
+	if _, err := api.Scheduler.Trigger(recalculationJob); err != nil {
+		log.Warn().Err(err).Msg("Failed to resume pending recalculations")
+	}
 
-func (api *API) startPeriodicTasks() {
-	ticker := time.NewTicker(24 * time.Hour)
-	defer ticker.Stop()
+	serveErr := make(chan error, 1)
+	go func() {
+		serveErr <- api.Echo.Start(api.Config.Server.Addr)
+	}()
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-serveErr:
+		err = fmt.Errorf("http server: %w", err)
+		log.Error().Err(err).Msg("Server failed")
+	}
 
-	api.setupNewDay()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), api.Config.Server.ShutdownTimeout)
+	defer cancel()
+	return errors.Join(err, api.Shutdown(shutdownCtx))
+}
 
-	// Recalculate hours for existing time logs
-	api.recalculateHoursForExistingLogs()
+// Shutdown stops accepting connections, waits for the in-flight requests and
+// then cancels the scheduler and waits for its running jobs, as long as ctx
+// allows. Requests still running when ctx expires are aborted.
+func (api *API) Shutdown(ctx context.Context) error {
+	log.Info().Msg("Shutting down server...")
 
-	for {
+	var err error
+	if shutdownErr := api.Echo.Shutdown(ctx); shutdownErr != nil {
+		err = fmt.Errorf("drain requests: %w", shutdownErr)
+		api.Echo.Close()
+	}
+
+	if api.stopScheduler != nil {
+		api.stopScheduler()
 		select {
-		case <-ticker.C:
-			api.setupNewDay()
+		case <-api.schedulerDone:
+		case <-ctx.Done():
+			err = errors.Join(err, fmt.Errorf("stop scheduler: %w", ctx.Err()))
 		}
 	}
-}
 
-// recalculateHoursForExistingLogs recalculates extra hours, missing hours, and balance
-// for all existing time logs that have all time fields filled
-func (api *API) recalculateHoursForExistingLogs() {
-	var timeLogs []schemas.TimeLog
-
-	// Find all time logs that have all time fields filled
-	if err := api.DB.DB.Where(
-		"entry_time != ? AND lunch_exit_time != ? AND lunch_return_time != ? AND exit_time != ?",
-		time.Time{}, time.Time{}, time.Time{}, time.Time{}).Find(&timeLogs).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to retrieve time logs for recalculation")
-		return
+	if err != nil {
+		log.Error().Err(err).Msg("Server did not shut down cleanly")
+	} else {
+		log.Info().Msg("Server stopped")
 	}
+	return err
+}
 
-	log.Info().Msgf("Found %d time logs to recalculate", len(timeLogs))
-
-	for _, timeLog := range timeLogs {
-		// Get employee workload
-		var employee schemas.Employee
-		if err := api.DB.DB.Where("email = ?", timeLog.EmployeeEmail).First(&employee).Error; err != nil {
-			log.Error().Err(err).Msgf("Failed to retrieve employee for time log ID %d", timeLog.ID)
-
-			// If employee not found, use a default workload of 40 hours
-			employee.Workload = 40.0
-			log.Warn().Msgf("Employee not found for time log ID %d, using default workload of 40 hours", timeLog.ID)
+// registerJobs adds the periodic jobs to the scheduler.
+func (api *API) registerJobs() {
+	jobs := []scheduler.Job{
+		// Runs hourly so every timezone gets its new day right after its own
+		// midnight; creating the day is idempotent.
+		{Name: "setup_new_day", Schedule: "0 * * * *", Run: func(ctx context.Context) error {
+			return api.setupNewDay()
+		}},
+		// Closes the previous day of each timezone shortly after midnight,
+		// detecting absences and incomplete days.
+		{Name: "close_days", Schedule: "30 * * * *", Run: api.closeDays},
+		// Full recalculation of the history, only on demand.
+		{Name: "recalculate_hours", Run: func(ctx context.Context) error {
+			return api.recalculateHoursForExistingLogs()
+		}},
+		// Works through the recalculation queue. Triggered whenever a task is
+		// queued and once at startup to resume interrupted tasks.
+		{Name: recalculationJob, Run: api.processPendingRecalculations},
+	}
+	for _, job := range jobs {
+		if err := api.Scheduler.Register(job); err != nil {
+			log.Fatal().Err(err).Msg("Failed to register job")
 		}
+	}
+}
 
-		// If workload is not set, use a default of 40 hours
-		if employee.Workload < 0.1 {
-			employee.Workload = 40.0
-			log.Warn().Msgf("Workload not set for employee %s, using default of 40 hours", timeLog.EmployeeEmail)
-		}
+// recalculateHoursForExistingLogs queues a recalculation of the whole history
+// of every company. Day to day changes only queue the affected period, see
+// enqueueRecalculation.
+func (api *API) recalculateHoursForExistingLogs() error {
+	companies, err := api.Repos.Companies.List(false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve companies for recalculation")
+		return err
+	}
 
-		// Calculate extra hours, missing hours, and balance
-		extraHours, missingHours, balance := api.CalculateHours(
-			timeLog.EntryTime,
-			timeLog.LunchExitTime,
-			timeLog.LunchReturnTime,
-			timeLog.ExitTime,
-			employee.Workload,
-		)
-
-		// Log the time log details
-		log.Info().
-			Uint("timeLogID", timeLog.ID).
-			Str("employeeEmail", timeLog.EmployeeEmail).
-			Str("logDate", timeLog.LogDate.Format("2006-01-02")).
-			Float32("workload", employee.Workload).
-			Float32("dailyWorkload", employee.Workload/5).
-			Float32("extraHours", extraHours).
-			Float32("missingHours", missingHours).
-			Float32("balance", balance).
-			Msg("Recalculating hours for time log")
-
-		// Update the time log with calculated values
-		timeLog.ExtraHours = extraHours
-		timeLog.MissingHours = missingHours
-		timeLog.Balance = balance
-
-		// Save the updated time log
-		if err := api.DB.DB.Save(&timeLog).Error; err != nil {
-			log.Error().Err(err).Msgf("Failed to update time log ID %d", timeLog.ID)
-		} else {
-			log.Info().Msgf("Successfully updated time log ID %d", timeLog.ID)
+	for _, company := range companies {
+		if _, err := api.enqueueRecalculation(schemas.RecalculationTask{
+			CompanyCNPJ: company.CNPJ,
+			Reason:      "Recálculo completo do histórico",
+			RequestedBy: "sistema",
+		}); err != nil {
+			log.Error().Err(err).Str("company", company.CNPJ).Msg("Failed to queue recalculation")
+			return err
 		}
 	}
-
-	log.Info().Msg("Finished recalculating hours for existing time logs")
+	return nil
 }
 
-func (api *API) setupNewDay() {
+// setupNewDay creates today's empty time log for every employee and brings
+// the workloads and tolerances scheduled for today into force. "Today" is
+// evaluated in each employee's timezone, the same way punchTime does.
+func (api *API) setupNewDay() error {
 
-	currentDate := time.Now().Truncate(24 * time.Hour)
+	now := api.Clock.Now().UTC()
 
-	var employeeIDs []int
-	if err := api.DB.DB.Table("employees").Select("id").Scan(&employeeIDs).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to retrieve employee IDs")
-		return
+	companies, err := api.Repos.Companies.List(false)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve companies")
+		return err
 	}
-
-	for _, id := range employeeIDs {
-		// Get the employee email from the ID
-		var employee schemas.Employee
-		if err := api.DB.DB.First(&employee, id).Error; err != nil {
-			log.Error().Err(err).Msgf("Failed to find employee with ID %d", id)
-			continue
+	for _, company := range companies {
+		if tolerance := api.toleranceOn(company, localDate(now, loadLocation(company.Timezone))); tolerance != company.ToleranceMinutes {
+			company.ToleranceMinutes = tolerance
+			if err := api.Repos.Companies.Update(&company); err != nil {
+				log.Error().Err(err).Str("company", company.CNPJ).Msg("Failed to apply the scheduled tolerance")
+			}
 		}
+	}
+
+	employees, err := api.Repos.Employees.List(db.EmployeeFilter{})
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve employees")
+		return err
+	}
 
-		newLog := schemas.TimeLog{
-			EmployeeEmail: employee.Email,
-			LogDate:       currentDate,
+	location := api.employeeLocations()
+	for _, employee := range employees {
+		id := employee.ID
+		currentDate := localDate(now, location(employee))
+
+		if workload := api.workloadOn(employee, currentDate); workload != employee.Workload {
+			employee.Workload = workload
+			if err := api.Repos.Employees.Update(&employee); err != nil {
+				log.Error().Err(err).Msgf("Failed to apply the scheduled workload of employee %d", id)
+			}
 		}
 
-		err := api.DB.DB.Where("employee_email = ? AND log_date = ?", employee.Email, currentDate).
-			FirstOrCreate(&newLog).Error
+		_, err := api.Repos.TimeLogs.GetByDate(employee.Email, currentDate)
+		if errors.Is(err, db.ErrNotFound) {
+			err = api.Repos.TimeLogs.Create(&schemas.TimeLog{
+				EmployeeEmail: employee.Email,
+				LogDate:       currentDate,
+			})
+			if errors.Is(err, db.ErrDuplicate) {
+				// a punch created it meanwhile
+				err = nil
+			}
+		}
 		if err != nil {
 			log.Error().Err(err).Msgf("Failed to create new log for employee %d", id)
 		} else {
 			log.Info().Msgf("Created new log for employee %d on %s", id, currentDate.Format("2006-01-02"))
 		}
 	}
+	return nil
 }
 
 func (api *API) ConfigureRoutes() {
 
-	api.Echo.GET("/employees/", api.getEmployees)
-	api.Echo.POST("/employee/", api.createEmployee)
+	api.Echo.GET("/employees/", api.getEmployees, api.requireManager)
+	api.Echo.POST("/employee/", api.createEmployee, api.requireAdmin)
 	api.Echo.GET("/employee/:id", api.getEmployeeId)
-	api.Echo.PUT("/employee/:id", api.updateEmployee)
-	api.Echo.DELETE("/employee/:id", api.deleteEmployee)
+	api.Echo.PUT("/employee/:id", api.updateEmployee, api.requireAdmin)
+	api.Echo.DELETE("/employee/:id", api.deleteEmployee, api.requireAdmin)
 
 	//  Routes time registration
 
 	api.Echo.POST("/time_logs", api.createTimeLog)
+	api.Echo.POST("/time_logs/sync", api.syncOfflinePunches, api.requireSession)
 	api.Echo.PUT("/time_logs/:id", api.punchTime)
 	api.Echo.GET("/time_logs", api.getTimeLogs)
 	api.Echo.GET("/time_logs/export", api.exportToExcel)
-	api.Echo.DELETE("/time_logs/:id", api.deleteTimeLog)
+	api.Echo.GET("/time_logs/next_punch", api.getNextPunch)
+	api.Echo.DELETE("/time_logs/:id", api.deleteTimeLog, api.requireAdmin)
 
-	api.Echo.POST("/login", api.login)
-	api.Echo.POST("/login/password", api.createOrUpdatePassword)
+	api.Echo.GET("/setup", api.getSetup)
+	api.Echo.POST("/setup", api.createInitialAdmin)
 
-	adminGroup := api.Echo.Group("/admin")
+	api.Echo.POST("/login", api.login)
+	api.Echo.POST("/logout", api.logout)
+	api.Echo.POST("/login/password", api.changePassword)
+	api.Echo.POST("/login/password/forgot", api.forgotPassword)
+	api.Echo.POST("/login/password/reset", api.resetPassword)
+	api.Echo.POST("/login/2fa", api.completeTwoFactorLogin)
+	api.Echo.POST("/login/2fa/setup", api.setupTwoFactor)
+	api.Echo.POST("/login/2fa/enable", api.enableTwoFactor)
+	api.Echo.POST("/login/2fa/disable", api.disableTwoFactor)
+	api.Echo.GET("/login/sso/callback", api.ssoCallback)
+	api.Echo.GET("/login/sso/:cnpj", api.startSSO)
+
+	// The admin routes act as the administrator of the session, who is
+	// recorded in the audit history
+	adminGroup := api.Echo.Group("/admin", api.requireAdmin)
 	adminGroup.POST("/create_company", api.createCompany)
 	adminGroup.GET("/companies", api.listCompanies)
+	adminGroup.PUT("/companies/:cnpj", api.updateCompany)
 	adminGroup.POST("/create_manager", api.createManager)
 	adminGroup.GET("/managers", api.listManagers)
-	api.Echo.PUT("/time_logs/:id/manual_edit", api.editTimeLogByManager)
+	adminGroup.PUT("/employees/:id/admin", api.setEmployeeAdmin)
+	adminGroup.POST("/employees/:id/unlock", api.unlockEmployeeLogin)
+	adminGroup.GET("/login_attempts", api.listLoginAttempts)
+	adminGroup.PUT("/employees/:id/kiosk", api.setKioskCredentials)
+	adminGroup.POST("/kiosk_devices", api.createKioskDevice)
+	adminGroup.GET("/kiosk_devices", api.listKioskDevices)
+	adminGroup.PUT("/kiosk_devices/:id", api.updateKioskDevice)
+	adminGroup.POST("/kiosk_devices/:id/rotate_key", api.rotateKioskKey)
+	adminGroup.POST("/workplaces", api.createWorkplace)
+	adminGroup.GET("/workplaces", api.listWorkplaces)
+	adminGroup.PUT("/workplaces/:id", api.updateWorkplace)
+	adminGroup.POST("/workplaces/:id/geofences", api.createGeofence)
+	adminGroup.GET("/geofences", api.listGeofences)
+	adminGroup.DELETE("/geofences/:id", api.deleteGeofence)
+	adminGroup.POST("/departments", api.createDepartment)
+	adminGroup.GET("/departments", api.listDepartments)
+	adminGroup.PUT("/departments/:id", api.updateDepartment)
+	adminGroup.DELETE("/departments/:id", api.deleteDepartment)
+	adminGroup.PUT("/departments/:id/employees", api.assignDepartmentEmployees)
+	adminGroup.POST("/companies/:cnpj/branches", api.createBranch)
+	adminGroup.GET("/companies/:cnpj/branches", api.listBranches)
+	adminGroup.PUT("/branches/:id", api.updateBranch)
+	adminGroup.PUT("/branches/:id/employees", api.assignBranchEmployees)
+	adminGroup.POST("/holidays", api.createHoliday)
+	adminGroup.GET("/holidays", api.listHolidays)
+	adminGroup.DELETE("/holidays/:id", api.deleteHoliday)
+	adminGroup.GET("/jobs", api.listJobs)
+	adminGroup.GET("/jobs/:name/runs", api.listJobRuns)
+	adminGroup.POST("/jobs/:name/run", api.triggerJob)
+	adminGroup.POST("/recalculations", api.createRecalculation)
+	adminGroup.GET("/recalculations", api.listRecalculations)
+	adminGroup.GET("/recalculations/:id", api.getRecalculation)
+	adminGroup.GET("/audit", api.listAuditLogs)
 	api.Echo.POST("/employee/request_change", api.requestTimeEdit)
-	api.Echo.GET("/time_logs/export_range", api.exportTimeLogsRange)
-	api.Echo.GET("/manager/requests", api.getManagerRequests)
-	api.Echo.PUT("/manager/requests/:id/status", api.updateRequestStatus)
+	api.Echo.GET("/time_logs/:id/punches", api.getTimeLogPunches, api.requireSession)
+
+	// The manager routes act as the manager of the session opened at login
+	api.Echo.PUT("/time_logs/:id/manual_edit", api.editTimeLogByManager, api.requireManager)
+	api.Echo.GET("/time_logs/export_range", api.exportTimeLogsRange, api.requireManager)
+	managerGroup := api.Echo.Group("/manager", api.requireManager)
+	managerGroup.GET("/requests", api.getManagerRequests)
+	managerGroup.PUT("/requests/:id/status", api.updateRequestStatus)
+	managerGroup.GET("/inconsistencies", api.getManagerInconsistencies)
+	managerGroup.GET("/punches", api.getManagerPunches)
+
+	kioskGroup := api.Echo.Group("/kiosk")
+	kioskGroup.GET("/device", api.getKioskDevice)
+	kioskGroup.POST("/punch", api.kioskPunch)
+	kioskGroup.GET("/workplaces/:id/qr_code", api.getWorkplaceQRCode)
+
+	reportGroup := api.Echo.Group("/reports", api.requireAdmin)
+	reportGroup.GET("/summary", api.getReportSummary)
+	reportGroup.GET("/afd", api.exportAFD)
+	reportGroup.GET("/punches", api.getPunchReport)
 
 	api.Echo.GET("/time-registration.html", func(c echo.Context) error {
-		return c.File("public/time-registration.html")
+		return c.File(filepath.Join(api.Config.Server.StaticDir, "time-registration.html"))
 	})
 
 	api.Echo.GET("/swagger/*", echoSwagger.EchoWrapHandler())
@@ -0,0 +1,2176 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/clock"
+	"github.com/MWismeck/marca-tempo/src/config"
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/db/dbtest"
+	"github.com/MWismeck/marca-tempo/src/mail"
+	"github.com/MWismeck/marca-tempo/src/oidc/oidctest"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/MWismeck/marca-tempo/src/totp"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog"
+)
+
+const testCNPJ = "12345678000190"
+
+var saoPaulo = loadLocation("America/Sao_Paulo")
+
+func TestMain(m *testing.M) {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+	os.Exit(m.Run())
+}
+
+type testServer struct {
+	t     *testing.T
+	api   *API
+	clock *clock.Fake
+	// token is the session sent with every request, see signIn
+	token string
+}
+
+// newTestServer starts an API backed by a private in-memory SQLite database
+// and a fake clock set to now. A company in São Paulo is created up front.
+func newTestServer(t *testing.T, now time.Time) *testServer {
+	t.Helper()
+
+	database := dbtest.Open(t)
+
+	fake := clock.NewFake(now)
+	s := &testServer{t: t, api: NewServer(config.Default(), database, fake), clock: fake}
+	s.create(&schemas.Company{Name: "ACME", CNPJ: testCNPJ, Active: true, Timezone: "America/Sao_Paulo"})
+	return s
+}
+
+// create stores value with the repository of its type.
+func (s *testServer) create(value interface{}) {
+	s.t.Helper()
+	repos := s.api.Repos
+	var err error
+	switch v := value.(type) {
+	case *schemas.Company:
+		err = repos.Companies.Create(v)
+	case *schemas.Employee:
+		err = repos.Employees.Create(v)
+	case *schemas.Department:
+		err = repos.Departments.Create(v)
+	case *schemas.Branch:
+		err = repos.Branches.Create(v)
+	case *schemas.Holiday:
+		err = repos.Holidays.Create(v)
+	case *schemas.TimeLog:
+		err = repos.TimeLogs.Create(v)
+	case *schemas.PunchRecord:
+		err = repos.Punches.Create(v)
+	case *schemas.PontoSolicitacao:
+		err = repos.Requests.Create(v)
+	default:
+		s.t.Fatalf("create %T: no repository", value)
+	}
+	if err != nil {
+		s.t.Fatalf("create %T: %v", value, err)
+	}
+}
+
+// updateEmployee changes the stored employee with change, bypassing the
+// versioning of the API.
+func (s *testServer) updateEmployee(email string, change func(*schemas.Employee)) {
+	s.t.Helper()
+	employee, err := s.api.Repos.Employees.GetByEmail(email)
+	if err != nil {
+		s.t.Fatalf("get employee %s: %v", email, err)
+	}
+	change(&employee)
+	if err := s.api.Repos.Employees.Update(&employee); err != nil {
+		s.t.Fatalf("update employee %s: %v", email, err)
+	}
+}
+
+func (s *testServer) employee(email string, manager bool) schemas.Employee {
+	s.t.Helper()
+	e := schemas.Employee{
+		Name:        email,
+		Email:       email,
+		Active:      true,
+		Workload:    40,
+		IsManager:   manager,
+		CompanyCNPJ: testCNPJ,
+	}
+	s.create(&e)
+	return e
+}
+
+// team puts the employees in a department managed by the manager.
+func (s *testServer) team(manager string, members ...string) schemas.Department {
+	s.t.Helper()
+	department := schemas.Department{Name: "Equipe de " + manager, CompanyCNPJ: testCNPJ, ManagerEmail: manager}
+	s.create(&department)
+	if err := s.api.Repos.Employees.SetDepartment(members, department.ID); err != nil {
+		s.t.Fatalf("set department: %v", err)
+	}
+	return department
+}
+
+func (s *testServer) do(method, target string, body interface{}) *httptest.ResponseRecorder {
+	s.t.Helper()
+	var payload []byte
+	if body != nil {
+		var err error
+		if payload, err = json.Marshal(body); err != nil {
+			s.t.Fatalf("marshal body: %v", err)
+		}
+	}
+	req := httptest.NewRequest(method, target, bytes.NewReader(payload))
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+s.token)
+	}
+	rec := httptest.NewRecorder()
+	s.api.Echo.ServeHTTP(rec, req)
+	return rec
+}
+
+// signIn opens a session for the employee, as a login does, and sends its
+// token with the following requests.
+func (s *testServer) signIn(email string) {
+	s.t.Helper()
+	employee, err := s.api.Repos.Employees.GetByEmail(email)
+	if err != nil {
+		s.t.Fatalf("sign in %s: %v", email, err)
+	}
+	response, err := s.api.loginResponse(employee)
+	if err != nil {
+		s.t.Fatalf("sign in %s: %v", email, err)
+	}
+	s.token = response.Token
+}
+
+// signInAdmin signs in as an administrator of the test company, creating it
+// on first use.
+func (s *testServer) signInAdmin() {
+	s.t.Helper()
+	if _, err := s.api.Repos.Employees.GetByEmail("admin@acme.com"); errors.Is(err, db.ErrNotFound) {
+		admin := schemas.Employee{Name: "Admin", Email: "admin@acme.com", Active: true, IsAdmin: true, CompanyCNPJ: testCNPJ}
+		if err := s.api.Repos.Employees.Create(&admin); err != nil {
+			s.t.Fatalf("create admin: %v", err)
+		}
+	}
+	s.signIn("admin@acme.com")
+}
+
+func (s *testServer) punch(email string, want int) schemas.TimeLog {
+	s.t.Helper()
+	rec := s.do(http.MethodPut, "/time_logs/1?employee_email="+email, nil)
+	if rec.Code != want {
+		s.t.Fatalf("punch at %s: status %d, want %d: %s", s.clock.Now(), rec.Code, want, rec.Body)
+	}
+	var timeLog schemas.TimeLog
+	json.Unmarshal(rec.Body.Bytes(), &timeLog)
+	return timeLog
+}
+
+func (s *testServer) timeLogs(email string) []schemas.TimeLog {
+	s.t.Helper()
+	timeLogs, err := s.api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{email}})
+	if err != nil {
+		s.t.Fatalf("load time logs: %v", err)
+	}
+	return timeLogs
+}
+
+func spTime(day, hour, minute int) time.Time {
+	return time.Date(2025, time.March, day, hour, minute, 0, 0, saoPaulo)
+}
+
+func TestPunchFullDay(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	first := s.punch("ana@acme.com", http.StatusCreated)
+	if !first.LogDate.Equal(time.Date(2025, time.March, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("log_date = %s, want 2025-03-10", first.LogDate)
+	}
+
+	s.clock.Set(spTime(10, 12, 0))
+	s.punch("ana@acme.com", http.StatusOK)
+	s.clock.Set(spTime(10, 13, 0))
+	s.punch("ana@acme.com", http.StatusOK)
+	s.clock.Set(spTime(10, 17, 30))
+	last := s.punch("ana@acme.com", http.StatusOK)
+
+	if !last.EntryTime.Equal(spTime(10, 8, 0)) || !last.ExitTime.Equal(spTime(10, 17, 30)) {
+		t.Errorf("entry/exit = %s/%s", last.EntryTime, last.ExitTime)
+	}
+	if last.ExtraHours != 0.5 || last.MissingHours != 0 || last.Balance != 0.5 {
+		t.Errorf("extra/missing/balance = %v/%v/%v, want 0.5/0/0.5", last.ExtraHours, last.MissingHours, last.Balance)
+	}
+
+	s.clock.Set(spTime(10, 18, 0))
+	s.punch("ana@acme.com", http.StatusBadRequest)
+}
+
+func TestPunchNextDayCreatesNewLog(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	s.punch("ana@acme.com", http.StatusCreated)
+	s.clock.Set(spTime(11, 8, 0))
+	s.punch("ana@acme.com", http.StatusCreated)
+
+	timeLogs := s.timeLogs("ana@acme.com")
+	if len(timeLogs) != 2 {
+		t.Fatalf("got %d time logs, want 2", len(timeLogs))
+	}
+	if timeLogs[1].LogDate.Day() != 11 {
+		t.Errorf("second log_date = %s, want day 11", timeLogs[1].LogDate)
+	}
+}
+
+// At 23:30 in São Paulo it is already the next day in UTC. The daily setup and
+// the punch must agree on the local day instead of creating two logs.
+func TestSetupNewDayAndPunchAgreeOnLocalDate(t *testing.T) {
+	s := newTestServer(t, spTime(10, 23, 30))
+	s.employee("ana@acme.com", false)
+
+	s.api.setupNewDay()
+	s.punch("ana@acme.com", http.StatusOK)
+
+	timeLogs := s.timeLogs("ana@acme.com")
+	if len(timeLogs) != 1 {
+		t.Fatalf("got %d time logs, want 1", len(timeLogs))
+	}
+	if !timeLogs[0].LogDate.Equal(time.Date(2025, time.March, 10, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("log_date = %s, want 2025-03-10", timeLogs[0].LogDate)
+	}
+}
+
+// log_date is a calendar day: a company west of UTC keeps the submitted date
+// instead of the day that instant falls on in its timezone.
+func TestCreateTimeLogKeepsCalendarDate(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	rec := s.do(http.MethodPost, "/time_logs", map[string]interface{}{
+		"employee_email": "ana@acme.com",
+		"log_date":       "2025-03-05T00:00:00Z",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create: %d %s", rec.Code, rec.Body)
+	}
+
+	timeLogs := s.timeLogs("ana@acme.com")
+	if len(timeLogs) != 1 || !timeLogs[0].LogDate.Equal(time.Date(2025, time.March, 5, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("time logs = %+v, want one on 2025-03-05", timeLogs)
+	}
+}
+
+func TestManagerEditWithinHierarchy(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("boss@acme.com", true)
+	ana := s.employee("ana@acme.com", false)
+	s.employee("bob@acme.com", false)
+
+	team := schemas.Department{Name: "Ops", CompanyCNPJ: testCNPJ, ManagerEmail: "boss@acme.com"}
+	s.create(&team)
+	if err := s.api.Repos.Employees.SetDepartment([]string{ana.Email}, team.ID); err != nil {
+		t.Fatal(err)
+	}
+
+	anaLog := s.punch("ana@acme.com", http.StatusCreated)
+	bobLog := s.punch("bob@acme.com", http.StatusCreated)
+
+	s.clock.Set(spTime(12, 9, 0))
+	edit := map[string]string{
+		"entry_time":    "2025-03-10T07:45",
+		"motivo_edicao": "Esqueceu de bater",
+	}
+
+	rec := s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", anaLog.ID), edit)
+	if rec.Code != http.StatusUnauthorized {
+		t.Errorf("edit without a session: status %d, want 401", rec.Code)
+	}
+	s.signIn("ana@acme.com")
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", anaLog.ID), edit); rec.Code != http.StatusForbidden {
+		t.Errorf("edit by an employee: status %d, want 403", rec.Code)
+	}
+
+	s.signIn("boss@acme.com")
+	rec = s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", anaLog.ID), edit)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("edit own team: status %d: %s", rec.Code, rec.Body)
+	}
+	var edited schemas.TimeLog
+	json.Unmarshal(rec.Body.Bytes(), &edited)
+	if !edited.EntryTime.Equal(spTime(10, 7, 45)) {
+		t.Errorf("entry_time = %s, want 07:45 in São Paulo", edited.EntryTime)
+	}
+	if !edited.EditadoEm.Equal(spTime(12, 9, 0)) {
+		t.Errorf("editado_em = %s, want clock time", edited.EditadoEm)
+	}
+
+	rec = s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", bobLog.ID), edit)
+	if rec.Code != http.StatusForbidden {
+		t.Errorf("edit outside team: status %d, want 403", rec.Code)
+	}
+
+	s.clock.Advance(s.api.Config.Auth.SessionTTL)
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", anaLog.ID), edit); rec.Code != http.StatusUnauthorized {
+		t.Errorf("edit with an expired session: status %d, want 401", rec.Code)
+	}
+}
+
+func TestDepartmentHierarchy(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	boss := s.employee("boss@acme.com", true)
+	ana := s.employee("ana@acme.com", false)
+	s.employee("lead@acme.com", true)
+
+	// Sem departamento o gerente não tem equipe, em vez da empresa inteira
+	if emails, err := s.api.managedEmployeeEmails(boss); err != nil || len(emails) != 0 {
+		t.Errorf("scope of a manager without department = %v, %v; want none", emails, err)
+	}
+
+	s.signInAdmin()
+	create := func(body map[string]interface{}) schemas.Department {
+		t.Helper()
+		var department schemas.Department
+		rec := s.do(http.MethodPost, "/admin/departments", body)
+		if err := json.Unmarshal(rec.Body.Bytes(), &department); err != nil || rec.Code != http.StatusCreated {
+			t.Fatalf("create department: status %d: %s", rec.Code, rec.Body)
+		}
+		return department
+	}
+	root := create(map[string]interface{}{"name": "Operações", "company_cnpj": testCNPJ, "manager_email": boss.Email})
+	team := create(map[string]interface{}{"name": "Turno A", "company_cnpj": testCNPJ, "parent_id": root.ID, "manager_email": "lead@acme.com"})
+
+	// E-mails repetidos contam uma vez
+	rec := s.do(http.MethodPut, fmt.Sprintf("/admin/departments/%d/employees", team.ID), map[string][]string{
+		"employee_emails": {ana.Email, ana.Email},
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("assign repeated emails: status %d: %s", rec.Code, rec.Body)
+	}
+	if ok, err := s.api.canManage(boss, ana); err != nil || !ok {
+		t.Errorf("manager of the parent department cannot manage ana: %v", err)
+	}
+
+	// parent_id 0 e manager_email vazio removem o pai e o gerente
+	var updated schemas.Department
+	rec = s.do(http.MethodPut, fmt.Sprintf("/admin/departments/%d", team.ID), map[string]interface{}{"parent_id": 0, "manager_email": ""})
+	if err := json.Unmarshal(rec.Body.Bytes(), &updated); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("clear parent and manager: status %d: %s", rec.Code, rec.Body)
+	}
+	if stored, _ := s.api.Repos.Departments.Get(team.ID); stored.ParentID != nil || stored.ManagerEmail != "" || stored.Name != "Turno A" {
+		t.Errorf("department after clearing = %+v", stored)
+	}
+	if ok, _ := s.api.canManage(boss, ana); ok {
+		t.Errorf("manager keeps ana after the department left the hierarchy")
+	}
+	// Campos omitidos são mantidos
+	rec = s.do(http.MethodPut, fmt.Sprintf("/admin/departments/%d", team.ID), map[string]interface{}{"parent_id": root.ID})
+	if stored, _ := s.api.Repos.Departments.Get(team.ID); rec.Code != http.StatusOK || stored.ParentID == nil || *stored.ParentID != root.ID {
+		t.Errorf("set parent again: status %d, department %+v", rec.Code, stored)
+	}
+}
+
+func TestUpdateRequestStatusUsesClock(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("boss@acme.com", true)
+	s.employee("ana@acme.com", false)
+	s.team("boss@acme.com", "ana@acme.com")
+
+	request := schemas.PontoSolicitacao{FuncionarioEmail: "ana@acme.com", Motivo: "Esqueci", Status: "pendente"}
+	s.create(&request)
+
+	s.clock.Set(spTime(11, 15, 0))
+	s.signIn("boss@acme.com")
+	rec := s.do(http.MethodPut, fmt.Sprintf("/manager/requests/%d/status", request.ID), map[string]string{
+		"status":             "aprovado",
+		"comentario_gerente": "Ok",
+		// ignored: the manager is the one of the session
+		"gerente_email": "ana@acme.com",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body)
+	}
+
+	stored, _ := s.api.Repos.Requests.Get(request.ID)
+	if stored.Status != "aprovado" || !stored.ProcessadoEm.Equal(spTime(11, 15, 0)) || stored.GerenteEmail != "boss@acme.com" {
+		t.Errorf("status/processado_em/gerente = %s/%s/%s", stored.Status, stored.ProcessadoEm, stored.GerenteEmail)
+	}
+}
+
+func TestListTeamEmployees(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("boss@acme.com", true)
+	s.employee("chefe@acme.com", true)
+	s.employee("ana@acme.com", false)
+	s.employee("bob@acme.com", false)
+	s.team("boss@acme.com", "ana@acme.com")
+	s.team("chefe@acme.com", "bob@acme.com")
+
+	list := func(query string) (int, []string) {
+		t.Helper()
+		rec := s.do(http.MethodGet, "/employees/"+query, nil)
+		var body map[string][]schemas.EmployeeResponse
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		var emails []string
+		for _, employee := range body["employees:"] {
+			emails = append(emails, employee.Email)
+		}
+		return rec.Code, emails
+	}
+
+	if code, _ := list("?active=true"); code != http.StatusUnauthorized {
+		t.Errorf("list without a session: status %d, want 401", code)
+	}
+	s.signIn("ana@acme.com")
+	if code, _ := list("?active=true"); code != http.StatusForbidden {
+		t.Errorf("list by an employee: status %d, want 403", code)
+	}
+	// The team is the one of the manager of the session, whatever the query says
+	s.signIn("boss@acme.com")
+	if code, emails := list("?active=true&manager_email=chefe@acme.com"); code != http.StatusOK || !slices.Equal(emails, []string{"ana@acme.com"}) {
+		t.Errorf("list by a manager: status %d, employees %v", code, emails)
+	}
+}
+
+func (s *testServer) workDay(email string, day int, exitHour, exitMinute int) schemas.TimeLog {
+	s.t.Helper()
+	timeLog := schemas.TimeLog{
+		EmployeeEmail:   email,
+		LogDate:         time.Date(2025, time.March, day, 0, 0, 0, 0, time.UTC),
+		EntryTime:       spTime(day, 8, 0).UTC(),
+		LunchExitTime:   spTime(day, 12, 0).UTC(),
+		LunchReturnTime: spTime(day, 13, 0).UTC(),
+		ExitTime:        spTime(day, exitHour, exitMinute).UTC(),
+	}
+	employee, err := s.api.Repos.Employees.GetByEmail(email)
+	if err != nil {
+		s.t.Fatalf("get employee %s: %v", email, err)
+	}
+	s.api.applyHours(&timeLog, employee)
+	s.create(&timeLog)
+	return timeLog
+}
+
+func TestWorkloadChangeRecalculatesFromEffectiveDate(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	ana := s.employee("ana@acme.com", false)
+	s.workDay("ana@acme.com", 10, 17, 0)
+	s.workDay("ana@acme.com", 11, 17, 0)
+
+	s.signInAdmin()
+	rec := s.do(http.MethodPut, fmt.Sprintf("/employee/%d?effective_from=2025-03-11", ana.ID),
+		map[string]interface{}{"workload": 30, "active": true})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update employee: status %d: %s", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+
+	timeLogs := s.timeLogs("ana@acme.com")
+	if timeLogs[0].Balance != 0 {
+		t.Errorf("day before effective date: balance = %v, want 0", timeLogs[0].Balance)
+	}
+	if timeLogs[1].ExtraHours != 2 || timeLogs[1].Balance != 2 {
+		t.Errorf("effective day: extra/balance = %v/%v, want 2/2", timeLogs[1].ExtraHours, timeLogs[1].Balance)
+	}
+
+	var task schemas.RecalculationTask
+	if tasks, _ := s.api.Repos.Recalculations.List(db.RecalculationFilter{Limit: 1}); len(tasks) == 1 {
+		task = tasks[0]
+	}
+	if task.Status != recalculationDone || task.Total != 1 || task.Changed != 1 {
+		t.Errorf("task status/total/changed = %s/%d/%d, want concluido/1/1", task.Status, task.Total, task.Changed)
+	}
+
+	audits, _ := s.api.Repos.AuditLogs.List(db.AuditLogFilter{Entity: "time_log", EntityID: &timeLogs[1].ID})
+	if len(audits) != 1 || audits[0].Actor != "admin@acme.com" {
+		t.Errorf("audit entries for the recalculated log = %+v, want one by the admin of the session", audits)
+	}
+}
+
+func TestToleranceChangeRecalculatesCompany(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.employee("ana@acme.com", false)
+	if timeLog := s.workDay("ana@acme.com", 11, 17, 6); timeLog.ExtraHours == 0 {
+		t.Fatalf("extra hours before tolerance = 0")
+	}
+
+	s.signInAdmin()
+	rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]interface{}{
+		"tolerance_minutes": 10,
+		"effective_from":    "2025-03-01",
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("update company: status %d: %s", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+
+	if timeLog := s.timeLogs("ana@acme.com")[0]; timeLog.ExtraHours != 0 || timeLog.Balance != 0 {
+		t.Errorf("extra/balance = %v/%v, want 0/0 within tolerance", timeLog.ExtraHours, timeLog.Balance)
+	}
+}
+
+func TestFutureWorkloadAppliesFromItsDate(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	ana := s.employee("ana@acme.com", false)
+
+	s.signInAdmin()
+	rec := s.do(http.MethodPut, fmt.Sprintf("/employee/%d?effective_from=2025-03-17", ana.ID),
+		map[string]interface{}{"workload": 30, "active": true})
+	if rec.Code != http.StatusOK || !strings.Contains(rec.Body.String(), `"workload":40`) {
+		t.Fatalf("update employee: status %d: %s, want the current workload kept", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+
+	if timeLog := s.workDay("ana@acme.com", 14, 17, 0); timeLog.Balance != 0 {
+		t.Errorf("day before the new workload: balance = %v, want 0", timeLog.Balance)
+	}
+	if timeLog := s.workDay("ana@acme.com", 17, 17, 0); timeLog.Balance != 2 {
+		t.Errorf("first day of the new workload: balance = %v, want 2", timeLog.Balance)
+	}
+
+	// The employee carries the new workload once its day arrives
+	s.clock.Set(spTime(17, 1, 0))
+	if err := s.api.setupNewDay(); err != nil {
+		t.Fatalf("setup new day: %v", err)
+	}
+	if employee, _ := s.api.Repos.Employees.Get(ana.ID); employee.Workload != 30 {
+		t.Errorf("workload on the effective day = %v, want 30", employee.Workload)
+	}
+}
+
+func TestRecalculationChargesAbsencesAndFollowsBranches(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	ana := s.employee("ana@acme.com", false)
+	absence := func(day int) schemas.TimeLog {
+		timeLog := schemas.TimeLog{EmployeeEmail: ana.Email, LogDate: time.Date(2025, time.March, day, 0, 0, 0, 0, time.UTC), Status: dayAbsent, MissingHours: 8, Balance: -8}
+		s.create(&timeLog)
+		return timeLog
+	}
+	missing := func(timeLog schemas.TimeLog) float32 {
+		stored, _ := s.api.Repos.TimeLogs.Get(timeLog.ID)
+		return stored.MissingHours
+	}
+	monday, tuesday := absence(10), absence(11)
+
+	s.signInAdmin()
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/employee/%d?effective_from=2025-03-11", ana.ID),
+		map[string]interface{}{"workload": 30, "active": true}); rec.Code != http.StatusOK {
+		t.Fatalf("update employee: status %d: %s", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+	if missing(monday) != 8 || missing(tuesday) != 6 {
+		t.Errorf("absences after the workload change = %v/%v, want 8/6", missing(monday), missing(tuesday))
+	}
+
+	// Moving to a branch charges its schedule from today on. Each change
+	// triggers the recalculation job, which runs once per second
+	s.clock.Advance(time.Second)
+	branch := schemas.Branch{CompanyCNPJ: testCNPJ, Name: "Norte", Active: true, ScheduleEntry: "08:00", ScheduleLunchExit: "12:00", ScheduleLunchReturn: "13:00", ScheduleExit: "17:00"}
+	s.create(&branch)
+	wednesday := absence(12)
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/branches/%d/employees", branch.ID),
+		map[string][]string{"employee_emails": {ana.Email}}); rec.Code != http.StatusOK {
+		t.Fatalf("assign branch: status %d: %s", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+	if missing(tuesday) != 6 || missing(wednesday) != 8 {
+		t.Errorf("absences after the branch change = %v/%v, want 6/8", missing(tuesday), missing(wednesday))
+	}
+
+	// A schedule change recharges the absences from its effective date
+	s.clock.Advance(time.Second)
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/branches/%d", branch.ID), map[string]string{
+		"schedule_exit":  "16:00",
+		"effective_from": "2025-03-11",
+	}); rec.Code != http.StatusOK {
+		t.Fatalf("update branch: status %d: %s", rec.Code, rec.Body)
+	}
+	s.api.Scheduler.Wait()
+	if missing(monday) != 8 || missing(tuesday) != 7 || missing(wednesday) != 7 {
+		t.Errorf("absences after the schedule change = %v/%v/%v, want 8/7/7", missing(monday), missing(tuesday), missing(wednesday))
+	}
+}
+
+func TestCloseDaysClassifiesAndListsInconsistencies(t *testing.T) {
+	s := newTestServer(t, spTime(13, 9, 0))
+	s.employee("boss@acme.com", true)
+	ana := s.employee("ana@acme.com", false)
+	s.team("boss@acme.com", ana.Email)
+	s.updateEmployee(ana.Email, func(e *schemas.Employee) { e.CreatedAt = spTime(7, 9, 0) })
+
+	s.workDay("ana@acme.com", 10, 17, 0)
+	s.create(&schemas.TimeLog{EmployeeEmail: "ana@acme.com", LogDate: time.Date(2025, time.March, 11, 0, 0, 0, 0, time.UTC), EntryTime: spTime(11, 8, 0).UTC()})
+	s.create(&schemas.Holiday{CompanyCNPJ: testCNPJ, Date: time.Date(2025, time.March, 12, 0, 0, 0, 0, time.UTC), Name: "Feriado"})
+
+	if err := s.api.closeDays(context.Background()); err != nil {
+		t.Fatalf("close days: %v", err)
+	}
+
+	want := map[int]string{7: dayAbsent, 8: dayOff, 9: dayOff, 10: dayComplete, 11: dayIncomplete, 12: dayHoliday}
+	timeLogs := s.timeLogs("ana@acme.com")
+	if len(timeLogs) != len(want) {
+		t.Fatalf("got %d time logs, want %d", len(timeLogs), len(want))
+	}
+	for _, tl := range timeLogs {
+		if tl.Status != want[tl.LogDate.Day()] {
+			t.Errorf("day %d: status %q, want %q", tl.LogDate.Day(), tl.Status, want[tl.LogDate.Day()])
+		}
+	}
+	if timeLogs[0].MissingHours != 8 || timeLogs[0].Balance != -8 {
+		t.Errorf("absence missing/balance = %v/%v, want 8/-8", timeLogs[0].MissingHours, timeLogs[0].Balance)
+	}
+
+	s.signIn("boss@acme.com")
+	rec := s.do(http.MethodGet, "/manager/inconsistencies", nil)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("inconsistencies: status %d: %s", rec.Code, rec.Body)
+	}
+	var got []Inconsistency
+	json.Unmarshal(rec.Body.Bytes(), &got)
+	if len(got) != 2 || got[0].Status != dayAbsent || got[1].Status != dayIncomplete || len(got[1].MissingPunches) != 3 {
+		t.Errorf("inconsistencies = %+v", got)
+	}
+}
+
+// Handlers only touch employees, companies, time logs and logins through the
+// repositories, so a punch day runs without any database.
+func TestPunchDayWithMemoryRepositories(t *testing.T) {
+	fake := clock.NewFake(spTime(10, 8, 0))
+	s := &testServer{t: t, api: NewServerWithRepositories(config.Default(), db.NewMemoryRepositories(), nil, fake), clock: fake}
+	s.signInAdmin()
+
+	rec := s.do(http.MethodPost, "/admin/create_company", map[string]interface{}{
+		"name": "ACME", "cnpj": testCNPJ, "email": "rh@acme.com", "fone": "1130000000", "active": true,
+		"timezone": "America/Sao_Paulo",
+	})
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("create company: status %d: %s", rec.Code, rec.Body)
+	}
+	company, err := s.api.Repos.Companies.GetByCNPJ(testCNPJ)
+	if err != nil {
+		t.Fatalf("get company: %v", err)
+	}
+	company.ToleranceMinutes = 10
+	s.api.Repos.Companies.Update(&company)
+	rec = s.do(http.MethodPost, "/employee/", map[string]interface{}{
+		"name": "Ana", "cpf": "12345678901", "rg": "123456789", "email": "ana@acme.com", "age": 30,
+		"active": true, "workload": 40, "password": "s3cret!", "company_cnpj": testCNPJ,
+	})
+	if rec.Code != http.StatusOK {
+		t.Fatalf("create employee: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodPost, "/login", map[string]string{"email": "ana@acme.com", "password": "s3cret!"}); rec.Code != http.StatusOK {
+		t.Fatalf("login: status %d: %s", rec.Code, rec.Body)
+	}
+
+	s.punch("ana@acme.com", http.StatusCreated)
+	s.clock.Set(spTime(10, 12, 0))
+	s.punch("ana@acme.com", http.StatusOK)
+	s.clock.Set(spTime(10, 13, 0))
+	s.punch("ana@acme.com", http.StatusOK)
+	// Five minutes over the workload, within the company tolerance
+	s.clock.Set(spTime(10, 17, 5))
+	last := s.punch("ana@acme.com", http.StatusOK)
+	if last.Balance != 0 || last.Status != dayComplete {
+		t.Errorf("balance/status = %v/%q, want 0/%q", last.Balance, last.Status, dayComplete)
+	}
+
+	rec = s.do(http.MethodGet, "/time_logs?employee_email=ana@acme.com", nil)
+	var timeLogs []schemas.TimeLog
+	json.Unmarshal(rec.Body.Bytes(), &timeLogs)
+	if len(timeLogs) != 1 || timeLogs[0].ExitTime.IsZero() {
+		t.Fatalf("time logs = %+v, want one complete day", timeLogs)
+	}
+
+	// Cadastrar e excluir funcionários e registros é só para administradores
+	ana, _ := s.api.Repos.Employees.GetByEmail("ana@acme.com")
+	deleteLog := fmt.Sprintf("/time_logs/%d", timeLogs[0].ID)
+	deleteAna := fmt.Sprintf("/employee/%d", ana.ID)
+	newEmployee := map[string]interface{}{"name": "Bia", "email": "bia@acme.com", "password": "s3cret!", "company_cnpj": testCNPJ}
+	s.token = ""
+	if rec := s.do(http.MethodDelete, deleteLog, nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous time log deletion: status %d, want 401", rec.Code)
+	}
+	s.signIn("ana@acme.com")
+	for _, req := range []struct {
+		method, path string
+		body         interface{}
+	}{
+		{http.MethodPost, "/employee/", newEmployee},
+		{http.MethodDelete, deleteAna, nil},
+		{http.MethodDelete, deleteLog, nil},
+	} {
+		if rec := s.do(req.method, req.path, req.body); rec.Code != http.StatusForbidden {
+			t.Errorf("%s %s by an employee: status %d, want 403", req.method, req.path, rec.Code)
+		}
+	}
+	s.signInAdmin()
+	if rec := s.do(http.MethodDelete, deleteLog, nil); rec.Code != http.StatusOK {
+		t.Errorf("time log deletion by an admin: status %d: %s", rec.Code, rec.Body)
+	}
+}
+
+func TestImportEmployeesAndExportCSV(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+
+	result, err := s.api.ImportEmployees(strings.NewReader(
+		"name,email,cpf,rg,age,company_cnpj,password,workload\n" +
+			"Ana,ana@acme.com,12345678901,123456789,30," + testCNPJ + ",senha!1,44\n" +
+			"Bia,bia@acme.com,123,123456789,25," + testCNPJ + ",senha!1,\n" +
+			"Ana de novo,ana@acme.com,12345678901,123456789,30," + testCNPJ + ",senha!1,\n"))
+	if err != nil {
+		t.Fatalf("import: %v", err)
+	}
+	if result.Created != 1 || len(result.Errors) != 2 || result.Errors[0].Line != 3 || result.Errors[1].Line != 4 {
+		t.Fatalf("import result = %+v", result)
+	}
+	if login, err := s.api.Repos.Logins.GetByEmail("ana@acme.com"); err != nil || !CheckPasswordHash("senha!1", login.Password) {
+		t.Errorf("imported login: %+v, %v", login, err)
+	}
+
+	s.workDay("ana@acme.com", 10, 17, 0)
+	s.workDay("ana@acme.com", 11, 18, 0)
+
+	export, err := s.api.Export(ExportCSV, testCNPJ, nil, time.Date(2025, time.March, 11, 0, 0, 0, 0, time.UTC), time.Date(2025, time.March, 12, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("export: %v", err)
+	}
+	records, err := csv.NewReader(bytes.NewReader(export.Content)).ReadAll()
+	if err != nil || len(records) != 2 {
+		t.Fatalf("exported records = %v, %v", records, err)
+	}
+	if got := strings.Join(records[1], ","); got != "Ana,ana@acme.com,11/03/2025,08:00,12:00,13:00,18:00,0.20,0.00,0.20,completo" {
+		t.Errorf("exported row = %s", got)
+	}
+}
+
+func TestRecalculateUpToDateAndCloseMonth(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	ana := s.employee("ana@acme.com", false)
+	s.updateEmployee(ana.Email, func(e *schemas.Employee) { e.CreatedAt = time.Date(2025, time.February, 25, 12, 0, 0, 0, time.UTC) })
+	s.workDay("ana@acme.com", 10, 17, 0)
+	s.workDay("ana@acme.com", 11, 17, 0)
+	s.updateEmployee(ana.Email, func(e *schemas.Employee) { e.Workload = 30 })
+
+	task, err := s.api.Recalculate(context.Background(), RecalculationRequest{CompanyCNPJ: testCNPJ, FromDate: "2025-03-01", ToDate: "2025-03-10"})
+	if err != nil || task.Processed != 1 || task.Changed != 1 {
+		t.Fatalf("recalculate = %+v, %v", task, err)
+	}
+	if timeLogs := s.timeLogs("ana@acme.com"); timeLogs[0].Balance != 2 || timeLogs[1].Balance != 0 {
+		t.Errorf("balances = %v/%v, want 2/0 (after the period untouched)", timeLogs[0].Balance, timeLogs[1].Balance)
+	}
+
+	// Queued again after an interruption, the task starts its counts over
+	task.Status = recalculationPending
+	if err := s.api.Repos.Recalculations.Update(&task); err != nil {
+		t.Fatalf("requeue: %v", err)
+	}
+	if err := s.api.processPendingRecalculations(context.Background()); err != nil {
+		t.Fatalf("process pending: %v", err)
+	}
+	if done, _ := s.api.Repos.Recalculations.List(db.RecalculationFilter{Status: recalculationDone}); len(done) != 1 || done[0].Processed != 1 || done[0].Changed != 0 {
+		t.Errorf("requeued task = %+v, want 1 processed and none changed", done)
+	}
+
+	summaries, err := s.api.CloseMonth(context.Background(), testCNPJ, time.Date(2025, time.February, 1, 0, 0, 0, 0, time.UTC))
+	if err != nil {
+		t.Fatalf("close month: %v", err)
+	}
+	// Hired on Tuesday the 25th: four working days without punches
+	if len(summaries) != 1 || summaries[0].Days != 4 || summaries[0].MissingHours != 24 {
+		t.Errorf("summaries = %+v", summaries)
+	}
+}
+
+func TestRunDrainsRequestsOnShutdown(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.api.Config.Server.Addr = "127.0.0.1:0"
+
+	inFlight, release := make(chan struct{}), make(chan struct{})
+	s.api.Echo.GET("/slow", func(c echo.Context) error {
+		close(inFlight)
+		<-release
+		return c.String(http.StatusOK, "ok")
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan error, 1)
+	go func() { stopped <- s.api.Run(ctx) }()
+
+	for s.api.Echo.ListenerAddr() == nil {
+		time.Sleep(10 * time.Millisecond)
+	}
+	response := make(chan int, 1)
+	go func() {
+		res, err := http.Get("http://" + s.api.Echo.ListenerAddr().String() + "/slow")
+		if err != nil {
+			response <- 0
+			return
+		}
+		res.Body.Close()
+		response <- res.StatusCode
+	}()
+
+	<-inFlight
+	cancel()
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+
+	if code := <-response; code != http.StatusOK {
+		t.Errorf("in-flight request: status %d, want 200", code)
+	}
+	if err := <-stopped; err != nil {
+		t.Errorf("run: %v", err)
+	}
+}
+
+func TestRunReportsListenFailure(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.api.Config.Server.Addr = "256.0.0.1:0"
+
+	if err := s.api.Run(context.Background()); err == nil {
+		t.Fatal("run with an invalid address: want an error")
+	}
+}
+
+func TestSetupCreatesFirstAdminOnceAndKeepsOneAdmin(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+
+	var status map[string]bool
+	json.Unmarshal(s.do(http.MethodGet, "/setup", nil).Body.Bytes(), &status)
+	if !status["setup_required"] {
+		t.Fatalf("setup status = %v, want required", status)
+	}
+
+	setup := map[string]string{
+		"name": "Admin", "email": "admin@nova.com", "password": "senha!1",
+		"company_cnpj": "98765432000110", "company_name": "Nova",
+	}
+	rec := s.do(http.MethodPost, "/setup", setup)
+	if rec.Code != http.StatusCreated {
+		t.Fatalf("setup: status %d: %s", rec.Code, rec.Body)
+	}
+	var admin schemas.Employee
+	json.Unmarshal(rec.Body.Bytes(), &admin)
+	if company, err := s.api.Repos.Companies.GetByCNPJ("98765432000110"); err != nil || company.Name != "Nova" {
+		t.Errorf("company created with the admin: %+v, %v", company, err)
+	}
+
+	ana := s.employee("ana@acme.com", false)
+	promote := map[string]interface{}{"is_admin": true}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/admin", ana.ID), promote); rec.Code != http.StatusUnauthorized {
+		t.Errorf("promote without a session: status %d, want 401", rec.Code)
+	}
+	s.signIn("ana@acme.com")
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/admin", ana.ID), promote); rec.Code != http.StatusForbidden {
+		t.Errorf("promote by an employee: status %d, want 403", rec.Code)
+	}
+
+	rec = s.do(http.MethodPost, "/login", map[string]string{"email": "admin@nova.com", "password": "senha!1"})
+	var session LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil || rec.Code != http.StatusOK || session.Role != "admin" || session.Token == "" {
+		t.Fatalf("admin login: status %d: %s", rec.Code, rec.Body)
+	}
+	s.token = session.Token
+
+	setup["email"] = "intruso@nova.com"
+	if rec := s.do(http.MethodPost, "/setup", setup); rec.Code != http.StatusForbidden {
+		t.Errorf("second setup: status %d, want 403", rec.Code)
+	}
+
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/admin", ana.ID), promote); rec.Code != http.StatusOK {
+		t.Fatalf("promote: status %d: %s", rec.Code, rec.Body)
+	}
+	var audit schemas.AuditLog
+	if audits, _ := s.api.Repos.AuditLogs.List(db.AuditLogFilter{Entity: "employee", EntityID: &ana.ID, Limit: 1}); len(audits) == 1 {
+		audit = audits[0]
+	}
+	if audit.Actor != "admin@nova.com" {
+		t.Errorf("promotion audited as %q, want the admin of the session", audit.Actor)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/admin", admin.ID), map[string]interface{}{"is_admin": false}); rec.Code != http.StatusOK {
+		t.Fatalf("demote: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodGet, "/admin/companies", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("session of a demoted admin: status %d, want 403", rec.Code)
+	}
+	s.signIn("ana@acme.com")
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/admin", ana.ID), map[string]interface{}{"is_admin": false}); rec.Code != http.StatusBadRequest {
+		t.Errorf("demote last admin: status %d, want 400", rec.Code)
+	}
+}
+
+// mailbox records the messages instead of sending them.
+type mailbox struct{ messages []mail.Message }
+
+func (m *mailbox) Send(msg mail.Message) error {
+	m.messages = append(m.messages, msg)
+	return nil
+}
+
+var resetTokenRegex = regexp.MustCompile(`token=([A-Za-z0-9_-]+)`)
+
+func TestPasswordResetByEmail(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	box := &mailbox{}
+	s.api.Mailer = box
+	s.employee("ana@acme.com", false)
+	if err := s.api.setPassword("ana@acme.com", "antiga!1"); err != nil {
+		t.Fatal(err)
+	}
+
+	forgot := func(email string) string {
+		t.Helper()
+		before := len(box.messages)
+		if rec := s.do(http.MethodPost, "/login/password/forgot", map[string]string{"email": email}); rec.Code != http.StatusAccepted {
+			t.Fatalf("forgot %s: status %d: %s", email, rec.Code, rec.Body)
+		}
+		if len(box.messages) == before {
+			return ""
+		}
+		return resetTokenRegex.FindStringSubmatch(box.messages[len(box.messages)-1].Body)[1]
+	}
+	reset := func(token, password string) int {
+		return s.do(http.MethodPost, "/login/password/reset", map[string]string{"token": token, "password": password}).Code
+	}
+	login := func(password string) int {
+		return s.do(http.MethodPost, "/login", map[string]string{"email": "ana@acme.com", "password": password}).Code
+	}
+	signedIn := func(token string) bool {
+		_, err := s.api.Repos.Sessions.GetByHash(hashResetToken(token))
+		return err == nil
+	}
+	s.signIn("ana@acme.com")
+	stolen := s.token
+	s.token = ""
+
+	if token := forgot("ninguem@acme.com"); token != "" {
+		t.Errorf("reset e-mail sent to an unknown account")
+	}
+
+	first := forgot("ana@acme.com")
+	token := forgot("ana@acme.com")
+	if box.messages[1].To != "ana@acme.com" {
+		t.Errorf("reset e-mail sent to %s", box.messages[1].To)
+	}
+	if code := reset(first, "nova!123"); code != http.StatusBadRequest {
+		t.Errorf("superseded token: status %d, want 400", code)
+	}
+	if code := reset(token, "fraca"); code != http.StatusBadRequest {
+		t.Errorf("weak password: status %d, want 400", code)
+	}
+	if code := reset(token, "nova!123"); code != http.StatusOK {
+		t.Fatalf("reset: status %d", code)
+	}
+	if signedIn(stolen) {
+		t.Errorf("session opened before the reset is still valid")
+	}
+	if login("nova!123") != http.StatusOK || login("antiga!1") != http.StatusUnauthorized {
+		t.Errorf("login after reset does not use the new password")
+	}
+	if code := reset(token, "outra!123"); code != http.StatusBadRequest {
+		t.Errorf("reused token: status %d, want 400", code)
+	}
+
+	expired := forgot("ana@acme.com")
+	s.clock.Advance(s.api.Config.Auth.PasswordResetTTL)
+	if code := reset(expired, "outra!123"); code != http.StatusBadRequest {
+		t.Errorf("expired token: status %d, want 400", code)
+	}
+
+	change := func(current, password string) int {
+		return s.do(http.MethodPost, "/login/password", map[string]string{
+			"email": "ana@acme.com", "current_password": current, "password": password,
+		}).Code
+	}
+	if code := change("errada!1", "outra!123"); code != http.StatusUnauthorized {
+		t.Errorf("change with wrong current password: status %d, want 401", code)
+	}
+	// Second failure of the account, after the login with the old password
+	s.clock.Advance(2 * s.api.Config.Auth.FailureDelay)
+	s.signIn("ana@acme.com")
+	other := s.token
+	s.signIn("ana@acme.com")
+	if code := change("nova!123", "outra!123"); code != http.StatusOK || login("outra!123") != http.StatusOK {
+		t.Errorf("change password: status %d", code)
+	}
+	if signedIn(other) || !signedIn(s.token) {
+		t.Errorf("change password must end the other sessions and keep the current one")
+	}
+}
+
+func TestTwoFactorLogin(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.employee("gerente@acme.com", true)
+	if err := s.api.setPassword("gerente@acme.com", "senha!12"); err != nil {
+		t.Fatal(err)
+	}
+	account := map[string]string{"email": "gerente@acme.com", "password": "senha!12"}
+	login := func() map[string]interface{} {
+		t.Helper()
+		rec := s.do(http.MethodPost, "/login", account)
+		var body map[string]interface{}
+		json.Unmarshal(rec.Body.Bytes(), &body)
+		body["status"] = float64(rec.Code)
+		return body
+	}
+	secondStep := func(challenge, code string) int {
+		return s.do(http.MethodPost, "/login/2fa", map[string]string{"challenge": challenge, "code": code}).Code
+	}
+
+	// Exigido pela empresa e ainda não cadastrado: o login pede o cadastro
+	s.signInAdmin()
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]bool{"require_two_factor": true}); rec.Code != http.StatusOK {
+		t.Fatalf("require 2FA: status %d: %s", rec.Code, rec.Body)
+	}
+	if body := login(); body["status"] != float64(http.StatusForbidden) || body["two_factor_setup_required"] != true {
+		t.Fatalf("login without enrolled 2FA: %v", body)
+	}
+
+	rec := s.do(http.MethodPost, "/login/2fa/setup", account)
+	var setup TwoFactorSetup
+	if err := json.Unmarshal(rec.Body.Bytes(), &setup); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("setup: status %d: %s", rec.Code, rec.Body)
+	}
+	if !strings.HasPrefix(setup.URI, "otpauth://totp/") || !strings.Contains(setup.URI, "secret="+setup.Secret) {
+		t.Errorf("setup URI %q", setup.URI)
+	}
+
+	currentCode := func() string {
+		t.Helper()
+		code, err := totp.Code(setup.Secret, totp.Step(s.clock.Now()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return code
+	}
+	enable := func(code string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPost, "/login/2fa/enable", map[string]string{"email": "gerente@acme.com", "password": "senha!12", "code": code})
+	}
+	if rec := enable("000000"); rec.Code != http.StatusUnauthorized {
+		t.Errorf("enable with wrong code: status %d, want 401", rec.Code)
+	}
+	s.clock.Advance(s.api.Config.Auth.FailureDelay)
+	rec = enable(currentCode())
+	var enabled struct {
+		RecoveryCodes []string `json:"recovery_codes"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &enabled); err != nil || rec.Code != http.StatusOK || len(enabled.RecoveryCodes) != recoveryCodeCount {
+		t.Fatalf("enable: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// O código usado na ativação não vale de novo
+	body := login()
+	challenge, _ := body["challenge"].(string)
+	if body["two_factor_required"] != true || challenge == "" || body["employee_id"] != nil || body["token"] != nil {
+		t.Fatalf("first step: %v", body)
+	}
+	if code := secondStep(challenge, currentCode()); code != http.StatusUnauthorized {
+		t.Errorf("replayed code: status %d, want 401", code)
+	}
+	s.clock.Advance(totp.Period)
+	rec = s.do(http.MethodPost, "/login/2fa", map[string]string{"challenge": challenge, "code": currentCode()})
+	var session LoginResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &session); err != nil || rec.Code != http.StatusOK || session.Token == "" {
+		t.Fatalf("second step: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// A sessão aberta na segunda etapa autoriza as rotas do gerente até o logout
+	s.token = session.Token
+	if rec := s.do(http.MethodGet, "/manager/requests", nil); rec.Code != http.StatusOK {
+		t.Errorf("manager route with the session: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodPost, "/logout", nil); rec.Code != http.StatusOK {
+		t.Errorf("logout: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodGet, "/manager/requests", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("manager route after logout: status %d, want 401", rec.Code)
+	}
+	s.token = ""
+	if code := secondStep(challenge, enabled.RecoveryCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("reused challenge: status %d, want 401", code)
+	}
+
+	// Códigos de recuperação valem uma única vez
+	challenge = login()["challenge"].(string)
+	if code := secondStep(challenge, strings.ToLower(enabled.RecoveryCodes[0])); code != http.StatusOK {
+		t.Fatalf("recovery code: status %d", code)
+	}
+	challenge = login()["challenge"].(string)
+	if code := secondStep(challenge, enabled.RecoveryCodes[0]); code != http.StatusUnauthorized {
+		t.Errorf("reused recovery code: status %d, want 401", code)
+	}
+	s.clock.Advance(loginChallengeTTL)
+	if code := secondStep(challenge, enabled.RecoveryCodes[1]); code != http.StatusUnauthorized {
+		t.Errorf("expired challenge: status %d, want 401", code)
+	}
+
+	disable := map[string]string{"email": "gerente@acme.com", "password": "senha!12", "code": enabled.RecoveryCodes[1]}
+	if rec := s.do(http.MethodPost, "/login/2fa/disable", disable); rec.Code != http.StatusForbidden {
+		t.Errorf("disable enforced 2FA: status %d, want 403", rec.Code)
+	}
+	s.signInAdmin()
+	s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]bool{"require_two_factor": false})
+	if rec := s.do(http.MethodPost, "/login/2fa/disable", disable); rec.Code != http.StatusOK {
+		t.Fatalf("disable: status %d: %s", rec.Code, rec.Body)
+	}
+	if body := login(); body["status"] != float64(http.StatusOK) || body["role"] != "manager" {
+		t.Errorf("login after disabling 2FA: %v", body)
+	}
+}
+
+func TestLoginLockout(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	ana := s.employee("ana@acme.com", false)
+	if err := s.api.setPassword("ana@acme.com", "senha!12"); err != nil {
+		t.Fatal(err)
+	}
+	login := func(password, remoteAddr string) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, _ := json.Marshal(map[string]string{"email": "ana@acme.com", "password": password})
+		req := httptest.NewRequest(http.MethodPost, "/login", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("User-Agent", "test-agent")
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		s.api.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// Cada falha dobra a espera pela próxima tentativa, até o bloqueio
+	for i, wait := range []string{"1", "2", "4", "8", "900"} {
+		if rec := login("errada", "10.0.0.1:1000"); rec.Code != http.StatusUnauthorized {
+			t.Fatalf("failure %d: status %d", i+1, rec.Code)
+		}
+		rec := login("senha!12", "10.0.0.1:1000")
+		if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") != wait {
+			t.Fatalf("after failure %d: status %d, Retry-After %q, want 429 and %s", i+1, rec.Code, rec.Header().Get("Retry-After"), wait)
+		}
+		if i < 4 {
+			s.clock.Advance(time.Duration(1<<i) * time.Second)
+		}
+	}
+
+	// O bloqueio vale para tudo que recebe a senha, e só administradores
+	// desbloqueiam a conta
+	for path, body := range map[string]map[string]string{
+		"/login/password":  {"email": "ana@acme.com", "current_password": "senha!12", "password": "nova!senha9"},
+		"/login/2fa/setup": {"email": "ana@acme.com", "password": "senha!12"},
+	} {
+		if rec := s.do(http.MethodPost, path, body); rec.Code != http.StatusTooManyRequests {
+			t.Errorf("%s on a locked account: status %d, want 429", path, rec.Code)
+		}
+	}
+	if rec := s.do(http.MethodPost, fmt.Sprintf("/admin/employees/%d/unlock", ana.ID), nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous unlock: status %d, want 401", rec.Code)
+	}
+	if rec := s.do(http.MethodGet, "/admin/login_attempts?email=ana@acme.com", nil); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous login attempts: status %d, want 401", rec.Code)
+	}
+	s.signIn(ana.Email)
+	if rec := s.do(http.MethodPost, fmt.Sprintf("/admin/employees/%d/unlock", ana.ID), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("unlock by an employee: status %d, want 403", rec.Code)
+	}
+
+	s.signInAdmin()
+	if rec := s.do(http.MethodPost, fmt.Sprintf("/admin/employees/%d/unlock", ana.ID), nil); rec.Code != http.StatusOK {
+		t.Fatalf("unlock: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := login("senha!12", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Fatalf("login after unlock: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var attempts []schemas.LoginAttempt
+	rec := s.do(http.MethodGet, "/admin/login_attempts?email=ana@acme.com&limit=5", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &attempts); err != nil || len(attempts) != 5 {
+		t.Fatalf("login attempts: status %d: %s", rec.Code, rec.Body)
+	}
+	if a := attempts[0]; !a.Success || a.IP != "10.0.0.1" || a.UserAgent != "test-agent" {
+		t.Errorf("latest attempt = %+v, want the successful login from 10.0.0.1", a)
+	}
+	for i, want := range []string{attemptAccountLocked, attemptAccountLocked, attemptAccountLocked, attemptWrongPassword} {
+		if got := attempts[i+1].Reason; got != want {
+			t.Errorf("attempt %d before the last: reason %q, want %q", i+1, got, want)
+		}
+	}
+
+	// Falhas em várias contas a partir do mesmo IP bloqueiam o IP, sem que
+	// X-Forwarded-For permita contorná-lo
+	for i := 0; i < s.api.Config.Auth.IPMaxFailedAttempts; i++ {
+		s.do(http.MethodPost, "/login", map[string]string{"email": fmt.Sprintf("u%d@acme.com", i), "password": "x"})
+	}
+	if rec := login("senha!12", "192.0.2.1:1000"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login from blocked IP: status %d, want 429", rec.Code)
+	}
+	if rec := login("senha!12", "10.0.0.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("login from another IP: status %d", rec.Code)
+	}
+	s.clock.Advance(s.api.Config.Auth.LockoutDuration)
+	if rec := login("senha!12", "192.0.2.1:1000"); rec.Code != http.StatusOK {
+		t.Errorf("login after the IP window: status %d", rec.Code)
+	}
+
+	// Senhas erradas na troca de senha contam como falhas de login
+	wrong := map[string]string{"email": "ana@acme.com", "current_password": "errada", "password": "nova!senha9"}
+	if rec := s.do(http.MethodPost, "/login/password", wrong); rec.Code != http.StatusUnauthorized {
+		t.Errorf("wrong current password: status %d, want 401", rec.Code)
+	}
+	if rec := login("senha!12", "10.0.0.1:1000"); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("login right after a wrong current password: status %d, want 429", rec.Code)
+	}
+	rec = s.do(http.MethodGet, "/admin/login_attempts?email=ana@acme.com&limit=2", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &attempts); err != nil || len(attempts) != 2 || attempts[1].Reason != attemptWrongPassword {
+		t.Errorf("attempts after the password change = %s", rec.Body)
+	}
+}
+
+func TestSingleSignOn(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.employee("ana@acme.com", false)
+	idp := oidctest.New("marca-tempo")
+	idp.Now = s.clock.Now
+	server := httptest.NewServer(idp)
+	defer server.Close()
+	idp.Issuer = server.URL
+
+	if rec := s.do(http.MethodGet, "/login/sso/"+testCNPJ, nil); rec.Code != http.StatusNotFound {
+		t.Fatalf("SSO not configured: status %d, want 404", rec.Code)
+	}
+	s.signInAdmin()
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]string{
+		"sso_issuer": server.URL, "sso_client_id": "marca-tempo", "sso_email_claim": "upn",
+	}); rec.Code != http.StatusOK {
+		t.Fatalf("configure SSO: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Segue os redirecionamentos até sso.html e devolve o fragmento
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	var lastCallback string
+	callback := func(query string) url.Values {
+		t.Helper()
+		lastCallback = query
+		rec := s.do(http.MethodGet, "/login/sso/callback?"+query, nil)
+		location := rec.Header().Get("Location")
+		if rec.Code != http.StatusFound || !strings.HasPrefix(location, "/sso.html#") {
+			t.Fatalf("callback: status %d, Location %q", rec.Code, location)
+		}
+		result, _ := url.ParseQuery(strings.TrimPrefix(location, "/sso.html#"))
+		return result
+	}
+	login := func() url.Values {
+		t.Helper()
+		rec := s.do(http.MethodGet, "/login/sso/"+testCNPJ, nil)
+		if rec.Code != http.StatusFound {
+			t.Fatalf("start SSO: status %d: %s", rec.Code, rec.Body)
+		}
+		resp, err := noRedirect.Get(rec.Header().Get("Location"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		redirect, _ := url.Parse(resp.Header.Get("Location"))
+		return callback(redirect.RawQuery)
+	}
+
+	idp.SetClaims(map[string]interface{}{"sub": "abc", "upn": "ana@acme.com"})
+	if result := login(); result.Get("employee_email") != "ana@acme.com" || result.Get("role") != "employee" {
+		t.Fatalf("first SSO login: %v", result)
+	}
+	if result := callback(lastCallback); result.Get("error") == "" {
+		t.Errorf("replayed callback logged in: %v", result)
+	}
+
+	// O vínculo vale mesmo que a claim de email mude no provedor
+	idp.SetClaims(map[string]interface{}{"sub": "abc", "upn": "ana.souza@acme.com"})
+	if result := login(); result.Get("employee_email") != "ana@acme.com" {
+		t.Errorf("linked SSO login: %v", result)
+	}
+	idp.SetClaims(map[string]interface{}{"sub": "xyz", "upn": "ninguem@acme.com"})
+	if result := login(); result.Get("error") == "" {
+		t.Errorf("unknown employee logged in: %v", result)
+	}
+	idp.SetClaims(nil)
+	if result := login(); result.Get("error") == "" {
+		t.Errorf("login denied by the provider succeeded: %v", result)
+	}
+
+	var attempts []schemas.LoginAttempt
+	json.Unmarshal(s.do(http.MethodGet, "/admin/login_attempts?email=ana@acme.com&success=true", nil).Body.Bytes(), &attempts)
+	if len(attempts) != 2 {
+		t.Errorf("recorded %d successful SSO logins, want 2", len(attempts))
+	}
+
+	// O login único passa pelos mesmos bloqueios e 2FA do /login
+	if err := s.api.setPassword("ana@acme.com", "senha!12"); err != nil {
+		t.Fatal(err)
+	}
+	account, _ := s.api.Repos.Logins.GetByEmail("ana@acme.com")
+	account.LockedUntil = s.clock.Now().Add(time.Minute)
+	if err := s.api.Repos.Logins.Update(&account); err != nil {
+		t.Fatal(err)
+	}
+	idp.SetClaims(map[string]interface{}{"sub": "abc", "upn": "ana@acme.com"})
+	if result := login(); result.Get("token") != "" || result.Get("error") == "" {
+		t.Errorf("SSO login to a locked account: %v", result)
+	}
+
+	secret, _ := totp.NewSecret()
+	account.LockedUntil, account.TOTPEnabled, account.TOTPSecret = time.Time{}, true, secret
+	if err := s.api.Repos.Logins.Update(&account); err != nil {
+		t.Fatal(err)
+	}
+	result := login()
+	if result.Get("token") != "" || result.Get("two_factor_required") != "true" || result.Get("challenge") == "" {
+		t.Fatalf("SSO login with 2FA: %v", result)
+	}
+	code, _ := totp.Code(secret, totp.Step(s.clock.Now()))
+	if rec := s.do(http.MethodPost, "/login/2fa", map[string]string{"challenge": result.Get("challenge"), "code": code}); rec.Code != http.StatusOK {
+		t.Errorf("second step of the SSO login: status %d: %s", rec.Code, rec.Body)
+	}
+
+	s.employee("gerente@acme.com", true)
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]bool{"require_two_factor": true}); rec.Code != http.StatusOK {
+		t.Fatalf("require 2FA: status %d: %s", rec.Code, rec.Body)
+	}
+	idp.SetClaims(map[string]interface{}{"sub": "def", "upn": "gerente@acme.com"})
+	if result := login(); result.Get("token") != "" || result.Get("error") == "" {
+		t.Errorf("SSO login of a manager without the 2FA the company requires: %v", result)
+	}
+}
+
+func TestKioskPunch(t *testing.T) {
+	s := newTestServer(t, spTime(12, 8, 0))
+	ana := s.employee("ana@acme.com", false)
+	bob := s.employee("bob@acme.com", false)
+
+	if rec := s.do(http.MethodPost, "/admin/kiosk_devices", map[string]string{"name": "Portaria", "company_cnpj": testCNPJ}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("anonymous device registration: status %d, want 401", rec.Code)
+	}
+	s.signIn(ana.Email)
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", ana.ID), map[string]string{"pin": "0000"}); rec.Code != http.StatusForbidden {
+		t.Errorf("credentials set by an employee: status %d, want 403", rec.Code)
+	}
+
+	s.signInAdmin()
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", ana.ID), map[string]string{
+		"matricula": "0042", "badge_number": "B-1", "pin": "1234",
+	}); rec.Code != http.StatusOK || strings.Contains(rec.Body.String(), "pin") {
+		t.Fatalf("set credentials: status %d: %s", rec.Code, rec.Body)
+	}
+	if stored, _ := s.api.Repos.Employees.GetByEmail(ana.Email); !CheckPasswordHash("1234", stored.KioskPINHash) {
+		t.Errorf("PIN not stored with bcrypt: %q", stored.KioskPINHash)
+	}
+	// PINs identify the employee alone, so colleagues may not share one
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", bob.ID), map[string]string{"badge_number": "B-2", "pin": "1234"}); rec.Code != http.StatusConflict {
+		t.Errorf("PIN in use: status %d, want 409", rec.Code)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", bob.ID), map[string]string{"badge_number": "B-2", "pin": "5678"}); rec.Code != http.StatusOK {
+		t.Errorf("set credentials of a colleague: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", bob.ID), map[string]string{"badge_number": "B-1"}); rec.Code != http.StatusConflict {
+		t.Errorf("badge in use: status %d, want 409", rec.Code)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/employees/%d/kiosk", bob.ID), map[string]string{"pin": "12a"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid PIN: status %d, want 400", rec.Code)
+	}
+
+	var created KioskDeviceKey
+	rec := s.do(http.MethodPost, "/admin/kiosk_devices", map[string]string{"name": "Portaria", "company_cnpj": testCNPJ})
+	if err := json.Unmarshal(rec.Body.Bytes(), &created); err != nil || rec.Code != http.StatusCreated || created.Key == "" {
+		t.Fatalf("register device: status %d: %s", rec.Code, rec.Body)
+	}
+
+	punch := func(key string, body map[string]string) *httptest.ResponseRecorder {
+		t.Helper()
+		payload, _ := json.Marshal(body)
+		req := httptest.NewRequest(http.MethodPost, "/kiosk/punch", bytes.NewReader(payload))
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set(kioskKeyHeader, key)
+		rec := httptest.NewRecorder()
+		s.api.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+
+	if rec := punch("outra-chave", map[string]string{"badge": "B-1", "pin": "1234"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("unknown key: status %d, want 401", rec.Code)
+	}
+
+	// Crachá e matrícula, confirmados pelo PIN, e o PIN sozinho identificam a
+	// mesma funcionária e seguem a sequência do registro pela web. O último
+	// PIN ainda está no formato anterior ao bcrypt.
+	for _, step := range []struct {
+		body      map[string]string
+		punch     string
+		legacyPIN bool
+	}{
+		{map[string]string{"badge": "B-1", "pin": "1234"}, punchEntry, false},
+		{map[string]string{"matricula": "0042", "pin": "1234"}, punchLunchExit, false},
+		{map[string]string{"pin": "1234"}, punchLunchReturn, true},
+	} {
+		if step.legacyPIN {
+			stored, _ := s.api.Repos.Employees.GetByEmail(ana.Email)
+			stored.KioskPINHash = legacyKioskPINHash(testCNPJ, "1234")
+			if err := s.api.Repos.Employees.Update(&stored); err != nil {
+				t.Fatal(err)
+			}
+		}
+		rec := punch(created.Key, step.body)
+		var receipt KioskReceipt
+		if err := json.Unmarshal(rec.Body.Bytes(), &receipt); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("punch %v: status %d: %s", step.body, rec.Code, rec.Body)
+		}
+		if receipt.EmployeeEmail != ana.Email || receipt.Punch != step.punch || receipt.Device != "Portaria" {
+			t.Errorf("receipt for %v = %+v, want %s of %s", step.body, receipt, step.punch, ana.Email)
+		}
+		if want := s.clock.Now().In(saoPaulo).Format("02/01/2006 15:04"); receipt.LocalTime != want {
+			t.Errorf("receipt time %q, want %q", receipt.LocalTime, want)
+		}
+		s.clock.Advance(time.Hour)
+	}
+	if logs := s.timeLogs(ana.Email); len(logs) != 1 || logs[0].LunchReturnTime.IsZero() {
+		t.Errorf("time logs after kiosk punches = %+v", logs)
+	}
+	punches, _ := s.api.Repos.Punches.List(db.PunchFilter{Emails: []string{ana.Email}})
+	for _, p := range punches {
+		if p.Source != sourceKiosk || p.DeviceID != kioskDeviceID(created.Device) {
+			t.Errorf("kiosk punch %s: source %q, device %q", p.Punch, p.Source, p.DeviceID)
+		}
+	}
+
+	if stored, _ := s.api.Repos.Employees.GetByEmail(ana.Email); !CheckPasswordHash("1234", stored.KioskPINHash) {
+		t.Errorf("legacy PIN not rehashed: %q", stored.KioskPINHash)
+	}
+
+	for _, body := range []map[string]string{
+		{},
+		{"badge": "B-1", "matricula": "0042", "pin": "1234"},
+	} {
+		if rec := punch(created.Key, body); rec.Code != http.StatusBadRequest {
+			t.Errorf("identification %v: status %d, want 400", body, rec.Code)
+		}
+	}
+	for _, body := range []map[string]string{
+		{"badge": "B-1", "pin": "9999"},
+		{"badge": "B-1"},
+		{"badge": "B-9", "pin": "1234"},
+		{"pin": "0000"},
+	} {
+		if rec := punch(created.Key, body); rec.Code != http.StatusNotFound {
+			t.Errorf("identification %v: status %d, want 404", body, rec.Code)
+		}
+	}
+
+	// Os PINs errados bloqueiam a funcionária no terminal, como no login
+	auth := s.api.Config.Auth
+	for i := 2; i < auth.MaxFailedAttempts; i++ {
+		punch(created.Key, map[string]string{"badge": "B-1", "pin": "9999"})
+	}
+	if rec := punch(created.Key, map[string]string{"pin": "1234"}); rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Errorf("locked employee: status %d, want 429 with Retry-After", rec.Code)
+	}
+	if rec := punch(created.Key, map[string]string{"badge": "B-2", "pin": "5678"}); rec.Code != http.StatusOK {
+		t.Errorf("colleague at the kiosk of a locked employee: status %d: %s", rec.Code, rec.Body)
+	}
+	s.clock.Advance(auth.LockoutDuration)
+	if rec := punch(created.Key, map[string]string{"pin": "1234"}); rec.Code != http.StatusOK {
+		t.Errorf("employee after the lockout: status %d: %s", rec.Code, rec.Body)
+	}
+	for i := 0; i < auth.IPMaxFailedAttempts; i++ {
+		punch(created.Key, map[string]string{"pin": "0000"})
+	}
+	if rec := punch(created.Key, map[string]string{"badge": "B-2", "pin": "5678"}); rec.Code != http.StatusTooManyRequests {
+		t.Errorf("blocked kiosk: status %d, want 429", rec.Code)
+	}
+
+	var rotated KioskDeviceKey
+	rec = s.do(http.MethodPost, fmt.Sprintf("/admin/kiosk_devices/%d/rotate_key", created.Device.ID), nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &rotated); err != nil || rotated.Key == created.Key {
+		t.Fatalf("rotate key: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := punch(created.Key, map[string]string{"badge": "B-1", "pin": "1234"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("old key after rotation: status %d, want 401", rec.Code)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/admin/kiosk_devices/%d", created.Device.ID), map[string]bool{"active": false}); rec.Code != http.StatusOK {
+		t.Fatalf("deactivate device: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := punch(rotated.Key, map[string]string{"badge": "B-1", "pin": "1234"}); rec.Code != http.StatusUnauthorized {
+		t.Errorf("inactive device: status %d, want 401", rec.Code)
+	}
+
+	var devices []schemas.KioskDevice
+	rec = s.do(http.MethodGet, "/admin/kiosk_devices?company_cnpj="+testCNPJ, nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &devices); err != nil || len(devices) != 1 || devices[0].LastSeenAt.IsZero() {
+		t.Errorf("devices = %s", rec.Body)
+	}
+}
+
+func TestQRCodePunch(t *testing.T) {
+	s := newTestServer(t, spTime(12, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	s.signInAdmin()
+	var workplace schemas.Workplace
+	rec := s.do(http.MethodPost, "/admin/workplaces", map[string]string{"name": "Fábrica", "company_cnpj": testCNPJ})
+	if err := json.Unmarshal(rec.Body.Bytes(), &workplace); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("create workplace: status %d: %s", rec.Code, rec.Body)
+	}
+	var device KioskDeviceKey
+	rec = s.do(http.MethodPost, "/admin/kiosk_devices", map[string]string{"name": "Tela da fábrica", "company_cnpj": testCNPJ})
+	if err := json.Unmarshal(rec.Body.Bytes(), &device); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("register device: status %d: %s", rec.Code, rec.Body)
+	}
+	qrCode := func() WorkplaceQRCode {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, fmt.Sprintf("/kiosk/workplaces/%d/qr_code", workplace.ID), nil)
+		req.Header.Set(kioskKeyHeader, device.Key)
+		rec := httptest.NewRecorder()
+		s.api.Echo.ServeHTTP(rec, req)
+		var code WorkplaceQRCode
+		if err := json.Unmarshal(rec.Body.Bytes(), &code); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("QR code: status %d: %s", rec.Code, rec.Body)
+		}
+		return code
+	}
+	punch := func(code string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPut, "/time_logs/1?employee_email=ana@acme.com&qr_code="+url.QueryEscape(code), nil)
+	}
+
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]bool{"require_qr_code": true}); rec.Code != http.StatusOK {
+		t.Fatalf("require QR code: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := punch(""); rec.Code != http.StatusForbidden {
+		t.Errorf("punch without QR code: status %d, want 403", rec.Code)
+	}
+
+	shown := qrCode()
+	if !shown.ExpiresAt.After(s.clock.Now()) || shown.Workplace != "Fábrica" {
+		t.Errorf("QR code = %+v", shown)
+	}
+	// O código lido alguns segundos depois, já na janela seguinte, ainda vale
+	s.clock.Advance(30 * time.Second)
+	if rec := punch(shown.Code); rec.Code != http.StatusCreated {
+		t.Fatalf("punch with QR code: status %d: %s", rec.Code, rec.Body)
+	}
+
+	s.clock.Set(spTime(12, 12, 0))
+	if rec := punch(shown.Code); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), "expirado") {
+		t.Errorf("punch with an old QR code: status %d: %s", rec.Code, rec.Body)
+	}
+	current := qrCode()
+	if rec := punch(current.Code + "x"); rec.Code != http.StatusBadRequest {
+		t.Errorf("punch with a forged QR code: status %d, want 400", rec.Code)
+	}
+	if rec := punch(current.Code); rec.Code != http.StatusOK {
+		t.Fatalf("punch with the current QR code: status %d: %s", rec.Code, rec.Body)
+	}
+
+	punches, err := s.api.Repos.Punches.List(db.PunchFilter{Emails: []string{"ana@acme.com"}})
+	if err != nil || len(punches) != 2 {
+		t.Fatalf("punches = %v, %v", punches, err)
+	}
+	for _, p := range punches {
+		if p.WorkplaceID == nil || *p.WorkplaceID != workplace.ID {
+			t.Errorf("punch %s without the workplace: %+v", p.Punch, p)
+		}
+	}
+	if punches[1].Punch != punchLunchExit || !punches[1].PunchedAt.Equal(spTime(12, 12, 0)) {
+		t.Errorf("second punch = %+v", punches[1])
+	}
+}
+
+func TestGeofencePunch(t *testing.T) {
+	s := newTestServer(t, spTime(12, 8, 0))
+	s.employee("boss@acme.com", true)
+	s.employee("ana@acme.com", false)
+	s.team("boss@acme.com", "ana@acme.com")
+
+	s.signInAdmin()
+	var workplace schemas.Workplace
+	rec := s.do(http.MethodPost, "/admin/workplaces", map[string]string{"name": "Fábrica", "company_cnpj": testCNPJ})
+	if err := json.Unmarshal(rec.Body.Bytes(), &workplace); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("create workplace: status %d: %s", rec.Code, rec.Body)
+	}
+	fence := map[string]interface{}{"kind": "circulo", "latitude": -23.31, "longitude": -51.16, "radius_meters": 200}
+	if rec := s.do(http.MethodPost, fmt.Sprintf("/admin/workplaces/%d/geofences", workplace.ID), fence); rec.Code != http.StatusCreated {
+		t.Fatalf("create geofence: status %d: %s", rec.Code, rec.Body)
+	}
+	triangle := map[string]interface{}{"kind": "poligono", "polygon": []map[string]float64{{"lat": -23.3, "lng": -51.1}}}
+	if rec := s.do(http.MethodPost, fmt.Sprintf("/admin/workplaces/%d/geofences", workplace.ID), triangle); rec.Code != http.StatusBadRequest {
+		t.Errorf("polygon with one vertex: status %d, want 400", rec.Code)
+	}
+
+	punch := func(query string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPut, "/time_logs/1?employee_email=ana@acme.com"+query, nil)
+	}
+	// 0.01° de latitude são cerca de 1,1 km
+	const inside, outside = "&latitude=-23.3105&longitude=-51.16&accuracy=15", "&latitude=-23.32&longitude=-51.16"
+
+	// Sem política a localização é apenas registrada
+	if rec := punch(outside); rec.Code != http.StatusCreated {
+		t.Fatalf("punch without policy: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := punch("&latitude=-91&longitude=0"); rec.Code != http.StatusBadRequest {
+		t.Errorf("punch with invalid location: status %d, want 400", rec.Code)
+	}
+
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]string{"geofence_policy": "bloquear"}); rec.Code != http.StatusBadRequest {
+		t.Errorf("invalid policy: status %d, want 400", rec.Code)
+	}
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]string{"geofence_policy": "rejeitar"}); rec.Code != http.StatusOK {
+		t.Fatalf("reject policy: status %d: %s", rec.Code, rec.Body)
+	}
+	s.clock.Set(spTime(12, 12, 0))
+	if rec := punch(outside); rec.Code != http.StatusForbidden {
+		t.Errorf("punch outside the fence: status %d, want 403", rec.Code)
+	}
+	if rec := punch(""); rec.Code != http.StatusForbidden {
+		t.Errorf("punch without location: status %d, want 403", rec.Code)
+	}
+	// Uma leitura imprecisa não conta a favor do ponto, nem pela web nem offline
+	if rec := punch(outside + "&accuracy=5000"); rec.Code != http.StatusForbidden || !strings.Contains(rec.Body.String(), ErrLocationVague.Error()) {
+		t.Errorf("punch with a vague location: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := punch(outside + "&accuracy=-1"); rec.Code != http.StatusBadRequest {
+		t.Errorf("punch with negative accuracy: status %d, want 400", rec.Code)
+	}
+	var synced OfflineSyncResult
+	s.signIn("ana@acme.com")
+	rec = s.do(http.MethodPost, "/time_logs/sync", OfflineSyncRequest{
+		EmployeeEmail: "ana@acme.com",
+		SentAt:        s.clock.Now(),
+		Punches: []OfflinePunch{
+			{IdempotencyKey: "vaga", DeviceTime: s.clock.Now().Add(-time.Minute), Location: &PunchLocation{Latitude: -23.32, Longitude: -51.16, Accuracy: 5000}},
+			{IdempotencyKey: "negativa", DeviceTime: s.clock.Now().Add(-time.Minute), Location: &PunchLocation{Latitude: -23.3105, Longitude: -51.16, Accuracy: -1}},
+		},
+	})
+	if err := json.Unmarshal(rec.Body.Bytes(), &synced); err != nil || len(synced.Results) != 2 ||
+		synced.Results[0].Error != ErrLocationVague.Error() || synced.Results[1].Error != ErrInvalidLocation.Error() {
+		t.Errorf("offline punches with bad accuracy: status %d: %s", rec.Code, rec.Body)
+	}
+	s.signInAdmin()
+	if rec := punch(inside); rec.Code != http.StatusOK {
+		t.Fatalf("punch inside the fence: status %d: %s", rec.Code, rec.Body)
+	}
+
+	if rec := s.do(http.MethodPut, "/admin/companies/"+testCNPJ, map[string]string{"geofence_policy": "sinalizar"}); rec.Code != http.StatusOK {
+		t.Fatalf("flag policy: status %d: %s", rec.Code, rec.Body)
+	}
+	s.clock.Set(spTime(12, 13, 0))
+	if rec := punch(outside); rec.Code != http.StatusOK {
+		t.Fatalf("flagged punch: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var punches []ManagerPunch
+	s.signIn("boss@acme.com")
+	rec = s.do(http.MethodGet, "/manager/punches?employee_email=ana@acme.com", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &punches); err != nil || rec.Code != http.StatusOK {
+		t.Fatalf("manager punches: status %d: %s", rec.Code, rec.Body)
+	}
+	if len(punches) != 3 {
+		t.Fatalf("punches = %+v", punches)
+	}
+	for i, want := range []string{"", geofenceInside, geofenceOutside} {
+		if punches[i].GeofenceStatus != want || punches[i].Latitude == nil {
+			t.Errorf("punch %d: status %q, latitude %v; want %q", i, punches[i].GeofenceStatus, punches[i].Latitude, want)
+		}
+	}
+	if punches[1].Accuracy == nil || *punches[1].Accuracy != 15 || punches[1].LocalTime != "12/03/2025 12:00" {
+		t.Errorf("punch inside the fence = %+v", punches[1])
+	}
+	s.signIn("ana@acme.com")
+	if rec := s.do(http.MethodGet, "/manager/punches", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("punches for a non-manager: status %d, want 403", rec.Code)
+	}
+}
+
+func TestPunchMetadata(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("boss@acme.com", true)
+	s.employee("ana@acme.com", false)
+	s.team("boss@acme.com", "ana@acme.com")
+
+	punch := func(source string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPut, "/time_logs/1?employee_email=ana@acme.com", nil)
+		req.Header.Set("User-Agent", "MarcaTempo/2.0 (Android 14)")
+		req.Header.Set(deviceIDHeader, "celular-ana")
+		req.Header.Set(punchSourceHeader, source)
+		req.RemoteAddr = "203.0.113.7:5000"
+		rec := httptest.NewRecorder()
+		s.api.Echo.ServeHTTP(rec, req)
+		return rec
+	}
+	if rec := punch("telegrama"); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown source: status %d, want 400", rec.Code)
+	}
+	rec := punch(sourceMobile)
+	var timeLog schemas.TimeLog
+	if err := json.Unmarshal(rec.Body.Bytes(), &timeLog); err != nil || rec.Code != http.StatusCreated {
+		t.Fatalf("mobile punch: status %d: %s", rec.Code, rec.Body)
+	}
+	s.clock.Set(spTime(10, 12, 0))
+	s.punch("ana@acme.com", http.StatusOK)
+
+	// O gerente corrige a entrada atendendo a uma solicitação aprovada
+	request := schemas.PontoSolicitacao{FuncionarioEmail: "ana@acme.com", Motivo: "Entrei às 7:50", Status: "pendente"}
+	s.create(&request)
+	edit := map[string]interface{}{
+		"entry_time":    "2025-03-10T07:50",
+		"motivo_edicao": "Solicitação da funcionária",
+		"request_id":    request.ID,
+	}
+	s.signIn("boss@acme.com")
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", timeLog.ID), edit); rec.Code != http.StatusBadRequest {
+		t.Errorf("edit for a pending request: status %d, want 400", rec.Code)
+	}
+	request.Status = "aprovado"
+	if err := s.api.Repos.Requests.Update(&request); err != nil {
+		t.Fatal(err)
+	}
+	if rec := s.do(http.MethodPut, fmt.Sprintf("/time_logs/%d/manual_edit", timeLog.ID), edit); rec.Code != http.StatusOK {
+		t.Fatalf("edit for the approved request: status %d: %s", rec.Code, rec.Body)
+	}
+
+	// Um dia importado de outro sistema entra com seus quatro horários
+	imported := schemas.TimeLog{
+		EmployeeEmail:   "ana@acme.com",
+		LogDate:         spTime(7, 0, 0),
+		EntryTime:       spTime(7, 8, 0),
+		LunchExitTime:   spTime(7, 12, 0),
+		LunchReturnTime: spTime(7, 13, 0),
+		ExitTime:        spTime(7, 17, 0),
+	}
+	if rec := s.do(http.MethodPost, "/time_logs", imported); rec.Code != http.StatusCreated {
+		t.Fatalf("import time log: status %d: %s", rec.Code, rec.Body)
+	}
+
+	var history []ManagerPunch
+	s.employee("eve@acme.com", false)
+	s.signIn("eve@acme.com")
+	if rec := s.do(http.MethodGet, fmt.Sprintf("/time_logs/%d/punches", timeLog.ID), nil); rec.Code != http.StatusForbidden {
+		t.Errorf("history of a colleague: status %d, want 403", rec.Code)
+	}
+	s.signIn("ana@acme.com")
+	rec = s.do(http.MethodGet, fmt.Sprintf("/time_logs/%d/punches", timeLog.ID), nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &history); err != nil || len(history) != 3 {
+		t.Fatalf("time log history: status %d: %s", rec.Code, rec.Body)
+	}
+	// A correção das 7:50 vem antes da entrada original
+	mobile := history[1]
+	if history[0].Source != sourceApprovedRequest || history[0].Punch != punchEntry || !history[0].PunchedAt.Equal(spTime(10, 7, 50)) {
+		t.Errorf("edited entry = %+v", history[0])
+	}
+	if mobile.Source != sourceMobile || mobile.ClientIP != "203.0.113.7" || mobile.DeviceID != "celular-ana" || mobile.UserAgent != "MarcaTempo/2.0 (Android 14)" {
+		t.Errorf("mobile punch = %+v", mobile)
+	}
+	if history[2].Source != sourceWeb {
+		t.Errorf("web punch source = %q", history[2].Source)
+	}
+
+	var report []ManagerPunch
+	if rec := s.do(http.MethodGet, "/reports/punches?company_cnpj="+testCNPJ+"&start=2025-03-01&end=2025-03-31", nil); rec.Code != http.StatusForbidden {
+		t.Errorf("report for an employee: status %d, want 403", rec.Code)
+	}
+	s.signInAdmin()
+	rec = s.do(http.MethodGet, "/reports/punches?company_cnpj="+testCNPJ+"&start=2025-03-01&end=2025-03-31&source=importacao", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil || len(report) != 4 || report[0].LocalTime != "07/03/2025 08:00" {
+		t.Errorf("imported punches: status %d: %s", rec.Code, rec.Body)
+	}
+	rec = s.do(http.MethodGet, "/reports/punches?company_cnpj="+testCNPJ+"&start=2025-03-01&end=2025-03-31&device_id=celular-ana&client_ip=203.0.113.7", nil)
+	if err := json.Unmarshal(rec.Body.Bytes(), &report); err != nil || len(report) != 1 {
+		t.Errorf("punches of the device: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodGet, "/reports/punches?company_cnpj="+testCNPJ+"&start=2025-03-01&end=2025-03-31&source=fax", nil); rec.Code != http.StatusBadRequest {
+		t.Errorf("unknown source filter: status %d, want 400", rec.Code)
+	}
+}
+
+func TestOfflineSync(t *testing.T) {
+	s := newTestServer(t, spTime(10, 13, 0))
+	s.employee("ana@acme.com", false)
+	s.signIn("ana@acme.com")
+	s.punch("ana@acme.com", http.StatusCreated) // retorno do almoço, já online
+
+	// O relógio do celular está dois minutos atrasado
+	s.clock.Set(spTime(10, 17, 30))
+	late := -2 * time.Minute
+	batch := OfflineSyncRequest{
+		EmployeeEmail: "ana@acme.com",
+		SentAt:        spTime(10, 17, 30).Add(late),
+		Punches: []OfflinePunch{
+			{IdempotencyKey: "saida", DeviceTime: spTime(10, 17, 0).Add(late)},
+			{IdempotencyKey: "entrada", DeviceTime: spTime(10, 8, 0).Add(late)},
+			{IdempotencyKey: "antiga", DeviceTime: spTime(5, 8, 0).Add(late)},
+			{IdempotencyKey: "almoco", DeviceTime: spTime(10, 12, 0).Add(late)},
+		},
+	}
+	sync := func() OfflineSyncResult {
+		t.Helper()
+		rec := s.do(http.MethodPost, "/time_logs/sync", batch)
+		var result OfflineSyncResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil || rec.Code != http.StatusOK || len(result.Results) != 4 {
+			t.Fatalf("sync: status %d: %s", rec.Code, rec.Body)
+		}
+		return result
+	}
+
+	result := sync()
+	want := []struct{ status, punch string }{
+		{offlineRegistered, punchExit},
+		{offlineRegistered, punchEntry},
+		{offlineRejected, ""},
+		{offlineRegistered, punchLunchExit},
+	}
+	for i, w := range want {
+		if got := result.Results[i]; got.Status != w.status || got.Punch != w.punch {
+			t.Errorf("result %d = %+v, want %s %s", i, got, w.status, w.punch)
+		}
+	}
+	if result.Results[2].Error != ErrOfflinePunchTooOld.Error() {
+		t.Errorf("old punch error = %q", result.Results[2].Error)
+	}
+
+	logs := s.timeLogs("ana@acme.com")
+	if len(logs) != 1 {
+		t.Fatalf("got %d time logs, want 1", len(logs))
+	}
+	day := logs[0]
+	if !day.EntryTime.Equal(spTime(10, 8, 0)) || !day.LunchExitTime.Equal(spTime(10, 12, 0)) ||
+		!day.LunchReturnTime.Equal(spTime(10, 13, 0)) || !day.ExitTime.Equal(spTime(10, 17, 0)) {
+		t.Errorf("day out of order: %+v", day)
+	}
+	if day.Status != dayComplete {
+		t.Errorf("status = %q, want %q", day.Status, dayComplete)
+	}
+	// The online punch moved from the entry to the lunch return, and its
+	// history with it
+	history, _ := s.api.Repos.Punches.List(db.PunchFilter{TimeLogID: day.ID})
+	var labels []string
+	for _, p := range history {
+		labels = append(labels, p.Punch)
+	}
+	if strings.Join(labels, ",") != strings.Join(punchOrder, ",") {
+		t.Errorf("punch history = %v, want %v", labels, punchOrder)
+	}
+
+	punches, err := s.api.Repos.Punches.List(db.PunchFilter{Emails: []string{"ana@acme.com"}, IdempotencyKey: "entrada"})
+	if err != nil || len(punches) != 1 {
+		t.Fatalf("punch by key: %v, %d", err, len(punches))
+	}
+	if !punches[0].Offline || punches[0].DeviceTime == nil || !punches[0].DeviceTime.Equal(spTime(10, 8, 0).Add(late)) {
+		t.Errorf("offline punch = %+v", punches[0])
+	}
+
+	// Reenviar o lote não registra nada de novo
+	result = sync()
+	for i, w := range want {
+		if w.status == offlineRegistered {
+			w.status = offlineDuplicate
+		}
+		if got := result.Results[i]; got.Status != w.status || got.Punch != w.punch {
+			t.Errorf("retry result %d = %+v, want %s %s", i, got, w.status, w.punch)
+		}
+	}
+
+	// Um segundo toque logo depois da saída é uma repetição dela
+	batch.Punches[0] = OfflinePunch{IdempotencyKey: "saida-2", DeviceTime: spTime(10, 17, 0).Add(late + 30*time.Second)}
+	if got := sync().Results[0]; got.Status != offlineDuplicate || got.Punch != punchExit || !got.At.Equal(spTime(10, 17, 0)) {
+		t.Errorf("punch within the minimum interval = %+v, want a duplicate of the exit", got)
+	}
+	if punches, _ := s.api.Repos.Punches.List(db.PunchFilter{Emails: []string{"ana@acme.com"}, IdempotencyKey: "saida-2"}); len(punches) != 0 {
+		t.Errorf("punch within the minimum interval recorded: %+v", punches)
+	}
+
+	batch.SentAt = spTime(10, 17, 30).Add(-10 * time.Minute)
+	if rec := s.do(http.MethodPost, "/time_logs/sync", batch); rec.Code != http.StatusBadRequest {
+		t.Errorf("clock too far off: status %d, want 400", rec.Code)
+	}
+
+	// Only the employee of the session syncs, and only while active
+	s.employee("bob@acme.com", false)
+	batch.SentAt, batch.EmployeeEmail = spTime(10, 17, 30), "bob@acme.com"
+	if rec := s.do(http.MethodPost, "/time_logs/sync", batch); rec.Code != http.StatusForbidden {
+		t.Errorf("sync for another employee: status %d, want 403", rec.Code)
+	}
+	s.token = ""
+	if rec := s.do(http.MethodPost, "/time_logs/sync", batch); rec.Code != http.StatusUnauthorized {
+		t.Errorf("sync without session: status %d, want 401", rec.Code)
+	}
+	bob, _ := s.api.Repos.Employees.GetByEmail("bob@acme.com")
+	bob.Active = false
+	s.api.Repos.Employees.Update(&bob)
+	if _, err := s.api.SyncOfflinePunches(batch, PunchDetails{}); !errors.Is(err, ErrEmployeeInactive) {
+		t.Errorf("sync of an inactive employee: err = %v, want ErrEmployeeInactive", err)
+	}
+}
+
+// racingTimeLogs creates the log of a day behind the first lookup that misses
+// it, as a concurrent request would.
+type racingTimeLogs struct {
+	db.TimeLogRepository
+	raced bool
+}
+
+func (r *racingTimeLogs) GetByDate(email string, logDate time.Time) (schemas.TimeLog, error) {
+	timeLog, err := r.TimeLogRepository.GetByDate(email, logDate)
+	if errors.Is(err, db.ErrNotFound) && !r.raced {
+		r.raced = true
+		r.TimeLogRepository.Create(&schemas.TimeLog{EmployeeEmail: email, LogDate: logDate})
+	}
+	return timeLog, err
+}
+
+func TestDayLogCreatedMeanwhile(t *testing.T) {
+	fake := clock.NewFake(spTime(10, 8, 0))
+	repos := db.NewMemoryRepositories()
+	api := NewServerWithRepositories(config.Default(), repos, nil, fake)
+	repos.Companies.Create(&schemas.Company{Name: "ACME", CNPJ: testCNPJ, Active: true, Timezone: "America/Sao_Paulo"})
+	ana := schemas.Employee{Name: "Ana", Email: "ana@acme.com", Active: true, Workload: 40, CompanyCNPJ: testCNPJ}
+	repos.Employees.Create(&ana)
+
+	api.Repos.TimeLogs = &racingTimeLogs{TimeLogRepository: repos.TimeLogs}
+	result, err := api.Punch("ana@acme.com", "", PunchDetails{Source: sourceWeb})
+	if err != nil || result.Punch != punchEntry || !result.TimeLog.EntryTime.Equal(spTime(10, 8, 0)) {
+		t.Fatalf("punch = %+v, %v; want the entry on the log created meanwhile", result, err)
+	}
+
+	// Friday the 7th, closed while a synchronization creates its log
+	api.Repos.TimeLogs = &racingTimeLogs{TimeLogRepository: repos.TimeLogs}
+	ana.CreatedAt = spTime(3, 9, 0)
+	day := time.Date(2025, time.March, 7, 0, 0, 0, 0, time.UTC)
+	if closed := api.closeEmployeeDays(ana, nil, day, day.AddDate(0, 0, 1)); closed != 1 {
+		t.Errorf("closed %d days, want 1", closed)
+	}
+
+	timeLogs, _ := repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{"ana@acme.com"}})
+	if len(timeLogs) != 2 || timeLogs[0].Status != dayAbsent || timeLogs[1].EntryTime.IsZero() {
+		t.Errorf("time logs = %+v, want an absence on the 7th and the entry on the 10th", timeLogs)
+	}
+}
+
+func TestPunchRetry(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	punch := func(key string) (int, schemas.TimeLog) {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodPut, "/time_logs/1?employee_email=ana@acme.com", nil)
+		if key != "" {
+			req.Header.Set(idempotencyKeyHeader, key)
+		}
+		rec := httptest.NewRecorder()
+		s.api.Echo.ServeHTTP(rec, req)
+		var timeLog schemas.TimeLog
+		if rec.Code < 300 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &timeLog); err != nil {
+				t.Fatalf("decode time log: %v: %s", err, rec.Body)
+			}
+		}
+		return rec.Code, timeLog
+	}
+	history := func() int {
+		t.Helper()
+		punches, err := s.api.Repos.Punches.List(db.PunchFilter{Emails: []string{"ana@acme.com"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return len(punches)
+	}
+
+	if code, _ := punch("clique-1"); code != http.StatusCreated {
+		t.Fatalf("first punch: status %d", code)
+	}
+	// O cliente repete o pedido depois de perder a resposta
+	s.clock.Set(spTime(10, 8, 5))
+	code, timeLog := punch("clique-1")
+	if code != http.StatusOK || !timeLog.EntryTime.Equal(spTime(10, 8, 0)) || !timeLog.LunchExitTime.IsZero() {
+		t.Errorf("retry with the same key: status %d, time log %+v", code, timeLog)
+	}
+	if n := history(); n != 1 {
+		t.Errorf("history has %d punches after the retry, want 1", n)
+	}
+
+	// Clique duplo sem chave, dentro do intervalo mínimo
+	s.clock.Set(spTime(10, 12, 0))
+	if code, _ := punch(""); code != http.StatusOK {
+		t.Fatalf("lunch exit: status %d", code)
+	}
+	s.clock.Set(spTime(10, 12, 0).Add(20 * time.Second))
+	code, timeLog = punch("")
+	if code != http.StatusOK || !timeLog.LunchExitTime.Equal(spTime(10, 12, 0)) || !timeLog.LunchReturnTime.IsZero() {
+		t.Errorf("double click: status %d, time log %+v", code, timeLog)
+	}
+	if n := history(); n != 2 {
+		t.Errorf("history has %d punches after the double click, want 2", n)
+	}
+
+	s.clock.Set(spTime(10, 13, 0))
+	if code, _ := punch(strings.Repeat("x", 101)); code != http.StatusBadRequest {
+		t.Errorf("long key: status %d, want 400", code)
+	}
+	code, timeLog = punch("clique-3")
+	if code != http.StatusOK || !timeLog.LunchReturnTime.Equal(spTime(10, 13, 0)) {
+		t.Errorf("lunch return: status %d, time log %+v", code, timeLog)
+	}
+
+	// Outro pedido com a mesma chave registrou a marcação entre a busca da
+	// chave e a gravação
+	s.clock.Set(spTime(10, 13, 30))
+	key := "clique-4"
+	s.create(&schemas.PunchRecord{EmployeeEmail: "ana@acme.com", TimeLogID: timeLog.ID, Punch: punchLunchReturn, PunchedAt: spTime(10, 13, 0).UTC(), IdempotencyKey: &key})
+	result, err := s.api.Punch("ana@acme.com", "", PunchDetails{IdempotencyKey: "clique-4"})
+	if err != nil || !result.Repeated || result.Punch != punchLunchReturn || !result.TimeLog.ExitTime.IsZero() {
+		t.Errorf("punch with a key registered meanwhile = %+v, %v; want the stored punch", result, err)
+	}
+	if stored := s.timeLogs("ana@acme.com")[0]; !stored.ExitTime.IsZero() {
+		t.Errorf("time log changed by the refused punch: %+v", stored)
+	}
+}
+
+func TestPunchType(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	s.employee("ana@acme.com", false)
+
+	punch := func(punchType string) (int, PunchResponse) {
+		t.Helper()
+		rec := s.do(http.MethodPut, "/time_logs/1?employee_email=ana@acme.com&punch_type="+punchType, nil)
+		var response PunchResponse
+		if rec.Code < 300 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+				t.Fatalf("decode punch: %v: %s", err, rec.Body)
+			}
+		}
+		return rec.Code, response
+	}
+	next := func() NextPunch {
+		t.Helper()
+		rec := s.do(http.MethodGet, "/time_logs/next_punch?employee_email=ana@acme.com", nil)
+		var suggestion NextPunch
+		if err := json.Unmarshal(rec.Body.Bytes(), &suggestion); err != nil || rec.Code != http.StatusOK {
+			t.Fatalf("next punch: status %d: %s", rec.Code, rec.Body)
+		}
+		return suggestion
+	}
+
+	if got := next(); got.Punch != punchEntry || len(got.Options) != 4 || got.DayComplete {
+		t.Errorf("suggestion before the first punch = %+v", got)
+	}
+	if code, _ := punch("almoco"); code != http.StatusBadRequest {
+		t.Errorf("unknown punch type: status %d, want 400", code)
+	}
+	if code, got := punch(""); code != http.StatusCreated || got.Punch != punchEntry || got.Warning != "" {
+		t.Fatalf("entry: status %d, %+v", code, got)
+	}
+
+	// Retorno sem a saída para o intervalo: registrado com aviso
+	s.clock.Set(spTime(10, 13, 0))
+	code, got := punch(punchLunchReturn)
+	if code != http.StatusOK || got.Punch != punchLunchReturn || !got.LunchReturnTime.Equal(spTime(10, 13, 0)) || !got.LunchExitTime.IsZero() {
+		t.Fatalf("lunch return: status %d, %+v", code, got)
+	}
+	if len(got.Skipped) != 1 || got.Skipped[0] != punchLunchExit || got.Warning == "" {
+		t.Errorf("skipped = %v, warning %q", got.Skipped, got.Warning)
+	}
+	if got := next(); got.Punch != punchExit || len(got.Options) != 1 || len(got.Skipped) != 1 || got.LastPunch != punchLunchReturn {
+		t.Errorf("suggestion after the lunch return = %+v", got)
+	}
+
+	s.clock.Set(spTime(10, 13, 30))
+	if code, _ := punch(punchLunchExit); code != http.StatusBadRequest {
+		t.Errorf("lunch exit after the return: status %d, want 400", code)
+	}
+	if code, _ := punch(punchEntry); code != http.StatusBadRequest {
+		t.Errorf("second entry: status %d, want 400", code)
+	}
+
+	// A saída de um dia com etapas puladas não calcula as horas
+	s.clock.Set(spTime(10, 17, 0))
+	code, got = punch("")
+	if code != http.StatusOK || got.Punch != punchExit || got.Status != "" || got.Balance != 0 {
+		t.Errorf("exit: status %d, %+v", code, got)
+	}
+	if got := next(); !got.DayComplete || got.Punch != "" || len(got.Options) != 0 {
+		t.Errorf("suggestion after the exit = %+v", got)
+	}
+	if rec := s.do(http.MethodGet, "/time_logs/next_punch?employee_email=ninguem@acme.com", nil); rec.Code != http.StatusNotFound {
+		t.Errorf("unknown employee: status %d, want 404", rec.Code)
+	}
+}
+
+func TestBranchCNPJ(t *testing.T) {
+	s := newTestServer(t, spTime(12, 9, 0))
+	s.signInAdmin()
+	create := func(body map[string]string) *httptest.ResponseRecorder {
+		return s.do(http.MethodPost, "/admin/companies/"+testCNPJ+"/branches", body)
+	}
+
+	// Filiais sem CNPJ próprio não colidem entre si
+	for _, name := range []string{"Norte", "Sul"} {
+		if rec := create(map[string]string{"name": name}); rec.Code != http.StatusCreated || !strings.Contains(rec.Body.String(), `"cnpj":null`) {
+			t.Fatalf("branch %s without CNPJ: status %d: %s", name, rec.Code, rec.Body)
+		}
+	}
+	cnpj := testCNPJ[:8] + "000271"
+	if rec := create(map[string]string{"name": "Leste", "cnpj": cnpj}); rec.Code != http.StatusCreated {
+		t.Fatalf("branch with CNPJ: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := create(map[string]string{"name": "Oeste", "cnpj": cnpj}); rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), ErrBranchCNPJInUse.Error()) {
+		t.Errorf("branch with a taken CNPJ: status %d: %s", rec.Code, rec.Body)
+	}
+	if rec := s.do(http.MethodPut, "/admin/branches/1", map[string]string{"cnpj": cnpj}); rec.Code != http.StatusBadRequest {
+		t.Errorf("update to a taken CNPJ: status %d, want 400", rec.Code)
+	}
+}
+
+// countingCompanies counts the company lookups.
+type countingCompanies struct {
+	db.CompanyRepository
+	lookups int
+}
+
+func (r *countingCompanies) GetByCNPJ(cnpj string) (schemas.Company, error) {
+	r.lookups++
+	return r.CompanyRepository.GetByCNPJ(cnpj)
+}
+
+func TestPunchViewsLookUpTimezonesOnce(t *testing.T) {
+	s := newTestServer(t, spTime(10, 8, 0))
+	var employees []schemas.Employee
+	var records []schemas.PunchRecord
+	for _, email := range []string{"ana@acme.com", "bob@acme.com", "caio@acme.com"} {
+		employees = append(employees, s.employee(email, false))
+		records = append(records, schemas.PunchRecord{EmployeeEmail: email, Punch: punchEntry, PunchedAt: spTime(10, 8, 0).UTC()})
+	}
+
+	companies := &countingCompanies{CompanyRepository: s.api.Repos.Companies}
+	s.api.Repos.Companies = companies
+	views := s.api.punchViews(records, employees)
+	if companies.lookups != 1 {
+		t.Errorf("%d company lookups for %d punches of one company, want 1", companies.lookups, len(records))
+	}
+	for _, view := range views {
+		if view.LocalTime != "10/03/2025 08:00" {
+			t.Errorf("local time of %s = %q", view.EmployeeEmail, view.LocalTime)
+		}
+	}
+}
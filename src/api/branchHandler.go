@@ -0,0 +1,433 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type BranchRequest struct {
+	CNPJ                string `json:"cnpj"`
+	Name                string `json:"name" validate:"required"`
+	Address             string `json:"address"`
+	City                string `json:"city"`
+	State               string `json:"state"`
+	Timezone            string `json:"timezone"`
+	Active              *bool  `json:"active"`
+	ScheduleEntry       string `json:"schedule_entry"`
+	ScheduleLunchExit   string `json:"schedule_lunch_exit"`
+	ScheduleLunchReturn string `json:"schedule_lunch_return"`
+	ScheduleExit        string `json:"schedule_exit"`
+	WorkDays            string `json:"work_days"`
+	// Alteração da jornada: os registros são recalculados a partir desta
+	// data (YYYY-MM-DD, padrão hoje)
+	EffectiveFrom string `json:"effective_from"`
+}
+
+type HolidayRequest struct {
+	CompanyCNPJ string `json:"company_cnpj" validate:"required"`
+	BranchID    *uint  `json:"branch_id"`
+	Date        string `json:"date" validate:"required"` // YYYY-MM-DD
+	Name        string `json:"name" validate:"required"`
+}
+
+type BranchEmployeesRequest struct {
+	EmployeeEmails []string `json:"employee_emails" validate:"required"`
+}
+
+// ErrBranchCNPJInUse refuses a branch CNPJ already given to another branch.
+var ErrBranchCNPJInUse = errors.New("Já existe uma filial com este CNPJ")
+
+var (
+	scheduleTimeRegex = regexp.MustCompile(`^([01]\d|2[0-3]):[0-5]\d$`)
+	workDaysRegex     = regexp.MustCompile(`^[0-6](,[0-6])*$`)
+	nonDigitRegex     = regexp.MustCompile(`\D`)
+)
+
+// cnpjRoot returns the first eight digits of a CNPJ, shared by the head office
+// and all of its branches.
+func cnpjRoot(cnpj string) string {
+	digits := nonDigitRegex.ReplaceAllString(cnpj, "")
+	if len(digits) < 8 {
+		return digits
+	}
+	return digits[:8]
+}
+
+// applyBranchRequest copies the request into the branch, validating the
+// fields that were provided. It returns a user facing message on error.
+func applyBranchRequest(branch *schemas.Branch, companyCNPJ string, req BranchRequest) string {
+	if req.CNPJ != "" {
+		if cnpjRoot(req.CNPJ) != cnpjRoot(companyCNPJ) {
+			return "CNPJ da filial deve ter a mesma raiz do CNPJ da empresa"
+		}
+		cnpj := req.CNPJ
+		branch.CNPJ = &cnpj
+	}
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return fmt.Sprintf("Fuso horário inválido: %s", req.Timezone)
+		}
+		branch.Timezone = req.Timezone
+	}
+	for _, t := range []string{req.ScheduleEntry, req.ScheduleLunchExit, req.ScheduleLunchReturn, req.ScheduleExit} {
+		if t != "" && !scheduleTimeRegex.MatchString(t) {
+			return fmt.Sprintf("Horário inválido na jornada: %s (use HH:MM)", t)
+		}
+	}
+	if req.WorkDays != "" {
+		if !workDaysRegex.MatchString(req.WorkDays) {
+			return "Dias úteis inválidos, use números de 0 (domingo) a 6 (sábado) separados por vírgula"
+		}
+		branch.WorkDays = req.WorkDays
+	}
+
+	if req.Name != "" {
+		branch.Name = req.Name
+	}
+	if req.Address != "" {
+		branch.Address = req.Address
+	}
+	if req.City != "" {
+		branch.City = req.City
+	}
+	if req.State != "" {
+		branch.State = strings.ToUpper(req.State)
+	}
+	if req.Active != nil {
+		branch.Active = *req.Active
+	}
+	if req.ScheduleEntry != "" {
+		branch.ScheduleEntry = req.ScheduleEntry
+	}
+	if req.ScheduleLunchExit != "" {
+		branch.ScheduleLunchExit = req.ScheduleLunchExit
+	}
+	if req.ScheduleLunchReturn != "" {
+		branch.ScheduleLunchReturn = req.ScheduleLunchReturn
+	}
+	if req.ScheduleExit != "" {
+		branch.ScheduleExit = req.ScheduleExit
+	}
+	return ""
+}
+
+// createBranch godoc
+//
+//	@Summary		Criar filial
+//	@Description	Cadastra uma filial para a empresa
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			cnpj	path		string			true	"CNPJ da empresa"
+//	@Param			body	body		BranchRequest	true	"Dados da filial"
+//	@Success		201		{object}	schemas.Branch
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/companies/{cnpj}/branches [post]
+func (api *API) createBranch(c echo.Context) error {
+	company, err := api.Repos.Companies.GetByCNPJ(c.Param("cnpj"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Empresa não encontrada"})
+	}
+
+	var req BranchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	if req.Name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nome da filial é obrigatório"})
+	}
+
+	branch := schemas.Branch{CompanyCNPJ: company.CNPJ, Active: true}
+	if msg := applyBranchRequest(&branch, company.CNPJ, req); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	err = api.Repos.Branches.Create(&branch)
+	if errors.Is(err, db.ErrDuplicate) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": ErrBranchCNPJInUse.Error()})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao salvar filial")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar filial"})
+	}
+
+	return c.JSON(http.StatusCreated, branch)
+}
+
+// listBranches godoc
+//
+//	@Summary		Listar filiais
+//	@Description	Retorna as filiais de uma empresa
+//	@Tags			admin
+//	@Produce		json
+//	@Param			cnpj	path		string	true	"CNPJ da empresa"
+//	@Success		200		{array}		schemas.Branch
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/companies/{cnpj}/branches [get]
+func (api *API) listBranches(c echo.Context) error {
+	branches, err := api.Repos.Branches.ListByCompany(c.Param("cnpj"))
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar filiais"})
+	}
+	return c.JSON(http.StatusOK, branches)
+}
+
+// updateBranch godoc
+//
+//	@Summary		Atualizar filial
+//	@Description	Atualiza endereço, fuso horário, jornada ou situação da filial. Mudanças de jornada ou dias úteis recalculam os registros dos funcionários a partir da vigência
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int				true	"ID da filial"
+//	@Param			body	body		BranchRequest	true	"Dados da filial"
+//	@Success		200		{object}	schemas.Branch
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/branches/{id} [put]
+func (api *API) updateBranch(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	branch, err := api.Repos.Branches.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Filial não encontrada"})
+	}
+
+	var req BranchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	previous := branch
+	if msg := applyBranchRequest(&branch, branch.CompanyCNPJ, req); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	// A schedule change recharges the absences from effective_from on
+	scheduleChanged := branch.ScheduleEntry != previous.ScheduleEntry || branch.ScheduleLunchExit != previous.ScheduleLunchExit ||
+		branch.ScheduleLunchReturn != previous.ScheduleLunchReturn || branch.ScheduleExit != previous.ScheduleExit ||
+		branch.WorkDays != previous.WorkDays
+	var effectiveFrom time.Time
+	if scheduleChanged {
+		if effectiveFrom, err = api.effectiveDate(req.EffectiveFrom, loadLocation(branch.Timezone)); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+
+	err = api.Repos.Branches.Update(&branch)
+	if errors.Is(err, db.ErrDuplicate) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": ErrBranchCNPJInUse.Error()})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao atualizar filial")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao atualizar filial"})
+	}
+
+	if scheduleChanged {
+		requestedBy := currentEmployee(c).Email
+		api.audit("branch", branch.ID, "jornada", requestedBy, fmt.Sprintf(
+			"Jornada %s-%s/%s-%s (dias %s) a partir de %s", branch.ScheduleEntry, branch.ScheduleLunchExit,
+			branch.ScheduleLunchReturn, branch.ScheduleExit, branch.WorkDays, effectiveFrom.Format("2006-01-02")))
+		if _, err := api.enqueueRecalculation(schemas.RecalculationTask{
+			CompanyCNPJ: branch.CompanyCNPJ,
+			BranchID:    &branch.ID,
+			FromDate:    effectiveFrom,
+			Reason:      "Alteração da jornada da filial",
+			RequestedBy: requestedBy,
+		}); err != nil {
+			log.Error().Err(err).Uint("branch", branch.ID).Msg("[api] Erro ao agendar recálculo")
+		}
+	}
+
+	return c.JSON(http.StatusOK, branch)
+}
+
+// assignBranchEmployees godoc
+//
+//	@Summary		Atribuir funcionários à filial
+//	@Description	Vincula os funcionários informados à filial e recalcula os registros dos que mudaram de filial a partir de hoje
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int						true	"ID da filial"
+//	@Param			body	body		BranchEmployeesRequest	true	"Emails dos funcionários"
+//	@Success		200		{object}	map[string]interface{}
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/branches/{id}/employees [put]
+func (api *API) assignBranchEmployees(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	var req BranchEmployeesRequest
+	if err := c.Bind(&req); err != nil || len(req.EmployeeEmails) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Informe ao menos um funcionário"})
+	}
+
+	branch, err := api.Repos.Branches.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Filial não encontrada"})
+	}
+
+	req.EmployeeEmails = distinctEmails(req.EmployeeEmails)
+	employees, err := api.Repos.Employees.List(db.EmployeeFilter{Emails: req.EmployeeEmails, CompanyCNPJ: branch.CompanyCNPJ})
+	if err != nil || len(employees) != len(req.EmployeeEmails) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Todos os funcionários devem pertencer à empresa da filial"})
+	}
+
+	if err := api.Repos.Employees.SetBranch(req.EmployeeEmails, branch.ID); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao atribuir funcionários à filial")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao atribuir funcionários"})
+	}
+
+	// The days of the moved employees are charged by the new branch schedule
+	requestedBy := currentEmployee(c).Email
+	today := localDate(api.Clock.Now(), loadLocation(branch.Timezone))
+	for _, employee := range employees {
+		if employee.BranchID != nil && *employee.BranchID == branch.ID {
+			continue
+		}
+		if _, err := api.enqueueRecalculation(schemas.RecalculationTask{
+			CompanyCNPJ:   branch.CompanyCNPJ,
+			EmployeeEmail: employee.Email,
+			FromDate:      today,
+			Reason:        "Mudança de filial",
+			RequestedBy:   requestedBy,
+		}); err != nil {
+			log.Error().Err(err).Str("employee", employee.Email).Msg("[api] Erro ao agendar recálculo")
+		}
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":   "Funcionários atribuídos com sucesso",
+		"branch_id": branch.ID,
+		"employees": req.EmployeeEmails,
+	})
+}
+
+// createHoliday godoc
+//
+//	@Summary		Cadastrar feriado
+//	@Description	Cadastra um feriado da empresa inteira ou de uma filial
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		HolidayRequest	true	"Dados do feriado"
+//	@Success		201		{object}	schemas.Holiday
+//	@Failure		400		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/holidays [post]
+func (api *API) createHoliday(c echo.Context) error {
+	var req HolidayRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	if req.CompanyCNPJ == "" || req.Date == "" || req.Name == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "CNPJ, data e nome são obrigatórios"})
+	}
+
+	date, err := time.Parse("2006-01-02", req.Date)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Formato de data inválido"})
+	}
+
+	if req.BranchID != nil {
+		if branch, err := api.Repos.Branches.Get(*req.BranchID); err != nil || branch.CompanyCNPJ != req.CompanyCNPJ {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Filial não encontrada nesta empresa"})
+		}
+	}
+
+	holiday := schemas.Holiday{
+		CompanyCNPJ: req.CompanyCNPJ,
+		BranchID:    req.BranchID,
+		Date:        date,
+		Name:        req.Name,
+	}
+	if err := api.Repos.Holidays.Create(&holiday); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao salvar feriado")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar feriado"})
+	}
+
+	return c.JSON(http.StatusCreated, holiday)
+}
+
+// listHolidays godoc
+//
+//	@Summary		Listar feriados
+//	@Description	Retorna os feriados da empresa; com branch_id inclui também os feriados da filial
+//	@Tags			admin
+//	@Produce		json
+//	@Param			company_cnpj	query		string	true	"CNPJ da empresa"
+//	@Param			branch_id		query		int		false	"ID da filial"
+//	@Success		200				{array}		schemas.Holiday
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/holidays [get]
+func (api *API) listHolidays(c echo.Context) error {
+	cnpj := c.QueryParam("company_cnpj")
+	if cnpj == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "CNPJ da empresa é obrigatório"})
+	}
+
+	filter := db.HolidayFilter{CompanyCNPJ: cnpj}
+	if branchParam := c.QueryParam("branch_id"); branchParam != "" {
+		branchID, err := strconv.Atoi(branchParam)
+		if err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Filial inválida"})
+		}
+		id := uint(branchID)
+		filter.BranchID = &id
+	}
+
+	holidays, err := api.Repos.Holidays.List(filter)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar feriados"})
+	}
+	return c.JSON(http.StatusOK, holidays)
+}
+
+// deleteHoliday godoc
+//
+//	@Summary		Excluir feriado
+//	@Description	Remove um feriado do calendário
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id	path		int	true	"ID do feriado"
+//	@Success		200	{object}	map[string]string
+//	@Failure		400	{object}	map[string]string
+//	@Failure		404	{object}	map[string]string
+//	@Failure		500	{object}	map[string]string
+//	@Router			/admin/holidays/{id} [delete]
+func (api *API) deleteHoliday(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	holiday, err := api.Repos.Holidays.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Feriado não encontrado"})
+	}
+	if err := api.Repos.Holidays.Delete(&holiday); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao excluir feriado"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Feriado excluído"})
+}
@@ -0,0 +1,291 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// DepartmentRequest creates or changes a department. On updates, omitted
+// fields are kept; a parent_id of 0 moves the department to the top of the
+// hierarchy and an empty manager_email removes its manager.
+type DepartmentRequest struct {
+	Name         string  `json:"name" validate:"required"`
+	CompanyCNPJ  string  `json:"company_cnpj" validate:"required"`
+	ParentID     *uint   `json:"parent_id"`
+	ManagerEmail *string `json:"manager_email"`
+}
+
+type DepartmentEmployeesRequest struct {
+	EmployeeEmails []string `json:"employee_emails" validate:"required"`
+}
+
+// createDepartment godoc
+//
+//	@Summary		Criar departamento
+//	@Description	Cria um departamento ou equipe, opcionalmente abaixo de outro departamento
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		DepartmentRequest	true	"Dados do departamento"
+//	@Success		201		{object}	schemas.Department
+//	@Failure		400		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/departments [post]
+func (api *API) createDepartment(c echo.Context) error {
+	var req DepartmentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	if req.Name == "" || req.CompanyCNPJ == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nome e CNPJ são obrigatórios"})
+	}
+
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empresa com este CNPJ não existe"})
+	}
+
+	department := schemas.Department{
+		Name:        req.Name,
+		CompanyCNPJ: req.CompanyCNPJ,
+	}
+	if msg := api.applyDepartmentChanges(&department, req.ParentID, req.ManagerEmail); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	if err := api.Repos.Departments.Create(&department); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao salvar departamento")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar departamento"})
+	}
+
+	return c.JSON(http.StatusCreated, department)
+}
+
+// listDepartments godoc
+//
+//	@Summary		Listar departamentos
+//	@Description	Retorna os departamentos de uma empresa
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			company_cnpj	query		string	true	"CNPJ da empresa"
+//	@Success		200				{array}		schemas.Department
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/departments [get]
+func (api *API) listDepartments(c echo.Context) error {
+	cnpj := c.QueryParam("company_cnpj")
+	if cnpj == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "CNPJ da empresa é obrigatório"})
+	}
+
+	departments, err := api.Repos.Departments.ListByCompany(cnpj)
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar departamentos"})
+	}
+	return c.JSON(http.StatusOK, departments)
+}
+
+// updateDepartment godoc
+//
+//	@Summary		Atualizar departamento
+//	@Description	Altera nome, departamento pai ou gerente responsável. parent_id 0 remove o departamento pai e manager_email vazio remove o gerente
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"ID do departamento"
+//	@Param			body	body		DepartmentRequest	true	"Dados do departamento"
+//	@Success		200		{object}	schemas.Department
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/departments/{id} [put]
+func (api *API) updateDepartment(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	var req DepartmentRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	department, err := api.Repos.Departments.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Departamento não encontrado"})
+	}
+
+	if req.Name != "" {
+		department.Name = req.Name
+	}
+	if msg := api.applyDepartmentChanges(&department, req.ParentID, req.ManagerEmail); msg != "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": msg})
+	}
+
+	if err := api.Repos.Departments.Update(&department); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao atualizar departamento")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao atualizar departamento"})
+	}
+
+	return c.JSON(http.StatusOK, department)
+}
+
+// deleteDepartment godoc
+//
+//	@Summary		Excluir departamento
+//	@Description	Remove um departamento sem subdepartamentos nem funcionários
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id	path		int	true	"ID do departamento"
+//	@Success		200	{object}	map[string]string
+//	@Failure		400	{object}	map[string]string
+//	@Failure		404	{object}	map[string]string
+//	@Failure		500	{object}	map[string]string
+//	@Router			/admin/departments/{id} [delete]
+func (api *API) deleteDepartment(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	department, err := api.Repos.Departments.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Departamento não encontrado"})
+	}
+
+	var children, members int
+	if departments, err := api.Repos.Departments.ListByCompany(department.CompanyCNPJ); err == nil {
+		for _, d := range departments {
+			if d.ParentID != nil && *d.ParentID == department.ID {
+				children++
+			}
+		}
+	}
+	if employees, err := api.Repos.Employees.List(db.EmployeeFilter{DepartmentIDs: []uint{department.ID}}); err == nil {
+		members = len(employees)
+	}
+	if children > 0 || members > 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Departamento possui subdepartamentos ou funcionários"})
+	}
+
+	if err := api.Repos.Departments.Delete(&department); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao excluir departamento"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Departamento excluído"})
+}
+
+// assignDepartmentEmployees godoc
+//
+//	@Summary		Atribuir funcionários ao departamento
+//	@Description	Move os funcionários informados para o departamento
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int							true	"ID do departamento"
+//	@Param			body	body		DepartmentEmployeesRequest	true	"Emails dos funcionários"
+//	@Success		200		{object}	map[string]interface{}
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/departments/{id}/employees [put]
+func (api *API) assignDepartmentEmployees(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	var req DepartmentEmployeesRequest
+	if err := c.Bind(&req); err != nil || len(req.EmployeeEmails) == 0 {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Informe ao menos um funcionário"})
+	}
+
+	department, err := api.Repos.Departments.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Departamento não encontrado"})
+	}
+
+	req.EmployeeEmails = distinctEmails(req.EmployeeEmails)
+	employees, err := api.Repos.Employees.List(db.EmployeeFilter{Emails: req.EmployeeEmails, CompanyCNPJ: department.CompanyCNPJ})
+	if err != nil || len(employees) != len(req.EmployeeEmails) {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Todos os funcionários devem pertencer à empresa do departamento"})
+	}
+
+	if err := api.Repos.Employees.SetDepartment(req.EmployeeEmails, department.ID); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao atribuir funcionários ao departamento")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao atribuir funcionários"})
+	}
+
+	return c.JSON(http.StatusOK, map[string]interface{}{
+		"message":       "Funcionários atribuídos com sucesso",
+		"department_id": department.ID,
+		"employees":     req.EmployeeEmails,
+	})
+}
+
+// distinctEmails drops repeated emails, keeping the order of the request.
+func distinctEmails(emails []string) []string {
+	seen := map[string]bool{}
+	distinct := []string{}
+	for _, email := range emails {
+		if !seen[email] {
+			seen[email] = true
+			distinct = append(distinct, email)
+		}
+	}
+	return distinct
+}
+
+// applyDepartmentChanges validates and applies the parent and manager of a
+// department, returning a user facing message when the change is not allowed.
+// Nil values are kept, while a zero parent and an empty manager are removed.
+func (api *API) applyDepartmentChanges(department *schemas.Department, parentID *uint, managerEmail *string) string {
+	if managerEmail != nil && *managerEmail == "" {
+		department.ManagerEmail = ""
+	} else if managerEmail != nil {
+		manager, err := api.findManager(*managerEmail)
+		if err != nil {
+			return "Gerente não encontrado"
+		}
+		if manager.CompanyCNPJ != department.CompanyCNPJ {
+			return "Gerente deve pertencer à empresa do departamento"
+		}
+		department.ManagerEmail = *managerEmail
+	}
+
+	if parentID != nil && *parentID == 0 {
+		department.ParentID = nil
+	} else if parentID != nil {
+		if department.ID != 0 && *parentID == department.ID {
+			return "Departamento não pode ser pai de si mesmo"
+		}
+
+		parent, err := api.Repos.Departments.Get(*parentID)
+		if err != nil {
+			return "Departamento pai não encontrado"
+		}
+		if parent.CompanyCNPJ != department.CompanyCNPJ {
+			return "Departamento pai deve pertencer à mesma empresa"
+		}
+
+		// Impede ciclos: o novo pai não pode estar abaixo deste departamento
+		for ancestor := parent; ancestor.ParentID != nil && department.ID != 0; {
+			if *ancestor.ParentID == department.ID {
+				return "Hierarquia inválida: ciclo entre departamentos"
+			}
+			next, err := api.Repos.Departments.Get(*ancestor.ParentID)
+			if err != nil {
+				break
+			}
+			ancestor = next
+		}
+		department.ParentID = parentID
+	}
+
+	return ""
+}
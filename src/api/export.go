@@ -0,0 +1,173 @@
+package api
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/xuri/excelize/v2"
+)
+
+// Export formats accepted by Export.
+const (
+	ExportAFD  = "afd"
+	ExportXLSX = "xlsx"
+	ExportCSV  = "csv"
+)
+
+// ExportFile is a generated report, ready to be downloaded or written to disk.
+type ExportFile struct {
+	Filename    string
+	ContentType string
+	Content     []byte
+}
+
+// Export generates the time logs of the company, or of one of its branches,
+// from start to end (exclusive) in the given format.
+func (api *API) Export(format, companyCNPJ string, branchID *uint, start, end time.Time) (ExportFile, error) {
+	company, branch, employees, err := api.ReportScope(companyCNPJ, branchID)
+	if err != nil {
+		return ExportFile{}, err
+	}
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: employeeEmails(employees), From: start, To: end})
+	if err != nil {
+		return ExportFile{}, err
+	}
+
+	switch format {
+	case ExportAFD:
+		return api.afdExport(company, branch, employees, timeLogs, start, end), nil
+	case ExportXLSX:
+		return api.xlsxExport(company, employees, timeLogs)
+	case ExportCSV:
+		return api.csvExport(company, employees, timeLogs)
+	}
+	return ExportFile{}, fmt.Errorf("formato de exportação inválido: %s", format)
+}
+
+// afdExport builds the AFD (Portaria 671) of the time logs, identified by the
+// branch CNPJ when the export covers a branch that has one.
+func (api *API) afdExport(company schemas.Company, branch *schemas.Branch, employees []schemas.Employee, timeLogs []schemas.TimeLog, start, end time.Time) ExportFile {
+	cnpj := company.CNPJ
+	if branch != nil && branch.CNPJ != nil {
+		cnpj = *branch.CNPJ
+	}
+
+	location := api.employeeLocations()
+	locations := map[string]*time.Location{}
+	for _, e := range employees {
+		locations[e.Email] = location(e)
+	}
+	generatedAt := api.Clock.Now().In(loadLocation(company.Timezone))
+	if branch != nil && branch.Timezone != "" {
+		generatedAt = generatedAt.In(loadLocation(branch.Timezone))
+	}
+
+	content := buildAFD(cnpj, company.Name, employees, locations, timeLogs, start, end.Add(-24*time.Hour), generatedAt)
+
+	return ExportFile{
+		Filename:    fmt.Sprintf("AFD%s%s.txt", nonDigitRegex.ReplaceAllString(cnpj, ""), generatedAt.Format("20060102")),
+		ContentType: "text/plain; charset=utf-8",
+		Content:     []byte(content),
+	}
+}
+
+var exportHeaders = []string{"Funcionário", "Email", "Data", "Entrada", "Saída Almoço", "Retorno", "Saída", "Extras", "Faltantes", "Saldo", "Status"}
+
+// exportRows lays out one row per time log, with the punches in the employee's
+// timezone and the hours as numbers.
+func (api *API) exportRows(employees []schemas.Employee, timeLogs []schemas.TimeLog) [][]interface{} {
+	byEmail := map[string]schemas.Employee{}
+	for _, e := range employees {
+		byEmail[e.Email] = e
+	}
+
+	location := api.employeeLocations()
+	rows := make([][]interface{}, 0, len(timeLogs))
+	for _, tl := range timeLogs {
+		employee := byEmail[tl.EmployeeEmail]
+		loc := location(employee)
+		rows = append(rows, []interface{}{
+			employee.Name,
+			tl.EmployeeEmail,
+			tl.LogDate.Format("02/01/2006"),
+			formatIn(tl.EntryTime, loc, "15:04"),
+			formatIn(tl.LunchExitTime, loc, "15:04"),
+			formatIn(tl.LunchReturnTime, loc, "15:04"),
+			formatIn(tl.ExitTime, loc, "15:04"),
+			tl.ExtraHours,
+			tl.MissingHours,
+			tl.Balance,
+			tl.Status,
+		})
+	}
+	return rows
+}
+
+func (api *API) exportFilename(company schemas.Company, extension string) string {
+	return fmt.Sprintf("Registros_%s_%s.%s", nonDigitRegex.ReplaceAllString(company.CNPJ, ""),
+		api.Clock.Now().In(loadLocation(company.Timezone)).Format("200601021504"), extension)
+}
+
+func (api *API) xlsxExport(company schemas.Company, employees []schemas.Employee, timeLogs []schemas.TimeLog) (ExportFile, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+
+	sheet := "Registros"
+	f.SetSheetName("Sheet1", sheet)
+
+	headers := make([]interface{}, len(exportHeaders))
+	for i, h := range exportHeaders {
+		headers[i] = h
+	}
+	if err := f.SetSheetRow(sheet, "A1", &headers); err != nil {
+		return ExportFile{}, err
+	}
+	for i, row := range api.exportRows(employees, timeLogs) {
+		if err := f.SetSheetRow(sheet, fmt.Sprintf("A%d", i+2), &row); err != nil {
+			return ExportFile{}, err
+		}
+	}
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return ExportFile{}, err
+	}
+	return ExportFile{
+		Filename:    api.exportFilename(company, "xlsx"),
+		ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+		Content:     buf.Bytes(),
+	}, nil
+}
+
+func (api *API) csvExport(company schemas.Company, employees []schemas.Employee, timeLogs []schemas.TimeLog) (ExportFile, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(exportHeaders)
+	for _, row := range api.exportRows(employees, timeLogs) {
+		record := make([]string, len(row))
+		for i, v := range row {
+			switch v := v.(type) {
+			case float32:
+				record[i] = strconv.FormatFloat(float64(v), 'f', 2, 32)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		w.Write(record)
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return ExportFile{}, err
+	}
+	return ExportFile{
+		Filename:    api.exportFilename(company, "csv"),
+		ContentType: "text/csv; charset=utf-8",
+		Content:     buf.Bytes(),
+	}, nil
+}
@@ -0,0 +1,218 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/geo"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// Company policies for punches outside the geofences.
+const (
+	geofenceAccept = "aceitar"
+	geofenceFlag   = "sinalizar"
+	geofenceReject = "rejeitar"
+)
+
+// Geofence shapes.
+const (
+	geofenceCircle  = "circulo"
+	geofencePolygon = "poligono"
+)
+
+// Geofence status of a punch, kept in the punch history.
+const (
+	geofenceInside     = "dentro"
+	geofenceOutside    = "fora"
+	geofenceNoLocation = "sem_localizacao"
+)
+
+var (
+	ErrInvalidLocation  = errors.New("Localização inválida")
+	ErrLocationRequired = errors.New("Esta empresa exige a localização do dispositivo para registrar o ponto")
+	ErrLocationVague    = errors.New("A localização do dispositivo está imprecisa demais para registrar o ponto")
+	ErrOutsideGeofence  = errors.New("Você está fora da área permitida para registrar o ponto")
+)
+
+// PunchLocation is the position reported by the device with a punch.
+type PunchLocation struct {
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	// Accuracy is the radius of uncertainty in meters, 0 when unknown
+	Accuracy float64 `json:"accuracy"`
+}
+
+func (l PunchLocation) point() geo.Point {
+	return geo.Point{Lat: l.Latitude, Lng: l.Longitude}
+}
+
+// valid checks the coordinates and that the accuracy is a distance.
+func (l PunchLocation) valid() bool {
+	return l.point().Valid() && l.Accuracy >= 0 && !math.IsInf(l.Accuracy, 0)
+}
+
+// GeofenceRequest adds a geofence to a workplace: a circle, given by its
+// center and radius, or a polygon, given by its vertices.
+type GeofenceRequest struct {
+	Name         string      `json:"name"`
+	Kind         string      `json:"kind"` // circulo ou poligono
+	Latitude     float64     `json:"latitude"`
+	Longitude    float64     `json:"longitude"`
+	RadiusMeters float64     `json:"radius_meters"`
+	Polygon      []geo.Point `json:"polygon"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+}
+
+// validGeofencePolicy reports whether policy is one of the company policies;
+// empty means the default, aceitar.
+func validGeofencePolicy(policy string) bool {
+	switch policy {
+	case "", geofenceAccept, geofenceFlag, geofenceReject:
+		return true
+	}
+	return false
+}
+
+// CreateGeofence adds an active geofence to the workplace.
+func (api *API) CreateGeofence(workplaceID uint, req GeofenceRequest) (schemas.Geofence, error) {
+	workplace, err := api.Repos.Workplaces.Get(workplaceID)
+	if err != nil {
+		return schemas.Geofence{}, err
+	}
+
+	fence := schemas.Geofence{
+		CompanyCNPJ: workplace.CompanyCNPJ,
+		WorkplaceID: workplace.ID,
+		Name:        strings.TrimSpace(req.Name),
+		Kind:        req.Kind,
+		Active:      true,
+	}
+	if fence.Name == "" {
+		fence.Name = workplace.Name
+	}
+	switch req.Kind {
+	case geofenceCircle:
+		center := geo.Point{Lat: req.Latitude, Lng: req.Longitude}
+		if !center.Valid() {
+			return schemas.Geofence{}, ErrInvalidLocation
+		}
+		if req.RadiusMeters <= 0 {
+			return schemas.Geofence{}, fmt.Errorf("O raio da cerca deve ser maior que zero")
+		}
+		fence.Latitude, fence.Longitude, fence.RadiusMeters = center.Lat, center.Lng, req.RadiusMeters
+	case geofencePolygon:
+		if len(req.Polygon) < 3 {
+			return schemas.Geofence{}, fmt.Errorf("O polígono deve ter ao menos três vértices")
+		}
+		for _, vertex := range req.Polygon {
+			if !vertex.Valid() {
+				return schemas.Geofence{}, ErrInvalidLocation
+			}
+		}
+		fence.Polygon = req.Polygon
+	default:
+		return schemas.Geofence{}, fmt.Errorf("Tipo de cerca inválido, use circulo ou poligono")
+	}
+
+	if err := api.Repos.Geofences.Create(&fence); err != nil {
+		return schemas.Geofence{}, err
+	}
+	api.audit("geofence", fence.ID, "criar_cerca", req.RequestedBy, fmt.Sprintf("Cerca %s (%s) no local %s", fence.Name, fence.Kind, workplace.Name))
+	return fence, nil
+}
+
+// ListGeofences returns the geofences of the company, or of every company when
+// cnpj is empty, optionally of one workplace.
+func (api *API) ListGeofences(cnpj string, workplaceID uint) ([]schemas.Geofence, error) {
+	return api.Repos.Geofences.List(db.GeofenceFilter{CompanyCNPJ: cnpj, WorkplaceID: workplaceID})
+}
+
+// DeleteGeofence removes a geofence.
+func (api *API) DeleteGeofence(id uint, requestedBy string) error {
+	fence, err := api.Repos.Geofences.Get(id)
+	if err != nil {
+		return err
+	}
+	if err := api.Repos.Geofences.Delete(&fence); err != nil {
+		return err
+	}
+	api.audit("geofence", fence.ID, "remover_cerca", requestedBy, "Cerca "+fence.Name)
+	return nil
+}
+
+// geofenceStatus checks the location of a web punch against the active
+// geofences of the employee's company, according to the company policy. It
+// returns the status to keep in the punch history, empty when the company
+// does not check locations, and refuses the punch under the rejeitar policy.
+// A location less accurate than work.max_location_accuracy proves nothing
+// and counts as no location.
+func (api *API) geofenceStatus(employeeEmail string, location *PunchLocation) (string, error) {
+	employee, err := api.Repos.Employees.GetByEmail(employeeEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	company, err := api.Repos.Companies.GetByCNPJ(employee.CompanyCNPJ)
+	if errors.Is(err, db.ErrNotFound) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if company.GeofencePolicy != geofenceFlag && company.GeofencePolicy != geofenceReject {
+		return "", nil
+	}
+
+	active := true
+	fences, err := api.Repos.Geofences.List(db.GeofenceFilter{CompanyCNPJ: company.CNPJ, Active: &active})
+	if err != nil {
+		return "", err
+	}
+	if len(fences) == 0 {
+		// nothing to check against until the company draws its fences
+		return "", nil
+	}
+
+	status := geofenceNoLocation
+	vague := location != nil && location.Accuracy > api.Config.Work.MaxLocationAccuracy
+	if location != nil && !vague {
+		status = geofenceOutside
+		for _, fence := range fences {
+			if insideGeofence(fence, *location) {
+				status = geofenceInside
+				break
+			}
+		}
+	}
+	if company.GeofencePolicy == geofenceReject {
+		switch status {
+		case geofenceNoLocation:
+			if vague {
+				return status, ErrLocationVague
+			}
+			return status, ErrLocationRequired
+		case geofenceOutside:
+			return status, ErrOutsideGeofence
+		}
+	}
+	return status, nil
+}
+
+// insideGeofence gives the reading the benefit of its accuracy: the punch is
+// inside when its uncertainty circle touches the fence.
+func insideGeofence(fence schemas.Geofence, location PunchLocation) bool {
+	switch fence.Kind {
+	case geofenceCircle:
+		return geo.InCircle(location.point(), location.Accuracy, geo.Point{Lat: fence.Latitude, Lng: fence.Longitude}, fence.RadiusMeters)
+	case geofencePolygon:
+		return geo.DistanceToPolygon(location.point(), fence.Polygon) <= location.Accuracy
+	}
+	return false
+}
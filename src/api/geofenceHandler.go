@@ -0,0 +1,127 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// parsePunchLocation reads the latitude, longitude and accuracy query
+// parameters of a punch. Without coordinates the punch has no location.
+func parsePunchLocation(c echo.Context) (*PunchLocation, error) {
+	lat, lng := c.QueryParam("latitude"), c.QueryParam("longitude")
+	if lat == "" && lng == "" {
+		return nil, nil
+	}
+	var location PunchLocation
+	var err1, err2 error
+	location.Latitude, err1 = strconv.ParseFloat(lat, 64)
+	location.Longitude, err2 = strconv.ParseFloat(lng, 64)
+	if err1 != nil || err2 != nil {
+		return nil, ErrInvalidLocation
+	}
+	if accuracy := c.QueryParam("accuracy"); accuracy != "" {
+		value, err := strconv.ParseFloat(accuracy, 64)
+		if err != nil {
+			return nil, ErrInvalidLocation
+		}
+		location.Accuracy = value
+	}
+	if !location.valid() {
+		return nil, ErrInvalidLocation
+	}
+	return &location, nil
+}
+
+// createGeofence godoc
+//
+//	@Summary		Cadastrar cerca virtual
+//	@Description	Adiciona ao local de trabalho uma cerca circular (centro e raio em metros) ou poligonal (vértices em latitude e longitude)
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int				true	"ID do local de trabalho"
+//	@Param			body	body		GeofenceRequest	true	"Forma da cerca"
+//	@Success		201		{object}	schemas.Geofence
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Router			/admin/workplaces/{id}/geofences [post]
+func (api *API) createGeofence(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	var req GeofenceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	fence, err := api.CreateGeofence(uint(id), req)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Local de trabalho não encontrado"})
+	}
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, fence)
+}
+
+// listGeofences godoc
+//
+//	@Summary		Cercas virtuais
+//	@Description	Lista as cercas virtuais da empresa, opcionalmente de um local de trabalho
+//	@Tags			admin
+//	@Produce		json
+//	@Param			company_cnpj	query		string	false	"CNPJ da empresa"
+//	@Param			workplace_id	query		int		false	"ID do local de trabalho"
+//	@Success		200				{array}		schemas.Geofence
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/geofences [get]
+func (api *API) listGeofences(c echo.Context) error {
+	var workplaceID uint64
+	if value := c.QueryParam("workplace_id"); value != "" {
+		var err error
+		if workplaceID, err = strconv.ParseUint(value, 10, 0); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID do local inválido"})
+		}
+	}
+	fences, err := api.ListGeofences(c.QueryParam("company_cnpj"), uint(workplaceID))
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar cercas virtuais")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar cercas virtuais"})
+	}
+	return c.JSON(http.StatusOK, fences)
+}
+
+// deleteGeofence godoc
+//
+//	@Summary		Remover cerca virtual
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id				path		int		true	"ID da cerca"
+//	@Success		200				{object}	map[string]string
+//	@Failure		400				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/geofences/{id} [delete]
+func (api *API) deleteGeofence(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	err = api.DeleteGeofence(uint(id), currentEmployee(c).Email)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Cerca não encontrada"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao remover cerca virtual")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao remover cerca virtual"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Cerca removida"})
+}
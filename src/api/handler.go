@@ -2,74 +2,53 @@ package api
 
 import (
 	"errors"
+	"fmt"
 	"net/http"
+	"net/url"
 	"strconv"
+	"strings"
+	"time"
 
+	"github.com/MWismeck/marca-tempo/src/db"
 	_ "github.com/MWismeck/marca-tempo/src/docs"
 	"github.com/MWismeck/marca-tempo/src/schemas"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
-	"gorm.io/gorm"
 )
 
 // getEmployees godoc
 //
 //	@Summary		Listar funcionários
-//	@Description	Retorna lista de funcionários com filtros opcionais
+//	@Description	Retorna os funcionários da equipe do gerente da sessão, com filtros opcionais
 //	@Tags			employees
 //	@Accept			json
 //	@Produce		json
-//	@Param			manager_email	query	string	false	"Email do gerente para filtrar funcionários da empresa"
+//	@Param			Authorization	header	string	true	"Bearer <token> de um gerente"
 //	@Param			active			query	boolean	false	"Filtrar por funcionários ativos/inativos"
 //	@Success		200	{object}	map[string][]schemas.EmployeeResponse
-//	@Failure		401	{string}	string	"Gerente não encontrado"
-//	@Failure		404	{string}	string	"Funcionários não encontrados"
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
 //	@Failure		500	{string}	string	"Erro interno do servidor"
 //	@Router			/employees/ [get]
 func (api *API) getEmployees(c echo.Context) error {
-	managerEmail := c.QueryParam("manager_email")
-	active := c.QueryParam("active")
-
-	var employees []schemas.Employee
-
-	if managerEmail != "" {
-		var manager schemas.Employee
-		if err := api.DB.DB.Where("email = ? AND is_manager = ?", managerEmail, true).First(&manager).Error; err != nil {
-			log.Error().Err(err).Msgf("[api] Gerente não encontrado: %s", managerEmail)
-			return c.String(http.StatusUnauthorized, "Gerente não encontrado")
-		}
-
-		query := api.DB.DB.Where("company_cnpj = ?", manager.CompanyCNPJ)
-
-		if active != "" {
-			if act, err := strconv.ParseBool(active); err == nil {
-				query = query.Where("active = ?", act)
-			}
-		}
+	manager := currentEmployee(c)
+	emails, err := api.managedEmployeeEmails(manager)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar equipe do gerente")
+		return c.String(http.StatusInternalServerError, "Erro ao buscar funcionários")
+	}
 
-		if err := query.Find(&employees).Error; err != nil {
-			log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da empresa")
-			return c.String(http.StatusInternalServerError, "Erro ao buscar funcionários")
-		}
-	} else {
-		var err error
-		employees, err = api.DB.GetEmployees()
-		if err != nil {
-			return c.String(http.StatusNotFound, "Failed to get employees")
+	filter := db.EmployeeFilter{Emails: emails}
+	if active := c.QueryParam("active"); active != "" {
+		if act, err := strconv.ParseBool(active); err == nil {
+			filter.Active = &act
 		}
+	}
 
-		if active != "" {
-			act, err := strconv.ParseBool(active)
-			if err != nil {
-				log.Error().Err(err).Msgf("[api] error to parsing boolean")
-				return c.String(http.StatusInternalServerError, "Failed to parse boolean")
-			}
-			employees, err = api.DB.GetFilteredEmployee(act)
-			if err != nil {
-				return c.String(http.StatusInternalServerError, "Failed to filter employees")
-			}
-		}
+	employees, err := api.Repos.Employees.List(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da equipe")
+		return c.String(http.StatusInternalServerError, "Erro ao buscar funcionários")
 	}
 
 	listOfEmployees := map[string][]schemas.EmployeeResponse{"employees:": schemas.NewResponse(employees)}
@@ -80,13 +59,15 @@ func (api *API) getEmployees(c echo.Context) error {
 // createEmployee godoc
 //
 //	@Summary		Criar funcionário
-//	@Description	Cria um novo funcionário no sistema
+//	@Description	Cria um novo funcionário no sistema. Exige a sessão de um administrador
 //	@Tags			employees
 //	@Accept			json
 //	@Produce		json
 //	@Param			body	body		EmployeeRequest	true	"Dados do funcionário"
 //	@Success		200		{object}	schemas.Employee
 //	@Failure		400		{string}	string	"Dados inválidos ou empresa não encontrada"
+//	@Failure		401		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
 //	@Failure		500		{string}	string	"Erro interno do servidor"
 //	@Router			/employee/ [post]
 func (api *API) createEmployee(c echo.Context) error {
@@ -99,21 +80,28 @@ func (api *API) createEmployee(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Error validating employee")
 	}
 
-	var company schemas.Company
-	if err := api.DB.DB.Where("cnpj = ?", employeeReq.CompanyCNPJ).First(&company).Error; err != nil {
+	company, err := api.Repos.Companies.GetByCNPJ(employeeReq.CompanyCNPJ)
+	if err != nil {
 		log.Warn().Str("cnpj", employeeReq.CompanyCNPJ).Msg("[api] CNPJ não encontrado")
 		return c.String(http.StatusBadRequest, "Empresa com este CNPJ não encontrada")
 	}
 
+	if employeeReq.DepartmentID != nil {
+		if department, err := api.Repos.Departments.Get(*employeeReq.DepartmentID); err != nil || department.CompanyCNPJ != company.CNPJ {
+			return c.String(http.StatusBadRequest, "Departamento não encontrado nesta empresa")
+		}
+	}
+
 	employee := schemas.Employee{
-		Name:        employeeReq.Name,
-		Email:       employeeReq.Email,
-		CPF:         employeeReq.CPF,
-		RG:          employeeReq.RG,
-		Age:         employeeReq.Age,
-		Active:      *employeeReq.Active,
-		Workload:    employeeReq.Workload,
-		CompanyCNPJ: employeeReq.CompanyCNPJ,
+		Name:         employeeReq.Name,
+		Email:        employeeReq.Email,
+		CPF:          employeeReq.CPF,
+		RG:           employeeReq.RG,
+		Age:          employeeReq.Age,
+		Active:       *employeeReq.Active,
+		Workload:     employeeReq.Workload,
+		CompanyCNPJ:  employeeReq.CompanyCNPJ,
+		DepartmentID: employeeReq.DepartmentID,
 	}
 	hashedPassword, err := HashPassword(employeeReq.Password)
 	if err != nil {
@@ -123,11 +111,12 @@ func (api *API) createEmployee(c echo.Context) error {
 		Email:    employee.Email,
 		Password: hashedPassword,
 	}
-	if err := api.DB.DB.Create(&login).Error; err != nil {
+	if err := api.Repos.Logins.Create(&login); err != nil {
 		return c.String(http.StatusInternalServerError, "Erro ao salvar login")
 	}
 
-	if err := api.DB.AddEmployee(employee); err != nil {
+	if err := api.Repos.Employees.Create(&employee); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao criar funcionário")
 		return c.String(http.StatusInternalServerError, "Erro ao criar funcionário")
 	}
 
@@ -151,8 +140,8 @@ func (api *API) getEmployeeId(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to get employee ID")
 	}
-	employee, err := api.DB.GetEmployee(id)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	employee, err := api.Repos.Employees.Get(uint(id))
+	if errors.Is(err, db.ErrNotFound) {
 		return c.String(http.StatusNotFound, "Employee not found")
 	}
 	if err != nil {
@@ -164,12 +153,13 @@ func (api *API) getEmployeeId(c echo.Context) error {
 // updateEmployee godoc
 //
 //	@Summary		Atualizar funcionário
-//	@Description	Atualiza os dados de um funcionário
+//	@Description	Atualiza os dados de um funcionário. Mudanças de jornada recalculam os registros a partir da vigência
 //	@Tags			employees
 //	@Accept			json
 //	@Produce		json
 //	@Param			id		path		int					true	"ID do funcionário"
-//	@Param			body	body		schemas.Employee	true	"Dados atualizados do funcionário"
+//	@Param			body			body		schemas.Employee	true	"Dados atualizados do funcionário"
+//	@Param			effective_from	query		string				false	"Vigência da nova jornada (YYYY-MM-DD, padrão hoje)"
 //	@Success		200		{object}	schemas.Employee
 //	@Failure		404		{string}	string	"Funcionário não encontrado"
 //	@Failure		500		{string}	string	"Erro interno do servidor"
@@ -183,8 +173,8 @@ func (api *API) updateEmployee(c echo.Context) error {
 	if err := c.Bind(&recivedEmployee); err != nil {
 		return err
 	}
-	updatingEmployee, err := api.DB.GetEmployee(id)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	updatingEmployee, err := api.Repos.Employees.Get(uint(id))
+	if errors.Is(err, db.ErrNotFound) {
 		return c.String(http.StatusNotFound, "Employee not found")
 	}
 	if err != nil {
@@ -192,10 +182,47 @@ func (api *API) updateEmployee(c echo.Context) error {
 	}
 
 	employee := updateEmployeeInfo(recivedEmployee, updatingEmployee)
-	if err := api.DB.UpdateEmployee(employee); err != nil {
+
+	// A workload change is stored as a version in force from effective_from
+	// (default today) on; the employee keeps the workload in force today
+	workloadChanged := employee.Workload != updatingEmployee.Workload
+	var effectiveFrom time.Time
+	if workloadChanged {
+		loc := api.employeeLocation(employee)
+		if effectiveFrom, err = api.effectiveDate(c.QueryParam("effective_from"), loc); err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if err := api.saveWorkRule(schemas.WorkRule{
+			CompanyCNPJ:   employee.CompanyCNPJ,
+			EmployeeEmail: employee.Email,
+			Kind:          ruleWorkload,
+			Value:         employee.Workload,
+			EffectiveFrom: effectiveFrom,
+		}, updatingEmployee.Workload); err != nil {
+			return c.String(http.StatusInternalServerError, "Failed to save workload")
+		}
+		employee.Workload = api.workloadOn(employee, localDate(api.Clock.Now(), loc))
+	}
+
+	if err := api.Repos.Employees.Update(&employee); err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to save employee")
 	}
 
+	if workloadChanged {
+		requestedBy := currentEmployee(c).Email
+		api.audit("employee", employee.ID, "jornada", requestedBy, fmt.Sprintf(
+			"Jornada semanal %.1fh → %.1fh a partir de %s", updatingEmployee.Workload, recivedEmployee.Workload, effectiveFrom.Format("2006-01-02")))
+		if _, err := api.enqueueRecalculation(schemas.RecalculationTask{
+			CompanyCNPJ:   employee.CompanyCNPJ,
+			EmployeeEmail: employee.Email,
+			FromDate:      effectiveFrom,
+			Reason:        "Alteração de jornada",
+			RequestedBy:   requestedBy,
+		}); err != nil {
+			log.Error().Err(err).Str("employee", employee.Email).Msg("[api] Erro ao agendar recálculo")
+		}
+	}
+
 	return c.JSON(http.StatusOK, employee)
 }
 
@@ -228,12 +255,14 @@ func updateEmployeeInfo(recivedEmployee, employee schemas.Employee) schemas.Empl
 // deleteEmployee godoc
 //
 //	@Summary		Excluir funcionário
-//	@Description	Remove um funcionário do sistema
+//	@Description	Remove um funcionário do sistema. Exige a sessão de um administrador
 //	@Tags			employees
 //	@Accept			json
 //	@Produce		json
 //	@Param			id	path		int	true	"ID do funcionário"
 //	@Success		200	{object}	schemas.Employee
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
 //	@Failure		404	{string}	string	"Funcionário não encontrado"
 //	@Failure		500	{string}	string	"Erro interno do servidor"
 //	@Router			/employee/{id} [delete]
@@ -242,14 +271,14 @@ func (api *API) deleteEmployee(c echo.Context) error {
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to get employee ID")
 	}
-	employee, err := api.DB.GetEmployee(id)
-	if errors.Is(err, gorm.ErrRecordNotFound) {
+	employee, err := api.Repos.Employees.Get(uint(id))
+	if errors.Is(err, db.ErrNotFound) {
 		return c.String(http.StatusNotFound, "Employee not found")
 	}
 	if err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to get employee")
 	}
-	if err := api.DB.DeleteEmployee(employee); err != nil {
+	if err := api.Repos.Employees.Delete(&employee); err != nil {
 		return c.String(http.StatusInternalServerError, "Failed to delete employee")
 	}
 	return c.JSON(http.StatusOK, employee)
@@ -263,9 +292,11 @@ func (api *API) deleteEmployee(c echo.Context) error {
 //	@Accept			json
 //	@Produce		json
 //	@Param			body	body		LoginRequest	true	"Credenciais de login"
-//	@Success		200		{object}	LoginResponse
+//	@Success		200		{object}	LoginResponse	"Ou TwoFactorChallengeResponse quando o 2FA está ativo"
 //	@Failure		400		{string}	string	"Dados inválidos"
 //	@Failure		401		{string}	string	"Email ou senha inválidos"
+//	@Failure		403		{object}	map[string]interface{}	"A empresa exige 2FA e ele não está ativo"
+//	@Failure		429		{object}	map[string]string	"Conta ou IP bloqueado por tentativas falhas, ver Retry-After"
 //	@Failure		500		{string}	string	"Erro interno do servidor"
 //	@Router			/login [post]
 func (api *API) login(c echo.Context) error {
@@ -278,37 +309,72 @@ func (api *API) login(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid request")
 	}
 
-	var login schemas.Login
-	if err := api.DB.DB.Where("email = ?", loginReq.Email).First(&login).Error; err != nil {
+	ip, userAgent := c.RealIP(), c.Request().UserAgent()
+	login, err := api.authenticate(loginReq.Email, loginReq.Password, ip, userAgent)
+	if errors.Is(err, ErrWrongPassword) {
 		return c.String(http.StatusUnauthorized, "Invalid email or password")
 	}
-
-	if !CheckPasswordHash(loginReq.Password, login.Password) {
-		return c.String(http.StatusUnauthorized, "Invalid email or password")
+	if err != nil {
+		return loginRefused(c, err)
 	}
 
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", loginReq.Email).First(&employee).Error; err != nil {
+	employee, err := api.Repos.Employees.GetByEmail(loginReq.Email)
+	if err != nil {
 		return c.String(http.StatusInternalServerError, "Error retrieving employee details")
 	}
 
-	return c.JSON(http.StatusOK, map[string]interface{}{
-		"message":        "Login successful",
-		"employee_id":    employee.ID,
-		"employee_email": employee.Email,
-		"employee_name":  employee.Name,
-		"role": func() string {
-			switch {
-			case employee.IsAdmin:
-				return "admin"
-			case employee.IsManager:
-				return "manager"
-			default:
-				return "employee"
-			}
-		}(),
-	})
+	// Com 2FA ativo a senha só abre a segunda etapa, concluída em /login/2fa
+	if login.TOTPEnabled {
+		challenge, err := api.newLoginChallenge(&login)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "Error starting two-factor login")
+		}
+		return c.JSON(http.StatusOK, TwoFactorChallengeResponse{TwoFactorRequired: true, Challenge: challenge})
+	}
+	if api.twoFactorEnforced(employee) {
+		api.recordLoginAttempt(loginReq.Email, ip, userAgent, false, attemptTwoFactorMissing)
+		return c.JSON(http.StatusForbidden, map[string]interface{}{
+			"error":                     ErrTwoFactorEnforced.Error() + ", ative-a antes de entrar",
+			"two_factor_setup_required": true,
+		})
+	}
+
+	api.loginSucceeded(&login)
+	api.recordLoginAttempt(loginReq.Email, ip, userAgent, true, "")
+	response, err := api.loginResponse(employee)
+	if err != nil {
+		return c.String(http.StatusInternalServerError, "Error starting session")
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// logout godoc
+//
+//	@Summary		Sair
+//	@Description	Encerra a sessão do token enviado no cabeçalho Authorization
+//	@Tags			auth
+//	@Produce		json
+//	@Param			Authorization	header		string	true	"Bearer <token>"
+//	@Success		200				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/logout [post]
+func (api *API) logout(c echo.Context) error {
+	if err := api.EndSession(bearerToken(c)); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao encerrar sessão")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao encerrar sessão"})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Sessão encerrada"})
+}
 
+// loginRefused answers 429 with Retry-After to a login blocked by LockoutError.
+func loginRefused(c echo.Context, err error) error {
+	var lockout LockoutError
+	if !errors.As(err, &lockout) {
+		log.Error().Err(err).Msg("[api] Erro ao verificar tentativas de login")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao verificar tentativas de login"})
+	}
+	c.Response().Header().Set("Retry-After", strconv.Itoa(lockout.retryAfterSeconds()))
+	return c.JSON(http.StatusTooManyRequests, map[string]string{"error": lockout.Error()})
 }
 
 type LoginRequest struct {
@@ -322,67 +388,136 @@ type LoginResponse struct {
 	EmployeeEmail string `json:"employee_email"`
 	EmployeeName  string `json:"employee_name"`
 	Role          string `json:"role"`
+	// Token opens the session; it goes in the "Authorization: Bearer" header
+	// of the manager and admin routes until ExpiresAt
+	Token     string    `json:"token"`
+	ExpiresAt time.Time `json:"expires_at"`
 }
 
 type PasswordRequest struct {
-	Email    string `json:"email"`
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+	Password        string `json:"password"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email"`
+}
+
+type ResetPasswordRequest struct {
+	Token    string `json:"token"`
 	Password string `json:"password"`
 }
 
-// createOrUpdatePassword godoc
+// changePassword godoc
 //
-//	@Summary		Criar ou atualizar senha
-//	@Description	Cria ou atualiza a senha de um funcionário
+//	@Summary		Alterar senha
+//	@Description	Altera a senha do próprio funcionário, que deve informar a senha atual. As demais sessões do funcionário são encerradas; a da requisição, se houver, é mantida
 //	@Tags			auth
 //	@Accept			json
 //	@Produce		json
-//	@Param			body	body		PasswordRequest	true	"Dados para criação/atualização de senha"
+//	@Param			Authorization	header		string			false	"Bearer <token> da sessão a manter"
+//	@Param			body	body		PasswordRequest	true	"Email, senha atual e nova senha"
 //	@Success		200		{object}	map[string]string
 //	@Failure		400		{object}	map[string]string
-//	@Failure		404		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		429		{object}	map[string]string	"Conta ou IP bloqueado por tentativas falhas, ver Retry-After"
 //	@Failure		500		{object}	map[string]string
 //	@Router			/login/password [post]
-func (api *API) createOrUpdatePassword(c echo.Context) error {
+func (api *API) changePassword(c echo.Context) error {
 	var req PasswordRequest
 	if err := c.Bind(&req); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Invalid request payload"})
 	}
 
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", req.Email).First(&employee).Error; err != nil {
-		return c.JSON(http.StatusNotFound, map[string]string{"error": "Employee not found"})
+	err := api.ChangePassword(req.Email, req.CurrentPassword, req.Password, bearerToken(c), c.RealIP(), c.Request().UserAgent())
+	if errors.Is(err, ErrWrongPassword) {
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	if errors.As(err, &LockoutError{}) {
+		return loginRefused(c, err)
 	}
-
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to hash password"})
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
 	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated successfully"})
+}
 
-	var login schemas.Login
-	if err := api.DB.DB.Where("email = ?", req.Email).First(&login).Error; err == nil {
-		login.Password = string(hashedPassword)
-		if err := api.DB.DB.Save(&login).Error; err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to update password"})
-		}
-	} else {
-		newLogin := schemas.Login{
-			Email:    req.Email,
-			Password: string(hashedPassword),
-		}
-		if err := api.DB.DB.Create(&newLogin).Error; err != nil {
-			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Failed to create login"})
-		}
+// forgotPassword godoc
+//
+//	@Summary		Esqueci minha senha
+//	@Description	Envia por e-mail um link de uso único para redefinir a senha. A resposta é a mesma para e-mails não cadastrados
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		ForgotPasswordRequest	true	"Email da conta"
+//	@Success		202		{object}	map[string]string
+//	@Failure		400		{object}	map[string]string
+//	@Router			/login/password/forgot [post]
+func (api *API) forgotPassword(c echo.Context) error {
+	var req ForgotPasswordRequest
+	if err := c.Bind(&req); err != nil || req.Email == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email é obrigatório"})
 	}
 
-	return c.JSON(http.StatusOK, map[string]string{"message": "Password updated successfully"})
+	if err := api.RequestPasswordReset(req.Email); err != nil {
+		log.Error().Err(err).Str("email", req.Email).Msg("[api] Erro ao enviar redefinição de senha")
+	}
+	return c.JSON(http.StatusAccepted, map[string]string{"message": "Se o e-mail estiver cadastrado, você receberá um link para redefinir a senha"})
+}
+
+// resetPassword godoc
+//
+//	@Summary		Redefinir senha
+//	@Description	Define uma nova senha usando o token recebido por e-mail
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		ResetPasswordRequest	true	"Token e nova senha"
+//	@Success		200		{object}	map[string]string
+//	@Failure		400		{object}	map[string]string
+//	@Router			/login/password/reset [post]
+func (api *API) resetPassword(c echo.Context) error {
+	var req ResetPasswordRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	if err := api.ResetPassword(req.Token, req.Password); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Senha redefinida com sucesso"})
 }
 
 type CompanyRequest struct {
-	Name   string `json:"name" validate:"required"`
-	CNPJ   string `json:"cnpj" validate:"required"`
-	Email  string `json:"email" validate:"required,email"`
-	Fone   string `json:"fone" validate:"required"`
-	Active bool   `json:"active"`
+	Name     string `json:"name" validate:"required"`
+	CNPJ     string `json:"cnpj" validate:"required"`
+	Email    string `json:"email" validate:"required,email"`
+	Fone     string `json:"fone" validate:"required"`
+	Active   bool   `json:"active"`
+	Timezone string `json:"timezone"`
+
+	// Alteração de regras: a nova tolerância vale a partir de EffectiveFrom
+	// (YYYY-MM-DD, padrão hoje) e os registros desde então são recalculados
+	ToleranceMinutes *int   `json:"tolerance_minutes"`
+	EffectiveFrom    string `json:"effective_from"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+
+	// Exige 2FA de gerentes e administradores da empresa
+	RequireTwoFactor *bool `json:"require_two_factor"`
+
+	// Login único OpenID Connect; um issuer vazio o desativa
+	SSOIssuer       *string `json:"sso_issuer"`
+	SSOClientID     *string `json:"sso_client_id"`
+	SSOClientSecret *string `json:"sso_client_secret"`
+	SSOEmailClaim   *string `json:"sso_email_claim"`
+
+	// Exige o QR code de um local de trabalho no registro de ponto pela web
+	RequireQRCode *bool `json:"require_qr_code"`
+
+	// aceitar, sinalizar ou rejeitar marcações fora das cercas virtuais
+	GeofencePolicy *string `json:"geofence_policy"`
 }
 
 // createCompany godoc
@@ -408,20 +543,26 @@ func (api *API) createCompany(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Nome e CNPJ são obrigatórios"})
 	}
 
-	var existing schemas.Company
-	if err := api.DB.DB.Where("cnpj = ?", req.CNPJ).First(&existing).Error; err == nil {
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CNPJ); err == nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empresa já cadastrada"})
 	}
 
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Fuso horário inválido"})
+		}
+	}
+
 	company := schemas.Company{
-		Name:   req.Name,
-		CNPJ:   req.CNPJ,
-		Email:  req.Email,
-		Fone:   req.Fone,
-		Active: req.Active,
+		Name:     req.Name,
+		CNPJ:     req.CNPJ,
+		Email:    req.Email,
+		Fone:     req.Fone,
+		Active:   req.Active,
+		Timezone: req.Timezone,
 	}
 
-	if err := api.DB.DB.Create(&company).Error; err != nil {
+	if err := api.Repos.Companies.Create(&company); err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar empresa"})
 	}
 
@@ -439,13 +580,138 @@ func (api *API) createCompany(c echo.Context) error {
 //	@Failure		500	{object}	map[string]string
 //	@Router			/admin/companies [get]
 func (api *API) listCompanies(c echo.Context) error {
-	var companies []schemas.Company
-	if err := api.DB.DB.Preload("Employees").Find(&companies).Error; err != nil {
+	companies, err := api.Repos.Companies.List(true)
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar empresas"})
 	}
 	return c.JSON(http.StatusOK, companies)
 }
 
+// updateCompany godoc
+//
+//	@Summary		Atualizar empresa
+//	@Description	Atualiza dados cadastrais e o fuso horário da empresa
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			cnpj	path		string			true	"CNPJ da empresa"
+//	@Param			body	body		CompanyRequest	true	"Dados da empresa"
+//	@Success		200		{object}	schemas.Company
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/companies/{cnpj} [put]
+func (api *API) updateCompany(c echo.Context) error {
+	company, err := api.Repos.Companies.GetByCNPJ(c.Param("cnpj"))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Empresa não encontrada"})
+	}
+
+	var req CompanyRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	if req.Timezone != "" {
+		if _, err := time.LoadLocation(req.Timezone); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Fuso horário inválido"})
+		}
+		company.Timezone = req.Timezone
+	}
+	if req.Name != "" {
+		company.Name = req.Name
+	}
+	if req.Email != "" {
+		company.Email = req.Email
+	}
+	if req.Fone != "" {
+		company.Fone = req.Fone
+	}
+
+	if req.RequireTwoFactor != nil && *req.RequireTwoFactor != company.RequireTwoFactor {
+		company.RequireTwoFactor = *req.RequireTwoFactor
+		api.audit("company", company.ID, "exigir_2fa", req.RequestedBy, fmt.Sprintf("Exigir 2FA: %t", company.RequireTwoFactor))
+	}
+
+	if req.RequireQRCode != nil && *req.RequireQRCode != company.RequireQRCode {
+		company.RequireQRCode = *req.RequireQRCode
+		api.audit("company", company.ID, "exigir_qr_code", req.RequestedBy, fmt.Sprintf("Exigir QR code: %t", company.RequireQRCode))
+	}
+
+	if req.GeofencePolicy != nil && *req.GeofencePolicy != company.GeofencePolicy {
+		if !validGeofencePolicy(*req.GeofencePolicy) {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Política de cerca virtual inválida, use aceitar, sinalizar ou rejeitar"})
+		}
+		api.audit("company", company.ID, "politica_cerca", req.RequestedBy, fmt.Sprintf("Cercas virtuais: %q → %q", company.GeofencePolicy, *req.GeofencePolicy))
+		company.GeofencePolicy = *req.GeofencePolicy
+	}
+
+	if req.SSOIssuer != nil || req.SSOClientID != nil || req.SSOClientSecret != nil || req.SSOEmailClaim != nil {
+		for target, value := range map[*string]*string{
+			&company.SSOIssuer:       req.SSOIssuer,
+			&company.SSOClientID:     req.SSOClientID,
+			&company.SSOClientSecret: req.SSOClientSecret,
+			&company.SSOEmailClaim:   req.SSOEmailClaim,
+		} {
+			if value != nil {
+				*target = strings.TrimSpace(*value)
+			}
+		}
+		if company.SSOIssuer != "" {
+			if u, err := url.Parse(company.SSOIssuer); err != nil || u.Scheme == "" || u.Host == "" {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Issuer do login único inválido"})
+			}
+			if company.SSOClientID == "" {
+				return c.JSON(http.StatusBadRequest, map[string]string{"error": "Client ID do login único é obrigatório"})
+			}
+		}
+		api.audit("company", company.ID, "configurar_sso", req.RequestedBy, "Login único: "+company.SSOIssuer)
+	}
+
+	// A tolerance change is stored as a version in force from effective_from
+	// (default today) on; the company keeps the tolerance in force today
+	toleranceChanged := req.ToleranceMinutes != nil && *req.ToleranceMinutes != company.ToleranceMinutes
+	previousTolerance := company.ToleranceMinutes
+	var effectiveFrom time.Time
+	if toleranceChanged {
+		if *req.ToleranceMinutes < 0 {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": "Tolerância inválida"})
+		}
+		loc := loadLocation(company.Timezone)
+		if effectiveFrom, err = api.effectiveDate(req.EffectiveFrom, loc); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+		if err := api.saveWorkRule(schemas.WorkRule{
+			CompanyCNPJ:   company.CNPJ,
+			Kind:          ruleTolerance,
+			Value:         float32(*req.ToleranceMinutes),
+			EffectiveFrom: effectiveFrom,
+		}, float32(previousTolerance)); err != nil {
+			return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar tolerância"})
+		}
+		company.ToleranceMinutes = api.toleranceOn(company, localDate(api.Clock.Now(), loc))
+	}
+
+	if err := api.Repos.Companies.Update(&company); err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao atualizar empresa"})
+	}
+
+	if toleranceChanged {
+		api.audit("company", company.ID, "tolerancia", req.RequestedBy, fmt.Sprintf(
+			"Tolerância %d → %d minutos a partir de %s", previousTolerance, *req.ToleranceMinutes, effectiveFrom.Format("2006-01-02")))
+		if _, err := api.enqueueRecalculation(schemas.RecalculationTask{
+			CompanyCNPJ: company.CNPJ,
+			FromDate:    effectiveFrom,
+			Reason:      "Alteração da tolerância da empresa",
+			RequestedBy: req.RequestedBy,
+		}); err != nil {
+			log.Error().Err(err).Str("company", company.CNPJ).Msg("[api] Erro ao agendar recálculo")
+		}
+	}
+	return c.JSON(http.StatusOK, company)
+}
+
 // createManager godoc
 //
 //	@Summary		Criar gerente
@@ -468,8 +734,7 @@ func (api *API) createManager(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Erro de validação: " + err.Error()})
 	}
 
-	var company schemas.Company
-	if err := api.DB.DB.Where("cnpj = ?", req.CompanyCNPJ).First(&company).Error; err != nil {
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ); err != nil {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Empresa com este CNPJ não existe"})
 	}
 
@@ -491,22 +756,22 @@ func (api *API) createManager(c echo.Context) error {
 		CompanyCNPJ: req.CompanyCNPJ,
 	}
 
-	tx := api.DB.DB.Begin()
-	if err := tx.Create(&manager).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao cadastrar gerente"})
-	}
-
-	login := schemas.Login{
-		Email:    req.Email,
-		Password: hashedPassword,
-	}
-	if err := tx.Create(&login).Error; err != nil {
-		tx.Rollback()
-		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar login do gerente"})
+	err = api.Repos.Transaction(func(repos db.Repositories) error {
+		if err := repos.Employees.Create(&manager); err != nil {
+			return errors.New("Erro ao cadastrar gerente")
+		}
+		login := schemas.Login{
+			Email:    req.Email,
+			Password: hashedPassword,
+		}
+		if err := repos.Logins.Create(&login); err != nil {
+			return errors.New("Erro ao salvar login do gerente")
+		}
+		return nil
+	})
+	if err != nil {
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": err.Error()})
 	}
-
-	tx.Commit()
 	return c.JSON(http.StatusCreated, manager)
 }
 
@@ -521,8 +786,9 @@ func (api *API) createManager(c echo.Context) error {
 //	@Failure		500	{object}	map[string]string
 //	@Router			/admin/managers [get]
 func (api *API) listManagers(c echo.Context) error {
-	var managers []schemas.Employee
-	if err := api.DB.DB.Where("is_manager = ?", true).Find(&managers).Error; err != nil {
+	isManager := true
+	managers, err := api.Repos.Employees.List(db.EmployeeFilter{IsManager: &isManager})
+	if err != nil {
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar gerentes"})
 	}
 	return c.JSON(http.StatusOK, managers)
@@ -0,0 +1,96 @@
+package api
+
+import (
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// managedDepartmentIDs returns the IDs of the departments managed by the given
+// manager together with every department nested below them.
+func (api *API) managedDepartmentIDs(manager schemas.Employee) ([]uint, error) {
+	departments, err := api.Repos.Departments.ListByCompany(manager.CompanyCNPJ)
+	if err != nil {
+		return nil, err
+	}
+
+	children := map[uint][]uint{}
+	var queue []uint
+	for _, d := range departments {
+		if d.ParentID != nil {
+			children[*d.ParentID] = append(children[*d.ParentID], d.ID)
+		}
+		if d.ManagerEmail == manager.Email {
+			queue = append(queue, d.ID)
+		}
+	}
+
+	visited := map[uint]bool{}
+	var ids []uint
+	for len(queue) > 0 {
+		id := queue[0]
+		queue = queue[1:]
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		ids = append(ids, id)
+		queue = append(queue, children[id]...)
+	}
+
+	return ids, nil
+}
+
+// managedEmployeeEmails returns the emails of the employees the manager is
+// responsible for: everyone in their departments and sub-departments. A
+// manager not assigned to any department has no one to manage.
+func (api *API) managedEmployeeEmails(manager schemas.Employee) ([]string, error) {
+	departmentIDs, err := api.managedDepartmentIDs(manager)
+	if err != nil {
+		return nil, err
+	}
+	emails := []string{}
+	if len(departmentIDs) == 0 {
+		log.Warn().
+			Str("managerEmail", manager.Email).
+			Msg("[api] Gerente sem departamento atribuído, sem funcionários sob sua gestão")
+		return emails, nil
+	}
+
+	employees, err := api.Repos.Employees.List(db.EmployeeFilter{CompanyCNPJ: manager.CompanyCNPJ, DepartmentIDs: departmentIDs})
+	if err != nil {
+		return nil, err
+	}
+	for _, employee := range employees {
+		emails = append(emails, employee.Email)
+	}
+	return emails, nil
+}
+
+// canManage reports whether the employee is within the manager's hierarchy.
+func (api *API) canManage(manager, employee schemas.Employee) (bool, error) {
+	if manager.CompanyCNPJ != employee.CompanyCNPJ {
+		return false, nil
+	}
+
+	emails, err := api.managedEmployeeEmails(manager)
+	if err != nil {
+		return false, err
+	}
+	for _, email := range emails {
+		if email == employee.Email {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// findManager looks up a manager by email; employees that are not managers are
+// reported as db.ErrNotFound.
+func (api *API) findManager(email string) (schemas.Employee, error) {
+	manager, err := api.Repos.Employees.GetByEmail(email)
+	if err == nil && !manager.IsManager {
+		return schemas.Employee{}, db.ErrNotFound
+	}
+	return manager, err
+}
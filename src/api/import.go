@@ -0,0 +1,164 @@
+package api
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// Columns of the employee import file. The header row names them in any order;
+// workload and active are optional (default workload and true).
+var (
+	importRequiredColumns = []string{"name", "email", "cpf", "rg", "age", "company_cnpj", "password"}
+	importOptionalColumns = []string{"workload", "active"}
+)
+
+// ImportError is a line of the import file that was not imported.
+type ImportError struct {
+	Line  int    `json:"line"`
+	Email string `json:"email"`
+	Error string `json:"error"`
+}
+
+// ImportResult summarizes an employee import.
+type ImportResult struct {
+	Created int           `json:"created"`
+	Errors  []ImportError `json:"errors"`
+}
+
+// ImportEmployees creates the employees, and their logins, listed in a CSV
+// file with a header row. Invalid lines are reported and skipped; the others
+// are imported.
+func (api *API) ImportEmployees(r io.Reader) (ImportResult, error) {
+	result := ImportResult{Errors: []ImportError{}}
+
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	header, err := reader.Read()
+	if err != nil {
+		return result, fmt.Errorf("cabeçalho do arquivo inválido: %w", err)
+	}
+
+	columns := map[string]int{}
+	for i, name := range header {
+		columns[strings.ToLower(strings.TrimSpace(name))] = i
+	}
+	for _, name := range importRequiredColumns {
+		if _, ok := columns[name]; !ok {
+			return result, fmt.Errorf("coluna obrigatória ausente: %s", name)
+		}
+	}
+
+	companies := map[string]bool{}
+	for line := 2; ; line++ {
+		record, err := reader.Read()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			result.Errors = append(result.Errors, ImportError{Line: line, Error: err.Error()})
+			continue
+		}
+
+		field := func(name string) string {
+			if i, ok := columns[name]; ok && i < len(record) {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		fail := func(err error) {
+			result.Errors = append(result.Errors, ImportError{Line: line, Email: field("email"), Error: err.Error()})
+		}
+
+		req, err := api.importRequest(field)
+		if err != nil {
+			fail(err)
+			continue
+		}
+
+		if _, ok := companies[req.CompanyCNPJ]; !ok {
+			_, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ)
+			companies[req.CompanyCNPJ] = err == nil
+		}
+		if !companies[req.CompanyCNPJ] {
+			fail(fmt.Errorf("Empresa com este CNPJ não encontrada"))
+			continue
+		}
+
+		if err := api.importEmployee(req); err != nil {
+			fail(err)
+			continue
+		}
+		result.Created++
+	}
+	return result, nil
+}
+
+// importRequest reads and validates a line of the import file.
+func (api *API) importRequest(field func(string) string) (EmployeeRequest, error) {
+	req := EmployeeRequest{
+		Name:        field("name"),
+		Email:       field("email"),
+		CPF:         field("cpf"),
+		RG:          field("rg"),
+		Password:    field("password"),
+		CompanyCNPJ: field("company_cnpj"),
+		Workload:    api.Config.Work.DefaultWorkload,
+	}
+
+	var err error
+	if req.Age, err = strconv.Atoi(field("age")); err != nil {
+		return req, errParamRequired("age", "int")
+	}
+	if v := field("workload"); v != "" {
+		workload, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return req, fmt.Errorf("jornada inválida: %s", v)
+		}
+		req.Workload = float32(workload)
+	}
+	active := true
+	if v := field("active"); v != "" {
+		if active, err = strconv.ParseBool(v); err != nil {
+			return req, fmt.Errorf("valor de active inválido: %s", v)
+		}
+	}
+	req.Active = &active
+
+	return req, req.Validate()
+}
+
+// importEmployee creates the employee and its login, or neither.
+func (api *API) importEmployee(req EmployeeRequest) error {
+	if _, err := api.Repos.Employees.GetByEmail(req.Email); err == nil {
+		return fmt.Errorf("Email já cadastrado")
+	}
+
+	hashedPassword, err := HashPassword(req.Password)
+	if err != nil {
+		return fmt.Errorf("Erro ao processar senha")
+	}
+
+	return api.Repos.Transaction(func(repos db.Repositories) error {
+		employee := schemas.Employee{
+			Name:        req.Name,
+			Email:       req.Email,
+			CPF:         req.CPF,
+			RG:          req.RG,
+			Age:         req.Age,
+			Active:      *req.Active,
+			Workload:    req.Workload,
+			CompanyCNPJ: req.CompanyCNPJ,
+		}
+		if err := repos.Employees.Create(&employee); err != nil {
+			return err
+		}
+		return repos.Logins.Create(&schemas.Login{Email: employee.Email, Password: hashedPassword})
+	})
+}
@@ -0,0 +1,70 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/scheduler"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// listJobs godoc
+//
+//	@Summary		Listar tarefas agendadas
+//	@Description	Retorna as tarefas periódicas com agenda, próxima execução e última execução
+//	@Tags			admin
+//	@Produce		json
+//	@Success		200	{array}	scheduler.JobInfo
+//	@Router			/admin/jobs [get]
+func (api *API) listJobs(c echo.Context) error {
+	return c.JSON(http.StatusOK, api.Scheduler.Jobs())
+}
+
+// listJobRuns godoc
+//
+//	@Summary		Histórico de execuções
+//	@Description	Retorna as execuções mais recentes de uma tarefa
+//	@Tags			admin
+//	@Produce		json
+//	@Param			name	path		string	true	"Nome da tarefa"
+//	@Param			limit	query		int		false	"Quantidade máxima (padrão 50)"
+//	@Success		200		{array}		schemas.JobRun
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/jobs/{name}/runs [get]
+func (api *API) listJobRuns(c echo.Context) error {
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	runs, err := api.Scheduler.Runs(c.Param("name"), limit)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar execuções da tarefa")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar execuções"})
+	}
+	return c.JSON(http.StatusOK, runs)
+}
+
+// triggerJob godoc
+//
+//	@Summary		Executar tarefa
+//	@Description	Dispara manualmente uma tarefa, que roda em segundo plano
+//	@Tags			admin
+//	@Produce		json
+//	@Param			name	path		string	true	"Nome da tarefa"
+//	@Success		202		{object}	schemas.JobRun
+//	@Failure		404		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Router			/admin/jobs/{name}/run [post]
+func (api *API) triggerJob(c echo.Context) error {
+	run, err := api.Scheduler.Trigger(c.Param("name"))
+	if errors.Is(err, scheduler.ErrUnknownJob) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusAccepted, run)
+}
@@ -0,0 +1,457 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// kioskKeyHeader carries the device key of a kiosk.
+const kioskKeyHeader = "X-Device-Key"
+
+var (
+	ErrKioskUnauthorized    = errors.New("Terminal não autorizado")
+	ErrKioskIdentification  = errors.New("Informe o PIN, o crachá ou a matrícula")
+	ErrKioskUnknownEmployee = errors.New("Funcionário não encontrado ou PIN incorreto")
+	ErrInvalidKioskPIN      = errors.New("O PIN deve ter de 4 a 8 dígitos")
+	ErrKioskCredentialInUse = errors.New("em uso por outro funcionário da empresa")
+)
+
+// KioskDeviceRequest registers or changes a kiosk device.
+type KioskDeviceRequest struct {
+	Name        string `json:"name"`
+	CompanyCNPJ string `json:"company_cnpj"`
+	Active      *bool  `json:"active"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+}
+
+// KioskDeviceKey is returned when a device is registered or its key rotated.
+// The key is shown only this once.
+type KioskDeviceKey struct {
+	Device schemas.KioskDevice `json:"device"`
+	Key    string              `json:"key"`
+}
+
+// KioskCredentials sets how the employee is identified at the kiosks. Nil
+// fields are kept and empty ones removed.
+type KioskCredentials struct {
+	Matricula   *string `json:"matricula"`
+	BadgeNumber *string `json:"badge_number"`
+	PIN         *string `json:"pin"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+}
+
+// KioskPunchRequest identifies the employee punching at a kiosk by the PIN
+// alone, or by the badge or the matricula together with the PIN when the
+// employee has one.
+type KioskPunchRequest struct {
+	PIN       string `json:"pin"`
+	Badge     string `json:"badge"`
+	Matricula string `json:"matricula"`
+	// PunchType is the punch the employee chose, empty for the next one
+	PunchType string `json:"punch_type"`
+}
+
+// KioskReceipt is shown on the kiosk screen after a punch.
+type KioskReceipt struct {
+	EmployeeName  string          `json:"employee_name"`
+	EmployeeEmail string          `json:"employee_email"`
+	Matricula     string          `json:"matricula"`
+	Punch         string          `json:"punch"`
+	At            time.Time       `json:"at"`
+	LocalTime     string          `json:"local_time"` // dd/mm/aaaa hh:mm no fuso do funcionário
+	Device        string          `json:"device"`
+	TimeLog       schemas.TimeLog `json:"time_log"`
+	// Skipped names the earlier punches of the day still missing
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// legacyKioskPINHash is how PINs were stored before they were hashed with
+// bcrypt. Such PINs are still accepted and rehashed on the next punch.
+func legacyKioskPINHash(cnpj, pin string) string {
+	return hashResetToken(cnpj + ":" + pin)
+}
+
+// kioskPINMatches checks the PIN of the employee. Employees without a PIN
+// punch with the badge or matricula alone.
+func (api *API) kioskPINMatches(employee *schemas.Employee, pin string) bool {
+	switch {
+	case employee.KioskPINHash == "":
+		return pin == ""
+	case CheckPasswordHash(pin, employee.KioskPINHash):
+		return true
+	case employee.KioskPINHash != legacyKioskPINHash(employee.CompanyCNPJ, pin):
+		return false
+	}
+	if hash, err := HashPassword(pin); err == nil {
+		employee.KioskPINHash = hash
+		if err := api.Repos.Employees.Update(employee); err != nil {
+			log.Error().Err(err).Str("employee", employee.Email).Msg("[api] Erro ao atualizar o PIN do quiosque")
+		}
+	}
+	return true
+}
+
+// Reasons recorded on failed kiosk identifications, which are login attempts
+// whose IP is the kioskDeviceID.
+const (
+	attemptKioskWrongPIN = "pin_incorreto"
+	attemptKioskUnknown  = "quiosque_nao_identificado"
+	attemptKioskLocked   = "quiosque_bloqueado"
+)
+
+// checkKioskLocked applies the login limits to the kiosk identifications: a
+// device with IPMaxFailedAttempts failures in LockoutDuration is blocked like
+// an IP, and an employee with MaxFailedAttempts wrong PINs at the device since
+// their last punch there waits until LockoutDuration has passed since the
+// oldest of them. The attempts refused meanwhile count too.
+func (api *API) checkKioskLocked(deviceID, email string) error {
+	if err := api.checkIP(deviceID); err != nil || email == "" {
+		return err
+	}
+	window, limit := api.Config.Auth.LockoutDuration, api.Config.Auth.MaxFailedAttempts
+	now := api.Clock.Now().UTC()
+
+	since := now.Add(-window)
+	succeeded, failed := true, false
+	last, err := api.Repos.LoginAttempts.List(db.LoginAttemptFilter{Email: email, IP: deviceID, Success: &succeeded, Since: since, Limit: 1})
+	if err != nil {
+		return err
+	}
+	if len(last) > 0 {
+		since = last[0].CreatedAt
+	}
+	failures, err := api.Repos.LoginAttempts.List(db.LoginAttemptFilter{Email: email, IP: deviceID, Success: &failed, Since: since, Limit: limit})
+	if err != nil {
+		return err
+	}
+	if len(failures) < limit {
+		return nil
+	}
+	if wait := failures[len(failures)-1].CreatedAt.Add(window).Sub(now); wait > 0 {
+		return LockoutError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// identifyKioskEmployee finds the active employee of the kiosk's company by
+// the badge or the matricula, confirmed by the PIN, or by the PIN alone.
+// Every attempt is recorded for checkKioskLocked.
+func (api *API) identifyKioskEmployee(device schemas.KioskDevice, req KioskPunchRequest, details PunchDetails) (schemas.Employee, error) {
+	deviceID := kioskDeviceID(device)
+	active := true
+	filter := db.EmployeeFilter{CompanyCNPJ: device.CompanyCNPJ, Active: &active}
+	given := 0
+	if badge := strings.TrimSpace(req.Badge); badge != "" {
+		filter.BadgeNumber = badge
+		given++
+	}
+	if matricula := strings.TrimSpace(req.Matricula); matricula != "" {
+		filter.Matricula = matricula
+		given++
+	}
+	pin := strings.TrimSpace(req.PIN)
+	if given > 1 || (given == 0 && pin == "") {
+		return schemas.Employee{}, ErrKioskIdentification
+	}
+
+	refuse := func(email, reason string) (schemas.Employee, error) {
+		api.recordLoginAttempt(email, deviceID, details.UserAgent, false, reason)
+		return schemas.Employee{}, ErrKioskUnknownEmployee
+	}
+	if err := api.checkKioskLocked(deviceID, ""); err != nil {
+		api.recordLoginAttempt("", deviceID, details.UserAgent, false, attemptKioskLocked)
+		return schemas.Employee{}, err
+	}
+
+	var employee schemas.Employee
+	if given == 0 {
+		found, err := api.kioskEmployeeByPIN(filter, pin)
+		if errors.Is(err, db.ErrNotFound) {
+			return refuse("", attemptKioskUnknown)
+		}
+		if err != nil {
+			return found, err
+		}
+		employee = found
+	} else {
+		employees, err := api.Repos.Employees.List(filter)
+		if err != nil {
+			return schemas.Employee{}, err
+		}
+		if len(employees) != 1 {
+			return refuse("", attemptKioskUnknown)
+		}
+		employee = employees[0]
+	}
+
+	if err := api.checkKioskLocked(deviceID, employee.Email); err != nil {
+		api.recordLoginAttempt(employee.Email, deviceID, details.UserAgent, false, attemptKioskLocked)
+		return schemas.Employee{}, err
+	}
+	if given > 0 && !api.kioskPINMatches(&employee, pin) {
+		return refuse(employee.Email, attemptKioskWrongPIN)
+	}
+	api.recordLoginAttempt(employee.Email, deviceID, details.UserAgent, true, "")
+	return employee, nil
+}
+
+// kioskEmployeeByPIN finds the employee of the filter whose PIN is pin. PINs
+// are hashed with bcrypt, so it checks the PIN of every employee that has
+// one; a PIN shared by colleagues, set before PINs had to be unique,
+// identifies nobody.
+func (api *API) kioskEmployeeByPIN(filter db.EmployeeFilter, pin string) (schemas.Employee, error) {
+	employees, err := api.Repos.Employees.List(filter)
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	var found []schemas.Employee
+	for i := range employees {
+		if employees[i].KioskPINHash != "" && api.kioskPINMatches(&employees[i], pin) {
+			found = append(found, employees[i])
+		}
+	}
+	if len(found) != 1 {
+		return schemas.Employee{}, db.ErrNotFound
+	}
+	return found[0], nil
+}
+
+// kioskDeviceID identifies the kiosk in the punch history.
+func kioskDeviceID(device schemas.KioskDevice) string {
+	return fmt.Sprintf("quiosque-%d", device.ID)
+}
+
+func validKioskPIN(pin string) bool {
+	if len(pin) < 4 || len(pin) > 8 {
+		return false
+	}
+	for _, r := range pin {
+		if r < '0' || r > '9' {
+			return false
+		}
+	}
+	return true
+}
+
+func newKioskKey() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// RegisterKioskDevice adds an active kiosk to the company and returns its key.
+func (api *API) RegisterKioskDevice(req KioskDeviceRequest) (KioskDeviceKey, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return KioskDeviceKey{}, errParamRequired("name", "string")
+	}
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ); err != nil {
+		return KioskDeviceKey{}, fmt.Errorf("Empresa com este CNPJ não existe")
+	}
+	key, err := newKioskKey()
+	if err != nil {
+		return KioskDeviceKey{}, err
+	}
+
+	device := schemas.KioskDevice{
+		Name:        strings.TrimSpace(req.Name),
+		CompanyCNPJ: req.CompanyCNPJ,
+		KeyHash:     hashResetToken(key),
+		Active:      true,
+	}
+	if err := api.Repos.KioskDevices.Create(&device); err != nil {
+		return KioskDeviceKey{}, err
+	}
+	api.audit("kiosk_device", device.ID, "registrar_quiosque", req.RequestedBy, "Terminal "+device.Name)
+	return KioskDeviceKey{Device: device, Key: key}, nil
+}
+
+// ListKioskDevices returns the kiosks of the company, or of every company when
+// cnpj is empty.
+func (api *API) ListKioskDevices(cnpj string) ([]schemas.KioskDevice, error) {
+	return api.Repos.KioskDevices.List(cnpj)
+}
+
+// UpdateKioskDevice renames, deactivates or reactivates a kiosk. An inactive
+// kiosk no longer accepts punches.
+func (api *API) UpdateKioskDevice(id uint, req KioskDeviceRequest) (schemas.KioskDevice, error) {
+	device, err := api.Repos.KioskDevices.Get(id)
+	if err != nil {
+		return device, err
+	}
+	var changes []string
+	if name := strings.TrimSpace(req.Name); name != "" && name != device.Name {
+		changes = append(changes, fmt.Sprintf("Nome %s → %s", device.Name, name))
+		device.Name = name
+	}
+	if req.Active != nil && *req.Active != device.Active {
+		changes = append(changes, fmt.Sprintf("Ativo %t → %t", device.Active, *req.Active))
+		device.Active = *req.Active
+	}
+	if len(changes) == 0 {
+		return device, nil
+	}
+	if err := api.Repos.KioskDevices.Update(&device); err != nil {
+		return device, err
+	}
+	api.audit("kiosk_device", device.ID, "alterar_quiosque", req.RequestedBy, strings.Join(changes, "; "))
+	return device, nil
+}
+
+// RotateKioskKey replaces the key of the kiosk; the old key stops working.
+func (api *API) RotateKioskKey(id uint, requestedBy string) (KioskDeviceKey, error) {
+	device, err := api.Repos.KioskDevices.Get(id)
+	if err != nil {
+		return KioskDeviceKey{}, err
+	}
+	key, err := newKioskKey()
+	if err != nil {
+		return KioskDeviceKey{}, err
+	}
+	device.KeyHash = hashResetToken(key)
+	if err := api.Repos.KioskDevices.Update(&device); err != nil {
+		return KioskDeviceKey{}, err
+	}
+	api.audit("kiosk_device", device.ID, "trocar_chave_quiosque", requestedBy, "Terminal "+device.Name)
+	return KioskDeviceKey{Device: device, Key: key}, nil
+}
+
+// AuthenticateKiosk returns the active kiosk with the key and records that it
+// was seen.
+func (api *API) AuthenticateKiosk(key string) (schemas.KioskDevice, error) {
+	if key == "" {
+		return schemas.KioskDevice{}, ErrKioskUnauthorized
+	}
+	device, err := api.Repos.KioskDevices.GetByKeyHash(hashResetToken(key))
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !device.Active) {
+		return schemas.KioskDevice{}, ErrKioskUnauthorized
+	}
+	if err != nil {
+		return device, err
+	}
+	device.LastSeenAt = api.Clock.Now().UTC()
+	if err := api.Repos.KioskDevices.Update(&device); err != nil {
+		return device, err
+	}
+	return device, nil
+}
+
+// SetKioskCredentials changes the matricula, badge number and PIN of the
+// employee. Each of them identifies the employee at the kiosk and must be
+// unique within the company; the PIN also confirms the other two and is
+// stored with bcrypt, like the password.
+func (api *API) SetKioskCredentials(id uint, req KioskCredentials) (schemas.Employee, error) {
+	employee, err := api.Repos.Employees.Get(id)
+	if err != nil {
+		return employee, err
+	}
+
+	// unique fails when another employee of the company already has the value
+	unique := func(field string, filter db.EmployeeFilter) error {
+		filter.CompanyCNPJ = employee.CompanyCNPJ
+		others, err := api.Repos.Employees.List(filter)
+		if err != nil {
+			return err
+		}
+		for _, other := range others {
+			if other.ID != employee.ID {
+				return fmt.Errorf("%s %w", field, ErrKioskCredentialInUse)
+			}
+		}
+		return nil
+	}
+
+	var changes []string
+	if req.Matricula != nil {
+		matricula := strings.TrimSpace(*req.Matricula)
+		if matricula != "" {
+			if err := unique("Matrícula", db.EmployeeFilter{Matricula: matricula}); err != nil {
+				return employee, err
+			}
+		}
+		employee.Matricula = matricula
+		changes = append(changes, "matrícula")
+	}
+	if req.BadgeNumber != nil {
+		badge := strings.TrimSpace(*req.BadgeNumber)
+		if badge != "" {
+			if err := unique("Crachá", db.EmployeeFilter{BadgeNumber: badge}); err != nil {
+				return employee, err
+			}
+		}
+		employee.BadgeNumber = badge
+		changes = append(changes, "crachá")
+	}
+	if req.PIN != nil {
+		var pinHash string
+		if *req.PIN != "" {
+			if !validKioskPIN(*req.PIN) {
+				return employee, ErrInvalidKioskPIN
+			}
+			active := true
+			owner, err := api.kioskEmployeeByPIN(db.EmployeeFilter{CompanyCNPJ: employee.CompanyCNPJ, Active: &active}, *req.PIN)
+			if err == nil && owner.ID != employee.ID {
+				return employee, fmt.Errorf("PIN %w", ErrKioskCredentialInUse)
+			}
+			if err != nil && !errors.Is(err, db.ErrNotFound) {
+				return employee, err
+			}
+			hash, err := HashPassword(*req.PIN)
+			if err != nil {
+				return employee, err
+			}
+			pinHash = hash
+		}
+		employee.KioskPINHash = pinHash
+		changes = append(changes, "PIN")
+	}
+	if len(changes) == 0 {
+		return employee, nil
+	}
+
+	if err := api.Repos.Employees.Update(&employee); err != nil {
+		return employee, err
+	}
+	api.audit("employee", employee.ID, "credenciais_quiosque", req.RequestedBy, "Alterado: "+strings.Join(changes, ", "))
+	return employee, nil
+}
+
+// KioskPunch identifies the active employee of the kiosk's company, under the
+// same attempt limits as the login, and registers the punch exactly like the
+// web punch. The punch history identifies the kiosk as the device, whatever
+// the request says.
+func (api *API) KioskPunch(device schemas.KioskDevice, req KioskPunchRequest, details PunchDetails) (KioskReceipt, error) {
+	employee, err := api.identifyKioskEmployee(device, req, details)
+	if err != nil {
+		return KioskReceipt{}, err
+	}
+
+	details.Source = sourceKiosk
+	details.DeviceID = kioskDeviceID(device)
+	result, err := api.Punch(employee.Email, req.PunchType, details)
+	if err != nil {
+		return KioskReceipt{}, err
+	}
+	return KioskReceipt{
+		EmployeeName:  employee.Name,
+		EmployeeEmail: employee.Email,
+		Matricula:     employee.Matricula,
+		Punch:         result.Punch,
+		At:            result.At,
+		LocalTime:     result.At.In(api.employeeLocation(employee)).Format("02/01/2006 15:04"),
+		Device:        device.Name,
+		TimeLog:       result.TimeLog,
+		Skipped:       result.Skipped,
+	}, nil
+}
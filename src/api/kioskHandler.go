@@ -0,0 +1,248 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// KioskDeviceResponse is what a kiosk learns about itself when it starts.
+type KioskDeviceResponse struct {
+	ID          uint   `json:"id"`
+	Name        string `json:"name"`
+	CompanyCNPJ string `json:"company_cnpj"`
+	CompanyName string `json:"company_name"`
+}
+
+// createKioskDevice godoc
+//
+//	@Summary		Cadastrar terminal de ponto
+//	@Description	Cadastra um quiosque (terminal compartilhado) da empresa. A chave do terminal é exibida apenas nesta resposta
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		KioskDeviceRequest	true	"Nome e empresa do terminal"
+//	@Success		201		{object}	KioskDeviceKey
+//	@Failure		400		{object}	map[string]string
+//	@Router			/admin/kiosk_devices [post]
+func (api *API) createKioskDevice(c echo.Context) error {
+	var req KioskDeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+	created, err := api.RegisterKioskDevice(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, created)
+}
+
+// listKioskDevices godoc
+//
+//	@Summary		Terminais de ponto
+//	@Description	Lista os quiosques cadastrados, com a última vez em que cada um foi usado
+//	@Tags			admin
+//	@Produce		json
+//	@Param			company_cnpj	query		string	false	"CNPJ da empresa"
+//	@Success		200				{array}		schemas.KioskDevice
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/kiosk_devices [get]
+func (api *API) listKioskDevices(c echo.Context) error {
+	devices, err := api.ListKioskDevices(c.QueryParam("company_cnpj"))
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar terminais")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar terminais"})
+	}
+	return c.JSON(http.StatusOK, devices)
+}
+
+// updateKioskDevice godoc
+//
+//	@Summary		Alterar terminal de ponto
+//	@Description	Renomeia, desativa ou reativa um quiosque. Terminais inativos não aceitam registros
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"ID do terminal"
+//	@Param			body	body		KioskDeviceRequest	true	"Nome e situação"
+//	@Success		200		{object}	schemas.KioskDevice
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/kiosk_devices/{id} [put]
+func (api *API) updateKioskDevice(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	var req KioskDeviceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	device, err := api.UpdateKioskDevice(uint(id), req)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Terminal não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao alterar terminal")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao alterar terminal"})
+	}
+	return c.JSON(http.StatusOK, device)
+}
+
+// rotateKioskKey godoc
+//
+//	@Summary		Trocar chave do terminal
+//	@Description	Gera uma nova chave para o quiosque; a anterior deixa de funcionar
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id				path		int		true	"ID do terminal"
+//	@Success		200				{object}	KioskDeviceKey
+//	@Failure		400				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/kiosk_devices/{id}/rotate_key [post]
+func (api *API) rotateKioskKey(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	rotated, err := api.RotateKioskKey(uint(id), currentEmployee(c).Email)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Terminal não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao trocar chave do terminal")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao trocar chave do terminal"})
+	}
+	return c.JSON(http.StatusOK, rotated)
+}
+
+// setKioskCredentials godoc
+//
+//	@Summary		Identificação no quiosque
+//	@Description	Define a matrícula, o número do crachá e o PIN (4 a 8 dígitos) com que o funcionário registra o ponto nos quiosques, únicos na empresa. O PIN também confirma o crachá e a matrícula. Campos omitidos são mantidos e vazios são removidos
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"ID do funcionário"
+//	@Param			body	body		KioskCredentials	true	"Matrícula, crachá e PIN"
+//	@Success		200		{object}	schemas.Employee
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/employees/{id}/kiosk [put]
+func (api *API) setKioskCredentials(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	var req KioskCredentials
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	employee, err := api.SetKioskCredentials(uint(id), req)
+	switch {
+	case errors.Is(err, db.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Funcionário não encontrado"})
+	case errors.Is(err, ErrInvalidKioskPIN):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrKioskCredentialInUse):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case err != nil:
+		log.Error().Err(err).Msg("[api] Erro ao alterar identificação no quiosque")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao alterar identificação no quiosque"})
+	}
+	return c.JSON(http.StatusOK, employee)
+}
+
+// kioskRefused answers a request whose X-Device-Key header did not
+// authenticate a kiosk.
+func kioskRefused(c echo.Context, err error) error {
+	if errors.Is(err, ErrKioskUnauthorized) {
+		log.Warn().Str("ip", c.RealIP()).Msg("[api] Chave de terminal inválida")
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	}
+	log.Error().Err(err).Msg("[api] Erro ao autenticar terminal")
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao autenticar terminal"})
+}
+
+// getKioskDevice godoc
+//
+//	@Summary		Terminal atual
+//	@Description	Identifica o quiosque pela chave no cabeçalho X-Device-Key
+//	@Tags			kiosk
+//	@Produce		json
+//	@Param			X-Device-Key	header		string	true	"Chave do terminal"
+//	@Success		200				{object}	KioskDeviceResponse
+//	@Failure		401				{object}	map[string]string
+//	@Router			/kiosk/device [get]
+func (api *API) getKioskDevice(c echo.Context) error {
+	device, err := api.AuthenticateKiosk(c.Request().Header.Get(kioskKeyHeader))
+	if err != nil {
+		return kioskRefused(c, err)
+	}
+	response := KioskDeviceResponse{ID: device.ID, Name: device.Name, CompanyCNPJ: device.CompanyCNPJ}
+	if company, err := api.Repos.Companies.GetByCNPJ(device.CompanyCNPJ); err == nil {
+		response.CompanyName = company.Name
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// kioskPunch godoc
+//
+//	@Summary		Registrar ponto no quiosque
+//	@Description	Registra o próximo ponto do funcionário identificado pelo PIN, ou pelo crachá ou pela matrícula com o PIN quando cadastrado, ou o tipo escolhido em punch_type, como em PUT /time_logs/{id}, e devolve o comprovante. Tentativas falhas bloqueiam o funcionário no terminal, e o terminal, como no login
+//	@Tags			kiosk
+//	@Accept			json
+//	@Produce		json
+//	@Param			X-Device-Key	header		string				true	"Chave do terminal"
+//	@Param			body			body		KioskPunchRequest	true	"PIN, ou crachá ou matrícula e PIN"
+//	@Success		200				{object}	KioskReceipt
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Failure		429				{object}	map[string]string	"Funcionário ou terminal bloqueado por tentativas falhas, ver Retry-After"
+//	@Failure		500				{object}	map[string]string
+//	@Router			/kiosk/punch [post]
+func (api *API) kioskPunch(c echo.Context) error {
+	device, err := api.AuthenticateKiosk(c.Request().Header.Get(kioskKeyHeader))
+	if err != nil {
+		return kioskRefused(c, err)
+	}
+	var req KioskPunchRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	receipt, err := api.KioskPunch(device, req, punchRequestDetails(c, sourceKiosk))
+	switch {
+	case errors.Is(err, ErrKioskIdentification), errors.Is(err, ErrInvalidPunchType),
+		errors.Is(err, ErrPunchRegistered), errors.Is(err, ErrPunchOutOfOrder):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrKioskUnknownEmployee):
+		log.Warn().Str("device", device.Name).Msg("[api] Identificação não reconhecida no quiosque")
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrDayComplete):
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Todos os pontos de hoje já foram registrados"})
+	case errors.As(err, &LockoutError{}):
+		log.Warn().Str("device", device.Name).Msg("[api] Identificação bloqueada no quiosque por tentativas falhas")
+		return loginRefused(c, err)
+	case err != nil:
+		log.Error().Err(err).Str("device", device.Name).Msg("[api] Erro ao registrar ponto no quiosque")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao registrar ponto"})
+	}
+	log.Info().Str("device", device.Name).Str("employee", receipt.EmployeeEmail).Str("punch", receipt.Punch).Msg("[api] Ponto registrado no quiosque")
+	return c.JSON(http.StatusOK, receipt)
+}
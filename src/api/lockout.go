@@ -0,0 +1,160 @@
+package api
+
+import (
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// Reasons recorded on failed login attempts.
+const (
+	attemptUnknownEmail  = "email_desconhecido"
+	attemptWrongPassword = "senha_incorreta"
+	attemptWrongCode     = "codigo_incorreto"
+	attemptAccountLocked = "conta_bloqueada"
+	attemptIPBlocked     = "ip_bloqueado"
+	attemptBadChallenge  = "desafio_invalido"
+	// The password was right, but the company requires 2FA not set up yet
+	attemptTwoFactorMissing = "2fa_nao_cadastrado"
+)
+
+// LockoutError refuses a login until RetryAfter has passed, either because of
+// the previous failures of the account or of the client IP.
+type LockoutError struct {
+	RetryAfter time.Duration
+}
+
+func (e LockoutError) Error() string {
+	return fmt.Sprintf("Muitas tentativas de login, tente novamente em %s", e.RetryAfter.Round(time.Second))
+}
+
+// retryAfterSeconds is the Retry-After header value, rounding up.
+func (e LockoutError) retryAfterSeconds() int {
+	return int(math.Ceil(e.RetryAfter.Seconds()))
+}
+
+// recordLoginAttempt stores an attempt for the admins and the per-IP limit.
+func (api *API) recordLoginAttempt(email, ip, userAgent string, success bool, reason string) {
+	if len(userAgent) > 512 {
+		userAgent = userAgent[:512]
+	}
+	attempt := schemas.LoginAttempt{Email: email, IP: ip, UserAgent: userAgent, Success: success, Reason: reason}
+	attempt.CreatedAt = api.Clock.Now().UTC()
+	if err := api.Repos.LoginAttempts.Create(&attempt); err != nil {
+		log.Error().Err(err).Str("email", email).Msg("[api] Erro ao registrar tentativa de login")
+	}
+}
+
+// checkIP refuses logins from an IP with too many recent failures. The block
+// lasts until the oldest of those failures leaves the counting window; the
+// attempts refused meanwhile count too, so a client that keeps trying stays
+// blocked.
+func (api *API) checkIP(ip string) error {
+	window, limit := api.Config.Auth.LockoutDuration, api.Config.Auth.IPMaxFailedAttempts
+	now := api.Clock.Now().UTC()
+
+	failed := false
+	failures, err := api.Repos.LoginAttempts.List(db.LoginAttemptFilter{IP: ip, Success: &failed, Since: now.Add(-window), Limit: limit})
+	if err != nil {
+		return err
+	}
+	if len(failures) < limit {
+		return nil
+	}
+	if wait := failures[len(failures)-1].CreatedAt.Add(window).Sub(now); wait > 0 {
+		return LockoutError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// checkLocked refuses logins to an account still waiting after failures.
+func (api *API) checkLocked(login schemas.Login) error {
+	if wait := login.LockedUntil.Sub(api.Clock.Now().UTC()); wait > 0 {
+		return LockoutError{RetryAfter: wait}
+	}
+	return nil
+}
+
+// loginFailed counts a wrong password or code. Each failure delays the next
+// attempt by FailureDelay, doubled every time, until MaxFailedAttempts locks
+// the account for LockoutDuration. The count restarts after a lockout.
+func (api *API) loginFailed(login *schemas.Login) {
+	auth := api.Config.Auth
+	if login.FailedAttempts >= auth.MaxFailedAttempts {
+		login.FailedAttempts = 0
+	}
+	login.FailedAttempts++
+
+	wait := auth.LockoutDuration
+	if login.FailedAttempts < auth.MaxFailedAttempts {
+		wait = min(auth.FailureDelay<<(login.FailedAttempts-1), auth.LockoutDuration)
+	} else {
+		log.Warn().Str("email", login.Email).Msg("[api] Conta bloqueada por excesso de tentativas de login")
+	}
+	login.LockedUntil = api.Clock.Now().UTC().Add(wait)
+
+	if err := api.Repos.Logins.Update(login); err != nil {
+		log.Error().Err(err).Str("email", login.Email).Msg("[api] Erro ao registrar falha de login")
+	}
+}
+
+// authenticate checks the password of the login under the same limits as the
+// login: blocked IPs and accounts get a LockoutError and wrong passwords count
+// as failed attempts. It is used by everything that takes the password, so
+// none of them can be used to guess it. A success is left for the caller to
+// record, as a second factor may still be missing.
+func (api *API) authenticate(email, password, ip, userAgent string) (schemas.Login, error) {
+	if err := api.checkIP(ip); err != nil {
+		api.recordLoginAttempt(email, ip, userAgent, false, attemptIPBlocked)
+		return schemas.Login{}, err
+	}
+	login, err := api.Repos.Logins.GetByEmail(email)
+	if err != nil {
+		api.recordLoginAttempt(email, ip, userAgent, false, attemptUnknownEmail)
+		return login, ErrWrongPassword
+	}
+	if err := api.checkLocked(login); err != nil {
+		api.recordLoginAttempt(email, ip, userAgent, false, attemptAccountLocked)
+		return login, err
+	}
+	if !CheckPasswordHash(password, login.Password) {
+		api.loginFailed(&login)
+		api.recordLoginAttempt(email, ip, userAgent, false, attemptWrongPassword)
+		return login, ErrWrongPassword
+	}
+	return login, nil
+}
+
+// loginSucceeded clears the failures of the account.
+func (api *API) loginSucceeded(login *schemas.Login) {
+	if login.FailedAttempts == 0 && login.LockedUntil.IsZero() {
+		return
+	}
+	login.FailedAttempts, login.LockedUntil = 0, time.Time{}
+	if err := api.Repos.Logins.Update(login); err != nil {
+		log.Error().Err(err).Str("email", login.Email).Msg("[api] Erro ao limpar falhas de login")
+	}
+}
+
+// UnlockLogin lifts the lockout of the employee's account.
+func (api *API) UnlockLogin(employeeID uint, requestedBy string) error {
+	employee, err := api.Repos.Employees.Get(employeeID)
+	if err != nil {
+		return err
+	}
+	login, err := api.Repos.Logins.GetByEmail(employee.Email)
+	if err != nil {
+		return err
+	}
+
+	login.FailedAttempts, login.LockedUntil = 0, time.Time{}
+	if err := api.Repos.Logins.Update(&login); err != nil {
+		return err
+	}
+	api.audit("login", login.ID, "desbloquear", requestedBy, "Login de "+login.Email+" desbloqueado")
+	return nil
+}
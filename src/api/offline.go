@@ -0,0 +1,314 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// maxOfflineBatch limits how many punches a single synchronization carries.
+const maxOfflineBatch = 100
+
+// Status of each punch of a synchronization.
+const (
+	offlineRegistered = "registrada"
+	offlineDuplicate  = "duplicada"
+	offlineRejected   = "rejeitada"
+)
+
+var (
+	ErrOfflineBatch         = fmt.Errorf("Envie de 1 a %d marcações por sincronização", maxOfflineBatch)
+	ErrOfflineSentAt        = errors.New("Informe o horário de envio (sent_at) no relógio do dispositivo")
+	ErrClockSkew            = errors.New("O relógio do dispositivo está fora do limite de diferença para o servidor; acerte a data e a hora e sincronize novamente")
+	ErrIdempotencyKey       = errors.New("Chave de idempotência obrigatória, com até 100 caracteres")
+	ErrOfflinePunchTooOld   = errors.New("Marcação antiga demais para ser sincronizada, solicite o ajuste ao gerente")
+	ErrOfflinePunchInFuture = errors.New("Horário da marcação posterior ao envio")
+	ErrEmployeeInactive     = errors.New("Funcionário inativo não pode registrar pontos")
+)
+
+// OfflinePunch is a punch captured without connection.
+type OfflinePunch struct {
+	IdempotencyKey string `json:"idempotency_key"`
+	// DeviceTime is when the punch was made, on the device clock
+	DeviceTime time.Time      `json:"device_time"`
+	Location   *PunchLocation `json:"location,omitempty"`
+	QRCode     string         `json:"qr_code,omitempty"`
+}
+
+// OfflineSyncRequest carries the punches a device captured offline.
+type OfflineSyncRequest struct {
+	// EmployeeEmail is taken from the session; when sent it must match it
+	EmployeeEmail string `json:"employee_email"`
+	// SentAt is the device clock when the batch was sent; its difference to
+	// the server clock when the batch was received corrects the time of
+	// every punch
+	SentAt  time.Time      `json:"sent_at"`
+	Punches []OfflinePunch `json:"punches"`
+	// ReceivedAt is when the server received the batch, the server clock
+	// when unset
+	ReceivedAt time.Time `json:"-"`
+}
+
+// OfflinePunchResult is the outcome of one punch of the synchronization.
+// Duplicates are punches already received; they return the punch recorded
+// the first time.
+type OfflinePunchResult struct {
+	IdempotencyKey string     `json:"idempotency_key"`
+	Status         string     `json:"status"` // registrada, duplicada ou rejeitada
+	Punch          string     `json:"punch,omitempty"`
+	At             *time.Time `json:"at,omitempty"`
+	TimeLogID      uint       `json:"time_log_id,omitempty"`
+	Error          string     `json:"error,omitempty"`
+}
+
+// OfflineSyncResult answers a synchronization, with the results in the order
+// the punches were sent.
+type OfflineSyncResult struct {
+	ClockSkewSeconds float64              `json:"clock_skew_seconds"`
+	Results          []OfflinePunchResult `json:"results"`
+}
+
+// SyncOfflinePunches registers the punches an employee's device captured
+// offline. The employee must be active. The difference between the device
+// clock at SentAt and the server clock at ReceivedAt must be within the
+// configured skew and corrects every punch time; punches older than the
+// configured age are refused. Punches are inserted in chronological order into the log of their day, which may already have
+// punches, and flagged as offline. Each punch is checked on its own, so a
+// refused punch does not stop the others, and a key already received returns
+// the original punch.
+func (api *API) SyncOfflinePunches(req OfflineSyncRequest, details PunchDetails) (OfflineSyncResult, error) {
+	if len(req.Punches) == 0 || len(req.Punches) > maxOfflineBatch {
+		return OfflineSyncResult{}, ErrOfflineBatch
+	}
+	if req.SentAt.IsZero() {
+		return OfflineSyncResult{}, ErrOfflineSentAt
+	}
+	employee, err := api.Repos.Employees.GetByEmail(req.EmployeeEmail)
+	if err != nil {
+		return OfflineSyncResult{}, err
+	}
+	if !employee.Active {
+		return OfflineSyncResult{}, ErrEmployeeInactive
+	}
+
+	now := req.ReceivedAt.UTC()
+	if req.ReceivedAt.IsZero() {
+		now = api.Clock.Now().UTC()
+	}
+	skew := now.Sub(req.SentAt)
+	if skew.Abs() > api.Config.Work.OfflineMaxClockSkew {
+		return OfflineSyncResult{}, ErrClockSkew
+	}
+
+	results := make([]OfflinePunchResult, len(req.Punches))
+	order := make([]int, len(req.Punches))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool {
+		return req.Punches[order[a]].DeviceTime.Before(req.Punches[order[b]].DeviceTime)
+	})
+
+	for _, i := range order {
+		punch := req.Punches[i]
+		result, err := api.syncOfflinePunch(employee, punch, punch.DeviceTime.Add(skew).UTC(), now, details)
+		result.IdempotencyKey = punch.IdempotencyKey
+		if err != nil {
+			var refused *offlineRefusal
+			if !errors.As(err, &refused) {
+				return OfflineSyncResult{}, err
+			}
+			result.Status, result.Error = offlineRejected, refused.Error()
+		}
+		results[i] = result
+	}
+	return OfflineSyncResult{ClockSkewSeconds: skew.Seconds(), Results: results}, nil
+}
+
+// offlineRefusal is a punch of the synchronization that was refused, as
+// opposed to a failure of the whole synchronization.
+type offlineRefusal struct{ err error }
+
+func (r *offlineRefusal) Error() string { return r.err.Error() }
+func (r *offlineRefusal) Unwrap() error { return r.err }
+
+func (api *API) syncOfflinePunch(employee schemas.Employee, punch OfflinePunch, at, now time.Time, details PunchDetails) (OfflinePunchResult, error) {
+	key := strings.TrimSpace(punch.IdempotencyKey)
+	if key == "" || len(key) > 100 {
+		return OfflinePunchResult{}, &offlineRefusal{ErrIdempotencyKey}
+	}
+	previous, found, err := api.punchByKey(employee.Email, key)
+	if err != nil {
+		return OfflinePunchResult{}, err
+	}
+	if found {
+		return offlineResult(offlineDuplicate, previous.Punch, previous.At, previous.TimeLog.ID), nil
+	}
+
+	switch {
+	case punch.DeviceTime.IsZero(), at.After(now):
+		return OfflinePunchResult{}, &offlineRefusal{ErrOfflinePunchInFuture}
+	case now.Sub(at) > api.Config.Work.OfflineMaxAge:
+		return OfflinePunchResult{}, &offlineRefusal{ErrOfflinePunchTooOld}
+	}
+	if punch.Location != nil && !punch.Location.valid() {
+		return OfflinePunchResult{}, &offlineRefusal{ErrInvalidLocation}
+	}
+
+	// the QR code is checked at the time of the punch, as it rotates
+	workplaceID, err := api.punchWorkplace(employee.Email, punch.QRCode, at)
+	if err != nil {
+		return OfflinePunchResult{}, refusal(err, ErrQRCodeRequired, ErrQRCodeInvalid, ErrQRCodeExpired)
+	}
+	geofence, err := api.geofenceStatus(employee.Email, punch.Location)
+	if err != nil {
+		return OfflinePunchResult{}, refusal(err, ErrLocationRequired, ErrLocationVague, ErrOutsideGeofence)
+	}
+
+	deviceTime := punch.DeviceTime.UTC()
+	details.WorkplaceID, details.Location, details.GeofenceStatus = workplaceID, punch.Location, geofence
+	details.IdempotencyKey, details.Offline, details.DeviceTime = key, true, &deviceTime
+	result, err := api.insertPunch(employee, at, details)
+	if errors.Is(err, db.ErrDuplicate) && result.Created {
+		// another request created the log of the day first: insert into it
+		result, err = api.insertPunch(employee, at, details)
+	}
+	if errors.Is(err, db.ErrDuplicate) {
+		result, err = api.punchRegisteredMeanwhile(employee.Email, key, err)
+	}
+	if err != nil {
+		return OfflinePunchResult{}, refusal(err, ErrDayComplete)
+	}
+	if result.Repeated {
+		return offlineResult(offlineDuplicate, result.Punch, result.At, result.TimeLog.ID), nil
+	}
+	return offlineResult(offlineRegistered, result.Punch, result.At, result.TimeLog.ID), nil
+}
+
+// refusal turns the expected errors into a refusal of the punch.
+func refusal(err error, expected ...error) error {
+	for _, target := range expected {
+		if errors.Is(err, target) {
+			return &offlineRefusal{err}
+		}
+	}
+	return err
+}
+
+func offlineResult(status, punch string, at time.Time, timeLogID uint) OfflinePunchResult {
+	return OfflinePunchResult{Status: status, Punch: punch, At: &at, TimeLogID: timeLogID}
+}
+
+// insertPunch adds a punch made at the given time to the log of its day. The
+// times of the day are kept in chronological order, so a punch earlier than
+// those already registered moves them to the following fields, and their
+// punch history with them. A day closed
+// as absent or incomplete is reopened as incomplete, or calculated when the
+// punch completes it. A punch less than the minimum interval away from one of
+// the day is taken as a retry of it, like online punches.
+func (api *API) insertPunch(employee schemas.Employee, at time.Time, details PunchDetails) (PunchResult, error) {
+	date := localDate(at, api.employeeLocation(employee))
+	result := PunchResult{At: at}
+	var timeLog schemas.TimeLog
+	err := api.Repos.Transaction(func(repos db.Repositories) error {
+		var err error
+		timeLog, err = repos.TimeLogs.LockByDate(employee.Email, date)
+		if errors.Is(err, db.ErrNotFound) {
+			timeLog, err = schemas.TimeLog{EmployeeEmail: employee.Email, LogDate: date}, nil
+			result.Created = true
+		}
+		if err != nil {
+			return fmt.Errorf("retrieve time log: %w", err)
+		}
+
+		fields := punchFields(&timeLog)
+		for i, field := range fields {
+			gap := at.Sub(*field)
+			if gap < 0 {
+				gap = -gap
+			}
+			if !field.IsZero() && gap < api.Config.Work.MinPunchInterval {
+				result.Punch, result.At, result.Repeated = punchOrder[i], *field, true
+				return nil
+			}
+		}
+		before := timeLog
+		times := []time.Time{at}
+		for _, field := range fields {
+			if !field.IsZero() {
+				times = append(times, *field)
+			}
+		}
+		if len(times) > len(fields) {
+			return ErrDayComplete
+		}
+		sort.SliceStable(times, func(i, j int) bool { return times[i].Before(times[j]) })
+		for i, field := range fields {
+			*field = time.Time{}
+			if i < len(times) {
+				*field = times[i]
+				if times[i].Equal(at) && result.Punch == "" {
+					result.Punch = punchOrder[i]
+				}
+			}
+		}
+
+		switch {
+		case len(times) == len(fields):
+			api.applyHours(&timeLog, employee)
+		case timeLog.Status != "":
+			timeLog.Status = dayIncomplete
+			timeLog.ExtraHours, timeLog.MissingHours, timeLog.Balance = 0, 0, 0
+		}
+
+		if result.Created {
+			err = repos.TimeLogs.Create(&timeLog)
+		} else {
+			err = repos.TimeLogs.Update(&timeLog)
+		}
+		if err != nil {
+			return fmt.Errorf("save time log: %w", err)
+		}
+		if err := relabelMoved(repos, before, timeLog); err != nil {
+			return err
+		}
+		return recordPunch(repos, timeLog, result, details)
+	})
+	result.TimeLog = timeLog
+	return result, err
+}
+
+// relabelMoved updates the history of the punches that a punch inserted
+// earlier in the day moved to the following fields of the log, so the
+// history keeps naming the same punches as the log.
+func relabelMoved(repos db.Repositories, before, after schemas.TimeLog) error {
+	if before.ID == 0 {
+		return nil
+	}
+	records, err := repos.Punches.List(db.PunchFilter{TimeLogID: before.ID})
+	if err != nil {
+		return fmt.Errorf("retrieve punch history: %w", err)
+	}
+	old, moved := punchFields(&before), punchFields(&after)
+	for _, record := range records {
+		from := slices.Index(punchOrder, record.Punch)
+		if from < 0 || !record.PunchedAt.Equal(*old[from]) || moved[from].Equal(record.PunchedAt) {
+			continue
+		}
+		for to, field := range moved {
+			if field.Equal(record.PunchedAt) {
+				if err := repos.Punches.Relabel(record.ID, punchOrder[to]); err != nil {
+					return fmt.Errorf("relabel punch: %w", err)
+				}
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// syncOfflinePunches godoc
+//
+//	@Summary		Sincronizar pontos offline
+//	@Description	Registra as marcações feitas sem conexão pelo funcionário da sessão, com o horário do dispositivo e uma chave de idempotência por marcação. A diferença entre o horário de envio e o recebimento pelo servidor corrige o relógio do dispositivo; cada marcação é registrada, reconhecida como duplicada ou rejeitada com o motivo
+//	@Tags			timeLogs
+//	@Accept			json
+//	@Produce		json
+//	@Param			Authorization	header		string				true	"Bearer <token> da sessão do funcionário"
+//	@Param			X-Punch-Source	header		string				false	"web (padrão) ou mobile"
+//	@Param			X-Device-ID		header		string				false	"Identificador do dispositivo"
+//	@Param			body			body		OfflineSyncRequest	true	"Marcações capturadas offline"
+//	@Success		200				{object}	OfflineSyncResult
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string	"Sessão inválida ou expirada"
+//	@Failure		403				{object}	map[string]string	"Marcações de outro funcionário ou funcionário inativo"
+//	@Failure		404				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/time_logs/sync [post]
+func (api *API) syncOfflinePunches(c echo.Context) error {
+	receivedAt := api.Clock.Now().UTC()
+	var req OfflineSyncRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	employee := currentEmployee(c)
+	if req.EmployeeEmail != "" && req.EmployeeEmail != employee.Email {
+		log.Warn().Str("session", employee.Email).Str("employee", req.EmployeeEmail).Msg("[api] Sincronização offline de outro funcionário recusada")
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Sincronize apenas as suas próprias marcações"})
+	}
+	req.EmployeeEmail, req.ReceivedAt = employee.Email, receivedAt
+	source, err := webPunchSource(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	result, err := api.SyncOfflinePunches(req, punchRequestDetails(c, source))
+	switch {
+	case errors.Is(err, ErrOfflineBatch), errors.Is(err, ErrOfflineSentAt), errors.Is(err, ErrClockSkew):
+		log.Warn().Err(err).Str("employee", req.EmployeeEmail).Msg("[api] Sincronização offline recusada")
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrEmployeeInactive):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	case errors.Is(err, db.ErrNotFound):
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Funcionário não encontrado"})
+	case err != nil:
+		log.Error().Err(err).Str("employee", req.EmployeeEmail).Msg("[api] Erro ao sincronizar pontos offline")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao sincronizar pontos"})
+	}
+	log.Info().Str("employee", req.EmployeeEmail).Int("punches", len(req.Punches)).Float64("skew", result.ClockSkewSeconds).Msg("[api] Pontos offline sincronizados")
+	return c.JSON(http.StatusOK, result)
+}
@@ -0,0 +1,155 @@
+package api
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/mail"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+var (
+	// ErrInvalidResetToken covers unknown, used and expired reset tokens alike.
+	ErrInvalidResetToken = errors.New("Link de redefinição inválido ou expirado")
+	// ErrWrongPassword is returned when the current password does not match.
+	ErrWrongPassword = errors.New("Senha atual incorreta")
+)
+
+// hashResetToken is how reset tokens are stored, so a leaked table does not
+// give working links.
+func hashResetToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// RequestPasswordReset e-mails a single use reset link to the employee. Unknown
+// or inactive e-mails are silently ignored, so callers cannot tell which
+// accounts exist. Links sent before stop working.
+func (api *API) RequestPasswordReset(email string) error {
+	employee, err := api.Repos.Employees.GetByEmail(email)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && !employee.Active) {
+		log.Info().Str("email", email).Msg("[api] Redefinição de senha solicitada para conta inexistente ou inativa")
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := api.Clock.Now().UTC()
+
+	if err := api.Repos.PasswordResets.Revoke(employee.Email, now); err != nil {
+		return err
+	}
+	if err := api.Repos.PasswordResets.Create(&schemas.PasswordResetToken{
+		Email:     employee.Email,
+		TokenHash: hashResetToken(token),
+		ExpiresAt: now.Add(api.Config.Auth.PasswordResetTTL),
+	}); err != nil {
+		return err
+	}
+
+	link, err := url.Parse(api.Config.Auth.PasswordResetURL)
+	if err != nil {
+		return err
+	}
+	query := link.Query()
+	query.Set("token", token)
+	link.RawQuery = query.Encode()
+
+	return api.Mailer.Send(mail.Message{
+		To:      employee.Email,
+		Subject: "Redefinição de senha - Marca Tempo",
+		Body: fmt.Sprintf("Olá, %s.\n\nRecebemos um pedido para redefinir a sua senha. Para escolher uma nova senha, acesse:\n\n%s\n\n"+
+			"O link vale por %s e pode ser usado uma única vez. Se você não fez este pedido, ignore este e-mail.\n",
+			employee.Name, link, api.Config.Auth.PasswordResetTTL),
+	})
+}
+
+// ResetPassword sets a new password with a token sent by RequestPasswordReset
+// and consumes the token. Every session of the employee is ended.
+func (api *API) ResetPassword(token, password string) error {
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+
+	now := api.Clock.Now().UTC()
+	reset, err := api.Repos.PasswordResets.GetByHash(hashResetToken(token))
+	if errors.Is(err, db.ErrNotFound) {
+		return ErrInvalidResetToken
+	}
+	if err != nil {
+		return err
+	}
+	if !reset.UsedAt.IsZero() || !now.Before(reset.ExpiresAt) {
+		return ErrInvalidResetToken
+	}
+
+	// Consume the token first: of two concurrent resets only one updates it
+	used, err := api.Repos.PasswordResets.Use(reset.ID, now)
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidResetToken
+	}
+
+	if err := api.setPassword(reset.Email, password); err != nil {
+		return err
+	}
+	if err := api.Repos.Sessions.DeleteByEmail(reset.Email, ""); err != nil {
+		return err
+	}
+	api.audit("login", reset.ID, "redefinir_senha", reset.Email, "Senha redefinida por e-mail")
+	return nil
+}
+
+// ChangePassword replaces the password of an employee who knows the current
+// one, which is checked like a login. The other sessions of the employee are
+// ended; the one of token, when it is theirs, is kept.
+func (api *API) ChangePassword(email, current, password, token, ip, userAgent string) error {
+	if _, err := api.authenticate(email, current, ip, userAgent); err != nil {
+		return err
+	}
+	if err := validatePassword(password); err != nil {
+		return err
+	}
+	if err := api.setPassword(email, password); err != nil {
+		return err
+	}
+	keep := ""
+	if token != "" {
+		keep = hashResetToken(token)
+	}
+	return api.Repos.Sessions.DeleteByEmail(email, keep)
+}
+
+// setPassword stores the hash of the password in the employee's login,
+// creating the login when missing.
+func (api *API) setPassword(email, password string) error {
+	hashedPassword, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	login, err := api.Repos.Logins.GetByEmail(email)
+	if errors.Is(err, db.ErrNotFound) {
+		return api.Repos.Logins.Create(&schemas.Login{Email: email, Password: hashedPassword})
+	}
+	if err != nil {
+		return err
+	}
+	login.Password = hashedPassword
+	return api.Repos.Logins.Update(&login)
+}
@@ -0,0 +1,383 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// Names of the four daily punches, in order, as listed by missingPunches.
+const (
+	punchEntry       = "entrada"
+	punchLunchExit   = "saida_almoco"
+	punchLunchReturn = "retorno_almoco"
+	punchExit        = "saida"
+)
+
+// punchOrder lists the daily punches in the order they are made.
+var punchOrder = []string{punchEntry, punchLunchExit, punchLunchReturn, punchExit}
+
+// punchLabels names the punches for employees.
+var punchLabels = map[string]string{
+	punchEntry:       "Entrada",
+	punchLunchExit:   "Saída para intervalo",
+	punchLunchReturn: "Retorno do intervalo",
+	punchExit:        "Saída",
+}
+
+// Sources of a punch, kept in the punch history.
+const (
+	sourceWeb             = "web"
+	sourceMobile          = "mobile"
+	sourceKiosk           = "quiosque"
+	sourceManualEdit      = "edicao_manual"
+	sourceImport          = "importacao"
+	sourceApprovedRequest = "solicitacao_aprovada"
+)
+
+// ErrDayComplete is returned by Punch when the four punches of the day are
+// already registered.
+var ErrDayComplete = errors.New("All time log fields are already filled for today")
+
+var (
+	ErrInvalidPunchType = errors.New("Tipo de marcação inválido, use entrada, saida_almoco, retorno_almoco ou saida")
+	ErrPunchRegistered  = errors.New("Esta marcação já foi registrada hoje")
+	ErrPunchOutOfOrder  = errors.New("Marcação fora de ordem: uma marcação posterior já foi registrada hoje")
+)
+
+// PunchResult is the outcome of a punch: the day's time log after it, which
+// punch was registered and when.
+type PunchResult struct {
+	TimeLog schemas.TimeLog `json:"time_log"`
+	Punch   string          `json:"punch"`
+	At      time.Time       `json:"at"`
+	// Created is set when the punch created the day's time log
+	Created bool `json:"-"`
+	// Repeated is set when the punch was taken as a retry of an earlier one,
+	// which is returned instead of registering a new punch
+	Repeated bool `json:"-"`
+	// Skipped names the earlier punches of the day still missing
+	Skipped []string `json:"skipped,omitempty"`
+}
+
+// PunchDetails describes where a punch comes from; it is kept in the punch
+// history.
+type PunchDetails struct {
+	// WorkplaceID is the workplace whose QR code was read
+	WorkplaceID *uint
+	// Location is the position reported by the device, if any
+	Location *PunchLocation
+	// GeofenceStatus is the result of the geofence check, empty when the
+	// company does not check locations
+	GeofenceStatus string
+	// Source is how the punch was made; ClientIP, UserAgent and DeviceID
+	// identify the request that made it
+	Source    string
+	ClientIP  string
+	UserAgent string
+	DeviceID  string
+	// IdempotencyKey is the client's key for the punch, if any
+	IdempotencyKey string
+	// Offline marks a punch captured without connection, made at DeviceTime
+	// on the device clock
+	Offline    bool
+	DeviceTime *time.Time
+}
+
+// Punch registers a punch of the employee's current day. punchType names the
+// punch the client means to register; when empty, the server registers the
+// one after the last punch of the day. Punches may skip steps, which are
+// returned in the result as a warning, but not go back to a step before one
+// already registered. The exit calculates the hours of a complete day. Every
+// way of punching (web, kiosk) goes through here, and each punch is added to
+// the punch history.
+//
+// A punch made less than the configured minimum interval after the previous
+// punch of the day is taken as a retry: the previous punch is returned and
+// nothing is registered. So is a punch whose idempotency key was registered
+// by a concurrent request. When a concurrent request created the day's log
+// first, the punch is made again on that log.
+func (api *API) Punch(employeeEmail, punchType string, details PunchDetails) (PunchResult, error) {
+	employee, err := api.Repos.Employees.GetByEmail(employeeEmail)
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to retrieve employee for punch")
+	}
+	loc := api.employeeLocation(employee)
+
+	result, err := api.punch(employee, employeeEmail, loc, punchType, details)
+	if errors.Is(err, db.ErrDuplicate) && result.Created {
+		log.Info().Str("employee", employeeEmail).Msg("Time log of the day created meanwhile, punching again")
+		result, err = api.punch(employee, employeeEmail, loc, punchType, details)
+	}
+	if errors.Is(err, db.ErrDuplicate) {
+		return api.punchRegisteredMeanwhile(employeeEmail, details.IdempotencyKey, err)
+	}
+	return result, err
+}
+
+// punch registers the punch on the current day's log, see Punch. The result
+// tells whether the log was being created even when saving it failed.
+func (api *API) punch(employee schemas.Employee, employeeEmail string, loc *time.Location, punchType string, details PunchDetails) (PunchResult, error) {
+	now := api.Clock.Now().UTC()
+	currentDate := localDate(now, loc)
+
+	log.Info().
+		Str("currentDate", currentDate.Format("2006-01-02")).
+		Str("currentTime", now.In(loc).Format("15:04:05")).
+		Str("timezone", loc.String()).
+		Msg("Current date and time")
+
+	// The log is read locked, so a double click waits for the first punch
+	// and is then taken as a retry of it
+	var result PunchResult
+	var timeLog schemas.TimeLog
+	err := api.Repos.Transaction(func(repos db.Repositories) error {
+		var err error
+		timeLog, err = repos.TimeLogs.LockByDate(employeeEmail, currentDate)
+		result.Created = errors.Is(err, db.ErrNotFound)
+		if result.Created {
+			timeLog, err = schemas.TimeLog{EmployeeEmail: employeeEmail, LogDate: currentDate}, nil
+		}
+		if err != nil {
+			return fmt.Errorf("retrieve time log: %w", err)
+		}
+
+		punch, at := lastPunch(timeLog)
+		if !at.IsZero() && (punchType == "" || punchType == punch) && !now.Before(at) && now.Sub(at) < api.Config.Work.MinPunchInterval {
+			log.Warn().Str("employee", employeeEmail).Str("punch", punch).Msg("Punch repeated within the minimum interval, keeping the previous one")
+			result.Punch, result.At, result.Repeated = punch, at, true
+			return nil
+		}
+
+		next, skipped, err := planPunch(timeLog, punchType)
+		if errors.Is(err, ErrDayComplete) {
+			log.Warn().Msgf("All time log fields are already filled for employee %s", employeeEmail)
+		}
+		if err != nil {
+			return err
+		}
+		if len(skipped) > 0 {
+			log.Warn().Str("employee", employeeEmail).Str("punch", punchOrder[next]).Strs("skipped", skipped).Msg("Punch skips earlier steps of the day")
+		}
+
+		*punchFields(&timeLog)[next] = now
+		result.Punch, result.At, result.Skipped = punchOrder[next], now, skipped
+		if result.Punch == punchExit {
+			if employee.ID == 0 {
+				log.Error().Msg("Failed to retrieve employee for workload calculation")
+			} else if len(skipped) == 0 {
+				api.applyHours(&timeLog, employee)
+			}
+		}
+
+		if result.Created {
+			if err := repos.TimeLogs.Create(&timeLog); err != nil {
+				return fmt.Errorf("create time log: %w", err)
+			}
+		} else if err := repos.TimeLogs.Update(&timeLog); err != nil {
+			return fmt.Errorf("update time log: %w", err)
+		}
+		return recordPunch(repos, timeLog, result, details)
+	})
+	if err != nil && !result.Created {
+		return PunchResult{}, err
+	}
+	result.TimeLog = timeLog
+	return result, err
+}
+
+// punchRegisteredMeanwhile returns the punch a concurrent retry registered
+// with the idempotency key first, which made saving this one fail with err.
+func (api *API) punchRegisteredMeanwhile(employeeEmail, key string, err error) (PunchResult, error) {
+	previous, found, lookupErr := api.punchByKey(employeeEmail, key)
+	if lookupErr != nil || !found {
+		return PunchResult{}, err
+	}
+	log.Info().Str("employee", employeeEmail).Str("punch", previous.Punch).Msg("Punch registered meanwhile with the same idempotency key")
+	return previous, nil
+}
+
+// NextPunch is the punch suggested to the employee now, and the ones the
+// employee may choose instead.
+type NextPunch struct {
+	// Punch is the suggested punch, empty when the day is complete
+	Punch       string `json:"punch"`
+	Label       string `json:"label"`
+	DayComplete bool   `json:"day_complete"`
+	// Skipped names the earlier punches of the day still missing
+	Skipped []string `json:"skipped,omitempty"`
+	// Options are the punches that may still be registered today, the
+	// suggested one first
+	Options []PunchOption `json:"options"`
+	// LastPunch and LastAt are the latest punch of the day, if any
+	LastPunch string     `json:"last_punch,omitempty"`
+	LastAt    *time.Time `json:"last_at,omitempty"`
+}
+
+// PunchOption is a punch the employee may register.
+type PunchOption struct {
+	Punch string `json:"punch"`
+	Label string `json:"label"`
+}
+
+// SuggestPunch returns the punch the employee would register now without
+// stating a type, following the last punch of the current day.
+func (api *API) SuggestPunch(employeeEmail string) (NextPunch, error) {
+	employee, err := api.Repos.Employees.GetByEmail(employeeEmail)
+	if err != nil {
+		return NextPunch{}, err
+	}
+	currentDate := localDate(api.Clock.Now(), api.employeeLocation(employee))
+	timeLog, err := api.Repos.TimeLogs.GetByDate(employee.Email, currentDate)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return NextPunch{}, fmt.Errorf("retrieve time log: %w", err)
+	}
+
+	suggestion := NextPunch{Options: []PunchOption{}}
+	if punch, at := lastPunch(timeLog); !at.IsZero() {
+		suggestion.LastPunch, suggestion.LastAt = punch, &at
+	}
+	next, skipped, err := planPunch(timeLog, "")
+	if errors.Is(err, ErrDayComplete) {
+		suggestion.DayComplete = true
+		return suggestion, nil
+	}
+	if err != nil {
+		return NextPunch{}, err
+	}
+	suggestion.Punch, suggestion.Label, suggestion.Skipped = punchOrder[next], punchLabels[punchOrder[next]], skipped
+	for _, punch := range punchOrder[next:] {
+		suggestion.Options = append(suggestion.Options, PunchOption{Punch: punch, Label: punchLabels[punch]})
+	}
+	return suggestion, nil
+}
+
+// planPunch decides which punch of the day to register, as an index of
+// punchOrder: punchType, or the punch after the last one registered when
+// punchType is empty. It also names the earlier punches still missing, which
+// the punch skips.
+func planPunch(timeLog schemas.TimeLog, punchType string) (int, []string, error) {
+	fields := punchFields(&timeLog)
+	next := 0
+	for i, field := range fields {
+		if !field.IsZero() {
+			next = i + 1
+		}
+	}
+	if punchType != "" {
+		target := slices.Index(punchOrder, punchType)
+		switch {
+		case target < 0:
+			return 0, nil, ErrInvalidPunchType
+		case !fields[target].IsZero():
+			return 0, nil, ErrPunchRegistered
+		case target < next:
+			return 0, nil, ErrPunchOutOfOrder
+		}
+		next = target
+	}
+	if next == len(punchOrder) {
+		return 0, nil, ErrDayComplete
+	}
+
+	var skipped []string
+	for i := 0; i < next; i++ {
+		if fields[i].IsZero() {
+			skipped = append(skipped, punchOrder[i])
+		}
+	}
+	return next, skipped, nil
+}
+
+// punchFields returns the fields of the time log that hold each punch, in
+// punchOrder.
+func punchFields(timeLog *schemas.TimeLog) []*time.Time {
+	return []*time.Time{&timeLog.EntryTime, &timeLog.LunchExitTime, &timeLog.LunchReturnTime, &timeLog.ExitTime}
+}
+
+// punchByKey looks for the punch the employee already registered with the
+// idempotency key, returned as a repeated punch.
+func (api *API) punchByKey(employeeEmail, key string) (PunchResult, bool, error) {
+	records, err := api.Repos.Punches.List(db.PunchFilter{Emails: []string{employeeEmail}, IdempotencyKey: key})
+	if err != nil || len(records) == 0 {
+		return PunchResult{}, false, err
+	}
+	record := records[0]
+	timeLog, err := api.Repos.TimeLogs.Get(record.TimeLogID)
+	if err != nil {
+		return PunchResult{}, false, fmt.Errorf("retrieve time log: %w", err)
+	}
+	return PunchResult{TimeLog: timeLog, Punch: record.Punch, At: record.PunchedAt, Repeated: true}, true, nil
+}
+
+// lastPunch returns the latest punch of the time log, zero when it has none.
+func lastPunch(timeLog schemas.TimeLog) (string, time.Time) {
+	var punch string
+	var at time.Time
+	for i, field := range punchFields(&timeLog) {
+		if field.After(at) {
+			punch, at = punchOrder[i], *field
+		}
+	}
+	return punch, at
+}
+
+// recordPunch adds the punch to the history.
+func recordPunch(repos db.Repositories, timeLog schemas.TimeLog, result PunchResult, details PunchDetails) error {
+	record := schemas.PunchRecord{
+		EmployeeEmail:  timeLog.EmployeeEmail,
+		TimeLogID:      timeLog.ID,
+		Punch:          result.Punch,
+		PunchedAt:      result.At,
+		WorkplaceID:    details.WorkplaceID,
+		GeofenceStatus: details.GeofenceStatus,
+		Source:         details.Source,
+		ClientIP:       details.ClientIP,
+		UserAgent:      details.UserAgent,
+		DeviceID:       details.DeviceID,
+		Offline:        details.Offline,
+		DeviceTime:     details.DeviceTime,
+	}
+	if details.IdempotencyKey != "" {
+		record.IdempotencyKey = &details.IdempotencyKey
+	}
+	if location := details.Location; location != nil {
+		record.Latitude, record.Longitude = &location.Latitude, &location.Longitude
+		if location.Accuracy > 0 {
+			record.Accuracy = &location.Accuracy
+		}
+	}
+	if err := repos.Punches.Create(&record); err != nil {
+		return fmt.Errorf("record punch: %w", err)
+	}
+	return nil
+}
+
+// recordChanges adds to the history each punch of the time log that was set
+// or changed from before to after, as when a manager edits the day or a time
+// log is imported whole.
+func recordChanges(repos db.Repositories, before, after schemas.TimeLog, details PunchDetails) error {
+	for _, change := range []struct {
+		punch         string
+		before, after time.Time
+	}{
+		{punchEntry, before.EntryTime, after.EntryTime},
+		{punchLunchExit, before.LunchExitTime, after.LunchExitTime},
+		{punchLunchReturn, before.LunchReturnTime, after.LunchReturnTime},
+		{punchExit, before.ExitTime, after.ExitTime},
+	} {
+		if change.after.IsZero() || change.after.Equal(change.before) {
+			continue
+		}
+		result := PunchResult{Punch: change.punch, At: change.after}
+		if err := recordPunch(repos, after, result, details); err != nil {
+			return err
+		}
+	}
+	return nil
+}
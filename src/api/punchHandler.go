@@ -0,0 +1,345 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// punchSourceHeader tells a punch from the mobile app (mobile) from one
+	// made in the browser (web, the default)
+	punchSourceHeader = "X-Punch-Source"
+	// deviceIDHeader carries an identifier of the device that punched
+	deviceIDHeader = "X-Device-ID"
+	// idempotencyKeyHeader identifies a punch request, so that its retries
+	// return the punch it registered
+	idempotencyKeyHeader = "Idempotency-Key"
+)
+
+var (
+	ErrInvalidPunchSource = errors.New("Origem da marcação inválida")
+	ErrLongIdempotencyKey = errors.New("Chave de idempotência com mais de 100 caracteres")
+)
+
+// ManagerPunch is a punch of the history as shown to managers and in reports,
+// with where it happened and where it came from.
+type ManagerPunch struct {
+	schemas.PunchRecord
+	EmployeeName string `json:"employee_name"`
+	Workplace    string `json:"workplace"`
+	LocalTime    string `json:"local_time"` // dd/mm/aaaa hh:mm no fuso do funcionário
+}
+
+// PunchResponse answers a web punch with the day's time log, which punch it
+// registered and the earlier punches of the day it skipped.
+type PunchResponse struct {
+	schemas.TimeLog
+	Punch   string   `json:"punch"`
+	Skipped []string `json:"skipped,omitempty"`
+	// Warning tells the employee which punches were skipped
+	Warning string `json:"warning,omitempty"`
+}
+
+func newPunchResponse(result PunchResult) PunchResponse {
+	response := PunchResponse{TimeLog: result.TimeLog, Punch: result.Punch, Skipped: result.Skipped}
+	if len(result.Skipped) > 0 {
+		labels := make([]string, len(result.Skipped))
+		for i, punch := range result.Skipped {
+			labels[i] = punchLabels[punch]
+		}
+		response.Warning = "Marcações não registradas hoje: " + strings.Join(labels, ", ")
+	}
+	return response
+}
+
+// punchRequestDetails describes the request that makes a punch, for the
+// punch history.
+func punchRequestDetails(c echo.Context, source string) PunchDetails {
+	return PunchDetails{
+		Source:    source,
+		ClientIP:  c.RealIP(),
+		UserAgent: truncate(c.Request().UserAgent(), 255),
+		DeviceID:  truncate(strings.TrimSpace(c.Request().Header.Get(deviceIDHeader)), 100),
+	}
+}
+
+// webPunchSource is the source of a punch through PUT /time_logs/{id}.
+func webPunchSource(c echo.Context) (string, error) {
+	switch source := c.Request().Header.Get(punchSourceHeader); source {
+	case "", sourceWeb:
+		return sourceWeb, nil
+	case sourceMobile:
+		return sourceMobile, nil
+	}
+	return "", ErrInvalidPunchSource
+}
+
+// punchIdempotencyKey reads the optional Idempotency-Key header.
+func punchIdempotencyKey(c echo.Context) (string, error) {
+	key := strings.TrimSpace(c.Request().Header.Get(idempotencyKeyHeader))
+	if len(key) > 100 {
+		return "", ErrLongIdempotencyKey
+	}
+	return key, nil
+}
+
+// parsePunchSources reads the comma separated source query parameter.
+func parsePunchSources(c echo.Context) ([]string, error) {
+	value := c.QueryParam("source")
+	if value == "" {
+		return nil, nil
+	}
+	var sources []string
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+		switch source {
+		case sourceWeb, sourceMobile, sourceKiosk, sourceManualEdit, sourceImport, sourceApprovedRequest:
+			sources = append(sources, source)
+		default:
+			return nil, ErrInvalidPunchSource
+		}
+	}
+	return sources, nil
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	// do not cut a multibyte character in half
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// punchViews adds the employee's name, the workplace and the local time to
+// the punches.
+func (api *API) punchViews(records []schemas.PunchRecord, employees []schemas.Employee) []ManagerPunch {
+	byEmail := map[string]schemas.Employee{}
+	for _, e := range employees {
+		byEmail[e.Email] = e
+	}
+	workplaces := map[uint]string{}
+	if list, err := api.ListWorkplaces(""); err == nil {
+		for _, w := range list {
+			workplaces[w.ID] = w.Name
+		}
+	}
+
+	location := api.employeeLocations()
+	punches := make([]ManagerPunch, 0, len(records))
+	for _, record := range records {
+		employee := byEmail[record.EmployeeEmail]
+		punch := ManagerPunch{
+			PunchRecord:  record,
+			EmployeeName: employee.Name,
+			LocalTime:    record.PunchedAt.In(location(employee)).Format("02/01/2006 15:04"),
+		}
+		if record.WorkplaceID != nil {
+			punch.Workplace = workplaces[*record.WorkplaceID]
+		}
+		punches = append(punches, punch)
+	}
+	return punches
+}
+
+// getManagerPunches godoc
+//
+//	@Summary		Marcações da equipe
+//	@Description	Lista as marcações dos funcionários da equipe do gerente, com o local de trabalho, a localização informada pelo dispositivo, o resultado da verificação das cercas virtuais, a origem, o IP, o navegador e o dispositivo
+//	@Tags			manager
+//	@Produce		json
+//	@Param			Authorization	header		string	true	"Bearer <token> da sessão do gerente"
+//	@Param			employee_email	query		string	false	"Email de um funcionário da equipe"
+//	@Param			start			query		string	false	"Data de início (YYYY-MM-DD, padrão 7 dias atrás)"
+//	@Param			end				query		string	false	"Data de fim (YYYY-MM-DD, padrão hoje)"
+//	@Param			source			query		string	false	"Origens separadas por vírgula (web, mobile, quiosque, edicao_manual, importacao, solicitacao_aprovada)"
+//	@Success		200				{array}		ManagerPunch
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		403				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/manager/punches [get]
+func (api *API) getManagerPunches(c echo.Context) error {
+	manager := currentEmployee(c)
+	loc := api.employeeLocation(manager)
+
+	// punches are stored in UTC, so the local days are converted back
+	end := localDate(api.Clock.Now(), loc).Add(24 * time.Hour)
+	start := end.AddDate(0, 0, -8)
+	var err error
+	if c.QueryParam("start") != "" || c.QueryParam("end") != "" {
+		if start, end, err = parseReportPeriod(c); err != nil {
+			return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+		}
+	}
+	sources, err := parsePunchSources(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	emails, err := api.managedEmployeeEmails(manager)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da equipe")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar funcionários"})
+	}
+	if employeeEmail := c.QueryParam("employee_email"); employeeEmail != "" {
+		if !slices.Contains(emails, employeeEmail) {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Funcionário não pertence à sua equipe"})
+		}
+		emails = []string{employeeEmail}
+	}
+	if len(emails) == 0 {
+		return c.JSON(http.StatusOK, []ManagerPunch{})
+	}
+
+	records, err := api.Repos.Punches.List(db.PunchFilter{
+		Emails:  emails,
+		From:    time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc),
+		To:      time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, loc),
+		Sources: sources,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar marcações")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar marcações"})
+	}
+	employees, _ := api.Repos.Employees.List(db.EmployeeFilter{Emails: emails})
+	return c.JSON(http.StatusOK, api.punchViews(records, employees))
+}
+
+// getNextPunch godoc
+//
+//	@Summary		Próxima marcação sugerida
+//	@Description	Indica a marcação que PUT /time_logs/{id} registraria agora sem punch_type, as etapas do dia puladas e as marcações que ainda podem ser escolhidas
+//	@Tags			timeLogs
+//	@Produce		json
+//	@Param			employee_email	query		string	true	"Email do funcionário"
+//	@Success		200				{object}	NextPunch
+//	@Failure		400				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/time_logs/next_punch [get]
+func (api *API) getNextPunch(c echo.Context) error {
+	employeeEmail := c.QueryParam("employee_email")
+	if employeeEmail == "" {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email do funcionário é obrigatório"})
+	}
+	suggestion, err := api.SuggestPunch(employeeEmail)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Funcionário não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao sugerir a próxima marcação")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar a próxima marcação"})
+	}
+	return c.JSON(http.StatusOK, suggestion)
+}
+
+// getTimeLogPunches godoc
+//
+//	@Summary		Histórico de marcações do dia
+//	@Description	Lista as marcações que formaram o registro de ponto, na ordem em que aconteceram, com a origem, o IP, o navegador e o dispositivo de cada uma. Disponível ao próprio funcionário e aos gerentes da sua equipe
+//	@Tags			timeLogs
+//	@Produce		json
+//	@Param			Authorization	header		string	true	"Bearer <token> da sessão"
+//	@Param			id	path		int	true	"ID do registro de ponto"
+//	@Success		200	{array}		ManagerPunch
+//	@Failure		400	{object}	map[string]string
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
+//	@Failure		404	{object}	map[string]string
+//	@Failure		500	{object}	map[string]string
+//	@Router			/time_logs/{id}/punches [get]
+func (api *API) getTimeLogPunches(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	timeLog, err := api.Repos.TimeLogs.Get(uint(id))
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Registro não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar registro de ponto")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar registro"})
+	}
+	if viewer := currentEmployee(c); viewer.Email != timeLog.EmployeeEmail {
+		allowed := false
+		if employee, err := api.Repos.Employees.GetByEmail(timeLog.EmployeeEmail); err == nil && viewer.IsManager {
+			if allowed, err = api.canManage(viewer, employee); err != nil {
+				log.Error().Err(err).Msg("[api] Erro ao verificar hierarquia do gerente")
+				return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao verificar permissões"})
+			}
+		}
+		if !allowed {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Registro de outro funcionário"})
+		}
+	}
+
+	records, err := api.Repos.Punches.List(db.PunchFilter{TimeLogID: timeLog.ID})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar marcações")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar marcações"})
+	}
+	employees, _ := api.Repos.Employees.List(db.EmployeeFilter{Emails: []string{timeLog.EmployeeEmail}})
+	return c.JSON(http.StatusOK, api.punchViews(records, employees))
+}
+
+// getPunchReport godoc
+//
+//	@Summary		Relatório de marcações
+//	@Description	Lista as marcações dos funcionários da empresa, opcionalmente de uma filial, filtradas pela origem, pelo IP ou pelo dispositivo
+//	@Tags			reports
+//	@Produce		json
+//	@Param			company_cnpj	query		string	true	"CNPJ da empresa"
+//	@Param			branch_id		query		int		false	"ID da filial"
+//	@Param			start			query		string	true	"Data de início (YYYY-MM-DD)"
+//	@Param			end				query		string	true	"Data de fim (YYYY-MM-DD)"
+//	@Param			source			query		string	false	"Origens separadas por vírgula (web, mobile, quiosque, edicao_manual, importacao, solicitacao_aprovada)"
+//	@Param			client_ip		query		string	false	"IP de origem"
+//	@Param			device_id		query		string	false	"Identificador do dispositivo"
+//	@Success		200				{array}		ManagerPunch
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/reports/punches [get]
+func (api *API) getPunchReport(c echo.Context) error {
+	start, end, err := parseReportPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	sources, err := parsePunchSources(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	company, _, employees, err := api.reportScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	loc := loadLocation(company.Timezone)
+
+	records, err := api.Repos.Punches.List(db.PunchFilter{
+		Emails:   employeeEmails(employees),
+		From:     time.Date(start.Year(), start.Month(), start.Day(), 0, 0, 0, 0, loc),
+		To:       time.Date(end.Year(), end.Month(), end.Day(), 0, 0, 0, 0, loc),
+		Sources:  sources,
+		ClientIP: c.QueryParam("client_ip"),
+		DeviceID: c.QueryParam("device_id"),
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar marcações para o relatório")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar marcações"})
+	}
+	return c.JSON(http.StatusOK, api.punchViews(records, employees))
+}
@@ -0,0 +1,322 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/scheduler"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	recalculationPending = "pendente"
+	recalculationRunning = "executando"
+	recalculationDone    = "concluido"
+	recalculationFailed  = "falha"
+
+	recalculationJob = "process_recalculations"
+
+	// A task "executando" without a heartbeat for this long was left behind
+	// by a server that stopped in the middle of it and is queued again.
+	// Running tasks renew their heartbeat every hundred logs.
+	recalculationStale = time.Hour
+
+	// Kinds of schemas.WorkRule
+	ruleWorkload  = "jornada"
+	ruleTolerance = "tolerancia"
+)
+
+// audit records an entry in the audit history. Failures are only logged, they
+// never abort the change being audited.
+func (api *API) audit(entity string, entityID uint, action, actor, details string) {
+	entry := schemas.AuditLog{Entity: entity, EntityID: entityID, Action: action, Actor: actor, Details: details}
+	if err := api.Repos.AuditLogs.Create(&entry); err != nil {
+		log.Error().Err(err).Str("entity", entity).Uint("entityID", entityID).Msg("[api] Erro ao registrar auditoria")
+	}
+}
+
+// effectiveDate parses the date (YYYY-MM-DD) from which a change applies. An
+// empty value means today in the given timezone.
+func (api *API) effectiveDate(value string, loc *time.Location) (time.Time, error) {
+	if value == "" {
+		return localDate(api.Clock.Now(), loc), nil
+	}
+	date, err := time.Parse("2006-01-02", value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("data de vigência inválida")
+	}
+	return date, nil
+}
+
+// saveWorkRule stores a new version of a workload or tolerance. The first
+// change of a rule also stores the previous value as the version in force
+// before it, so the days before the change keep being calculated with it.
+func (api *API) saveWorkRule(rule schemas.WorkRule, previous float32) error {
+	versions, err := api.Repos.WorkRules.List(db.WorkRuleFilter{CompanyCNPJ: rule.CompanyCNPJ, EmployeeEmail: rule.EmployeeEmail, Kind: rule.Kind})
+	if err != nil {
+		return err
+	}
+	if len(versions) == 0 {
+		initial := schemas.WorkRule{CompanyCNPJ: rule.CompanyCNPJ, EmployeeEmail: rule.EmployeeEmail, Kind: rule.Kind, Value: previous}
+		if err := api.Repos.WorkRules.Save(&initial); err != nil {
+			return err
+		}
+	}
+	return api.Repos.WorkRules.Save(&rule)
+}
+
+// ruleOn returns the value of the last version in force on date, or current
+// when the rule never changed.
+func ruleOn(versions []schemas.WorkRule, date time.Time, current float32) float32 {
+	for _, version := range versions {
+		if version.EffectiveFrom.After(date) {
+			break
+		}
+		current = version.Value
+	}
+	return current
+}
+
+// workloadOn returns the weekly workload of the employee in force on date.
+func (api *API) workloadOn(employee schemas.Employee, date time.Time) float32 {
+	versions, err := api.Repos.WorkRules.List(db.WorkRuleFilter{EmployeeEmail: employee.Email, Kind: ruleWorkload})
+	if err != nil {
+		log.Error().Err(err).Str("employee", employee.Email).Msg("[api] Erro ao buscar versões da jornada")
+	}
+	return ruleOn(versions, date, employee.Workload)
+}
+
+// toleranceOn returns the tolerance of the company in force on date.
+func (api *API) toleranceOn(company schemas.Company, date time.Time) int {
+	if company.CNPJ == "" {
+		return company.ToleranceMinutes
+	}
+	versions, err := api.Repos.WorkRules.List(db.WorkRuleFilter{CompanyCNPJ: company.CNPJ, Kind: ruleTolerance})
+	if err != nil {
+		log.Error().Err(err).Str("company", company.CNPJ).Msg("[api] Erro ao buscar versões da tolerância")
+	}
+	return int(ruleOn(versions, date, float32(company.ToleranceMinutes)))
+}
+
+// recalculationTask validates the scope and period of a recalculation request
+// and builds the task that carries it out.
+func (api *API) recalculationTask(req RecalculationRequest) (schemas.RecalculationTask, error) {
+	company, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ)
+	if err != nil {
+		return schemas.RecalculationTask{}, fmt.Errorf("Empresa não encontrada")
+	}
+	if req.BranchID != nil {
+		if branch, err := api.Repos.Branches.Get(*req.BranchID); err != nil || branch.CompanyCNPJ != company.CNPJ {
+			return schemas.RecalculationTask{}, fmt.Errorf("Filial não encontrada nesta empresa")
+		}
+	}
+	if req.EmployeeEmail != "" {
+		if employee, err := api.Repos.Employees.GetByEmail(req.EmployeeEmail); err != nil || employee.CompanyCNPJ != company.CNPJ {
+			return schemas.RecalculationTask{}, fmt.Errorf("Funcionário não encontrado nesta empresa")
+		}
+	}
+
+	fromDate, err := api.effectiveDate(req.FromDate, loadLocation(company.Timezone))
+	if err != nil {
+		return schemas.RecalculationTask{}, err
+	}
+	var toDate time.Time
+	if req.ToDate != "" {
+		if toDate, err = time.Parse("2006-01-02", req.ToDate); err != nil {
+			return schemas.RecalculationTask{}, fmt.Errorf("data final inválida")
+		}
+		if toDate.Before(fromDate) {
+			return schemas.RecalculationTask{}, fmt.Errorf("data final anterior à data inicial")
+		}
+	}
+	if req.Reason == "" {
+		req.Reason = "Recálculo manual"
+	}
+
+	return schemas.RecalculationTask{
+		CompanyCNPJ:   company.CNPJ,
+		BranchID:      req.BranchID,
+		EmployeeEmail: req.EmployeeEmail,
+		FromDate:      fromDate,
+		ToDate:        toDate,
+		Reason:        req.Reason,
+		RequestedBy:   req.RequestedBy,
+	}, nil
+}
+
+// Recalculate runs a recalculation right away instead of queueing it, for the
+// command line. The task is recorded and audited like the queued ones.
+func (api *API) Recalculate(ctx context.Context, req RecalculationRequest) (schemas.RecalculationTask, error) {
+	task, err := api.recalculationTask(req)
+	if err != nil {
+		return task, err
+	}
+
+	task.Status = recalculationRunning
+	task.StartedAt = api.Clock.Now().UTC()
+	task.HeartbeatAt = task.StartedAt
+	if err := api.Repos.Recalculations.Create(&task); err != nil {
+		return task, err
+	}
+	err = api.processRecalculation(ctx, &task)
+	return task, err
+}
+
+// enqueueRecalculation stores a pending recalculation and wakes the background
+// job that processes the queue.
+func (api *API) enqueueRecalculation(task schemas.RecalculationTask) (schemas.RecalculationTask, error) {
+	task.Status = recalculationPending
+	if err := api.Repos.Recalculations.Create(&task); err != nil {
+		return task, err
+	}
+
+	log.Info().
+		Uint("taskID", task.ID).
+		Str("company", task.CompanyCNPJ).
+		Str("employee", task.EmployeeEmail).
+		Str("from", task.FromDate.Format("2006-01-02")).
+		Msg("[api] Recálculo agendado")
+
+	// When the job is already running it picks the new task up before
+	// finishing; otherwise the next periodic run does.
+	if _, err := api.Scheduler.Trigger(recalculationJob); err != nil && !errors.Is(err, scheduler.ErrAlreadyRunning) {
+		log.Error().Err(err).Msg("[api] Erro ao iniciar processamento de recálculos")
+	}
+	return task, nil
+}
+
+// processPendingRecalculations runs the queued recalculations, oldest first,
+// until the queue is empty or ctx is cancelled.
+func (api *API) processPendingRecalculations(ctx context.Context) error {
+	stale := api.Clock.Now().UTC().Add(-recalculationStale)
+	if err := api.Repos.Recalculations.RequeueStale(stale); err != nil {
+		return err
+	}
+
+	for ctx.Err() == nil {
+		task, err := api.Repos.Recalculations.NextPending()
+		if errors.Is(err, db.ErrNotFound) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Claim the task so a second instance does not process it as well
+		startedAt := api.Clock.Now().UTC()
+		claimed, err := api.Repos.Recalculations.Claim(task.ID, startedAt)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		task.Status, task.StartedAt, task.HeartbeatAt = recalculationRunning, startedAt, startedAt
+
+		if err := api.processRecalculation(ctx, &task); err != nil {
+			log.Error().Err(err).Uint("taskID", task.ID).Msg("[api] Recálculo falhou")
+		}
+	}
+	return ctx.Err()
+}
+
+// processRecalculation recalculates the time logs from the task's FromDate
+// on, up to its ToDate when set, of the employees in its scope: complete days
+// and the hours charged to absences. Each day uses the rules in force on it.
+// The progress is saved as it goes and every changed result is audited.
+func (api *API) processRecalculation(ctx context.Context, task *schemas.RecalculationTask) error {
+	finish := func(err error) error {
+		task.Status, task.FinishedAt = recalculationDone, api.Clock.Now().UTC()
+		if err != nil {
+			task.Status, task.Error = recalculationFailed, err.Error()
+		}
+		api.saveRecalculation(task)
+		return err
+	}
+
+	filter := db.EmployeeFilter{CompanyCNPJ: task.CompanyCNPJ, BranchID: task.BranchID}
+	if task.EmployeeEmail != "" {
+		filter.Emails = []string{task.EmployeeEmail}
+	}
+	employees, err := api.Repos.Employees.List(filter)
+	if err != nil {
+		return finish(err)
+	}
+	byEmail := map[string]schemas.Employee{}
+	for _, e := range employees {
+		byEmail[e.Email] = e
+	}
+
+	period := db.TimeLogFilter{Emails: employeeEmails(employees), From: task.FromDate}
+	if !task.ToDate.IsZero() {
+		period.To = task.ToDate.AddDate(0, 0, 1)
+	}
+	logs, err := api.Repos.TimeLogs.List(period)
+	if err != nil {
+		return finish(err)
+	}
+	// Only complete days and absences carry hours
+	timeLogs := logs[:0]
+	for _, timeLog := range logs {
+		if len(missingPunches(timeLog)) == 0 || timeLog.Status == dayAbsent {
+			timeLogs = append(timeLogs, timeLog)
+		}
+	}
+	branches := map[uint]*schemas.Branch{}
+
+	// A task queued again after an interruption starts over
+	task.Total, task.Processed, task.Changed = len(timeLogs), 0, 0
+	api.saveRecalculation(task)
+
+	for i := range timeLogs {
+		if err := ctx.Err(); err != nil {
+			// Interrupted: queue it again so the next run starts over
+			task.Status = recalculationPending
+			api.saveRecalculation(task)
+			return err
+		}
+
+		timeLog := &timeLogs[i]
+		before := *timeLog
+		employee := byEmail[timeLog.EmployeeEmail]
+		if timeLog.Status == dayAbsent {
+			chargeAbsence(timeLog, api.weeklyWorkload(employee, timeLog.LogDate), api.cachedBranch(employee, branches))
+		} else {
+			api.applyHours(timeLog, employee)
+		}
+
+		if timeLog.ExtraHours != before.ExtraHours || timeLog.MissingHours != before.MissingHours || timeLog.Balance != before.Balance {
+			if err := api.Repos.TimeLogs.Update(timeLog); err != nil {
+				return finish(err)
+			}
+			api.audit("time_log", timeLog.ID, "recalculo", task.RequestedBy, fmt.Sprintf(
+				"Recálculo #%d: saldo %.2f → %.2f, extras %.2f → %.2f, faltantes %.2f → %.2f",
+				task.ID, before.Balance, timeLog.Balance, before.ExtraHours, timeLog.ExtraHours, before.MissingHours, timeLog.MissingHours))
+			task.Changed++
+		}
+
+		task.Processed++
+		if task.Processed%100 == 0 {
+			task.HeartbeatAt = api.Clock.Now().UTC()
+			api.saveRecalculation(task)
+		}
+	}
+
+	api.audit("recalculation", task.ID, "concluido", task.RequestedBy, fmt.Sprintf(
+		"%s: %d registros a partir de %s, %d alterados",
+		task.Reason, task.Processed, task.FromDate.Format("2006-01-02"), task.Changed))
+	log.Info().Uint("taskID", task.ID).Int("processed", task.Processed).Int("changed", task.Changed).Msg("[api] Recálculo concluído")
+	return finish(nil)
+}
+
+// saveRecalculation stores the progress of a task. Failures are only logged,
+// the task goes on.
+func (api *API) saveRecalculation(task *schemas.RecalculationTask) {
+	if err := api.Repos.Recalculations.Update(task); err != nil {
+		log.Error().Err(err).Uint("taskID", task.ID).Msg("[api] Erro ao salvar progresso do recálculo")
+	}
+}
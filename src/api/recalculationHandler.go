@@ -0,0 +1,138 @@
+package api
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type RecalculationRequest struct {
+	CompanyCNPJ   string `json:"company_cnpj" validate:"required"`
+	BranchID      *uint  `json:"branch_id"`
+	EmployeeEmail string `json:"employee_email"`
+	FromDate      string `json:"from_date"` // YYYY-MM-DD, padrão hoje
+	ToDate        string `json:"to_date"`   // YYYY-MM-DD, opcional
+	Reason        string `json:"reason"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+}
+
+// createRecalculation godoc
+//
+//	@Summary		Agendar recálculo
+//	@Description	Recalcula em segundo plano os registros a partir de uma data (e opcionalmente até outra), da empresa, de uma filial ou de um funcionário
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		RecalculationRequest	true	"Escopo e data de vigência"
+//	@Success		202		{object}	schemas.RecalculationTask
+//	@Failure		400		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/recalculations [post]
+func (api *API) createRecalculation(c echo.Context) error {
+	var req RecalculationRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	task, err := api.recalculationTask(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	task, err = api.enqueueRecalculation(task)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao agendar recálculo")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao agendar recálculo"})
+	}
+	return c.JSON(http.StatusAccepted, task)
+}
+
+// listRecalculations godoc
+//
+//	@Summary		Listar recálculos
+//	@Description	Retorna os recálculos mais recentes com o progresso de cada um
+//	@Tags			admin
+//	@Produce		json
+//	@Param			company_cnpj	query		string	false	"CNPJ da empresa"
+//	@Param			status			query		string	false	"pendente, executando, concluido ou falha"
+//	@Param			limit			query		int		false	"Quantidade máxima (padrão 50)"
+//	@Success		200				{array}		schemas.RecalculationTask
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/recalculations [get]
+func (api *API) listRecalculations(c echo.Context) error {
+	limit := 50
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	tasks, err := api.Repos.Recalculations.List(db.RecalculationFilter{
+		CompanyCNPJ: c.QueryParam("company_cnpj"),
+		Status:      c.QueryParam("status"),
+		Limit:       limit,
+	})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar recálculos")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar recálculos"})
+	}
+	return c.JSON(http.StatusOK, tasks)
+}
+
+// getRecalculation godoc
+//
+//	@Summary		Consultar recálculo
+//	@Description	Retorna o status e o progresso de um recálculo
+//	@Tags			admin
+//	@Produce		json
+//	@Param			id	path		int	true	"ID do recálculo"
+//	@Success		200	{object}	schemas.RecalculationTask
+//	@Failure		404	{object}	map[string]string
+//	@Router			/admin/recalculations/{id} [get]
+func (api *API) getRecalculation(c echo.Context) error {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	task, err := api.Repos.Recalculations.Get(uint(id))
+	if err != nil {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Recálculo não encontrado"})
+	}
+	return c.JSON(http.StatusOK, task)
+}
+
+// listAuditLogs godoc
+//
+//	@Summary		Histórico de auditoria
+//	@Description	Retorna as alterações registradas, opcionalmente de uma entidade
+//	@Tags			admin
+//	@Produce		json
+//	@Param			entity		query		string	false	"Entidade (employee, company, time_log, recalculation)"
+//	@Param			entity_id	query		int		false	"ID da entidade"
+//	@Param			limit		query		int		false	"Quantidade máxima (padrão 100)"
+//	@Success		200			{array}		schemas.AuditLog
+//	@Failure		500			{object}	map[string]string
+//	@Router			/admin/audit [get]
+func (api *API) listAuditLogs(c echo.Context) error {
+	limit := 100
+	if l, err := strconv.Atoi(c.QueryParam("limit")); err == nil && l > 0 {
+		limit = l
+	}
+
+	filter := db.AuditLogFilter{Entity: c.QueryParam("entity"), Limit: limit}
+	if entityID, err := strconv.Atoi(c.QueryParam("entity_id")); err == nil {
+		id := uint(entityID)
+		filter.EntityID = &id
+	}
+
+	entries, err := api.Repos.AuditLogs.List(filter)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar auditoria")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar auditoria"})
+	}
+	return c.JSON(http.StatusOK, entries)
+}
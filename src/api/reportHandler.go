@@ -0,0 +1,181 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+type EmployeeSummary struct {
+	Name          string  `json:"name"`
+	Email         string  `json:"email"`
+	BranchID      *uint   `json:"branch_id"`
+	Days          int     `json:"days"`
+	CompletedDays int     `json:"completed_days"`
+	ExtraHours    float32 `json:"extra_hours"`
+	MissingHours  float32 `json:"missing_hours"`
+	Balance       float32 `json:"balance"`
+}
+
+// ReportScope loads the company, the optional branch and the employees, ordered
+// by name, a report must cover.
+func (api *API) ReportScope(companyCNPJ string, branchID *uint) (schemas.Company, *schemas.Branch, []schemas.Employee, error) {
+	company, err := api.Repos.Companies.GetByCNPJ(companyCNPJ)
+	if err != nil {
+		return company, nil, nil, fmt.Errorf("empresa não encontrada")
+	}
+
+	filter := db.EmployeeFilter{CompanyCNPJ: company.CNPJ}
+
+	var branch *schemas.Branch
+	if branchID != nil {
+		b, err := api.Repos.Branches.Get(*branchID)
+		if err != nil || b.CompanyCNPJ != company.CNPJ {
+			return company, nil, nil, fmt.Errorf("filial não encontrada nesta empresa")
+		}
+		branch = &b
+		filter.BranchID = &branch.ID
+	}
+
+	employees, err := api.Repos.Employees.List(filter)
+	if err != nil {
+		return company, branch, nil, err
+	}
+	sort.SliceStable(employees, func(i, j int) bool { return employees[i].Name < employees[j].Name })
+	return company, branch, employees, nil
+}
+
+// reportScope is ReportScope for the company_cnpj and branch_id query
+// parameters.
+func (api *API) reportScope(c echo.Context) (schemas.Company, *schemas.Branch, []schemas.Employee, error) {
+	var branchID *uint
+	if branchParam := c.QueryParam("branch_id"); branchParam != "" {
+		id, err := strconv.ParseUint(branchParam, 10, 0)
+		if err != nil {
+			return schemas.Company{}, nil, nil, fmt.Errorf("filial inválida")
+		}
+		branchID = new(uint)
+		*branchID = uint(id)
+	}
+	return api.ReportScope(c.QueryParam("company_cnpj"), branchID)
+}
+
+// parseReportPeriod parses the start and end query parameters (YYYY-MM-DD).
+// The returned end is exclusive, one day after the informed date.
+func parseReportPeriod(c echo.Context) (time.Time, time.Time, error) {
+	start, err1 := time.Parse("2006-01-02", c.QueryParam("start"))
+	end, err2 := time.Parse("2006-01-02", c.QueryParam("end"))
+	if err1 != nil || err2 != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("formato de data inválido")
+	}
+	if end.Before(start) {
+		return time.Time{}, time.Time{}, fmt.Errorf("data final anterior à data inicial")
+	}
+	return start, end.Add(24 * time.Hour), nil
+}
+
+func employeeEmails(employees []schemas.Employee) []string {
+	emails := make([]string, 0, len(employees))
+	for _, e := range employees {
+		emails = append(emails, e.Email)
+	}
+	return emails
+}
+
+// getReportSummary godoc
+//
+//	@Summary		Resumo de horas por funcionário
+//	@Description	Totaliza dias, horas extras, faltantes e saldo por funcionário da empresa, opcionalmente de uma filial
+//	@Tags			reports
+//	@Produce		json
+//	@Param			company_cnpj	query		string	true	"CNPJ da empresa"
+//	@Param			branch_id		query		int		false	"ID da filial"
+//	@Param			start			query		string	true	"Data de início (YYYY-MM-DD)"
+//	@Param			end				query		string	true	"Data de fim (YYYY-MM-DD)"
+//	@Success		200				{array}		EmployeeSummary
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/reports/summary [get]
+func (api *API) getReportSummary(c echo.Context) error {
+	start, end, err := parseReportPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	_, _, employees, err := api.reportScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: employeeEmails(employees), From: start, To: end})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar registros para o relatório")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar registros"})
+	}
+
+	return c.JSON(http.StatusOK, summarize(employees, timeLogs))
+}
+
+// summarize totals the time logs of each employee, in the employees' order.
+func summarize(employees []schemas.Employee, timeLogs []schemas.TimeLog) []EmployeeSummary {
+	summaries := make([]EmployeeSummary, 0, len(employees))
+	index := map[string]int{}
+	for i, e := range employees {
+		summaries = append(summaries, EmployeeSummary{Name: e.Name, Email: e.Email, BranchID: e.BranchID})
+		index[e.Email] = i
+	}
+	for _, tl := range timeLogs {
+		s := &summaries[index[tl.EmployeeEmail]]
+		s.Days++
+		if !tl.ExitTime.IsZero() {
+			s.CompletedDays++
+		}
+		s.ExtraHours += tl.ExtraHours
+		s.MissingHours += tl.MissingHours
+		s.Balance += tl.Balance
+	}
+	return summaries
+}
+
+// exportAFD godoc
+//
+//	@Summary		Exportar AFD
+//	@Description	Gera o Arquivo Fonte de Dados (Portaria 671) da empresa ou de uma filial no período
+//	@Tags			export
+//	@Produce		text/plain
+//	@Param			company_cnpj	query		string	true	"CNPJ da empresa"
+//	@Param			branch_id		query		int		false	"ID da filial"
+//	@Param			start			query		string	true	"Data de início (YYYY-MM-DD)"
+//	@Param			end				query		string	true	"Data de fim (YYYY-MM-DD)"
+//	@Success		200				{file}		binary	"Arquivo AFD"
+//	@Failure		400				{object}	map[string]string
+//	@Failure		500				{object}	map[string]string
+//	@Router			/reports/afd [get]
+func (api *API) exportAFD(c echo.Context) error {
+	start, end, err := parseReportPeriod(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	company, branch, employees, err := api.reportScope(c)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: employeeEmails(employees), From: start, To: end})
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar registros para o AFD")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar registros"})
+	}
+
+	export := api.afdExport(company, branch, employees, timeLogs, start, end)
+	c.Response().Header().Set("Content-Disposition", "attachment; filename="+export.Filename)
+	return c.Blob(http.StatusOK, export.ContentType, export.Content)
+}
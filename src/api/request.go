@@ -15,6 +15,8 @@ type EmployeeRequest struct {
 	Workload    float32 `json:"workload"`
 	Password    string  `json:"password"`
 	CompanyCNPJ string  `json:"company_cnpj"`
+
+	DepartmentID *uint `json:"department_id"`
 }
 
 func errParamRequired(param, typ string) error {
@@ -47,17 +49,19 @@ func (e *EmployeeRequest) Validate() error {
 	if e.Active == nil {
 		return errParamRequired("active", "bool")
 	}
-	if e.Password == "" {
+	return validatePassword(e.Password)
+}
+
+// validatePassword applies the password security rules.
+func validatePassword(password string) error {
+	if password == "" {
 		return errParamRequired("password", "string")
 	}
-
-	// Regras de segurança para senha (exceto admin, controlado no handler)
-	if len(e.Password) < 6 {
+	if len(password) < 6 {
 		return fmt.Errorf("Senha deve conter no mínimo 6 caracteres")
 	}
-	if !specialCharRegex.MatchString(e.Password) {
+	if !specialCharRegex.MatchString(password) {
 		return fmt.Errorf("Senha deve conter pelo menos um caractere especial")
 	}
-
 	return nil
 }
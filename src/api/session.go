@@ -0,0 +1,131 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// sessionEmployeeKey holds the employee of the session in the echo context.
+const sessionEmployeeKey = "session_employee"
+
+// ErrInvalidSession covers missing, unknown and expired session tokens alike.
+var ErrInvalidSession = errors.New("Sessão inválida ou expirada, entre novamente")
+
+// loginResponse opens a session for the employee and builds the body of a
+// successful login, which carries the session token.
+func (api *API) loginResponse(employee schemas.Employee) (LoginResponse, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return LoginResponse{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(raw)
+	now := api.Clock.Now().UTC()
+
+	if err := api.Repos.Sessions.DeleteExpired(now); err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao remover sessões expiradas")
+	}
+	session := schemas.Session{
+		EmployeeEmail: employee.Email,
+		TokenHash:     hashResetToken(token),
+		ExpiresAt:     now.Add(api.Config.Auth.SessionTTL),
+	}
+	if err := api.Repos.Sessions.Create(&session); err != nil {
+		return LoginResponse{}, err
+	}
+
+	role := "employee"
+	switch {
+	case employee.IsAdmin:
+		role = "admin"
+	case employee.IsManager:
+		role = "manager"
+	}
+	return LoginResponse{
+		Message:       "Login successful",
+		EmployeeID:    employee.ID,
+		EmployeeEmail: employee.Email,
+		EmployeeName:  employee.Name,
+		Role:          role,
+		Token:         token,
+		ExpiresAt:     session.ExpiresAt,
+	}, nil
+}
+
+// bearerToken returns the token of the "Authorization: Bearer" header.
+func bearerToken(c echo.Context) string {
+	header := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(header) > 7 && strings.EqualFold(header[:7], "Bearer ") {
+		return strings.TrimSpace(header[7:])
+	}
+	return ""
+}
+
+// sessionEmployee returns the active employee of an unexpired session.
+func (api *API) sessionEmployee(token string) (schemas.Employee, error) {
+	if token == "" {
+		return schemas.Employee{}, ErrInvalidSession
+	}
+	session, err := api.Repos.Sessions.GetByHash(hashResetToken(token))
+	if err != nil || !api.Clock.Now().UTC().Before(session.ExpiresAt) {
+		return schemas.Employee{}, ErrInvalidSession
+	}
+	employee, err := api.Repos.Employees.GetByEmail(session.EmployeeEmail)
+	if err != nil || !employee.Active {
+		return schemas.Employee{}, ErrInvalidSession
+	}
+	return employee, nil
+}
+
+// requireSession refuses requests without a valid session token and makes the
+// employee of the session available to the handler through currentEmployee.
+func (api *API) requireSession(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		employee, err := api.sessionEmployee(bearerToken(c))
+		if err != nil {
+			return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+		}
+		c.Set(sessionEmployeeKey, employee)
+		return next(c)
+	}
+}
+
+// requireManager lets through only sessions of managers.
+func (api *API) requireManager(next echo.HandlerFunc) echo.HandlerFunc {
+	return api.requireSession(func(c echo.Context) error {
+		if !currentEmployee(c).IsManager {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Acesso restrito a gerentes"})
+		}
+		return next(c)
+	})
+}
+
+// requireAdmin lets through only sessions of administrators.
+func (api *API) requireAdmin(next echo.HandlerFunc) echo.HandlerFunc {
+	return api.requireSession(func(c echo.Context) error {
+		if !currentEmployee(c).IsAdmin {
+			return c.JSON(http.StatusForbidden, map[string]string{"error": "Acesso restrito a administradores"})
+		}
+		return next(c)
+	})
+}
+
+// currentEmployee is the employee of the session checked by requireSession.
+func currentEmployee(c echo.Context) schemas.Employee {
+	employee, _ := c.Get(sessionEmployeeKey).(schemas.Employee)
+	return employee
+}
+
+// EndSession ends the session of the token, if any.
+func (api *API) EndSession(token string) error {
+	if token == "" {
+		return nil
+	}
+	return api.Repos.Sessions.Delete(hashResetToken(token))
+}
@@ -0,0 +1,165 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/oidc"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// ssoStateTTL is how long the user may take at the identity provider.
+const ssoStateTTL = 10 * time.Minute
+
+var (
+	ErrSSONotConfigured   = errors.New("Login único não configurado para esta empresa")
+	ErrSSOInvalidState    = errors.New("Login único expirado, tente novamente")
+	ErrSSOUnknownEmployee = errors.New("Nenhum funcionário ativo da empresa corresponde a esta identidade")
+)
+
+// ssoProviders caches the discovered identity providers by issuer.
+type ssoProviders struct {
+	mu       sync.Mutex
+	byIssuer map[string]*oidc.Provider
+}
+
+var ssoHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// ssoProvider discovers the issuer once; failures are retried on the next
+// login.
+func (api *API) ssoProvider(ctx context.Context, issuer string) (*oidc.Provider, error) {
+	api.sso.mu.Lock()
+	defer api.sso.mu.Unlock()
+	if provider, ok := api.sso.byIssuer[issuer]; ok {
+		return provider, nil
+	}
+	provider, err := oidc.Discover(ctx, ssoHTTPClient, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if api.sso.byIssuer == nil {
+		api.sso.byIssuer = map[string]*oidc.Provider{}
+	}
+	api.sso.byIssuer[issuer] = provider
+	return provider, nil
+}
+
+func (api *API) ssoClient(company schemas.Company) oidc.Client {
+	return oidc.Client{ID: company.SSOClientID, Secret: company.SSOClientSecret, RedirectURL: api.Config.Auth.SSORedirectURL}
+}
+
+// StartSSO begins a single sign-on with the company's identity provider and
+// returns the URL to send the user to.
+func (api *API) StartSSO(ctx context.Context, cnpj string) (string, error) {
+	company, err := api.Repos.Companies.GetByCNPJ(cnpj)
+	if errors.Is(err, db.ErrNotFound) || (err == nil && (company.SSOIssuer == "" || company.SSOClientID == "")) {
+		return "", ErrSSONotConfigured
+	}
+	if err != nil {
+		return "", err
+	}
+	provider, err := api.ssoProvider(ctx, company.SSOIssuer)
+	if err != nil {
+		return "", err
+	}
+
+	var state, nonce, verifier string
+	for _, value := range []*string{&state, &nonce, &verifier} {
+		if *value, err = oidc.RandomString(); err != nil {
+			return "", err
+		}
+	}
+	now := api.Clock.Now().UTC()
+	if err := api.Repos.SSOStates.DeleteExpired(now); err != nil {
+		return "", err
+	}
+	if err := api.Repos.SSOStates.Create(&schemas.SSOLoginState{
+		StateHash:   hashResetToken(state),
+		CompanyCNPJ: company.CNPJ,
+		Nonce:       nonce,
+		Verifier:    verifier,
+		ExpiresAt:   now.Add(ssoStateTTL),
+	}); err != nil {
+		return "", err
+	}
+	return provider.AuthCodeURL(api.ssoClient(company), state, nonce, verifier), nil
+}
+
+// FinishSSO completes a single sign-on with the code returned by the identity
+// provider. The first login finds the employee of the company by the
+// configured e-mail claim and links the identity (issuer and subject) to it;
+// later logins follow the link.
+func (api *API) FinishSSO(ctx context.Context, state, code string) (schemas.Employee, error) {
+	if state == "" {
+		return schemas.Employee{}, ErrSSOInvalidState
+	}
+	pending, err := api.Repos.SSOStates.Take(hashResetToken(state))
+	if errors.Is(err, db.ErrNotFound) {
+		return schemas.Employee{}, ErrSSOInvalidState
+	}
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	if !api.Clock.Now().UTC().Before(pending.ExpiresAt) {
+		return schemas.Employee{}, ErrSSOInvalidState
+	}
+
+	company, err := api.Repos.Companies.GetByCNPJ(pending.CompanyCNPJ)
+	if err != nil || company.SSOIssuer == "" {
+		return schemas.Employee{}, ErrSSONotConfigured
+	}
+	provider, err := api.ssoProvider(ctx, company.SSOIssuer)
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	client := api.ssoClient(company)
+	idToken, err := provider.Exchange(ctx, client, code, pending.Verifier)
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	claims, err := provider.Verify(ctx, idToken, client.ID, pending.Nonce, api.Clock.Now())
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+	subject := claims["sub"].(string)
+
+	identity, err := api.Repos.SSOIdentities.Get(company.SSOIssuer, subject)
+	linked := err == nil
+	if !linked && !errors.Is(err, db.ErrNotFound) {
+		return schemas.Employee{}, err
+	}
+
+	email := identity.Email
+	if !linked {
+		claim := company.SSOEmailClaim
+		if claim == "" {
+			claim = "email"
+		}
+		email, _ = claims[claim].(string)
+		if verified, ok := claims["email_verified"].(bool); claim == "email" && ok && !verified {
+			email = ""
+		}
+	}
+
+	employee, err := api.Repos.Employees.GetByEmail(email)
+	if email == "" || errors.Is(err, db.ErrNotFound) || (err == nil && (employee.CompanyCNPJ != company.CNPJ || !employee.Active)) {
+		return schemas.Employee{}, fmt.Errorf("%w: %s", ErrSSOUnknownEmployee, email)
+	}
+	if err != nil {
+		return schemas.Employee{}, err
+	}
+
+	if !linked {
+		identity = schemas.SSOIdentity{Issuer: company.SSOIssuer, Subject: subject, Email: employee.Email}
+		if err := api.Repos.SSOIdentities.Create(&identity); err != nil {
+			return schemas.Employee{}, err
+		}
+		api.audit("employee", employee.ID, "vincular_sso", employee.Email, fmt.Sprintf("Identidade %s de %s", subject, company.SSOIssuer))
+	}
+	return employee, nil
+}
@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// ssoPage is the web page that receives the result of a single sign-on in
+// the URL fragment, like the JSON of /login.
+const ssoPage = "/sso.html"
+
+// attemptSSORefused is recorded when the identity provider or the employee
+// lookup refuses a single sign-on.
+const attemptSSORefused = "sso_recusado"
+
+// startSSO godoc
+//
+//	@Summary		Login único
+//	@Description	Redireciona ao provedor de identidade (OpenID Connect) configurado para a empresa
+//	@Tags			auth
+//	@Param			cnpj	path	string	true	"CNPJ da empresa"
+//	@Success		302
+//	@Failure		404	{object}	map[string]string
+//	@Failure		502	{object}	map[string]string
+//	@Router			/login/sso/{cnpj} [get]
+func (api *API) startSSO(c echo.Context) error {
+	target, err := api.StartSSO(c.Request().Context(), c.Param("cnpj"))
+	if errors.Is(err, ErrSSONotConfigured) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": err.Error()})
+	}
+	if err != nil {
+		log.Error().Err(err).Str("company", c.Param("cnpj")).Msg("[api] Erro ao iniciar login único")
+		return c.JSON(http.StatusBadGateway, map[string]string{"error": "Provedor de identidade indisponível"})
+	}
+	return c.Redirect(http.StatusFound, target)
+}
+
+// ssoCallback godoc
+//
+//	@Summary		Retorno do login único
+//	@Description	Recebe o código do provedor de identidade e redireciona para sso.html com o resultado do login no fragmento da URL. Os bloqueios por tentativas falhas e a autenticação em dois fatores valem como no /login: com 2FA ativo o fragmento traz two_factor_required e o challenge a concluir em /login/2fa
+//	@Tags			auth
+//	@Param			state	query	string	true	"State do início do login"
+//	@Param			code	query	string	false	"Código de autorização"
+//	@Param			error	query	string	false	"Erro informado pelo provedor"
+//	@Success		302
+//	@Router			/login/sso/callback [get]
+func (api *API) ssoCallback(c echo.Context) error {
+	ip, userAgent := c.RealIP(), c.Request().UserAgent()
+	result := func(values url.Values) error {
+		return c.Redirect(http.StatusFound, ssoPage+"#"+values.Encode())
+	}
+	fail := func(message string) error {
+		api.recordLoginAttempt("", ip, userAgent, false, attemptSSORefused)
+		return result(url.Values{"error": {message}})
+	}
+
+	if providerError := c.QueryParam("error"); providerError != "" {
+		log.Warn().Str("error", providerError).Str("description", c.QueryParam("error_description")).Msg("[api] Login único recusado pelo provedor")
+		return fail("Login recusado pelo provedor de identidade")
+	}
+
+	employee, err := api.FinishSSO(c.Request().Context(), c.QueryParam("state"), c.QueryParam("code"))
+	switch {
+	case errors.Is(err, ErrSSOInvalidState), errors.Is(err, ErrSSONotConfigured):
+		return fail(err.Error())
+	case errors.Is(err, ErrSSOUnknownEmployee):
+		log.Warn().Err(err).Msg("[api] Login único sem funcionário correspondente")
+		return fail(ErrSSOUnknownEmployee.Error())
+	case err != nil:
+		log.Error().Err(err).Msg("[api] Erro ao concluir login único")
+		return fail("Não foi possível validar o login com o provedor de identidade")
+	}
+
+	// O provedor substitui só a senha: bloqueios e 2FA valem como no /login
+	if err := api.checkIP(ip); err != nil {
+		api.recordLoginAttempt(employee.Email, ip, userAgent, false, attemptIPBlocked)
+		return result(url.Values{"error": {err.Error()}})
+	}
+	login, err := api.Repos.Logins.GetByEmail(employee.Email)
+	hasLogin := err == nil
+	if hasLogin {
+		if err := api.checkLocked(login); err != nil {
+			api.recordLoginAttempt(employee.Email, ip, userAgent, false, attemptAccountLocked)
+			return result(url.Values{"error": {err.Error()}})
+		}
+		if login.TOTPEnabled {
+			challenge, err := api.newLoginChallenge(&login)
+			if err != nil {
+				log.Error().Err(err).Msg("[api] Erro ao iniciar segunda etapa do login único")
+				return fail("Não foi possível concluir o login")
+			}
+			return result(url.Values{"two_factor_required": {"true"}, "challenge": {challenge}})
+		}
+	}
+	if api.twoFactorEnforced(employee) {
+		api.recordLoginAttempt(employee.Email, ip, userAgent, false, attemptTwoFactorMissing)
+		return result(url.Values{"error": {ErrTwoFactorEnforced.Error() + ", ative-a antes de entrar"}})
+	}
+
+	if hasLogin {
+		api.loginSucceeded(&login)
+	}
+	api.recordLoginAttempt(employee.Email, ip, userAgent, true, "")
+	response, err := api.loginResponse(employee)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao abrir sessão do login único")
+		return fail("Não foi possível concluir o login")
+	}
+	return result(url.Values{
+		"employee_id":    {strconv.FormatUint(uint64(response.EmployeeID), 10)},
+		"employee_email": {response.EmployeeEmail},
+		"employee_name":  {response.EmployeeName},
+		"role":           {response.Role},
+		"token":          {response.Token},
+		"expires_at":     {response.ExpiresAt.Format(time.RFC3339)},
+	})
+}
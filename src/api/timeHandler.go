@@ -1,13 +1,15 @@
 package api
 
 import (
+	"errors"
 	"fmt"
+	"github.com/MWismeck/marca-tempo/src/db"
 	"github.com/MWismeck/marca-tempo/src/schemas"
 	"github.com/labstack/echo/v4"
 	"github.com/rs/zerolog/log"
 	"github.com/xuri/excelize/v2"
-	"gorm.io/gorm"
 	"net/http"
+	"slices"
 	"strconv"
 	"time"
 )
@@ -15,13 +17,14 @@ import (
 // createTimeLog godoc
 //
 //	@Summary		Criar registro de ponto
-//	@Description	Cria um novo registro de ponto para um funcionário
+//	@Description	Cria um novo registro de ponto para um funcionário, importado de outro sistema; os horários informados entram no histórico de marcações com origem importacao
 //	@Tags			timeLogs
 //	@Accept			json
 //	@Produce		json
 //	@Param			body	body		schemas.TimeLog	true	"Dados do registro de ponto"
 //	@Success		201		{object}	schemas.TimeLog
 //	@Failure		400		{string}	string	"Dados inválidos ou funcionário não encontrado"
+//	@Failure		409		{string}	string	"Já existe registro de ponto do funcionário neste dia"
 //	@Failure		500		{string}	string	"Erro interno do servidor"
 //	@Router			/time_logs [post]
 func (api *API) createTimeLog(c echo.Context) error {
@@ -36,12 +39,23 @@ func (api *API) createTimeLog(c echo.Context) error {
 		log.Error().Msg("Invalid employee email")
 		return c.String(http.StatusBadRequest, "Invalid employee ID")
 	}
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", timeLog.EmployeeEmail).First(&employee).Error; err != nil {
+	if _, err := api.Repos.Employees.GetByEmail(timeLog.EmployeeEmail); err != nil {
 		log.Error().Err(err).Msg("Employee not found")
 		return c.String(http.StatusBadRequest, "Employee not found")
 	}
-	if err := api.DB.DB.Create(&timeLog).Error; err != nil {
+	// log_date is a calendar day, not an instant: keep the submitted date
+	timeLog.LogDate = localDate(timeLog.LogDate, time.UTC)
+	err := api.Repos.Transaction(func(repos db.Repositories) error {
+		if err := repos.TimeLogs.Create(&timeLog); err != nil {
+			return err
+		}
+		return recordChanges(repos, schemas.TimeLog{}, timeLog, punchRequestDetails(c, sourceImport))
+	})
+	if errors.Is(err, db.ErrDuplicate) {
+		log.Warn().Str("employee", timeLog.EmployeeEmail).Msg("Time log of the day already exists")
+		return c.String(http.StatusConflict, "Time log already exists for this day")
+	}
+	if err != nil {
 		log.Error().Err(err).Msg("Failed to create time log")
 		return c.String(http.StatusInternalServerError, "Error creating time log")
 	}
@@ -69,9 +83,8 @@ func (api *API) getTimeLogs(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid employee email")
 	}
 
-	var timeLogs []schemas.TimeLog
-
-	if err := api.DB.DB.Where("employee_email = ?", employeeEmail).Find(&timeLogs).Error; err != nil {
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{employeeEmail}})
+	if err != nil {
 		log.Error().Err(err).Msgf("Failed to retrieve time logs for employee email %s", employeeEmail)
 		return c.String(http.StatusInternalServerError, "Error retrieving time logs")
 	}
@@ -82,15 +95,24 @@ func (api *API) getTimeLogs(c echo.Context) error {
 // punchTime godoc
 //
 //	@Summary		Registrar ponto
-//	@Description	Registra entrada, saída para almoço, retorno do almoço ou saída
+//	@Description	Registra entrada, saída para almoço, retorno do almoço ou saída: a marcação indicada em punch_type ou, sem ela, a seguinte à última do dia. Marcações que pulam etapas são aceitas e devolvem as etapas puladas em skipped; voltar a uma etapa anterior a outra já registrada é recusado. Uma repetição com a mesma Idempotency-Key, ou feita antes do intervalo mínimo entre marcações, devolve o registro sem marcar de novo
 //	@Tags			timeLogs
 //	@Accept			json
 //	@Produce		json
 //	@Param			id				path	int		true	"ID do registro de ponto"
 //	@Param			employee_email	query	string	true	"Email do funcionário"
-//	@Success		200				{object}	schemas.TimeLog
-//	@Success		201				{object}	schemas.TimeLog
-//	@Failure		400				{string}	string	"Dados inválidos ou todos os pontos já registrados"
+//	@Param			punch_type		query	string	false	"entrada, saida_almoco, retorno_almoco ou saida"
+//	@Param			qr_code			query	string	false	"QR code lido no local de trabalho"
+//	@Param			latitude		query	number	false	"Latitude do dispositivo (graus decimais)"
+//	@Param			longitude		query	number	false	"Longitude do dispositivo (graus decimais)"
+//	@Param			accuracy		query	number	false	"Precisão da localização em metros"
+//	@Param			X-Punch-Source	header	string	false	"web (padrão) ou mobile"
+//	@Param			X-Device-ID		header	string	false	"Identificador do dispositivo"
+//	@Param			Idempotency-Key	header	string	false	"Chave da tentativa; repetições devolvem o ponto já registrado"
+//	@Success		200				{object}	PunchResponse
+//	@Success		201				{object}	PunchResponse
+//	@Failure		400				{string}	string	"Dados inválidos, tipo de marcação inválido, já registrado ou fora de ordem, QR code ou localização inválidos ou todos os pontos já registrados"
+//	@Failure		403				{string}	string	"A empresa exige o QR code do local ou a marcação está fora da cerca virtual"
 //	@Failure		500				{string}	string	"Erro interno do servidor"
 //	@Router			/time_logs/{id} [put]
 func (api *API) punchTime(c echo.Context) error {
@@ -101,70 +123,85 @@ func (api *API) punchTime(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Employee email is required")
 	}
 
-	now := time.Now()
-	year, month, day := now.Date()
-	currentDate := time.Date(year, month, day, 0, 0, 0, 0, now.Location())
-
-	log.Info().
-		Str("currentDate", currentDate.Format("2006-01-02")).
-		Str("currentTime", now.Format("15:04:05")).
-		Msg("Current date and time")
-
-	var timeLog schemas.TimeLog
-	if err := api.DB.DB.Where("employee_email = ? AND log_date = ?", employeeEmail, currentDate).First(&timeLog).Error; err != nil {
-		if err == gorm.ErrRecordNotFound {
-			timeLog = schemas.TimeLog{
-				EmployeeEmail: employeeEmail,
-				LogDate:       currentDate,
-				EntryTime:     now,
-			}
-			if err := api.DB.DB.Create(&timeLog).Error; err != nil {
-				log.Error().Err(err).Msg("Failed to create time log")
-				return c.String(http.StatusInternalServerError, "Error creating time log")
-			}
+	punchType := c.QueryParam("punch_type")
+	if punchType != "" && !slices.Contains(punchOrder, punchType) {
+		return c.String(http.StatusBadRequest, ErrInvalidPunchType.Error())
+	}
 
-			return c.JSON(http.StatusCreated, timeLog)
+	// a retry of a punch already registered gets the original result, before
+	// its QR code or location are checked again
+	key, err := punchIdempotencyKey(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if key != "" {
+		previous, found, err := api.punchByKey(employeeEmail, key)
+		if err != nil {
+			log.Error().Err(err).Msg("Failed to look up idempotency key")
+			return c.String(http.StatusInternalServerError, "Error registering punch")
 		}
-		log.Error().Err(err).Msg("Failed to retrieve time log")
-		return c.String(http.StatusInternalServerError, "Error retrieving time log")
-	}
-
-	if timeLog.EntryTime.IsZero() {
-		timeLog.EntryTime = now
-	} else if timeLog.LunchExitTime.IsZero() {
-		timeLog.LunchExitTime = now
-	} else if timeLog.LunchReturnTime.IsZero() {
-		timeLog.LunchReturnTime = now
-	} else if timeLog.ExitTime.IsZero() {
-		timeLog.ExitTime = now
-
-		var employee schemas.Employee
-		if err := api.DB.DB.Where("email = ?", employeeEmail).First(&employee).Error; err != nil {
-			log.Error().Err(err).Msg("Failed to retrieve employee for workload calculation")
-		} else {
-			extraHours, missingHours, balance := api.CalculateHours(
-				timeLog.EntryTime,
-				timeLog.LunchExitTime,
-				timeLog.LunchReturnTime,
-				timeLog.ExitTime,
-				employee.Workload,
-			)
-
-			timeLog.ExtraHours = extraHours
-			timeLog.MissingHours = missingHours
-			timeLog.Balance = balance
+		if found {
+			log.Info().Str("employee", employeeEmail).Str("punch", previous.Punch).Msg("Punch retried with the same idempotency key")
+			return c.JSON(http.StatusOK, newPunchResponse(previous))
 		}
-	} else {
-		log.Warn().Msgf("All time log fields are already filled for employee %s", employeeEmail)
-		return c.String(http.StatusBadRequest, "All time log fields are already filled for today")
 	}
 
-	if err := api.DB.DB.Save(&timeLog).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to update time log")
-		return c.String(http.StatusInternalServerError, "Error updating time log")
+	workplaceID, err := api.punchWorkplace(employeeEmail, c.QueryParam("qr_code"), api.Clock.Now())
+	switch {
+	case errors.Is(err, ErrQRCodeRequired):
+		return c.String(http.StatusForbidden, err.Error())
+	case errors.Is(err, ErrQRCodeInvalid), errors.Is(err, ErrQRCodeExpired):
+		log.Warn().Str("employee", employeeEmail).Msg("QR code refused")
+		return c.String(http.StatusBadRequest, err.Error())
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to validate QR code")
+		return c.String(http.StatusInternalServerError, "Error registering punch")
 	}
 
-	return c.JSON(http.StatusOK, timeLog)
+	source, err := webPunchSource(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	location, err := parsePunchLocation(c)
+	if err != nil {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	geofence, err := api.geofenceStatus(employeeEmail, location)
+	switch {
+	case errors.Is(err, ErrLocationRequired), errors.Is(err, ErrLocationVague), errors.Is(err, ErrOutsideGeofence):
+		log.Warn().Str("employee", employeeEmail).Str("geofence", geofence).Msg("Punch refused by geofence")
+		return c.String(http.StatusForbidden, err.Error())
+	case err != nil:
+		log.Error().Err(err).Msg("Failed to check geofences")
+		return c.String(http.StatusInternalServerError, "Error registering punch")
+	}
+
+	details := punchRequestDetails(c, source)
+	details.WorkplaceID, details.Location, details.GeofenceStatus = workplaceID, location, geofence
+	details.IdempotencyKey = key
+	result, err := api.Punch(employeeEmail, punchType, details)
+	if errors.Is(err, ErrDayComplete) || errors.Is(err, ErrPunchRegistered) || errors.Is(err, ErrPunchOutOfOrder) {
+		return c.String(http.StatusBadRequest, err.Error())
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Failed to register punch")
+		return c.String(http.StatusInternalServerError, "Error registering punch")
+	}
+
+	if result.Created {
+		return c.JSON(http.StatusCreated, newPunchResponse(result))
+	}
+	return c.JSON(http.StatusOK, newPunchResponse(result))
+}
+
+// weeklyWorkload returns the employee's weekly workload in force on date, or
+// the configured default for employees without one.
+func (api *API) weeklyWorkload(employee schemas.Employee, date time.Time) float32 {
+	workload := api.workloadOn(employee, date)
+	if workload < 0.1 {
+		return api.Config.Work.DefaultWorkload
+	}
+	return workload
 }
 
 func (api *API) CalculateHours(entryTime, lunchExitTime, lunchReturnTime, exitTime time.Time, workload float32) (extraHours, missingHours, balance float32) {
@@ -173,8 +210,8 @@ func (api *API) CalculateHours(entryTime, lunchExitTime, lunchReturnTime, exitTi
 	}
 
 	if workload < 0.1 {
-		workload = 40.0
-		log.Warn().Msg("Workload not set or too small, using default of 40 hours per week")
+		workload = api.Config.Work.DefaultWorkload
+		log.Warn().Float32("workload", workload).Msg("Workload not set or too small, using the default weekly workload")
 	}
 
 	dailyWorkload := workload / 5
@@ -213,6 +250,37 @@ func (api *API) CalculateHours(entryTime, lunchExitTime, lunchReturnTime, exitTi
 	return
 }
 
+// withinTolerance zeroes the day's result when the difference from the daily
+// workload does not exceed the company tolerance (CLT art. 58 §1º).
+func withinTolerance(extraHours, missingHours, balance float32, toleranceMinutes int) (float32, float32, float32) {
+	limit := float32(toleranceMinutes) / 60
+	if toleranceMinutes > 0 && balance <= limit && balance >= -limit {
+		return 0, 0, 0
+	}
+	return extraHours, missingHours, balance
+}
+
+// applyHours calculates the extra hours, missing hours and balance of a
+// complete time log using the employee's workload and company rules in force
+// on the day of the log.
+func (api *API) applyHours(timeLog *schemas.TimeLog, employee schemas.Employee) {
+	var company schemas.Company
+	if employee.CompanyCNPJ != "" {
+		company, _ = api.Repos.Companies.GetByCNPJ(employee.CompanyCNPJ)
+	}
+
+	extraHours, missingHours, balance := api.CalculateHours(
+		timeLog.EntryTime,
+		timeLog.LunchExitTime,
+		timeLog.LunchReturnTime,
+		timeLog.ExitTime,
+		api.workloadOn(employee, timeLog.LogDate),
+	)
+	timeLog.ExtraHours, timeLog.MissingHours, timeLog.Balance =
+		withinTolerance(extraHours, missingHours, balance, api.toleranceOn(company, timeLog.LogDate))
+	timeLog.Status = dayComplete
+}
+
 // exportToExcel godoc
 //
 //	@Summary		Exportar registros para Excel
@@ -232,14 +300,16 @@ func (api *API) exportToExcel(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid employee email")
 	}
 
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", employeeEmail).First(&employee).Error; err != nil {
+	employee, err := api.Repos.Employees.GetByEmail(employeeEmail)
+	if err != nil {
 		log.Error().Err(err).Msg("Employee not found")
 		return c.String(http.StatusBadRequest, "Employee not found")
 	}
 
-	var timeLogs []schemas.TimeLog
-	if err := api.DB.DB.Where("employee_email = ?", employeeEmail).Order("log_date DESC").Find(&timeLogs).Error; err != nil {
+	loc := api.employeeLocation(employee)
+
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{employeeEmail}, Descending: true})
+	if err != nil {
 		log.Error().Err(err).Msgf("Failed to retrieve time logs for employee email %s", employeeEmail)
 		return c.String(http.StatusInternalServerError, "Error retrieving time logs")
 	}
@@ -262,7 +332,7 @@ func (api *API) exportToExcel(c echo.Context) error {
 	f.SetCellValue(sheetName, "A1", "Relatório de Ponto")
 	f.SetCellValue(sheetName, "A2", fmt.Sprintf("Funcionário: %s", employee.Name))
 	f.SetCellValue(sheetName, "A3", fmt.Sprintf("Email: %s", employee.Email))
-	f.SetCellValue(sheetName, "A4", fmt.Sprintf("Data de Geração: %s", time.Now().Format("02/01/2006 15:04:05")))
+	f.SetCellValue(sheetName, "A4", fmt.Sprintf("Data de Geração: %s", api.Clock.Now().In(loc).Format("02/01/2006 15:04:05")))
 
 	headers := []string{"Data", "Entrada", "Saída Almoço", "Retorno Almoço", "Saída", "Horas Extras", "Horas Faltantes", "Saldo", "Status", "Editado Por", "Data Edição", "Motivo Edição"}
 	for i, header := range headers {
@@ -283,22 +353,22 @@ func (api *API) exportToExcel(c echo.Context) error {
 		}
 
 		if !log.EntryTime.IsZero() {
-			timeStr := log.EntryTime.Format(timeFormat)
+			timeStr := log.EntryTime.In(loc).Format(timeFormat)
 			f.SetCellValue(sheetName, fmt.Sprintf("B%d", row), timeStr)
 		}
 
 		if !log.LunchExitTime.IsZero() {
-			timeStr := log.LunchExitTime.Format(timeFormat)
+			timeStr := log.LunchExitTime.In(loc).Format(timeFormat)
 			f.SetCellValue(sheetName, fmt.Sprintf("C%d", row), timeStr)
 		}
 
 		if !log.LunchReturnTime.IsZero() {
-			timeStr := log.LunchReturnTime.Format(timeFormat)
+			timeStr := log.LunchReturnTime.In(loc).Format(timeFormat)
 			f.SetCellValue(sheetName, fmt.Sprintf("D%d", row), timeStr)
 		}
 
 		if !log.ExitTime.IsZero() {
-			timeStr := log.ExitTime.Format(timeFormat)
+			timeStr := log.ExitTime.In(loc).Format(timeFormat)
 			f.SetCellValue(sheetName, fmt.Sprintf("E%d", row), timeStr)
 		}
 
@@ -311,7 +381,7 @@ func (api *API) exportToExcel(c echo.Context) error {
 			f.SetCellValue(sheetName, fmt.Sprintf("I%d", row), "EDITADO")
 			f.SetCellValue(sheetName, fmt.Sprintf("J%d", row), log.EditadoPorGerente)
 			if !log.EditadoEm.IsZero() {
-				f.SetCellValue(sheetName, fmt.Sprintf("K%d", row), log.EditadoEm.Format("02/01/2006 15:04"))
+				f.SetCellValue(sheetName, fmt.Sprintf("K%d", row), log.EditadoEm.In(loc).Format("02/01/2006 15:04"))
 			}
 			f.SetCellValue(sheetName, fmt.Sprintf("L%d", row), log.MotivoEdicao)
 		} else {
@@ -348,7 +418,7 @@ func (api *API) exportToExcel(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Error generating Excel file")
 	}
 
-	fileName := fmt.Sprintf("registros_ponto_%s_%s.xlsx", employee.Name, time.Now().Format("20060102"))
+	fileName := fmt.Sprintf("registros_ponto_%s_%s.xlsx", employee.Name, api.Clock.Now().In(loc).Format("20060102"))
 	c.Response().Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%s", fileName))
 	c.Response().Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 
@@ -358,11 +428,13 @@ func (api *API) exportToExcel(c echo.Context) error {
 // deleteTimeLog godoc
 //
 //	@Summary		Excluir registro de ponto
-//	@Description	Remove um registro de ponto do sistema
+//	@Description	Remove um registro de ponto do sistema. Exige a sessão de um administrador
 //	@Tags			timeLogs
 //	@Param			id	path		int	true	"ID do registro de ponto"
 //	@Success		200	{string}	string	"Registro excluído com sucesso"
 //	@Failure		400	{string}	string	"ID inválido"
+//	@Failure		401	{object}	map[string]string
+//	@Failure		403	{object}	map[string]string
 //	@Failure		404	{string}	string	"Registro não encontrado"
 //	@Failure		500	{string}	string	"Erro interno do servidor"
 //	@Router			/time_logs/{id} [delete]
@@ -375,13 +447,13 @@ func (api *API) deleteTimeLog(c echo.Context) error {
 		return c.String(http.StatusBadRequest, "Invalid time log ID")
 	}
 
-	var timeLog schemas.TimeLog
-	if err := api.DB.DB.First(&timeLog, id).Error; err != nil {
+	timeLog, err := api.Repos.TimeLogs.Get(uint(id))
+	if err != nil {
 		log.Error().Err(err).Msgf("Time log with ID %d not found", id)
 		return c.String(http.StatusNotFound, "Time log not found")
 	}
 
-	if err := api.DB.DB.Delete(&timeLog).Error; err != nil {
+	if err := api.Repos.TimeLogs.Delete(&timeLog); err != nil {
 		log.Error().Err(err).Msg("Failed to delete time log")
 		return c.String(http.StatusInternalServerError, "Error deleting time log")
 	}
@@ -396,12 +468,13 @@ func (api *API) deleteTimeLog(c echo.Context) error {
 //	@Tags			manager
 //	@Accept			json
 //	@Produce		json
+//	@Param			Authorization	header	string				true	"Bearer <token> da sessão do gerente"
 //	@Param			id		path	int					true	"ID do registro de ponto"
 //	@Param			body	body	ManualEditRequest	true	"Dados para edição manual"
 //	@Success		200		{object}	schemas.TimeLog
 //	@Failure		400		{string}	string	"Dados inválidos ou motivo obrigatório"
-//	@Failure		401		{string}	string	"Gerente não encontrado"
-//	@Failure		403		{string}	string	"Sem permissão para editar funcionários de outra empresa"
+//	@Failure		401		{object}	map[string]string	"Sessão inválida ou expirada"
+//	@Failure		403		{string}	string	"Sem permissão para editar funcionários fora da sua equipe"
 //	@Failure		404		{string}	string	"Registro não encontrado"
 //	@Failure		500		{string}	string	"Erro interno do servidor"
 //	@Router			/time_logs/{id}/manual_edit [put]
@@ -417,13 +490,15 @@ func (api *API) editTimeLogByManager(c echo.Context) error {
 		LunchReturnTime string `json:"lunch_return_time"`
 		ExitTime        string `json:"exit_time"`
 		MotivoEdicao    string `json:"motivo_edicao"`
-		ManagerEmail    string `json:"manager_email"`
+		// RequestID is the approved request the edit carries out, if any
+		RequestID uint `json:"request_id"`
 	}
 
 	if err := c.Bind(&updateData); err != nil {
 		log.Error().Err(err).Msg("[api] Erro ao fazer bind dos dados de edição")
 		return c.JSON(http.StatusBadRequest, "Dados inválidos")
 	}
+	manager := currentEmployee(c)
 
 	log.Info().
 		Int("timeLogId", id).
@@ -432,42 +507,49 @@ func (api *API) editTimeLogByManager(c echo.Context) error {
 		Str("lunchReturnTime", updateData.LunchReturnTime).
 		Str("exitTime", updateData.ExitTime).
 		Str("motivo", updateData.MotivoEdicao).
-		Str("managerEmail", updateData.ManagerEmail).
+		Str("managerEmail", manager.Email).
 		Msg("[api] Dados recebidos para edição")
 
 	if updateData.MotivoEdicao == "" {
 		return c.JSON(http.StatusBadRequest, "Motivo da edição é obrigatório")
 	}
 
-	if updateData.ManagerEmail == "" {
-		return c.JSON(http.StatusBadRequest, "Email do gerente é obrigatório")
-	}
-
-	var timeLog schemas.TimeLog
-	if err := api.DB.DB.First(&timeLog, id).Error; err != nil {
+	timeLog, err := api.Repos.TimeLogs.Get(uint(id))
+	if err != nil {
 		return c.JSON(http.StatusNotFound, "Registro não encontrado")
 	}
 
-	var manager schemas.Employee
-	if err := api.DB.DB.Where("email = ? AND is_manager = ?", updateData.ManagerEmail, true).First(&manager).Error; err != nil {
-		log.Error().Err(err).Msgf("[api] Gerente não encontrado: %s", updateData.ManagerEmail)
-		return c.JSON(http.StatusUnauthorized, "Gerente não encontrado")
-	}
-
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", timeLog.EmployeeEmail).First(&employee).Error; err != nil {
+	employee, err := api.Repos.Employees.GetByEmail(timeLog.EmployeeEmail)
+	if err != nil {
 		log.Error().Err(err).Msgf("[api] Funcionário não encontrado: %s", timeLog.EmployeeEmail)
 		return c.JSON(http.StatusNotFound, "Funcionário não encontrado")
 	}
 
-	if manager.CompanyCNPJ != employee.CompanyCNPJ {
+	allowed, err := api.canManage(manager, employee)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao verificar hierarquia do gerente")
+		return c.JSON(http.StatusInternalServerError, "Erro ao verificar permissões")
+	}
+	if !allowed {
 		log.Warn().
-			Str("manager_cnpj", manager.CompanyCNPJ).
-			Str("employee_cnpj", employee.CompanyCNPJ).
-			Msg("[api] Tentativa de edição entre empresas diferentes")
-		return c.JSON(http.StatusForbidden, "Você só pode editar funcionários da sua empresa")
+			Str("managerEmail", manager.Email).
+			Str("employeeEmail", employee.Email).
+			Msg("[api] Tentativa de edição fora da equipe do gerente")
+		return c.JSON(http.StatusForbidden, "Você só pode editar funcionários da sua equipe")
 	}
 
+	details := punchRequestDetails(c, sourceManualEdit)
+	if updateData.RequestID != 0 {
+		request, err := api.Repos.Requests.Get(updateData.RequestID)
+		if err != nil || request.Status != "aprovado" || request.FuncionarioEmail != timeLog.EmployeeEmail {
+			return c.JSON(http.StatusBadRequest, "Solicitação aprovada não encontrada para este funcionário")
+		}
+		details.Source = sourceApprovedRequest
+	}
+	before := timeLog
+
+	// Horários sem fuso são interpretados no fuso da empresa e gravados em UTC
+	loc := api.employeeLocation(employee)
 	parseDateTime := func(dateTimeStr string) (time.Time, error) {
 		if dateTimeStr == "" {
 			return time.Time{}, nil
@@ -479,8 +561,8 @@ func (api *API) editTimeLogByManager(c echo.Context) error {
 		}
 		
 		for _, format := range formats {
-			if t, err := time.Parse(format, dateTimeStr); err == nil {
-				return t, nil
+			if t, err := time.ParseInLocation(format, dateTimeStr, loc); err == nil {
+				return t.UTC(), nil
 			}
 		}
 		return time.Time{}, fmt.Errorf("formato de data/hora inválido: %s", dateTimeStr)
@@ -523,40 +605,36 @@ func (api *API) editTimeLogByManager(c echo.Context) error {
 	}
 
 	timeLog.EditadoPorGerente = manager.Name
-	timeLog.EditadoEm = time.Now()
+	timeLog.EditadoEm = api.Clock.Now().UTC()
 	timeLog.MotivoEdicao = updateData.MotivoEdicao
 
 	// Recalcular horas se todos os horários estão preenchidos
 	if !timeLog.EntryTime.IsZero() && !timeLog.LunchExitTime.IsZero() && 
 	   !timeLog.LunchReturnTime.IsZero() && !timeLog.ExitTime.IsZero() {
-		extraHours, missingHours, balance := api.CalculateHours(
-			timeLog.EntryTime,
-			timeLog.LunchExitTime,
-			timeLog.LunchReturnTime,
-			timeLog.ExitTime,
-			employee.Workload,
-		)
-		
-		timeLog.ExtraHours = extraHours
-		timeLog.MissingHours = missingHours
-		timeLog.Balance = balance
+		api.applyHours(&timeLog, employee)
 		
 		log.Info().
 			Int("timeLogId", id).
-			Float32("extraHours", extraHours).
-			Float32("missingHours", missingHours).
-			Float32("balance", balance).
+			Float32("extraHours", timeLog.ExtraHours).
+			Float32("missingHours", timeLog.MissingHours).
+			Float32("balance", timeLog.Balance).
 			Msg("[api] Horas recalculadas após edição")
 	}
 
-	if err := api.DB.DB.Save(&timeLog).Error; err != nil {
+	err = api.Repos.Transaction(func(repos db.Repositories) error {
+		if err := repos.TimeLogs.Update(&timeLog); err != nil {
+			return err
+		}
+		return recordChanges(repos, before, timeLog, details)
+	})
+	if err != nil {
 		log.Error().Err(err).Msg("[api] Erro ao salvar edição do time log")
 		return c.JSON(http.StatusInternalServerError, "Erro ao salvar")
 	}
 
 	log.Info().
 		Int("timeLogId", id).
-		Str("managerEmail", updateData.ManagerEmail).
+		Str("managerEmail", manager.Email).
 		Str("employeeEmail", timeLog.EmployeeEmail).
 		Str("motivo", updateData.MotivoEdicao).
 		Msg("[api] Time log editado pelo gerente")
@@ -602,7 +680,7 @@ func (api *API) requestTimeEdit(c echo.Context) error {
 		Str("status", req.Status).
 		Msg("[api] Criando nova solicitação")
 
-	if err := api.DB.DB.Create(&req).Error; err != nil {
+	if err := api.Repos.Requests.Create(&req); err != nil {
 		log.Error().Err(err).Msg("[api] Erro ao salvar solicitação no banco")
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao salvar solicitação"})
 	}
@@ -627,11 +705,14 @@ func (api *API) requestTimeEdit(c echo.Context) error {
 //	@Tags			export
 //	@Accept			json
 //	@Produce		application/vnd.openxmlformats-officedocument.spreadsheetml.sheet
+//	@Param			Authorization	header	string	true	"Bearer <token> da sessão do gerente"
 //	@Param			employee_email	query	string	true	"Email do funcionário"
 //	@Param			start			query	string	true	"Data de início (YYYY-MM-DD)"
 //	@Param			end				query	string	true	"Data de fim (YYYY-MM-DD)"
 //	@Success		200				{file}	binary	"Arquivo Excel gerado com sucesso"
 //	@Failure		400				{string}	string	"Parâmetros obrigatórios ou formato de data inválido"
+//	@Failure		401				{object}	map[string]string	"Sessão inválida ou expirada"
+//	@Failure		403				{string}	string	"Funcionário fora da equipe do gerente"
 //	@Failure		404				{string}	string	"Nenhum registro no período selecionado"
 //	@Failure		500				{string}	string	"Erro interno do servidor"
 //	@Router			/time_logs/export_range [get]
@@ -652,16 +733,23 @@ func (api *API) exportTimeLogsRange(c echo.Context) error {
 
 	end = end.Add(24 * time.Hour)
 
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", email).First(&employee).Error; err != nil {
+	employee, err := api.Repos.Employees.GetByEmail(email)
+	if err != nil {
 		return c.String(http.StatusBadRequest, "Funcionário não encontrado")
 	}
+	allowed, err := api.canManage(currentEmployee(c), employee)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao verificar hierarquia do gerente")
+		return c.String(http.StatusInternalServerError, "Erro ao verificar permissões")
+	}
+	if !allowed {
+		return c.String(http.StatusForbidden, "Você só pode exportar funcionários da sua equipe")
+	}
+
+	loc := api.employeeLocation(employee)
 
-	var timeLogs []schemas.TimeLog
-	if err := api.DB.DB.
-		Where("employee_email = ? AND log_date BETWEEN ? AND ?", email, start, end).
-		Order("log_date").
-		Find(&timeLogs).Error; err != nil {
+	timeLogs, err := api.Repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{email}, From: start, To: end})
+	if err != nil {
 		return c.String(http.StatusInternalServerError, "Erro ao buscar registros")
 	}
 
@@ -695,10 +783,10 @@ func (api *API) exportTimeLogsRange(c echo.Context) error {
 			timeFormat = "15:04*"
 		}
 		
-		f.SetCellValue(sheet, fmt.Sprintf("B%d", row), log.EntryTime.Format(timeFormat))
-		f.SetCellValue(sheet, fmt.Sprintf("C%d", row), log.LunchExitTime.Format(timeFormat))
-		f.SetCellValue(sheet, fmt.Sprintf("D%d", row), log.LunchReturnTime.Format(timeFormat))
-		f.SetCellValue(sheet, fmt.Sprintf("E%d", row), log.ExitTime.Format(timeFormat))
+		f.SetCellValue(sheet, fmt.Sprintf("B%d", row), formatIn(log.EntryTime, loc, timeFormat))
+		f.SetCellValue(sheet, fmt.Sprintf("C%d", row), formatIn(log.LunchExitTime, loc, timeFormat))
+		f.SetCellValue(sheet, fmt.Sprintf("D%d", row), formatIn(log.LunchReturnTime, loc, timeFormat))
+		f.SetCellValue(sheet, fmt.Sprintf("E%d", row), formatIn(log.ExitTime, loc, timeFormat))
 		f.SetCellValue(sheet, fmt.Sprintf("F%d", row), log.ExtraHours)
 		f.SetCellValue(sheet, fmt.Sprintf("G%d", row), log.MissingHours)
 		f.SetCellValue(sheet, fmt.Sprintf("H%d", row), log.Balance)
@@ -708,7 +796,7 @@ func (api *API) exportTimeLogsRange(c echo.Context) error {
 			f.SetCellValue(sheet, fmt.Sprintf("I%d", row), "EDITADO")
 			f.SetCellValue(sheet, fmt.Sprintf("J%d", row), log.EditadoPorGerente)
 			if !log.EditadoEm.IsZero() {
-				f.SetCellValue(sheet, fmt.Sprintf("K%d", row), log.EditadoEm.Format("02/01/2006 15:04"))
+				f.SetCellValue(sheet, fmt.Sprintf("K%d", row), log.EditadoEm.In(loc).Format("02/01/2006 15:04"))
 			}
 			f.SetCellValue(sheet, fmt.Sprintf("L%d", row), log.MotivoEdicao)
 		} else {
@@ -724,7 +812,7 @@ func (api *API) exportTimeLogsRange(c echo.Context) error {
 		return c.String(http.StatusInternalServerError, "Erro ao gerar planilha")
 	}
 
-	filename := fmt.Sprintf("Relatorio_%s_%s.xlsx", employee.Name, time.Now().Format("200601021504"))
+	filename := fmt.Sprintf("Relatorio_%s_%s.xlsx", employee.Name, api.Clock.Now().In(loc).Format("200601021504"))
 	c.Response().Header().Set("Content-Disposition", "attachment; filename="+filename)
 	c.Response().Header().Set("Content-Type", "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet")
 	return c.Blob(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
@@ -737,27 +825,15 @@ func (api *API) exportTimeLogsRange(c echo.Context) error {
 //	@Tags			manager
 //	@Accept			json
 //	@Produce		json
-//	@Param			manager_email	query	string	true	"Email do gerente"
+//	@Param			Authorization	header	string	true	"Bearer <token> da sessão do gerente"
 //	@Success		200				{object}	map[string]interface{}
-//	@Failure		400				{object}	map[string]string
 //	@Failure		401				{object}	map[string]string
+//	@Failure		403				{object}	map[string]string
 //	@Failure		500				{object}	map[string]string
 //	@Router			/manager/requests [get]
 func (api *API) getManagerRequests(c echo.Context) error {
-	managerEmail := c.QueryParam("manager_email")
-	if managerEmail == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email do gerente é obrigatório"})
-	}
-
-	log.Info().
-		Str("managerEmail", managerEmail).
-		Msg("[api] Iniciando busca de solicitações para gerente")
-
-	var manager schemas.Employee
-	if err := api.DB.DB.Where("email = ? AND is_manager = ?", managerEmail, true).First(&manager).Error; err != nil {
-		log.Error().Err(err).Msgf("[api] Gerente não encontrado: %s", managerEmail)
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Gerente não encontrado"})
-	}
+	manager := currentEmployee(c)
+	managerEmail := manager.Email
 
 	log.Info().
 		Str("managerEmail", managerEmail).
@@ -766,11 +842,9 @@ func (api *API) getManagerRequests(c echo.Context) error {
 		Bool("isManager", manager.IsManager).
 		Msg("[api] Gerente encontrado")
 
-	var employeeEmails []string
-	if err := api.DB.DB.Model(&schemas.Employee{}).
-		Where("company_cnpj = ?", manager.CompanyCNPJ).
-		Pluck("email", &employeeEmails).Error; err != nil {
-		log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da empresa")
+	employeeEmails, err := api.managedEmployeeEmails(manager)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao buscar funcionários da equipe")
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar funcionários"})
 	}
 
@@ -778,23 +852,21 @@ func (api *API) getManagerRequests(c echo.Context) error {
 		Str("companyCNPJ", manager.CompanyCNPJ).
 		Int("employeeCount", len(employeeEmails)).
 		Strs("employeeEmails", employeeEmails).
-		Msg("[api] Funcionários da empresa encontrados")
+		Msg("[api] Funcionários da equipe encontrados")
 
 	if len(employeeEmails) == 0 {
 		log.Warn().
 			Str("managerEmail", managerEmail).
 			Str("companyCNPJ", manager.CompanyCNPJ).
-			Msg("[api] Nenhum funcionário encontrado na empresa")
+			Msg("[api] Nenhum funcionário encontrado na equipe")
 		return c.JSON(http.StatusOK, map[string]interface{}{
 			"pending":   []schemas.PontoSolicitacao{},
 			"processed": []schemas.PontoSolicitacao{},
 		})
 	}
 
-	var allRequests []schemas.PontoSolicitacao
-	if err := api.DB.DB.Where("funcionario_email IN ?", employeeEmails).
-		Order("created_at DESC").
-		Find(&allRequests).Error; err != nil {
+	allRequests, err := api.Repos.Requests.ListByEmployees(employeeEmails)
+	if err != nil {
 		log.Error().Err(err).Msg("[api] Erro ao buscar solicitações")
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao buscar solicitações"})
 	}
@@ -839,8 +911,8 @@ func (api *API) getManagerRequests(c echo.Context) error {
 	var processedWithNames []RequestWithEmployeeName
 
 	for _, req := range pending {
-		var employee schemas.Employee
-		if err := api.DB.DB.Where("email = ?", req.FuncionarioEmail).First(&employee).Error; err == nil {
+		employee, err := api.Repos.Employees.GetByEmail(req.FuncionarioEmail)
+		if err == nil {
 			pendingWithNames = append(pendingWithNames, RequestWithEmployeeName{
 				PontoSolicitacao: req,
 				FuncionarioNome:  employee.Name,
@@ -859,8 +931,8 @@ func (api *API) getManagerRequests(c echo.Context) error {
 	}
 
 	for _, req := range processed {
-		var employee schemas.Employee
-		if err := api.DB.DB.Where("email = ?", req.FuncionarioEmail).First(&employee).Error; err == nil {
+		employee, err := api.Repos.Employees.GetByEmail(req.FuncionarioEmail)
+		if err == nil {
 			processedWithNames = append(processedWithNames, RequestWithEmployeeName{
 				PontoSolicitacao: req,
 				FuncionarioNome:  employee.Name,
@@ -887,6 +959,7 @@ func (api *API) getManagerRequests(c echo.Context) error {
 //	@Tags			manager
 //	@Accept			json
 //	@Produce		json
+//	@Param			Authorization	header	string						true	"Bearer <token> da sessão do gerente"
 //	@Param			id		path	int							true	"ID da solicitação"
 //	@Param			body	body	UpdateRequestStatusRequest	true	"Dados para atualização do status"
 //	@Success		200		{object}	map[string]interface{}
@@ -905,7 +978,6 @@ func (api *API) updateRequestStatus(c echo.Context) error {
 	var updateData struct {
 		Status            string `json:"status"`
 		ComentarioGerente string `json:"comentario_gerente"`
-		GerenteEmail      string `json:"gerente_email"`
 	}
 
 	if err := c.Bind(&updateData); err != nil {
@@ -916,16 +988,12 @@ func (api *API) updateRequestStatus(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Status deve ser 'aprovado' ou 'rejeitado'"})
 	}
 
-	if updateData.GerenteEmail == "" {
-		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Email do gerente é obrigatório"})
-	}
-
 	if updateData.ComentarioGerente == "" {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Comentário do gerente é obrigatório"})
 	}
 
-	var request schemas.PontoSolicitacao
-	if err := api.DB.DB.First(&request, id).Error; err != nil {
+	request, err := api.Repos.Requests.Get(uint(id))
+	if err != nil {
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Solicitação não encontrada"})
 	}
 
@@ -933,32 +1001,33 @@ func (api *API) updateRequestStatus(c echo.Context) error {
 		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Solicitação já foi processada"})
 	}
 
-	var manager schemas.Employee
-	if err := api.DB.DB.Where("email = ? AND is_manager = ?", updateData.GerenteEmail, true).First(&manager).Error; err != nil {
-		log.Error().Err(err).Msgf("[api] Gerente não encontrado: %s", updateData.GerenteEmail)
-		return c.JSON(http.StatusUnauthorized, map[string]string{"error": "Gerente não encontrado"})
-	}
+	manager := currentEmployee(c)
 
-	var employee schemas.Employee
-	if err := api.DB.DB.Where("email = ?", request.FuncionarioEmail).First(&employee).Error; err != nil {
+	employee, err := api.Repos.Employees.GetByEmail(request.FuncionarioEmail)
+	if err != nil {
 		log.Error().Err(err).Msgf("[api] Funcionário não encontrado: %s", request.FuncionarioEmail)
 		return c.JSON(http.StatusNotFound, map[string]string{"error": "Funcionário não encontrado"})
 	}
 
-	if manager.CompanyCNPJ != employee.CompanyCNPJ {
+	allowed, err := api.canManage(manager, employee)
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao verificar hierarquia do gerente")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao verificar permissões"})
+	}
+	if !allowed {
 		log.Warn().
-			Str("manager_cnpj", manager.CompanyCNPJ).
-			Str("employee_cnpj", employee.CompanyCNPJ).
-			Msg("[api] Tentativa de processar solicitação entre empresas diferentes")
-		return c.JSON(http.StatusForbidden, map[string]string{"error": "Você só pode processar solicitações de funcionários da sua empresa"})
+			Str("managerEmail", manager.Email).
+			Str("employeeEmail", employee.Email).
+			Msg("[api] Tentativa de processar solicitação fora da equipe do gerente")
+		return c.JSON(http.StatusForbidden, map[string]string{"error": "Você só pode processar solicitações de funcionários da sua equipe"})
 	}
 
 	request.Status = updateData.Status
 	request.ComentarioGerente = updateData.ComentarioGerente
-	request.GerenteEmail = updateData.GerenteEmail
-	request.ProcessadoEm = time.Now()
+	request.GerenteEmail = manager.Email
+	request.ProcessadoEm = api.Clock.Now().UTC()
 
-	if err := api.DB.DB.Save(&request).Error; err != nil {
+	if err := api.Repos.Requests.Update(&request); err != nil {
 		log.Error().Err(err).Msg("[api] Erro ao salvar solicitação processada")
 		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao processar solicitação"})
 	}
@@ -966,7 +1035,7 @@ func (api *API) updateRequestStatus(c echo.Context) error {
 	log.Info().
 		Int("requestId", id).
 		Str("status", updateData.Status).
-		Str("managerEmail", updateData.GerenteEmail).
+		Str("managerEmail", manager.Email).
 		Str("employeeEmail", request.FuncionarioEmail).
 		Str("comentario", updateData.ComentarioGerente).
 		Msg("[api] Solicitação processada pelo gerente")
@@ -984,11 +1053,10 @@ type ManualEditRequest struct {
 	LunchReturnTime string `json:"lunch_return_time"`
 	ExitTime        string `json:"exit_time"`
 	MotivoEdicao    string `json:"motivo_edicao" validate:"required"`
-	ManagerEmail    string `json:"manager_email" validate:"required,email"`
+	RequestID       uint   `json:"request_id"` // solicitação aprovada que a edição atende
 }
 
 type UpdateRequestStatusRequest struct {
 	Status            string `json:"status" validate:"required"`
 	ComentarioGerente string `json:"comentario_gerente" validate:"required"`
-	GerenteEmail      string `json:"gerente_email" validate:"required,email"`
 }
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog/log"
+)
+
+// defaultTimezone is used for companies created before timezones were
+// configurable or when the configured zone cannot be loaded.
+const defaultTimezone = "America/Sao_Paulo"
+
+// loadLocation resolves an IANA timezone name, falling back to the default
+// timezone and finally to UTC.
+func loadLocation(name string) *time.Location {
+	if name == "" {
+		name = defaultTimezone
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil {
+		log.Warn().Err(err).Str("timezone", name).Msg("[api] Fuso horário inválido, usando padrão")
+		if loc, err = time.LoadLocation(defaultTimezone); err != nil {
+			return time.UTC
+		}
+	}
+	return loc
+}
+
+// employeeLocation returns the timezone the employee works in: the timezone of
+// their branch when one is set, otherwise the timezone of the company.
+func (api *API) employeeLocation(employee schemas.Employee) *time.Location {
+	if employee.BranchID != nil {
+		if branch, err := api.Repos.Branches.Get(*employee.BranchID); err == nil && branch.Timezone != "" {
+			return loadLocation(branch.Timezone)
+		}
+	}
+
+	company, err := api.Repos.Companies.GetByCNPJ(employee.CompanyCNPJ)
+	if err != nil {
+		return loadLocation("")
+	}
+	return loadLocation(company.Timezone)
+}
+
+// employeeLocations returns employeeLocation memoized by company and branch,
+// for the views and jobs that go through many employees in one run.
+func (api *API) employeeLocations() func(schemas.Employee) *time.Location {
+	locations := map[string]*time.Location{}
+	return func(employee schemas.Employee) *time.Location {
+		key := employee.CompanyCNPJ
+		if employee.BranchID != nil {
+			key += "/" + strconv.FormatUint(uint64(*employee.BranchID), 10)
+		}
+		loc, ok := locations[key]
+		if !ok {
+			loc = api.employeeLocation(employee)
+			locations[key] = loc
+		}
+		return loc
+	}
+}
+
+// emailLocation is like employeeLocation but looks the employee up by email.
+func (api *API) emailLocation(email string) *time.Location {
+	employee, err := api.Repos.Employees.GetByEmail(email)
+	if err != nil {
+		return loadLocation("")
+	}
+	return api.employeeLocation(employee)
+}
+
+// localDate returns the calendar day of t in loc, represented as midnight UTC.
+// This is the canonical value stored in TimeLog.LogDate.
+func localDate(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// formatIn formats t in loc, returning an empty string for unset times.
+func formatIn(t time.Time, loc *time.Location, layout string) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.In(loc).Format(layout)
+}
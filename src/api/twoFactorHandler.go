@@ -0,0 +1,159 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// TwoFactorRequest identifies the account by its password, plus the code of
+// the authenticator app (or a recovery code) where one is needed.
+type TwoFactorRequest struct {
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	Code     string `json:"code"`
+}
+
+type TwoFactorLoginRequest struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TwoFactorChallengeResponse struct {
+	TwoFactorRequired bool   `json:"two_factor_required"`
+	Challenge         string `json:"challenge"`
+}
+
+// twoFactorError maps the 2FA errors to a response.
+func twoFactorError(c echo.Context, err error) error {
+	switch {
+	case errors.As(err, &LockoutError{}):
+		return loginRefused(c, err)
+	case errors.Is(err, ErrWrongPassword), errors.Is(err, ErrInvalidCode), errors.Is(err, ErrInvalidChallenge):
+		return c.JSON(http.StatusUnauthorized, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrTwoFactorEnabled), errors.Is(err, ErrTwoFactorNotStarted):
+		return c.JSON(http.StatusConflict, map[string]string{"error": err.Error()})
+	case errors.Is(err, ErrTwoFactorEnforced):
+		return c.JSON(http.StatusForbidden, map[string]string{"error": err.Error()})
+	}
+	log.Error().Err(err).Msg("[api] Erro na autenticação em dois fatores")
+	return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro na autenticação em dois fatores"})
+}
+
+// completeTwoFactorLogin godoc
+//
+//	@Summary		Segunda etapa do login
+//	@Description	Conclui o login de contas com 2FA usando o desafio devolvido por /login e o código do aplicativo ou um código de recuperação
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		TwoFactorLoginRequest	true	"Desafio e código"
+//	@Success		200		{object}	LoginResponse
+//	@Failure		400		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		429		{object}	map[string]string
+//	@Router			/login/2fa [post]
+func (api *API) completeTwoFactorLogin(c echo.Context) error {
+	var req TwoFactorLoginRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	ip := c.RealIP()
+	if err := api.checkIP(ip); err != nil {
+		api.recordLoginAttempt("", ip, c.Request().UserAgent(), false, attemptIPBlocked)
+		return loginRefused(c, err)
+	}
+
+	employee, err := api.CompleteLogin(req.Challenge, req.Code, ip, c.Request().UserAgent())
+	if errors.As(err, &LockoutError{}) {
+		return loginRefused(c, err)
+	}
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+	response, err := api.loginResponse(employee)
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+	return c.JSON(http.StatusOK, response)
+}
+
+// setupTwoFactor godoc
+//
+//	@Summary		Iniciar cadastro do 2FA
+//	@Description	Gera o segredo TOTP e a URI otpauth:// para o QR code do aplicativo autenticador
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		TwoFactorRequest	true	"Email e senha"
+//	@Success		200		{object}	TwoFactorSetup
+//	@Failure		401		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Failure		429		{object}	map[string]string
+//	@Router			/login/2fa/setup [post]
+func (api *API) setupTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	setup, err := api.StartTwoFactorSetup(req.Email, req.Password, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+	return c.JSON(http.StatusOK, setup)
+}
+
+// enableTwoFactor godoc
+//
+//	@Summary		Ativar 2FA
+//	@Description	Confirma o cadastro com um código do aplicativo e devolve os códigos de recuperação, exibidos apenas uma vez
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		TwoFactorRequest	true	"Email, senha e código"
+//	@Success		200		{object}	map[string][]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		409		{object}	map[string]string
+//	@Failure		429		{object}	map[string]string
+//	@Router			/login/2fa/enable [post]
+func (api *API) enableTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	codes, err := api.EnableTwoFactor(req.Email, req.Password, req.Code, c.RealIP(), c.Request().UserAgent())
+	if err != nil {
+		return twoFactorError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string][]string{"recovery_codes": codes})
+}
+
+// disableTwoFactor godoc
+//
+//	@Summary		Desativar 2FA
+//	@Description	Desativa o 2FA com a senha e um código. Não é permitido quando a empresa o exige do perfil
+//	@Tags			auth
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		TwoFactorRequest	true	"Email, senha e código"
+//	@Success		200		{object}	map[string]string
+//	@Failure		401		{object}	map[string]string
+//	@Failure		403		{object}	map[string]string
+//	@Failure		429		{object}	map[string]string
+//	@Router			/login/2fa/disable [post]
+func (api *API) disableTwoFactor(c echo.Context) error {
+	var req TwoFactorRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+
+	if err := api.DisableTwoFactor(req.Email, req.Password, req.Code, c.RealIP(), c.Request().UserAgent()); err != nil {
+		return twoFactorError(c, err)
+	}
+	return c.JSON(http.StatusOK, map[string]string{"message": "Autenticação em dois fatores desativada"})
+}
@@ -0,0 +1,225 @@
+package api
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/MWismeck/marca-tempo/src/totp"
+)
+
+const (
+	// loginChallengeTTL is how long the second step of a login may take.
+	loginChallengeTTL = 5 * time.Minute
+	// recoveryCodeCount recovery codes are issued when 2FA is enabled.
+	recoveryCodeCount = 10
+)
+
+var (
+	ErrInvalidCode         = errors.New("Código de verificação inválido")
+	ErrInvalidChallenge    = errors.New("Login expirado, entre novamente")
+	ErrTwoFactorEnabled    = errors.New("Autenticação em dois fatores já está ativa")
+	ErrTwoFactorNotStarted = errors.New("Cadastro da autenticação em dois fatores não iniciado")
+	ErrTwoFactorEnforced   = errors.New("A empresa exige autenticação em dois fatores para este perfil")
+)
+
+// TwoFactorSetup is what the employee needs to add the account to an
+// authenticator app: the URI is rendered as a QR code, the secret typed in.
+type TwoFactorSetup struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+// twoFactorEnforced reports whether the employee's company requires 2FA from
+// them: managers and administrators of companies with RequireTwoFactor.
+func (api *API) twoFactorEnforced(employee schemas.Employee) bool {
+	if !employee.IsManager && !employee.IsAdmin {
+		return false
+	}
+	company, err := api.Repos.Companies.GetByCNPJ(employee.CompanyCNPJ)
+	return err == nil && company.RequireTwoFactor
+}
+
+// StartTwoFactorSetup generates a new TOTP secret for the login. It only
+// becomes required after EnableTwoFactor confirms the app produces its codes.
+func (api *API) StartTwoFactorSetup(email, password, ip, userAgent string) (TwoFactorSetup, error) {
+	login, err := api.authenticate(email, password, ip, userAgent)
+	if err != nil {
+		return TwoFactorSetup{}, err
+	}
+	if login.TOTPEnabled {
+		return TwoFactorSetup{}, ErrTwoFactorEnabled
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		return TwoFactorSetup{}, err
+	}
+	login.TOTPSecret = secret
+	if err := api.Repos.Logins.Update(&login); err != nil {
+		return TwoFactorSetup{}, err
+	}
+	return TwoFactorSetup{Secret: secret, URI: totp.URI(api.Config.Auth.TOTPIssuer, email, secret)}, nil
+}
+
+// EnableTwoFactor turns 2FA on once the code from the app checks out and
+// returns the recovery codes, which are only shown this once.
+func (api *API) EnableTwoFactor(email, password, code, ip, userAgent string) ([]string, error) {
+	login, err := api.authenticate(email, password, ip, userAgent)
+	if err != nil {
+		return nil, err
+	}
+	if login.TOTPEnabled {
+		return nil, ErrTwoFactorEnabled
+	}
+	if login.TOTPSecret == "" {
+		return nil, ErrTwoFactorNotStarted
+	}
+	step, ok := totp.Validate(login.TOTPSecret, code, api.Clock.Now(), login.TOTPLastStep)
+	if !ok {
+		api.loginFailed(&login)
+		api.recordLoginAttempt(email, ip, userAgent, false, attemptWrongCode)
+		return nil, ErrInvalidCode
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		raw := make([]byte, 5)
+		if _, err := rand.Read(raw); err != nil {
+			return nil, err
+		}
+		encoded := base32.StdEncoding.EncodeToString(raw)
+		codes[i] = encoded[:4] + "-" + encoded[4:]
+	}
+
+	hashes := make([]string, len(codes))
+	for i, c := range codes {
+		hashes[i] = hashRecoveryCode(c)
+	}
+	login.TOTPEnabled, login.TOTPLastStep = true, step
+	err = api.Repos.Transaction(func(repos db.Repositories) error {
+		if err := repos.RecoveryCodes.Replace(email, hashes); err != nil {
+			return err
+		}
+		return repos.Logins.Update(&login)
+	})
+	if err != nil {
+		return nil, err
+	}
+	api.audit("login", login.ID, "ativar_2fa", email, "Autenticação em dois fatores ativada")
+	return codes, nil
+}
+
+// DisableTwoFactor turns 2FA off, which needs the password and a current code
+// or a recovery code. It is refused when the company enforces 2FA.
+func (api *API) DisableTwoFactor(email, password, code, ip, userAgent string) error {
+	login, err := api.authenticate(email, password, ip, userAgent)
+	if err != nil {
+		return err
+	}
+	if !login.TOTPEnabled {
+		return nil
+	}
+	if employee, err := api.Repos.Employees.GetByEmail(email); err == nil && api.twoFactorEnforced(employee) {
+		return ErrTwoFactorEnforced
+	}
+	if err := api.verifySecondFactor(&login, code); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			api.loginFailed(&login)
+			api.recordLoginAttempt(email, ip, userAgent, false, attemptWrongCode)
+		}
+		return err
+	}
+
+	login.TOTPEnabled, login.TOTPSecret, login.TOTPLastStep = false, "", 0
+	if err := api.Repos.Logins.Update(&login); err != nil {
+		return err
+	}
+	if err := api.Repos.RecoveryCodes.Delete(email); err != nil {
+		return err
+	}
+	api.audit("login", login.ID, "desativar_2fa", email, "Autenticação em dois fatores desativada")
+	return nil
+}
+
+// verifySecondFactor accepts a TOTP code, or else an unused recovery code,
+// consuming it.
+func (api *API) verifySecondFactor(login *schemas.Login, code string) error {
+	if step, ok := totp.Validate(login.TOTPSecret, code, api.Clock.Now(), login.TOTPLastStep); ok {
+		login.TOTPLastStep = step
+		return api.Repos.Logins.Update(login)
+	}
+
+	used, err := api.Repos.RecoveryCodes.Use(login.Email, hashRecoveryCode(code), api.Clock.Now().UTC())
+	if err != nil {
+		return err
+	}
+	if !used {
+		return ErrInvalidCode
+	}
+	api.audit("login", login.ID, "codigo_recuperacao", login.Email, "Login com código de recuperação")
+	return nil
+}
+
+// hashRecoveryCode normalizes the code, so it can be typed without the dash or
+// in lower case, and hashes it.
+func hashRecoveryCode(code string) string {
+	code = strings.ToUpper(strings.NewReplacer("-", "", " ", "").Replace(code))
+	return hashResetToken(code)
+}
+
+// newLoginChallenge starts the second step of a login, returning the token
+// the client sends back with the code.
+func (api *API) newLoginChallenge(login *schemas.Login) (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	challenge := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(raw)
+
+	login.ChallengeHash = hashResetToken(challenge)
+	login.ChallengeExpiresAt = api.Clock.Now().UTC().Add(loginChallengeTTL)
+	return challenge, api.Repos.Logins.Update(login)
+}
+
+// CompleteLogin finishes a login started with a challenge, checking the code.
+// The challenge is single use when the code is right. Wrong codes count as
+// failed attempts of the account, like wrong passwords.
+func (api *API) CompleteLogin(challenge, code, ip, userAgent string) (schemas.Employee, error) {
+	var login schemas.Login
+	if challenge != "" {
+		login, _ = api.Repos.Logins.GetByChallenge(hashResetToken(challenge))
+	}
+	if login.ID == 0 || !api.Clock.Now().UTC().Before(login.ChallengeExpiresAt) {
+		api.recordLoginAttempt(login.Email, ip, userAgent, false, attemptBadChallenge)
+		return schemas.Employee{}, ErrInvalidChallenge
+	}
+	if err := api.checkLocked(login); err != nil {
+		api.recordLoginAttempt(login.Email, ip, userAgent, false, attemptAccountLocked)
+		return schemas.Employee{}, err
+	}
+	if err := api.verifySecondFactor(&login, code); err != nil {
+		if errors.Is(err, ErrInvalidCode) {
+			api.loginFailed(&login)
+			api.recordLoginAttempt(login.Email, ip, userAgent, false, attemptWrongCode)
+		}
+		return schemas.Employee{}, err
+	}
+
+	login.ChallengeHash, login.ChallengeExpiresAt = "", time.Time{}
+	login.FailedAttempts, login.LockedUntil = 0, time.Time{}
+	if err := api.Repos.Logins.Update(&login); err != nil {
+		return schemas.Employee{}, err
+	}
+	api.recordLoginAttempt(login.Email, ip, userAgent, true, "")
+
+	employee, err := api.Repos.Employees.GetByEmail(login.Email)
+	if errors.Is(err, db.ErrNotFound) {
+		return employee, ErrInvalidChallenge
+	}
+	return employee, err
+}
@@ -0,0 +1,166 @@
+package api
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/qrtoken"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+var (
+	ErrQRCodeRequired = errors.New("Esta empresa exige a leitura do QR code do local de trabalho para registrar o ponto")
+	ErrQRCodeInvalid  = errors.New("QR code inválido")
+	ErrQRCodeExpired  = errors.New("QR code expirado, leia o código novamente")
+)
+
+// WorkplaceRequest registers or changes a workplace.
+type WorkplaceRequest struct {
+	CompanyCNPJ string `json:"company_cnpj"`
+	BranchID    *uint  `json:"branch_id"`
+	Name        string `json:"name"`
+	Active      *bool  `json:"active"`
+	// RequestedBy is the administrator of the session, for the audit history
+	RequestedBy string `json:"-"`
+}
+
+// WorkplaceQRCode is the code a screen at the workplace displays until
+// ExpiresAt.
+type WorkplaceQRCode struct {
+	WorkplaceID uint      `json:"workplace_id"`
+	Workplace   string    `json:"workplace"`
+	Code        string    `json:"code"`
+	ExpiresAt   time.Time `json:"expires_at"`
+}
+
+// CreateWorkplace adds an active workplace, with a new QR code secret, to the
+// company.
+func (api *API) CreateWorkplace(req WorkplaceRequest) (schemas.Workplace, error) {
+	if strings.TrimSpace(req.Name) == "" {
+		return schemas.Workplace{}, errParamRequired("name", "string")
+	}
+	if _, err := api.Repos.Companies.GetByCNPJ(req.CompanyCNPJ); err != nil {
+		return schemas.Workplace{}, fmt.Errorf("Empresa com este CNPJ não existe")
+	}
+	if req.BranchID != nil {
+		if branch, err := api.Repos.Branches.Get(*req.BranchID); err != nil || branch.CompanyCNPJ != req.CompanyCNPJ {
+			return schemas.Workplace{}, fmt.Errorf("Filial não encontrada na empresa")
+		}
+	}
+	secret, err := qrtoken.NewSecret()
+	if err != nil {
+		return schemas.Workplace{}, err
+	}
+
+	workplace := schemas.Workplace{
+		CompanyCNPJ: req.CompanyCNPJ,
+		BranchID:    req.BranchID,
+		Name:        strings.TrimSpace(req.Name),
+		QRSecret:    secret,
+		Active:      true,
+	}
+	if err := api.Repos.Workplaces.Create(&workplace); err != nil {
+		return schemas.Workplace{}, err
+	}
+	api.audit("workplace", workplace.ID, "criar_local", req.RequestedBy, "Local "+workplace.Name)
+	return workplace, nil
+}
+
+// ListWorkplaces returns the workplaces of the company, or of every company
+// when cnpj is empty.
+func (api *API) ListWorkplaces(cnpj string) ([]schemas.Workplace, error) {
+	return api.Repos.Workplaces.List(cnpj)
+}
+
+// UpdateWorkplace renames, deactivates or reactivates a workplace. The codes
+// of an inactive workplace are refused.
+func (api *API) UpdateWorkplace(id uint, req WorkplaceRequest) (schemas.Workplace, error) {
+	workplace, err := api.Repos.Workplaces.Get(id)
+	if err != nil {
+		return workplace, err
+	}
+	var changes []string
+	if name := strings.TrimSpace(req.Name); name != "" && name != workplace.Name {
+		changes = append(changes, fmt.Sprintf("Nome %s → %s", workplace.Name, name))
+		workplace.Name = name
+	}
+	if req.Active != nil && *req.Active != workplace.Active {
+		changes = append(changes, fmt.Sprintf("Ativo %t → %t", workplace.Active, *req.Active))
+		workplace.Active = *req.Active
+	}
+	if len(changes) == 0 {
+		return workplace, nil
+	}
+	if err := api.Repos.Workplaces.Update(&workplace); err != nil {
+		return workplace, err
+	}
+	api.audit("workplace", workplace.ID, "alterar_local", req.RequestedBy, strings.Join(changes, "; "))
+	return workplace, nil
+}
+
+// WorkplaceQRCode returns the current code of a workplace of the kiosk's
+// company.
+func (api *API) WorkplaceQRCode(device schemas.KioskDevice, workplaceID uint) (WorkplaceQRCode, error) {
+	workplace, err := api.Repos.Workplaces.Get(workplaceID)
+	if err != nil {
+		return WorkplaceQRCode{}, err
+	}
+	if workplace.CompanyCNPJ != device.CompanyCNPJ || !workplace.Active {
+		return WorkplaceQRCode{}, db.ErrNotFound
+	}
+	window := qrtoken.Window(api.Clock.Now())
+	return WorkplaceQRCode{
+		WorkplaceID: workplace.ID,
+		Workplace:   workplace.Name,
+		Code:        qrtoken.Generate(workplace.QRSecret, workplace.CompanyCNPJ, workplace.ID, window),
+		ExpiresAt:   qrtoken.WindowEnd(window),
+	}, nil
+}
+
+// punchWorkplace validates the QR code sent with a web punch made at the
+// given time and returns the workplace it came from. Without a code the punch
+// has no workplace, unless the employee's company requires one.
+func (api *API) punchWorkplace(employeeEmail, code string, at time.Time) (*uint, error) {
+	employee, err := api.Repos.Employees.GetByEmail(employeeEmail)
+	if err != nil && !errors.Is(err, db.ErrNotFound) {
+		return nil, err
+	}
+	if code == "" {
+		if employee.ID == 0 {
+			return nil, nil
+		}
+		company, err := api.Repos.Companies.GetByCNPJ(employee.CompanyCNPJ)
+		if err != nil && !errors.Is(err, db.ErrNotFound) {
+			return nil, err
+		}
+		if company.RequireQRCode {
+			return nil, ErrQRCodeRequired
+		}
+		return nil, nil
+	}
+
+	id, err := qrtoken.Location(code)
+	if err != nil || employee.ID == 0 {
+		return nil, ErrQRCodeInvalid
+	}
+	workplace, err := api.Repos.Workplaces.Get(id)
+	if errors.Is(err, db.ErrNotFound) {
+		return nil, ErrQRCodeInvalid
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !workplace.Active || workplace.CompanyCNPJ != employee.CompanyCNPJ {
+		return nil, ErrQRCodeInvalid
+	}
+	switch err := qrtoken.Verify(workplace.QRSecret, workplace.CompanyCNPJ, code, at); {
+	case errors.Is(err, qrtoken.ErrExpired):
+		return nil, ErrQRCodeExpired
+	case err != nil:
+		return nil, ErrQRCodeInvalid
+	}
+	return &workplace.ID, nil
+}
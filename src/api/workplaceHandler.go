@@ -0,0 +1,124 @@
+package api
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/labstack/echo/v4"
+	"github.com/rs/zerolog/log"
+)
+
+// createWorkplace godoc
+//
+//	@Summary		Cadastrar local de trabalho
+//	@Description	Cadastra um local de trabalho da empresa, onde uma tela exibe o QR code rotativo para o registro de ponto pelo celular
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			body	body		WorkplaceRequest	true	"Empresa, filial (opcional) e nome do local"
+//	@Success		201		{object}	schemas.Workplace
+//	@Failure		400		{object}	map[string]string
+//	@Router			/admin/workplaces [post]
+func (api *API) createWorkplace(c echo.Context) error {
+	var req WorkplaceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+	workplace, err := api.CreateWorkplace(req)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": err.Error()})
+	}
+	return c.JSON(http.StatusCreated, workplace)
+}
+
+// listWorkplaces godoc
+//
+//	@Summary		Locais de trabalho
+//	@Description	Lista os locais de trabalho cadastrados
+//	@Tags			admin
+//	@Produce		json
+//	@Param			company_cnpj	query		string	false	"CNPJ da empresa"
+//	@Success		200				{array}		schemas.Workplace
+//	@Failure		500				{object}	map[string]string
+//	@Router			/admin/workplaces [get]
+func (api *API) listWorkplaces(c echo.Context) error {
+	workplaces, err := api.ListWorkplaces(c.QueryParam("company_cnpj"))
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao listar locais de trabalho")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao listar locais de trabalho"})
+	}
+	return c.JSON(http.StatusOK, workplaces)
+}
+
+// updateWorkplace godoc
+//
+//	@Summary		Alterar local de trabalho
+//	@Description	Renomeia, desativa ou reativa um local de trabalho. QR codes de locais inativos são recusados
+//	@Tags			admin
+//	@Accept			json
+//	@Produce		json
+//	@Param			id		path		int					true	"ID do local"
+//	@Param			body	body		WorkplaceRequest	true	"Nome e situação"
+//	@Success		200		{object}	schemas.Workplace
+//	@Failure		400		{object}	map[string]string
+//	@Failure		404		{object}	map[string]string
+//	@Failure		500		{object}	map[string]string
+//	@Router			/admin/workplaces/{id} [put]
+func (api *API) updateWorkplace(c echo.Context) error {
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+	var req WorkplaceRequest
+	if err := c.Bind(&req); err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "Dados inválidos"})
+	}
+	req.RequestedBy = currentEmployee(c).Email
+
+	workplace, err := api.UpdateWorkplace(uint(id), req)
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Local de trabalho não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao alterar local de trabalho")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao alterar local de trabalho"})
+	}
+	return c.JSON(http.StatusOK, workplace)
+}
+
+// getWorkplaceQRCode godoc
+//
+//	@Summary		QR code do local
+//	@Description	Retorna o código atual do local de trabalho, que muda a cada 30 segundos, para o quiosque ou a tela do local exibir como QR code
+//	@Tags			kiosk
+//	@Produce		json
+//	@Param			X-Device-Key	header		string	true	"Chave do terminal"
+//	@Param			id				path		int		true	"ID do local"
+//	@Success		200				{object}	WorkplaceQRCode
+//	@Failure		400				{object}	map[string]string
+//	@Failure		401				{object}	map[string]string
+//	@Failure		404				{object}	map[string]string
+//	@Router			/kiosk/workplaces/{id}/qr_code [get]
+func (api *API) getWorkplaceQRCode(c echo.Context) error {
+	device, err := api.AuthenticateKiosk(c.Request().Header.Get(kioskKeyHeader))
+	if err != nil {
+		return kioskRefused(c, err)
+	}
+	id, err := strconv.ParseUint(c.Param("id"), 10, 0)
+	if err != nil {
+		return c.JSON(http.StatusBadRequest, map[string]string{"error": "ID inválido"})
+	}
+
+	code, err := api.WorkplaceQRCode(device, uint(id))
+	if errors.Is(err, db.ErrNotFound) {
+		return c.JSON(http.StatusNotFound, map[string]string{"error": "Local de trabalho não encontrado"})
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("[api] Erro ao gerar QR code")
+		return c.JSON(http.StatusInternalServerError, map[string]string{"error": "Erro ao gerar QR code"})
+	}
+	return c.JSON(http.StatusOK, code)
+}
@@ -0,0 +1,73 @@
+// Package clock provides the source of the current time used by the server,
+// so date dependent behaviour can be controlled in tests and development.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock returns the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Real is the production clock backed by time.Now.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+// New returns the real clock.
+func New() Clock {
+	return Real{}
+}
+
+// Offset is a clock that runs in real time but starts at a simulated instant.
+// It is meant for development, to try the system on a different date.
+type Offset struct {
+	offset time.Duration
+}
+
+// NewOffset returns a clock whose current time is start at the moment of the
+// call and advances normally from there.
+func NewOffset(start time.Time) *Offset {
+	return &Offset{offset: time.Until(start)}
+}
+
+func (o *Offset) Now() time.Time {
+	return time.Now().Add(o.offset)
+}
+
+// Fake is a manually controlled clock for tests. Its time only changes
+// through Set and Advance.
+type Fake struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewFake returns a fake clock stopped at now.
+func NewFake(now time.Time) *Fake {
+	return &Fake{now: now}
+}
+
+func (f *Fake) Now() time.Time {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.now
+}
+
+// Set moves the clock to t.
+func (f *Fake) Set(t time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = t
+}
+
+// Advance moves the clock forward by d.
+func (f *Fake) Advance(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.now = f.now.Add(d)
+}
@@ -0,0 +1,402 @@
+// Package config loads the server configuration: built-in defaults, then an
+// optional YAML file, then environment variables, validated at startup.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/mail"
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultFile is read when no file is given and it exists in the working
+// directory.
+const DefaultFile = "config.yaml"
+
+type Config struct {
+	Server    ServerConfig    `yaml:"server"`
+	Database  db.Config       `yaml:"database"`
+	Work      WorkConfig      `yaml:"work"`
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Mail      mail.Config     `yaml:"mail"`
+	Auth      AuthConfig      `yaml:"auth"`
+}
+
+type ServerConfig struct {
+	// Addr is the address the HTTP server listens on, e.g. ":8080"
+	Addr string `yaml:"addr"`
+	// StaticDir holds the web pages served at /
+	StaticDir string `yaml:"static_dir"`
+	// AllowOrigins lists the origins accepted by CORS, "*" for any
+	AllowOrigins []string `yaml:"allow_origins"`
+	// ShutdownTimeout bounds how long a stopping server waits for in-flight
+	// requests and running jobs
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+	// TrustProxy takes the client IP from X-Forwarded-For and X-Real-IP. Only
+	// enable it behind a reverse proxy that sets them, or clients can spoof
+	// their address and escape the per-IP login limits
+	TrustProxy bool `yaml:"trust_proxy"`
+}
+
+type WorkConfig struct {
+	// DefaultWorkload is the weekly workload, in hours, used for employees
+	// without one
+	DefaultWorkload float32 `yaml:"default_workload"`
+	// Punches captured offline are accepted when the device clock is at most
+	// OfflineMaxClockSkew away from the server's and the punch is at most
+	// OfflineMaxAge old
+	OfflineMaxClockSkew time.Duration `yaml:"offline_max_clock_skew"`
+	OfflineMaxAge       time.Duration `yaml:"offline_max_age"`
+	// MinPunchInterval is the shortest time between two punches of the same
+	// day; a punch sooner than that is taken as a retry of the previous one.
+	// Zero disables the check
+	MinPunchInterval time.Duration `yaml:"min_punch_interval"`
+	// MaxLocationAccuracy is the largest uncertainty, in meters, of a location
+	// checked against the geofences; vaguer readings count as no location
+	MaxLocationAccuracy float64 `yaml:"max_location_accuracy"`
+}
+
+type SchedulerConfig struct {
+	// Interval is how often the scheduler looks for due jobs
+	Interval time.Duration `yaml:"interval"`
+	// Lease is how long a running job holds its slot before another instance
+	// may take it over; it is renewed while the job runs
+	Lease time.Duration `yaml:"lease"`
+}
+
+type AuthConfig struct {
+	// PasswordResetURL is the page the reset e-mail links to, with the token
+	// appended as the "token" query parameter
+	PasswordResetURL string `yaml:"password_reset_url"`
+	// PasswordResetTTL is how long a reset link stays valid
+	PasswordResetTTL time.Duration `yaml:"password_reset_ttl"`
+	// SessionTTL is how long the token issued at login stays valid
+	SessionTTL time.Duration `yaml:"session_ttl"`
+	// TOTPIssuer names the service in the authenticator apps
+	TOTPIssuer string `yaml:"totp_issuer"`
+	// MaxFailedAttempts consecutive wrong passwords or codes lock the account
+	// for LockoutDuration. Before that, each failure makes the next attempt
+	// wait FailureDelay, doubled at every failure
+	MaxFailedAttempts int           `yaml:"max_failed_attempts"`
+	FailureDelay      time.Duration `yaml:"failure_delay"`
+	LockoutDuration   time.Duration `yaml:"lockout_duration"`
+	// IPMaxFailedAttempts failed logins from one IP within LockoutDuration
+	// block further logins from it, whatever the account
+	IPMaxFailedAttempts int `yaml:"ip_max_failed_attempts"`
+	// SSORedirectURL is the callback of the single sign-on, as registered at
+	// the companies' identity providers
+	SSORedirectURL string `yaml:"sso_redirect_url"`
+}
+
+// Default returns the configuration used when nothing is overridden.
+func Default() Config {
+	return Config{
+		Server: ServerConfig{
+			Addr:            ":8080",
+			StaticDir:       "public",
+			AllowOrigins:    []string{"*"},
+			ShutdownTimeout: 15 * time.Second,
+		},
+		Database: db.Config{
+			Driver: db.DriverSQLite,
+			DSN:    "employee.db",
+		},
+		Work: WorkConfig{
+			DefaultWorkload:     40,
+			OfflineMaxClockSkew: 5 * time.Minute,
+			OfflineMaxAge:       72 * time.Hour,
+			MinPunchInterval:    time.Minute,
+			MaxLocationAccuracy: 100,
+		},
+		Scheduler: SchedulerConfig{
+			Interval: 30 * time.Second,
+			Lease:    time.Hour,
+		},
+		Mail: mail.Config{
+			Port: 25,
+			From: "marca-tempo@localhost",
+		},
+		Auth: AuthConfig{
+			PasswordResetURL: "http://localhost:8080/reset-password.html",
+			PasswordResetTTL: time.Hour,
+			SessionTTL:       12 * time.Hour,
+			TOTPIssuer:       "Marca Tempo",
+
+			MaxFailedAttempts:   5,
+			FailureDelay:        time.Second,
+			LockoutDuration:     15 * time.Minute,
+			IPMaxFailedAttempts: 20,
+
+			SSORedirectURL: "http://localhost:8080/login/sso/callback",
+		},
+	}
+}
+
+// Load builds the effective configuration from the defaults, the YAML file at
+// path and the environment, in this order, and validates it. An empty path
+// reads CONFIG_FILE or, when it exists, DefaultFile.
+func Load(path string) (Config, error) {
+	config := Default()
+
+	if path == "" {
+		path = os.Getenv("CONFIG_FILE")
+	}
+	if path == "" {
+		if _, err := os.Stat(DefaultFile); err == nil {
+			path = DefaultFile
+		}
+	}
+	if path != "" {
+		if err := config.readFile(path); err != nil {
+			return config, err
+		}
+	}
+
+	if err := config.applyEnv(os.LookupEnv); err != nil {
+		return config, err
+	}
+	return config, config.Validate()
+}
+
+func (c *Config) readFile(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("read config file: %w", err)
+	}
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("parse config file %s: %w", path, err)
+	}
+	return nil
+}
+
+// applyEnv overrides the configuration with the environment variables that
+// are set. DB_DRIVER changes the default DSN as well, since employee.db only
+// makes sense for SQLite.
+func (c *Config) applyEnv(lookup func(string) (string, bool)) error {
+	if v, ok := lookup("SERVER_ADDR"); ok {
+		c.Server.Addr = v
+	}
+	if v, ok := lookup("STATIC_DIR"); ok {
+		c.Server.StaticDir = v
+	}
+	if v, ok := lookup("CORS_ALLOW_ORIGINS"); ok {
+		c.Server.AllowOrigins = nil
+		for _, origin := range strings.Split(v, ",") {
+			if origin = strings.TrimSpace(origin); origin != "" {
+				c.Server.AllowOrigins = append(c.Server.AllowOrigins, origin)
+			}
+		}
+	}
+	if v, ok := lookup("DB_DRIVER"); ok {
+		if v != c.Database.Driver && c.Database.DSN == Default().Database.DSN {
+			c.Database.DSN = ""
+		}
+		c.Database.Driver = v
+	}
+	if v, ok := lookup("DB_DSN"); ok {
+		c.Database.DSN = v
+	}
+	for name, target := range map[string]*string{
+		"SMTP_HOST":          &c.Mail.Host,
+		"SMTP_USERNAME":      &c.Mail.Username,
+		"SMTP_PASSWORD":      &c.Mail.Password,
+		"MAIL_FROM":          &c.Mail.From,
+		"PASSWORD_RESET_URL": &c.Auth.PasswordResetURL,
+		"TOTP_ISSUER":        &c.Auth.TOTPIssuer,
+		"SSO_REDIRECT_URL":   &c.Auth.SSORedirectURL,
+	} {
+		if v, ok := lookup(name); ok {
+			*target = v
+		}
+	}
+	for name, target := range map[string]*int{
+		"SMTP_PORT":            &c.Mail.Port,
+		"MAX_FAILED_LOGINS":    &c.Auth.MaxFailedAttempts,
+		"IP_MAX_FAILED_LOGINS": &c.Auth.IPMaxFailedAttempts,
+	} {
+		if v, ok := lookup(name); ok {
+			n, err := strconv.Atoi(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = n
+		}
+	}
+	if v, ok := lookup("TRUST_PROXY"); ok {
+		trust, err := strconv.ParseBool(v)
+		if err != nil {
+			return fmt.Errorf("TRUST_PROXY: %w", err)
+		}
+		c.Server.TrustProxy = trust
+	}
+	if v, ok := lookup("DEFAULT_WORKLOAD"); ok {
+		workload, err := strconv.ParseFloat(v, 32)
+		if err != nil {
+			return fmt.Errorf("DEFAULT_WORKLOAD: %w", err)
+		}
+		c.Work.DefaultWorkload = float32(workload)
+	}
+	if v, ok := lookup("MAX_LOCATION_ACCURACY"); ok {
+		accuracy, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return fmt.Errorf("MAX_LOCATION_ACCURACY: %w", err)
+		}
+		c.Work.MaxLocationAccuracy = accuracy
+	}
+	for name, target := range map[string]*time.Duration{
+		"SHUTDOWN_TIMEOUT":       &c.Server.ShutdownTimeout,
+		"SCHEDULER_INTERVAL":     &c.Scheduler.Interval,
+		"SCHEDULER_LEASE":        &c.Scheduler.Lease,
+		"PASSWORD_RESET_TTL":     &c.Auth.PasswordResetTTL,
+		"SESSION_TTL":            &c.Auth.SessionTTL,
+		"LOGIN_FAILURE_DELAY":    &c.Auth.FailureDelay,
+		"LOCKOUT_DURATION":       &c.Auth.LockoutDuration,
+		"OFFLINE_MAX_CLOCK_SKEW": &c.Work.OfflineMaxClockSkew,
+		"OFFLINE_MAX_AGE":        &c.Work.OfflineMaxAge,
+		"MIN_PUNCH_INTERVAL":     &c.Work.MinPunchInterval,
+	} {
+		if v, ok := lookup(name); ok {
+			d, err := time.ParseDuration(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+			*target = d
+		}
+	}
+	return nil
+}
+
+// Validate reports every invalid setting at once.
+func (c Config) Validate() error {
+	var errs []error
+	if c.Server.Addr == "" {
+		errs = append(errs, errors.New("server.addr is required"))
+	}
+	if c.Server.StaticDir == "" {
+		errs = append(errs, errors.New("server.static_dir is required"))
+	}
+	if len(c.Server.AllowOrigins) == 0 {
+		errs = append(errs, errors.New("server.allow_origins needs at least one origin"))
+	}
+	if c.Server.ShutdownTimeout <= 0 {
+		errs = append(errs, errors.New("server.shutdown_timeout must be positive"))
+	}
+	if _, err := db.Dialector(c.Database.Driver, c.Database.DSN); err != nil {
+		errs = append(errs, fmt.Errorf("database.driver: %w", err))
+	}
+	if c.Database.DSN == "" {
+		errs = append(errs, errors.New("database.dsn is required"))
+	}
+	if c.Work.DefaultWorkload <= 0 || c.Work.DefaultWorkload > 168 {
+		errs = append(errs, fmt.Errorf("work.default_workload must be between 0 and 168 hours, got %v", c.Work.DefaultWorkload))
+	}
+	if c.Work.OfflineMaxClockSkew <= 0 {
+		errs = append(errs, errors.New("work.offline_max_clock_skew must be positive"))
+	}
+	if c.Work.OfflineMaxAge <= 0 {
+		errs = append(errs, errors.New("work.offline_max_age must be positive"))
+	}
+	if c.Work.MinPunchInterval < 0 {
+		errs = append(errs, errors.New("work.min_punch_interval must not be negative"))
+	}
+	if !(c.Work.MaxLocationAccuracy > 0) {
+		errs = append(errs, errors.New("work.max_location_accuracy must be positive"))
+	}
+	if c.Scheduler.Interval <= 0 {
+		errs = append(errs, errors.New("scheduler.interval must be positive"))
+	}
+	if c.Scheduler.Lease <= 0 {
+		errs = append(errs, errors.New("scheduler.lease must be positive"))
+	}
+	if c.Mail.Host != "" {
+		if c.Mail.Port <= 0 || c.Mail.Port > 65535 {
+			errs = append(errs, fmt.Errorf("mail.port must be a TCP port, got %d", c.Mail.Port))
+		}
+		if c.Mail.From == "" {
+			errs = append(errs, errors.New("mail.from is required to send e-mails"))
+		}
+	}
+	if c.Auth.PasswordResetURL == "" {
+		errs = append(errs, errors.New("auth.password_reset_url is required"))
+	}
+	if c.Auth.PasswordResetTTL <= 0 {
+		errs = append(errs, errors.New("auth.password_reset_ttl must be positive"))
+	}
+	if c.Auth.SessionTTL <= 0 {
+		errs = append(errs, errors.New("auth.session_ttl must be positive"))
+	}
+	if c.Auth.TOTPIssuer == "" {
+		errs = append(errs, errors.New("auth.totp_issuer is required"))
+	}
+	if c.Auth.MaxFailedAttempts <= 0 {
+		errs = append(errs, errors.New("auth.max_failed_attempts must be positive"))
+	}
+	if c.Auth.FailureDelay < 0 {
+		errs = append(errs, errors.New("auth.failure_delay must not be negative"))
+	}
+	if c.Auth.LockoutDuration <= 0 {
+		errs = append(errs, errors.New("auth.lockout_duration must be positive"))
+	}
+	if c.Auth.IPMaxFailedAttempts <= 0 {
+		errs = append(errs, errors.New("auth.ip_max_failed_attempts must be positive"))
+	}
+	if u, err := url.Parse(c.Auth.SSORedirectURL); err != nil || !u.IsAbs() {
+		errs = append(errs, errors.New("auth.sso_redirect_url must be an absolute URL"))
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid configuration: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// redacted replaces the secrets in the printed configuration.
+const redacted = "xxxxx"
+
+var (
+	// password=secret and password='a secret' in key/value DSNs (PostgreSQL)
+	dsnPasswordRegex = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+	// user:secret@ at the start of MySQL DSNs
+	dsnUserInfoRegex = regexp.MustCompile(`^([^:@/]*):([^@]*)@`)
+)
+
+// redactDSN hides the password of a database DSN, in URL, key/value or MySQL
+// form.
+func redactDSN(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		return u.String()
+	}
+	dsn = dsnPasswordRegex.ReplaceAllString(dsn, "${1}"+redacted)
+	return dsnUserInfoRegex.ReplaceAllString(dsn, "${1}:"+redacted+"@")
+}
+
+// YAML renders the configuration in the format read by Load, with the
+// database and mail passwords replaced by xxxxx.
+func (c Config) YAML() ([]byte, error) {
+	c.Database.DSN = redactDSN(c.Database.DSN)
+	if c.Mail.Password != "" {
+		c.Mail.Password = redacted
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(c); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), encoder.Close()
+}
@@ -0,0 +1,129 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func writeFile(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadFileThenEnvironment(t *testing.T) {
+	path := writeFile(t, `
+server:
+  addr: ":9090"
+  allow_origins: ["https://ponto.acme.com"]
+database:
+  driver: postgres
+  dsn: host=db user=marca dbname=marca
+work:
+  default_workload: 44
+`)
+	t.Setenv("SERVER_ADDR", ":7070")
+	t.Setenv("SCHEDULER_INTERVAL", "1m")
+
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if cfg.Server.Addr != ":7070" {
+		t.Errorf("addr = %q, want the environment to win", cfg.Server.Addr)
+	}
+	if cfg.Server.StaticDir != "public" {
+		t.Errorf("static_dir = %q, want the default", cfg.Server.StaticDir)
+	}
+	if len(cfg.Server.AllowOrigins) != 1 || cfg.Server.AllowOrigins[0] != "https://ponto.acme.com" {
+		t.Errorf("allow_origins = %v", cfg.Server.AllowOrigins)
+	}
+	if cfg.Database.Driver != "postgres" || cfg.Work.DefaultWorkload != 44 {
+		t.Errorf("database/workload = %+v/%v", cfg.Database, cfg.Work.DefaultWorkload)
+	}
+	if cfg.Scheduler.Interval != time.Minute || cfg.Scheduler.Lease != time.Hour {
+		t.Errorf("scheduler = %+v", cfg.Scheduler)
+	}
+
+	// The printed configuration loads back to the same values
+	out, err := cfg.YAML()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SERVER_ADDR", ":7070")
+	again, err := Load(writeFile(t, string(out)))
+	if err != nil || again.Scheduler.Interval != time.Minute || again.Database.DSN != cfg.Database.DSN {
+		t.Errorf("reloaded = %+v, %v", again, err)
+	}
+}
+
+func TestYAMLRedactsPasswords(t *testing.T) {
+	for dsn, want := range map[string]string{
+		"employee.db": "employee.db",
+		"host=db user=marca password=secret dbname=marca":       "host=db user=marca password=xxxxx dbname=marca",
+		"host=db password='a secret' dbname=marca":              "host=db password=xxxxx dbname=marca",
+		"postgres://marca:secret@db:5432/marca?sslmode=require": "postgres://marca:xxxxx@db:5432/marca?sslmode=require",
+		"marca:secret@tcp(db:3306)/marca?parseTime=True":        "marca:xxxxx@tcp(db:3306)/marca?parseTime=True",
+	} {
+		cfg := Default()
+		cfg.Database.DSN = dsn
+		cfg.Mail.Password = "smtp-secret"
+		out, err := cfg.YAML()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(out), want) || strings.Contains(string(out), "secret") {
+			t.Errorf("printed DSN %q: %s, want %q and no password", dsn, out, want)
+		}
+	}
+}
+
+func TestLoadRejectsInvalidConfiguration(t *testing.T) {
+	for name, tc := range map[string]struct {
+		file string
+		env  map[string]string
+		want []string
+	}{
+		"unknown field":      {file: "server:\n  port: 8080\n", want: []string{"field port not found"}},
+		"driver without dsn": {env: map[string]string{"DB_DRIVER": "postgres"}, want: []string{"database.dsn is required"}},
+		"several errors": {
+			file: "work:\n  default_workload: 0\nscheduler:\n  interval: 0s\n",
+			env:  map[string]string{"DB_DRIVER": "oracle"},
+			want: []string{"unsupported database driver", "default_workload", "scheduler.interval"},
+		},
+		"bad duration": {env: map[string]string{"SCHEDULER_LEASE": "forever"}, want: []string{"SCHEDULER_LEASE"}},
+		"offline limits": {
+			file: "work:\n  offline_max_age: 0s\n",
+			env:  map[string]string{"OFFLINE_MAX_CLOCK_SKEW": "-1m"},
+			want: []string{"work.offline_max_clock_skew", "work.offline_max_age"},
+		},
+		"negative punch interval": {env: map[string]string{"MIN_PUNCH_INTERVAL": "-30s"}, want: []string{"work.min_punch_interval"}},
+		"no location accuracy":    {env: map[string]string{"MAX_LOCATION_ACCURACY": "0"}, want: []string{"work.max_location_accuracy"}},
+		"no session ttl":          {env: map[string]string{"SESSION_TTL": "0s"}, want: []string{"auth.session_ttl"}},
+	} {
+		t.Run(name, func(t *testing.T) {
+			for k, v := range tc.env {
+				t.Setenv(k, v)
+			}
+			path := ""
+			if tc.file != "" {
+				path = writeFile(t, tc.file)
+			}
+			_, err := Load(path)
+			if err == nil {
+				t.Fatal("Load succeeded, want an error")
+			}
+			for _, want := range tc.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q does not mention %q", err, want)
+				}
+			}
+		})
+	}
+}
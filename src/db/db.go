@@ -1,114 +1,81 @@
 package db
 
 import (
-	"github.com/MWismeck/marca-tempo/src/schemas"
+	"fmt"
+
 	"github.com/rs/zerolog/log"
+	"gorm.io/driver/mysql"
+	"gorm.io/driver/postgres"
 	"gorm.io/driver/sqlite"
 	"gorm.io/gorm"
-	"time"
 )
 
-type EmployeeHandler struct {
-	DB *gorm.DB
+// Supported database drivers
+const (
+	DriverSQLite   = "sqlite"
+	DriverPostgres = "postgres"
+	DriverMySQL    = "mysql"
+)
+
+// Config selects the database the server connects to. It is loaded by the
+// config package.
+//
+// DSN examples:
+//
+//	sqlite:   employee.db
+//	postgres: host=localhost user=marca password=secret dbname=marca_tempo port=5432 sslmode=disable
+//	mysql:    marca:secret@tcp(localhost:3306)/marca_tempo?charset=utf8mb4&parseTime=True&loc=UTC
+type Config struct {
+	Driver string `yaml:"driver"`
+	DSN    string `yaml:"dsn"`
 }
 
-func Init() *gorm.DB {
-	db, err := gorm.Open(sqlite.Open("employee.db"), &gorm.Config{})
+// Init connects to the configured database and makes sure its schema is up
+// to date. The server refuses to start on a database with pending migrations,
+// which are applied with the migrate command.
+func Init(config Config) *gorm.DB {
+	db, err := Open(config.Driver, config.DSN)
 	if err != nil {
-		log.Fatal().Err(err).Msgf("Failed to initialize SQLite: %s", err.Error())
+		log.Fatal().Err(err).Str("driver", config.Driver).Msgf("Failed to initialize database: %s", err.Error())
 	}
-	db.AutoMigrate(
-		&schemas.Employee{},
-		&schemas.Login{},
-		&schemas.TimeLog{},
-		&schemas.Company{},
-		&schemas.PontoSolicitacao{},
-	)
+	if err := CheckSchema(db); err != nil {
+		log.Fatal().Err(err).Msg("Database schema is not up to date, run the migrate command")
+	}
+	log.Info().Str("driver", config.Driver).Msg("Database initialized")
 	return db
 }
 
-func NewEmployeeHandler(db *gorm.DB) *EmployeeHandler {
-	return &EmployeeHandler{DB: db}
-}
-
-func (e *EmployeeHandler) AddEmployee(employee schemas.Employee) error {
-	if result := e.DB.Create(&employee); result.Error != nil {
-		log.Error().Msg("Failed to create employee")
-		return result.Error
+// Close closes the connections opened by Init or Open.
+func Close(database *gorm.DB) error {
+	sqlDB, err := database.DB()
+	if err != nil {
+		return err
 	}
-	log.Info().Msg("Create Employee!")
-	return nil
-}
-
-func (e *EmployeeHandler) GetEmployees() ([]schemas.Employee, error) {
-	employees := []schemas.Employee{}
-
-	err := e.DB.Find(&employees).Error
-	return employees, err
-}
-
-func (e *EmployeeHandler) GetEmployee(id int) (schemas.Employee, error) {
-	var employee schemas.Employee
-	err := e.DB.First(&employee, id).Error
-	return employee, err
-}
-
-func (e *EmployeeHandler) UpdateEmployee(updateEmployee schemas.Employee) error {
-
-	return e.DB.Save(&updateEmployee).Error
-}
-
-func (e *EmployeeHandler) DeleteEmployee(employee schemas.Employee) error {
-
-	return e.DB.Delete(&employee).Error
+	return sqlDB.Close()
 }
 
-func (e *EmployeeHandler) GetFilteredEmployee(active bool) ([]schemas.Employee, error) {
-	filteredEmployees := []schemas.Employee{}
-
-	err := e.DB.Where("active= ?", active).Find(&filteredEmployees).Error
-
-	return filteredEmployees, err
-}
-
-func (e *EmployeeHandler) AddTimeLog(timeLog schemas.TimeLog) error {
-	if result := e.DB.Create(&timeLog); result.Error != nil {
-		log.Error().Msg("Failed to create time log")
-		return result.Error
+// Dialector returns the GORM dialector for the driver.
+func Dialector(driver, dsn string) (gorm.Dialector, error) {
+	switch driver {
+	case DriverSQLite:
+		return sqlite.Open(dsn), nil
+	case DriverPostgres:
+		return postgres.Open(dsn), nil
+	case DriverMySQL:
+		return mysql.Open(dsn), nil
 	}
-	log.Info().Msg("Time log created successfully")
-	return nil
+	return nil, fmt.Errorf("unsupported database driver %q (use %s, %s or %s)", driver, DriverSQLite, DriverPostgres, DriverMySQL)
 }
 
-func (e *EmployeeHandler) UpdateExitTime(timeLogID uint, exitTime time.Time) error {
-	var timeLog schemas.TimeLog
-	if err := e.DB.First(&timeLog, timeLogID).Error; err != nil {
-		return err
+// Open connects to the database without touching its schema, see Migrate.
+func Open(driver, dsn string) (*gorm.DB, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("database DSN is required for driver %s", driver)
 	}
-
-	timeLog.ExitTime = exitTime
-	if err := e.DB.Save(&timeLog).Error; err != nil {
-		log.Error().Err(err).Msg("Failed to update exit time")
-		return err
-	}
-	log.Info().Msg("Exit time updated successfully")
-	return nil
-}
-
-func (e *EmployeeHandler) GetTimeLogsByEmployeeID(employeeID uint) ([]schemas.TimeLog, error) {
-
-	var employee schemas.Employee
-	if err := e.DB.First(&employee, employeeID).Error; err != nil {
+	dialector, err := Dialector(driver, dsn)
+	if err != nil {
 		return nil, err
 	}
-
-	var timeLogs []schemas.TimeLog
-	err := e.DB.Where("employee_email = ?", employee.Email).Find(&timeLogs).Error
-	return timeLogs, err
-}
-
-func (e *EmployeeHandler) GetTimeLogsByEmail(email string) ([]schemas.TimeLog, error) {
-	var timeLogs []schemas.TimeLog
-	err := e.DB.Where("employee_email = ?", email).Find(&timeLogs).Error
-	return timeLogs, err
+	// TranslateError reports unique violations as gorm.ErrDuplicatedKey
+	return gorm.Open(dialector, &gorm.Config{TranslateError: true})
 }
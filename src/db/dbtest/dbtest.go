@@ -0,0 +1,114 @@
+// Package dbtest opens an isolated, migrated database for each test. SQLite in
+// memory is used by default; setting TEST_DB_DRIVER (postgres or mysql) and
+// TEST_DB_DSN runs the same tests against a database server, each test in its
+// own schema (PostgreSQL) or database (MySQL), dropped when the test ends.
+package dbtest
+
+import (
+	"fmt"
+	"hash/fnv"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	mysqldriver "github.com/go-sql-driver/mysql"
+	"gorm.io/gorm"
+)
+
+// Open returns a database private to the test.
+func Open(t testing.TB) *gorm.DB {
+	t.Helper()
+
+	driver, dsn := os.Getenv("TEST_DB_DRIVER"), os.Getenv("TEST_DB_DSN")
+	switch driver {
+	case "", db.DriverSQLite:
+		dsn = fmt.Sprintf("file:%s?mode=memory&cache=shared", strings.ReplaceAll(t.Name(), "/", "_"))
+		return open(t, db.DriverSQLite, dsn, nil)
+
+	case db.DriverPostgres:
+		name := isolatedName(t)
+		admin := connect(t, driver, dsn)
+		exec(t, admin, "CREATE SCHEMA "+name)
+		separator := " "
+		if strings.Contains(dsn, "://") {
+			separator = "&"
+			if !strings.Contains(dsn, "?") {
+				separator = "?"
+			}
+		}
+		return open(t, driver, dsn+separator+"search_path="+name, func() {
+			exec(t, admin, "DROP SCHEMA "+name+" CASCADE")
+		})
+
+	case db.DriverMySQL:
+		name := isolatedName(t)
+		config, err := mysqldriver.ParseDSN(dsn)
+		if err != nil {
+			t.Fatalf("parse TEST_DB_DSN: %v", err)
+		}
+		admin := connect(t, driver, dsn)
+		exec(t, admin, "CREATE DATABASE "+name)
+		config.DBName = name
+		return open(t, driver, config.FormatDSN(), func() {
+			exec(t, admin, "DROP DATABASE "+name)
+		})
+	}
+
+	t.Fatalf("unsupported TEST_DB_DRIVER %q", driver)
+	return nil
+}
+
+func open(t testing.TB, driver, dsn string, drop func()) *gorm.DB {
+	t.Helper()
+	database, err := db.Open(driver, dsn)
+	if err != nil {
+		t.Fatalf("open %s database: %v", driver, err)
+	}
+	if _, err := db.Migrate(database); err != nil {
+		t.Fatalf("migrate %s database: %v", driver, err)
+	}
+	sqlDB, err := database.DB()
+	if err != nil {
+		t.Fatalf("database handle: %v", err)
+	}
+	t.Cleanup(func() {
+		sqlDB.Close()
+		if drop != nil {
+			drop()
+		}
+	})
+	return database
+}
+
+// connect opens the server database without migrating it, to create and drop
+// the per test schemas.
+func connect(t testing.TB, driver, dsn string) *gorm.DB {
+	t.Helper()
+	dialector, err := db.Dialector(driver, dsn)
+	if err != nil {
+		t.Fatalf("%v", err)
+	}
+	admin, err := gorm.Open(dialector, &gorm.Config{})
+	if err != nil {
+		t.Fatalf("connect to %s: %v", driver, err)
+	}
+	sqlDB, _ := admin.DB()
+	t.Cleanup(func() { sqlDB.Close() })
+	return admin
+}
+
+func exec(t testing.TB, database *gorm.DB, statement string) {
+	t.Helper()
+	if err := database.Exec(statement).Error; err != nil {
+		t.Fatalf("%s: %v", statement, err)
+	}
+}
+
+// isolatedName derives a valid identifier from the test name and process, so
+// parallel test binaries sharing the server do not collide.
+func isolatedName(t testing.TB) string {
+	h := fnv.New32a()
+	h.Write([]byte(t.Name()))
+	return fmt.Sprintf("test_%d_%x", os.Getpid(), h.Sum32())
+}
@@ -0,0 +1,1078 @@
+package db
+
+import (
+	"errors"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// ErrDuplicate is returned when a unique field (employee email, company CNPJ,
+// login email, the day of a time log) is already taken. The GORM repositories return it where the
+// caller handles it, such as branch CNPJs.
+var ErrDuplicate = errors.New("duplicate record")
+
+// memoryStore holds the records of the in-memory repositories. Every
+// repository returns copies, so callers never share state with the store.
+type memoryStore struct {
+	mu        sync.Mutex
+	nextID    uint
+	employees map[uint]schemas.Employee
+	companies map[uint]schemas.Company
+	timeLogs  map[uint]schemas.TimeLog
+	requests  map[uint]schemas.PontoSolicitacao
+	logins    map[uint]schemas.Login
+	attempts  map[uint]schemas.LoginAttempt
+	punches   map[uint]schemas.PunchRecord
+
+	branches       map[uint]schemas.Branch
+	departments    map[uint]schemas.Department
+	holidays       map[uint]schemas.Holiday
+	workplaces     map[uint]schemas.Workplace
+	geofences      map[uint]schemas.Geofence
+	kioskDevices   map[uint]schemas.KioskDevice
+	ssoStates      map[uint]schemas.SSOLoginState
+	ssoIdentities  map[uint]schemas.SSOIdentity
+	passwordResets map[uint]schemas.PasswordResetToken
+	recoveryCodes  map[uint]schemas.RecoveryCode
+	sessions       map[uint]schemas.Session
+	recalculations map[uint]schemas.RecalculationTask
+	auditLogs      map[uint]schemas.AuditLog
+	workRules      map[uint]schemas.WorkRule
+}
+
+// NewMemoryRepositories returns repositories that keep everything in memory,
+// for unit tests of the handlers. Transactions are not isolated: fn runs
+// directly on the store and nothing is rolled back.
+func NewMemoryRepositories() Repositories {
+	store := &memoryStore{
+		employees: map[uint]schemas.Employee{},
+		companies: map[uint]schemas.Company{},
+		timeLogs:  map[uint]schemas.TimeLog{},
+		requests:  map[uint]schemas.PontoSolicitacao{},
+		logins:    map[uint]schemas.Login{},
+		attempts:  map[uint]schemas.LoginAttempt{},
+		punches:   map[uint]schemas.PunchRecord{},
+
+		branches:       map[uint]schemas.Branch{},
+		departments:    map[uint]schemas.Department{},
+		holidays:       map[uint]schemas.Holiday{},
+		workplaces:     map[uint]schemas.Workplace{},
+		geofences:      map[uint]schemas.Geofence{},
+		kioskDevices:   map[uint]schemas.KioskDevice{},
+		ssoStates:      map[uint]schemas.SSOLoginState{},
+		ssoIdentities:  map[uint]schemas.SSOIdentity{},
+		passwordResets: map[uint]schemas.PasswordResetToken{},
+		recoveryCodes:  map[uint]schemas.RecoveryCode{},
+		sessions:       map[uint]schemas.Session{},
+		recalculations: map[uint]schemas.RecalculationTask{},
+		auditLogs:      map[uint]schemas.AuditLog{},
+		workRules:      map[uint]schemas.WorkRule{},
+	}
+	return Repositories{
+		Employees: memoryEmployees{store},
+		Companies: memoryCompanies{store},
+		TimeLogs:  memoryTimeLogs{store},
+		Requests:  memoryRequests{store},
+		Logins:    memoryLogins{store},
+
+		LoginAttempts: memoryLoginAttempts{store},
+		Punches:       memoryPunches{store},
+
+		Branches:       memoryBranches{store},
+		Departments:    memoryDepartments{store},
+		Holidays:       memoryHolidays{store},
+		Workplaces:     memoryWorkplaces{store},
+		Geofences:      memoryGeofences{store},
+		KioskDevices:   memoryKioskDevices{store},
+		SSOStates:      memorySSOStates{store},
+		SSOIdentities:  memorySSOIdentities{store},
+		PasswordResets: memoryPasswordResets{store},
+		RecoveryCodes:  memoryRecoveryCodes{store},
+		Sessions:       memorySessions{store},
+		Recalculations: memoryRecalculations{store},
+		AuditLogs:      memoryAuditLogs{store},
+		WorkRules:      memoryWorkRules{store},
+	}
+}
+
+// create assigns the ID and timestamps of a new record.
+func (s *memoryStore) create(id *uint, createdAt, updatedAt *time.Time) {
+	s.nextID++
+	*id = s.nextID
+	now := time.Now()
+	if createdAt.IsZero() {
+		*createdAt = now
+	}
+	*updatedAt = now
+}
+
+// get returns the record with the ID, or ErrNotFound.
+func get[T any](s *memoryStore, m map[uint]T, id uint) (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	value, ok := m[id]
+	if !ok {
+		return value, ErrNotFound
+	}
+	return value, nil
+}
+
+// first returns the record with the lowest ID that keep accepts, or
+// ErrNotFound.
+func first[T any](s *memoryStore, m map[uint]T, keep func(T) bool) (T, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	values := sortedValues(m, keep)
+	if len(values) == 0 {
+		var zero T
+		return zero, ErrNotFound
+	}
+	return values[0], nil
+}
+
+func sortedValues[T any](m map[uint]T, keep func(T) bool) []T {
+	ids := make([]uint, 0, len(m))
+	for id := range m {
+		ids = append(ids, id)
+	}
+	slices.Sort(ids)
+	values := []T{}
+	for _, id := range ids {
+		if keep(m[id]) {
+			values = append(values, m[id])
+		}
+	}
+	return values
+}
+
+type memoryEmployees struct{ s *memoryStore }
+
+func (r memoryEmployees) Create(employee *schemas.Employee) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, e := range r.s.employees {
+		if e.Email == employee.Email {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&employee.ID, &employee.CreatedAt, &employee.UpdatedAt)
+	r.s.employees[employee.ID] = *employee
+	return nil
+}
+
+func (r memoryEmployees) Get(id uint) (schemas.Employee, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	employee, ok := r.s.employees[id]
+	if !ok {
+		return schemas.Employee{}, ErrNotFound
+	}
+	return employee, nil
+}
+
+func (r memoryEmployees) GetByEmail(email string) (schemas.Employee, error) {
+	employees, err := r.List(EmployeeFilter{Emails: []string{email}})
+	if err != nil || len(employees) == 0 {
+		return schemas.Employee{}, ErrNotFound
+	}
+	return employees[0], nil
+}
+
+func (r memoryEmployees) List(filter EmployeeFilter) ([]schemas.Employee, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return sortedValues(r.s.employees, func(e schemas.Employee) bool {
+		switch {
+		case filter.Emails != nil && !slices.Contains(filter.Emails, e.Email),
+			filter.CompanyCNPJ != "" && e.CompanyCNPJ != filter.CompanyCNPJ,
+			filter.BranchID != nil && (e.BranchID == nil || *e.BranchID != *filter.BranchID),
+			filter.DepartmentIDs != nil && (e.DepartmentID == nil || !slices.Contains(filter.DepartmentIDs, *e.DepartmentID)),
+			filter.Active != nil && e.Active != *filter.Active,
+			filter.IsManager != nil && e.IsManager != *filter.IsManager,
+			filter.IsAdmin != nil && e.IsAdmin != *filter.IsAdmin,
+			filter.Matricula != "" && e.Matricula != filter.Matricula,
+			filter.BadgeNumber != "" && e.BadgeNumber != filter.BadgeNumber:
+			return false
+		}
+		return true
+	}), nil
+}
+
+func (r memoryEmployees) Update(employee *schemas.Employee) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if employee.ID == 0 {
+		r.s.create(&employee.ID, &employee.CreatedAt, &employee.UpdatedAt)
+	} else {
+		employee.UpdatedAt = time.Now()
+	}
+	r.s.employees[employee.ID] = *employee
+	return nil
+}
+
+func (r memoryEmployees) Delete(employee *schemas.Employee) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	delete(r.s.employees, employee.ID)
+	return nil
+}
+
+func (r memoryEmployees) SetBranch(emails []string, branchID uint) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, e := range r.s.employees {
+		if slices.Contains(emails, e.Email) {
+			e.BranchID = &branchID
+			r.s.employees[id] = e
+		}
+	}
+	return nil
+}
+
+func (r memoryEmployees) SetDepartment(emails []string, departmentID uint) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, e := range r.s.employees {
+		if slices.Contains(emails, e.Email) {
+			e.DepartmentID = &departmentID
+			r.s.employees[id] = e
+		}
+	}
+	return nil
+}
+
+type memoryCompanies struct{ s *memoryStore }
+
+func (r memoryCompanies) Create(company *schemas.Company) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, c := range r.s.companies {
+		if c.CNPJ == company.CNPJ {
+			return ErrDuplicate
+		}
+	}
+	if company.Timezone == "" {
+		company.Timezone = "America/Sao_Paulo"
+	}
+	r.s.create(&company.ID, &company.CreatedAt, &company.UpdatedAt)
+	stored := *company
+	stored.Employees = nil
+	r.s.companies[company.ID] = stored
+	return nil
+}
+
+func (r memoryCompanies) GetByCNPJ(cnpj string) (schemas.Company, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, c := range r.s.companies {
+		if c.CNPJ == cnpj {
+			return c, nil
+		}
+	}
+	return schemas.Company{}, ErrNotFound
+}
+
+func (r memoryCompanies) List(withEmployees bool) ([]schemas.Company, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	companies := sortedValues(r.s.companies, func(schemas.Company) bool { return true })
+	if withEmployees {
+		for i := range companies {
+			companies[i].Employees = sortedValues(r.s.employees, func(e schemas.Employee) bool {
+				return e.CompanyCNPJ == companies[i].CNPJ
+			})
+		}
+	}
+	return companies, nil
+}
+
+func (r memoryCompanies) Update(company *schemas.Company) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if company.ID == 0 {
+		r.s.create(&company.ID, &company.CreatedAt, &company.UpdatedAt)
+	} else {
+		company.UpdatedAt = time.Now()
+	}
+	stored := *company
+	stored.Employees = nil
+	r.s.companies[company.ID] = stored
+	return nil
+}
+
+type memoryTimeLogs struct{ s *memoryStore }
+
+func (r memoryTimeLogs) Create(timeLog *schemas.TimeLog) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.dayTaken(*timeLog) {
+		return ErrDuplicate
+	}
+	r.s.create(&timeLog.ID, &timeLog.CreatedAt, &timeLog.UpdatedAt)
+	r.s.timeLogs[timeLog.ID] = *timeLog
+	return nil
+}
+
+func (r memoryTimeLogs) Get(id uint) (schemas.TimeLog, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	timeLog, ok := r.s.timeLogs[id]
+	if !ok {
+		return schemas.TimeLog{}, ErrNotFound
+	}
+	return timeLog, nil
+}
+
+func (r memoryTimeLogs) GetByDate(email string, logDate time.Time) (schemas.TimeLog, error) {
+	timeLogs, _ := r.List(TimeLogFilter{Emails: []string{email}, From: logDate, To: logDate.Add(time.Nanosecond)})
+	if len(timeLogs) == 0 {
+		return schemas.TimeLog{}, ErrNotFound
+	}
+	return timeLogs[0], nil
+}
+
+// LockByDate does not lock: the in-memory transactions are not isolated.
+func (r memoryTimeLogs) LockByDate(email string, logDate time.Time) (schemas.TimeLog, error) {
+	return r.GetByDate(email, logDate)
+}
+
+func (r memoryTimeLogs) List(filter TimeLogFilter) ([]schemas.TimeLog, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	timeLogs := sortedValues(r.s.timeLogs, func(tl schemas.TimeLog) bool {
+		switch {
+		case filter.Emails != nil && !slices.Contains(filter.Emails, tl.EmployeeEmail),
+			!filter.From.IsZero() && tl.LogDate.Before(filter.From),
+			!filter.To.IsZero() && !tl.LogDate.Before(filter.To),
+			len(filter.Statuses) > 0 && !slices.Contains(filter.Statuses, tl.Status),
+			filter.Complete && (tl.EntryTime.IsZero() || tl.LunchExitTime.IsZero() || tl.LunchReturnTime.IsZero() || tl.ExitTime.IsZero()):
+			return false
+		}
+		return true
+	})
+	sort.SliceStable(timeLogs, func(i, j int) bool {
+		a, b := timeLogs[i], timeLogs[j]
+		if !a.LogDate.Equal(b.LogDate) {
+			return a.LogDate.Before(b.LogDate) != filter.Descending
+		}
+		return a.EmployeeEmail < b.EmployeeEmail
+	})
+	return timeLogs, nil
+}
+
+func (r memoryTimeLogs) Update(timeLog *schemas.TimeLog) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.dayTaken(*timeLog) {
+		return ErrDuplicate
+	}
+	if timeLog.ID == 0 {
+		r.s.create(&timeLog.ID, &timeLog.CreatedAt, &timeLog.UpdatedAt)
+	} else {
+		timeLog.UpdatedAt = time.Now()
+	}
+	r.s.timeLogs[timeLog.ID] = *timeLog
+	return nil
+}
+
+// dayTaken reports whether another log of the employee is on the same day.
+func (r memoryTimeLogs) dayTaken(timeLog schemas.TimeLog) bool {
+	for _, tl := range r.s.timeLogs {
+		if tl.ID != timeLog.ID && tl.EmployeeEmail == timeLog.EmployeeEmail && tl.LogDate.Equal(timeLog.LogDate) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r memoryTimeLogs) Delete(timeLog *schemas.TimeLog) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	delete(r.s.timeLogs, timeLog.ID)
+	return nil
+}
+
+type memoryRequests struct{ s *memoryStore }
+
+func (r memoryRequests) Create(request *schemas.PontoSolicitacao) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if request.Status == "" {
+		request.Status = "pendente"
+	}
+	r.s.create(&request.ID, &request.CreatedAt, &request.UpdatedAt)
+	r.s.requests[request.ID] = *request
+	return nil
+}
+
+func (r memoryRequests) Get(id uint) (schemas.PontoSolicitacao, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	request, ok := r.s.requests[id]
+	if !ok {
+		return schemas.PontoSolicitacao{}, ErrNotFound
+	}
+	return request, nil
+}
+
+func (r memoryRequests) ListByEmployees(emails []string) ([]schemas.PontoSolicitacao, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	requests := sortedValues(r.s.requests, func(p schemas.PontoSolicitacao) bool {
+		return slices.Contains(emails, p.FuncionarioEmail)
+	})
+	slices.Reverse(requests)
+	sort.SliceStable(requests, func(i, j int) bool {
+		return requests[i].CreatedAt.After(requests[j].CreatedAt)
+	})
+	return requests, nil
+}
+
+func (r memoryRequests) Update(request *schemas.PontoSolicitacao) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if request.ID == 0 {
+		r.s.create(&request.ID, &request.CreatedAt, &request.UpdatedAt)
+	} else {
+		request.UpdatedAt = time.Now()
+	}
+	r.s.requests[request.ID] = *request
+	return nil
+}
+
+type memoryLogins struct{ s *memoryStore }
+
+func (r memoryLogins) Create(login *schemas.Login) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, l := range r.s.logins {
+		if l.Email == login.Email {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&login.ID, &login.CreatedAt, &login.UpdatedAt)
+	r.s.logins[login.ID] = *login
+	return nil
+}
+
+func (r memoryLogins) GetByEmail(email string) (schemas.Login, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, l := range r.s.logins {
+		if l.Email == email {
+			return l, nil
+		}
+	}
+	return schemas.Login{}, ErrNotFound
+}
+
+func (r memoryLogins) GetByChallenge(challengeHash string) (schemas.Login, error) {
+	return first(r.s, r.s.logins, func(l schemas.Login) bool { return l.ChallengeHash == challengeHash })
+}
+
+func (r memoryLogins) Update(login *schemas.Login) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if login.ID == 0 {
+		r.s.create(&login.ID, &login.CreatedAt, &login.UpdatedAt)
+	} else {
+		login.UpdatedAt = time.Now()
+	}
+	r.s.logins[login.ID] = *login
+	return nil
+}
+
+type memoryLoginAttempts struct{ s *memoryStore }
+
+func (r memoryLoginAttempts) Create(attempt *schemas.LoginAttempt) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&attempt.ID, &attempt.CreatedAt, &attempt.UpdatedAt)
+	r.s.attempts[attempt.ID] = *attempt
+	return nil
+}
+
+func (r memoryLoginAttempts) List(filter LoginAttemptFilter) ([]schemas.LoginAttempt, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	attempts := sortedValues(r.s.attempts, func(a schemas.LoginAttempt) bool {
+		return (filter.Email == "" || a.Email == filter.Email) &&
+			(filter.IP == "" || a.IP == filter.IP) &&
+			(filter.Success == nil || a.Success == *filter.Success) &&
+			(filter.Since.IsZero() || !a.CreatedAt.Before(filter.Since)) &&
+			(filter.Until.IsZero() || a.CreatedAt.Before(filter.Until))
+	})
+	sort.SliceStable(attempts, func(i, j int) bool {
+		if !attempts[i].CreatedAt.Equal(attempts[j].CreatedAt) {
+			return attempts[i].CreatedAt.After(attempts[j].CreatedAt)
+		}
+		return attempts[i].ID > attempts[j].ID
+	})
+	if filter.Limit > 0 && len(attempts) > filter.Limit {
+		attempts = attempts[:filter.Limit]
+	}
+	return attempts, nil
+}
+
+type memoryPunches struct{ s *memoryStore }
+
+func (r memoryPunches) Create(punch *schemas.PunchRecord) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, p := range r.s.punches {
+		if punch.IdempotencyKey != nil && p.IdempotencyKey != nil && *p.IdempotencyKey == *punch.IdempotencyKey && p.EmployeeEmail == punch.EmployeeEmail {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&punch.ID, &punch.CreatedAt, &punch.UpdatedAt)
+	r.s.punches[punch.ID] = *punch
+	return nil
+}
+
+func (r memoryPunches) Relabel(id uint, punch string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	record, ok := r.s.punches[id]
+	if !ok {
+		return ErrNotFound
+	}
+	record.Punch = punch
+	r.s.punches[id] = record
+	return nil
+}
+
+func (r memoryPunches) List(filter PunchFilter) ([]schemas.PunchRecord, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	punches := sortedValues(r.s.punches, func(p schemas.PunchRecord) bool {
+		return (filter.Emails == nil || slices.Contains(filter.Emails, p.EmployeeEmail)) &&
+			(filter.TimeLogID == 0 || p.TimeLogID == filter.TimeLogID) &&
+			(filter.From.IsZero() || !p.PunchedAt.Before(filter.From)) &&
+			(filter.To.IsZero() || p.PunchedAt.Before(filter.To)) &&
+			(len(filter.Sources) == 0 || slices.Contains(filter.Sources, p.Source)) &&
+			(filter.ClientIP == "" || p.ClientIP == filter.ClientIP) &&
+			(filter.DeviceID == "" || p.DeviceID == filter.DeviceID) &&
+			(filter.IdempotencyKey == "" || p.IdempotencyKey != nil && *p.IdempotencyKey == filter.IdempotencyKey)
+	})
+	sort.SliceStable(punches, func(i, j int) bool { return punches[i].PunchedAt.Before(punches[j].PunchedAt) })
+	return punches, nil
+}
+
+type memoryBranches struct{ s *memoryStore }
+
+func (r memoryBranches) Create(branch *schemas.Branch) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, b := range r.s.branches {
+		if branch.CNPJ != nil && b.CNPJ != nil && *b.CNPJ == *branch.CNPJ {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&branch.ID, &branch.CreatedAt, &branch.UpdatedAt)
+	r.s.branches[branch.ID] = *branch
+	return nil
+}
+
+func (r memoryBranches) Get(id uint) (schemas.Branch, error) {
+	return get(r.s, r.s.branches, id)
+}
+
+func (r memoryBranches) ListByCompany(cnpj string) ([]schemas.Branch, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	branches := sortedValues(r.s.branches, func(b schemas.Branch) bool { return b.CompanyCNPJ == cnpj })
+	sort.SliceStable(branches, func(i, j int) bool { return branches[i].Name < branches[j].Name })
+	return branches, nil
+}
+
+func (r memoryBranches) Update(branch *schemas.Branch) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, b := range r.s.branches {
+		if branch.CNPJ != nil && b.CNPJ != nil && *b.CNPJ == *branch.CNPJ && b.ID != branch.ID {
+			return ErrDuplicate
+		}
+	}
+	branch.UpdatedAt = time.Now()
+	r.s.branches[branch.ID] = *branch
+	return nil
+}
+
+type memoryDepartments struct{ s *memoryStore }
+
+func (r memoryDepartments) Create(department *schemas.Department) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&department.ID, &department.CreatedAt, &department.UpdatedAt)
+	r.s.departments[department.ID] = *department
+	return nil
+}
+
+func (r memoryDepartments) Get(id uint) (schemas.Department, error) {
+	return get(r.s, r.s.departments, id)
+}
+
+func (r memoryDepartments) ListByCompany(cnpj string) ([]schemas.Department, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	departments := sortedValues(r.s.departments, func(d schemas.Department) bool { return d.CompanyCNPJ == cnpj })
+	sort.SliceStable(departments, func(i, j int) bool { return departments[i].Name < departments[j].Name })
+	return departments, nil
+}
+
+func (r memoryDepartments) Update(department *schemas.Department) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	department.UpdatedAt = time.Now()
+	r.s.departments[department.ID] = *department
+	return nil
+}
+
+func (r memoryDepartments) Delete(department *schemas.Department) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	delete(r.s.departments, department.ID)
+	return nil
+}
+
+type memoryHolidays struct{ s *memoryStore }
+
+func (r memoryHolidays) Create(holiday *schemas.Holiday) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&holiday.ID, &holiday.CreatedAt, &holiday.UpdatedAt)
+	r.s.holidays[holiday.ID] = *holiday
+	return nil
+}
+
+func (r memoryHolidays) Get(id uint) (schemas.Holiday, error) {
+	return get(r.s, r.s.holidays, id)
+}
+
+func (r memoryHolidays) List(filter HolidayFilter) ([]schemas.Holiday, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	holidays := sortedValues(r.s.holidays, func(h schemas.Holiday) bool {
+		return (filter.CompanyCNPJ == "" || h.CompanyCNPJ == filter.CompanyCNPJ) &&
+			(filter.BranchID == nil || h.BranchID == nil || *h.BranchID == *filter.BranchID) &&
+			(filter.Date.IsZero() || h.Date.Equal(filter.Date))
+	})
+	sort.SliceStable(holidays, func(i, j int) bool { return holidays[i].Date.Before(holidays[j].Date) })
+	return holidays, nil
+}
+
+func (r memoryHolidays) Delete(holiday *schemas.Holiday) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	delete(r.s.holidays, holiday.ID)
+	return nil
+}
+
+type memoryWorkplaces struct{ s *memoryStore }
+
+func (r memoryWorkplaces) Create(workplace *schemas.Workplace) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&workplace.ID, &workplace.CreatedAt, &workplace.UpdatedAt)
+	r.s.workplaces[workplace.ID] = *workplace
+	return nil
+}
+
+func (r memoryWorkplaces) Get(id uint) (schemas.Workplace, error) {
+	return get(r.s, r.s.workplaces, id)
+}
+
+func (r memoryWorkplaces) List(cnpj string) ([]schemas.Workplace, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return sortedValues(r.s.workplaces, func(w schemas.Workplace) bool {
+		return cnpj == "" || w.CompanyCNPJ == cnpj
+	}), nil
+}
+
+func (r memoryWorkplaces) Update(workplace *schemas.Workplace) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	workplace.UpdatedAt = time.Now()
+	r.s.workplaces[workplace.ID] = *workplace
+	return nil
+}
+
+type memoryGeofences struct{ s *memoryStore }
+
+func (r memoryGeofences) Create(fence *schemas.Geofence) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&fence.ID, &fence.CreatedAt, &fence.UpdatedAt)
+	r.s.geofences[fence.ID] = *fence
+	return nil
+}
+
+func (r memoryGeofences) Get(id uint) (schemas.Geofence, error) {
+	return get(r.s, r.s.geofences, id)
+}
+
+func (r memoryGeofences) List(filter GeofenceFilter) ([]schemas.Geofence, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return sortedValues(r.s.geofences, func(g schemas.Geofence) bool {
+		return (filter.CompanyCNPJ == "" || g.CompanyCNPJ == filter.CompanyCNPJ) &&
+			(filter.WorkplaceID == 0 || g.WorkplaceID == filter.WorkplaceID) &&
+			(filter.Active == nil || g.Active == *filter.Active)
+	}), nil
+}
+
+func (r memoryGeofences) Delete(fence *schemas.Geofence) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	delete(r.s.geofences, fence.ID)
+	return nil
+}
+
+type memoryKioskDevices struct{ s *memoryStore }
+
+func (r memoryKioskDevices) Create(device *schemas.KioskDevice) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, d := range r.s.kioskDevices {
+		if d.KeyHash == device.KeyHash {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&device.ID, &device.CreatedAt, &device.UpdatedAt)
+	r.s.kioskDevices[device.ID] = *device
+	return nil
+}
+
+func (r memoryKioskDevices) Get(id uint) (schemas.KioskDevice, error) {
+	return get(r.s, r.s.kioskDevices, id)
+}
+
+func (r memoryKioskDevices) GetByKeyHash(keyHash string) (schemas.KioskDevice, error) {
+	return first(r.s, r.s.kioskDevices, func(d schemas.KioskDevice) bool { return d.KeyHash == keyHash })
+}
+
+func (r memoryKioskDevices) List(cnpj string) ([]schemas.KioskDevice, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	return sortedValues(r.s.kioskDevices, func(d schemas.KioskDevice) bool {
+		return cnpj == "" || d.CompanyCNPJ == cnpj
+	}), nil
+}
+
+func (r memoryKioskDevices) Update(device *schemas.KioskDevice) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	device.UpdatedAt = time.Now()
+	r.s.kioskDevices[device.ID] = *device
+	return nil
+}
+
+type memorySSOStates struct{ s *memoryStore }
+
+func (r memorySSOStates) Create(state *schemas.SSOLoginState) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&state.ID, &state.CreatedAt, &state.UpdatedAt)
+	r.s.ssoStates[state.ID] = *state
+	return nil
+}
+
+func (r memorySSOStates) Take(stateHash string) (schemas.SSOLoginState, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, state := range r.s.ssoStates {
+		if state.StateHash == stateHash {
+			delete(r.s.ssoStates, id)
+			return state, nil
+		}
+	}
+	return schemas.SSOLoginState{}, ErrNotFound
+}
+
+func (r memorySSOStates) DeleteExpired(now time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, state := range r.s.ssoStates {
+		if state.ExpiresAt.Before(now) {
+			delete(r.s.ssoStates, id)
+		}
+	}
+	return nil
+}
+
+type memorySSOIdentities struct{ s *memoryStore }
+
+func (r memorySSOIdentities) Create(identity *schemas.SSOIdentity) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, i := range r.s.ssoIdentities {
+		if i.Issuer == identity.Issuer && i.Subject == identity.Subject {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&identity.ID, &identity.CreatedAt, &identity.UpdatedAt)
+	r.s.ssoIdentities[identity.ID] = *identity
+	return nil
+}
+
+func (r memorySSOIdentities) Get(issuer, subject string) (schemas.SSOIdentity, error) {
+	return first(r.s, r.s.ssoIdentities, func(i schemas.SSOIdentity) bool {
+		return i.Issuer == issuer && i.Subject == subject
+	})
+}
+
+type memoryPasswordResets struct{ s *memoryStore }
+
+func (r memoryPasswordResets) Create(token *schemas.PasswordResetToken) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, t := range r.s.passwordResets {
+		if t.TokenHash == token.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&token.ID, &token.CreatedAt, &token.UpdatedAt)
+	r.s.passwordResets[token.ID] = *token
+	return nil
+}
+
+func (r memoryPasswordResets) GetByHash(tokenHash string) (schemas.PasswordResetToken, error) {
+	return first(r.s, r.s.passwordResets, func(t schemas.PasswordResetToken) bool { return t.TokenHash == tokenHash })
+}
+
+func (r memoryPasswordResets) Use(id uint, at time.Time) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	token, ok := r.s.passwordResets[id]
+	if !ok || !token.UsedAt.IsZero() {
+		return false, nil
+	}
+	token.UsedAt = at
+	r.s.passwordResets[id] = token
+	return true, nil
+}
+
+func (r memoryPasswordResets) Revoke(email string, at time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, token := range r.s.passwordResets {
+		if token.Email == email && token.UsedAt.IsZero() {
+			token.UsedAt = at
+			r.s.passwordResets[id] = token
+		}
+	}
+	return nil
+}
+
+type memorySessions struct{ s *memoryStore }
+
+func (r memorySessions) Create(session *schemas.Session) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, existing := range r.s.sessions {
+		if existing.TokenHash == session.TokenHash {
+			return ErrDuplicate
+		}
+	}
+	r.s.create(&session.ID, &session.CreatedAt, &session.UpdatedAt)
+	r.s.sessions[session.ID] = *session
+	return nil
+}
+
+func (r memorySessions) GetByHash(tokenHash string) (schemas.Session, error) {
+	return first(r.s, r.s.sessions, func(session schemas.Session) bool { return session.TokenHash == tokenHash })
+}
+
+func (r memorySessions) Delete(tokenHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, session := range r.s.sessions {
+		if session.TokenHash == tokenHash {
+			delete(r.s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (r memorySessions) DeleteByEmail(email, exceptHash string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, session := range r.s.sessions {
+		if session.EmployeeEmail == email && session.TokenHash != exceptHash {
+			delete(r.s.sessions, id)
+		}
+	}
+	return nil
+}
+
+func (r memorySessions) DeleteExpired(now time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, session := range r.s.sessions {
+		if session.ExpiresAt.Before(now) {
+			delete(r.s.sessions, id)
+		}
+	}
+	return nil
+}
+
+type memoryRecoveryCodes struct{ s *memoryStore }
+
+func (r memoryRecoveryCodes) Replace(email string, codeHashes []string) error {
+	r.Delete(email)
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for _, hash := range codeHashes {
+		code := schemas.RecoveryCode{Email: email, CodeHash: hash}
+		r.s.create(&code.ID, &code.CreatedAt, &code.UpdatedAt)
+		r.s.recoveryCodes[code.ID] = code
+	}
+	return nil
+}
+
+func (r memoryRecoveryCodes) Use(email, codeHash string, at time.Time) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, code := range r.s.recoveryCodes {
+		if code.Email == email && code.CodeHash == codeHash && code.UsedAt.IsZero() {
+			code.UsedAt = at
+			r.s.recoveryCodes[id] = code
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (r memoryRecoveryCodes) Delete(email string) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, code := range r.s.recoveryCodes {
+		if code.Email == email {
+			delete(r.s.recoveryCodes, id)
+		}
+	}
+	return nil
+}
+
+type memoryRecalculations struct{ s *memoryStore }
+
+func (r memoryRecalculations) Create(task *schemas.RecalculationTask) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&task.ID, &task.CreatedAt, &task.UpdatedAt)
+	r.s.recalculations[task.ID] = *task
+	return nil
+}
+
+func (r memoryRecalculations) Get(id uint) (schemas.RecalculationTask, error) {
+	return get(r.s, r.s.recalculations, id)
+}
+
+func (r memoryRecalculations) List(filter RecalculationFilter) ([]schemas.RecalculationTask, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	tasks := sortedValues(r.s.recalculations, func(t schemas.RecalculationTask) bool {
+		return (filter.CompanyCNPJ == "" || t.CompanyCNPJ == filter.CompanyCNPJ) &&
+			(filter.Status == "" || t.Status == filter.Status)
+	})
+	slices.Reverse(tasks)
+	if filter.Limit > 0 && len(tasks) > filter.Limit {
+		tasks = tasks[:filter.Limit]
+	}
+	return tasks, nil
+}
+
+func (r memoryRecalculations) Update(task *schemas.RecalculationTask) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	task.UpdatedAt = time.Now()
+	r.s.recalculations[task.ID] = *task
+	return nil
+}
+
+func (r memoryRecalculations) NextPending() (schemas.RecalculationTask, error) {
+	return first(r.s, r.s.recalculations, func(t schemas.RecalculationTask) bool { return t.Status == "pendente" })
+}
+
+func (r memoryRecalculations) Claim(id uint, startedAt time.Time) (bool, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	task, ok := r.s.recalculations[id]
+	if !ok || task.Status != "pendente" {
+		return false, nil
+	}
+	task.Status, task.StartedAt, task.HeartbeatAt = "executando", startedAt, startedAt
+	r.s.recalculations[id] = task
+	return true, nil
+}
+
+func (r memoryRecalculations) RequeueStale(before time.Time) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, task := range r.s.recalculations {
+		if task.Status == "executando" && task.HeartbeatAt.Before(before) {
+			task.Status = "pendente"
+			r.s.recalculations[id] = task
+		}
+	}
+	return nil
+}
+
+type memoryAuditLogs struct{ s *memoryStore }
+
+func (r memoryAuditLogs) Create(entry *schemas.AuditLog) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	r.s.create(&entry.ID, &entry.CreatedAt, &entry.UpdatedAt)
+	r.s.auditLogs[entry.ID] = *entry
+	return nil
+}
+
+func (r memoryAuditLogs) List(filter AuditLogFilter) ([]schemas.AuditLog, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	entries := sortedValues(r.s.auditLogs, func(e schemas.AuditLog) bool {
+		return (filter.Entity == "" || e.Entity == filter.Entity) &&
+			(filter.EntityID == nil || e.EntityID == *filter.EntityID)
+	})
+	slices.Reverse(entries)
+	if filter.Limit > 0 && len(entries) > filter.Limit {
+		entries = entries[:filter.Limit]
+	}
+	return entries, nil
+}
+
+type memoryWorkRules struct{ s *memoryStore }
+
+func (r memoryWorkRules) Save(rule *schemas.WorkRule) error {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	for id, existing := range r.s.workRules {
+		if existing.CompanyCNPJ == rule.CompanyCNPJ && existing.EmployeeEmail == rule.EmployeeEmail &&
+			existing.Kind == rule.Kind && existing.EffectiveFrom.Equal(rule.EffectiveFrom) {
+			rule.ID, rule.CreatedAt, rule.UpdatedAt = id, existing.CreatedAt, time.Now()
+			r.s.workRules[id] = *rule
+			return nil
+		}
+	}
+	r.s.create(&rule.ID, &rule.CreatedAt, &rule.UpdatedAt)
+	r.s.workRules[rule.ID] = *rule
+	return nil
+}
+
+func (r memoryWorkRules) List(filter WorkRuleFilter) ([]schemas.WorkRule, error) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	rules := sortedValues(r.s.workRules, func(w schemas.WorkRule) bool {
+		return (filter.CompanyCNPJ == "" || w.CompanyCNPJ == filter.CompanyCNPJ) &&
+			(filter.EmployeeEmail == "" || w.EmployeeEmail == filter.EmployeeEmail) &&
+			(filter.Kind == "" || w.Kind == filter.Kind)
+	})
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].EffectiveFrom.Before(rules[j].EffectiveFrom) })
+	return rules, nil
+}
@@ -0,0 +1,156 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// ErrSchemaBehind is returned by CheckSchema when migrations are pending.
+var ErrSchemaBehind = errors.New("database schema has pending migrations")
+
+// Migration is a versioned schema change. Up and Down run inside a
+// transaction on databases with transactional DDL (SQLite and PostgreSQL).
+//
+// Migrations must not use the live models from the schemas package, which keep
+// changing: declare a local struct with just the columns being touched and a
+// TableName method, as in the migrations below.
+type Migration struct {
+	ID          string
+	Description string
+	Up          func(tx *gorm.DB) error
+	Down        func(tx *gorm.DB) error
+}
+
+// SchemaMigration records an applied migration.
+type SchemaMigration struct {
+	ID        string    `gorm:"type:varchar(255);primaryKey"`
+	AppliedAt time.Time `gorm:"not null"`
+}
+
+// MigrationStatus reports whether a migration was applied.
+type MigrationStatus struct {
+	ID          string     `json:"id"`
+	Description string     `json:"description"`
+	AppliedAt   *time.Time `json:"applied_at"`
+}
+
+func ensureMigrationsTable(db *gorm.DB) error {
+	return db.AutoMigrate(&SchemaMigration{})
+}
+
+func appliedMigrations(db *gorm.DB) (map[string]time.Time, error) {
+	if err := ensureMigrationsTable(db); err != nil {
+		return nil, err
+	}
+	var rows []SchemaMigration
+	if err := db.Find(&rows).Error; err != nil {
+		return nil, err
+	}
+	applied := map[string]time.Time{}
+	for _, row := range rows {
+		applied[row.ID] = row.AppliedAt
+	}
+	return applied, nil
+}
+
+// Status lists every known migration, in order, with when it was applied.
+func Status(db *gorm.DB) ([]MigrationStatus, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	statuses := make([]MigrationStatus, 0, len(migrations))
+	for _, m := range migrations {
+		status := MigrationStatus{ID: m.ID, Description: m.Description}
+		if at, ok := applied[m.ID]; ok {
+			status.AppliedAt = &at
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// Pending returns the migrations not applied yet, in order.
+func Pending(db *gorm.DB) ([]Migration, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+	var pending []Migration
+	for _, m := range migrations {
+		if _, ok := applied[m.ID]; !ok {
+			pending = append(pending, m)
+		}
+	}
+	return pending, nil
+}
+
+// CheckSchema fails with ErrSchemaBehind when there are pending migrations.
+func CheckSchema(db *gorm.DB) error {
+	pending, err := Pending(db)
+	if err != nil {
+		return err
+	}
+	if len(pending) > 0 {
+		return fmt.Errorf("%w: %d pending, next is %s", ErrSchemaBehind, len(pending), pending[0].ID)
+	}
+	return nil
+}
+
+// Migrate applies every pending migration, in order, and returns the IDs of
+// the migrations applied.
+func Migrate(db *gorm.DB) ([]string, error) {
+	pending, err := Pending(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for _, m := range pending {
+		log.Info().Str("migration", m.ID).Msg("Applying migration")
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Up(tx); err != nil {
+				return err
+			}
+			return tx.Create(&SchemaMigration{ID: m.ID, AppliedAt: time.Now().UTC()}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("migration %s: %w", m.ID, err)
+		}
+		done = append(done, m.ID)
+	}
+	return done, nil
+}
+
+// Rollback reverts the last steps applied migrations, newest first, and
+// returns the IDs of the migrations reverted.
+func Rollback(db *gorm.DB, steps int) ([]string, error) {
+	applied, err := appliedMigrations(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var done []string
+	for i := len(migrations) - 1; i >= 0 && len(done) < steps; i-- {
+		m := migrations[i]
+		if _, ok := applied[m.ID]; !ok {
+			continue
+		}
+		log.Info().Str("migration", m.ID).Msg("Rolling back migration")
+		err := db.Transaction(func(tx *gorm.DB) error {
+			if err := m.Down(tx); err != nil {
+				return err
+			}
+			return tx.Delete(&SchemaMigration{ID: m.ID}).Error
+		})
+		if err != nil {
+			return done, fmt.Errorf("rollback %s: %w", m.ID, err)
+		}
+		done = append(done, m.ID)
+	}
+	return done, nil
+}
@@ -0,0 +1,217 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/db/dbtest"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+}
+
+// Every column of the models must be created by the migrations, so a schema
+// change without its migration fails here instead of in production.
+func TestMigrationsMatchModels(t *testing.T) {
+	database := dbtest.Open(t)
+
+	models := []interface{}{
+		&schemas.Employee{}, &schemas.Login{}, &schemas.TimeLog{}, &schemas.Company{},
+		&schemas.PontoSolicitacao{}, &schemas.Department{}, &schemas.Branch{}, &schemas.Holiday{},
+		&schemas.JobRun{}, &schemas.RecalculationTask{}, &schemas.AuditLog{}, &schemas.PasswordResetToken{},
+		&schemas.RecoveryCode{},
+		&schemas.LoginAttempt{},
+		&schemas.SSOIdentity{},
+		&schemas.SSOLoginState{},
+		&schemas.KioskDevice{},
+		&schemas.Workplace{},
+		&schemas.PunchRecord{},
+		&schemas.Geofence{},
+		&schemas.Session{},
+		&schemas.WorkRule{},
+	}
+	for _, model := range models {
+		stmt := database.Model(model).Statement
+		if err := stmt.Parse(model); err != nil {
+			t.Fatalf("parse %T: %v", model, err)
+		}
+		if !database.Migrator().HasTable(model) {
+			t.Errorf("table %s not created by migrations", stmt.Schema.Table)
+			continue
+		}
+		for _, field := range stmt.Schema.Fields {
+			if field.DBName == "" || field.IgnoreMigration {
+				continue
+			}
+			if !database.Migrator().HasColumn(model, field.DBName) {
+				t.Errorf("column %s.%s not created by migrations", stmt.Schema.Table, field.DBName)
+			}
+		}
+	}
+}
+
+func TestMigrateRollbackAndStatus(t *testing.T) {
+	database := dbtest.Open(t)
+
+	if err := db.CheckSchema(database); err != nil {
+		t.Fatalf("check migrated schema: %v", err)
+	}
+
+	reverted, err := db.Rollback(database, 1)
+	if err != nil || len(reverted) != 1 {
+		t.Fatalf("rollback = %v, %v", reverted, err)
+	}
+	if err := db.CheckSchema(database); err == nil {
+		t.Fatalf("check schema after rollback: want ErrSchemaBehind")
+	}
+
+	statuses, err := db.Status(database)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	for _, s := range statuses {
+		if s.ID == reverted[0] && s.AppliedAt != nil {
+			t.Errorf("%s still applied after rollback", s.ID)
+		}
+	}
+
+	applied, err := db.Migrate(database)
+	if err != nil || len(applied) != 1 || applied[0] != reverted[0] {
+		t.Fatalf("migrate = %v, %v", applied, err)
+	}
+	if err := db.CheckSchema(database); err != nil {
+		t.Errorf("check schema after migrating again: %v", err)
+	}
+}
+
+// rollbackTo reverts the migrations down to and including id.
+func rollbackTo(t *testing.T, database *gorm.DB, id string) {
+	t.Helper()
+	statuses, err := db.Status(database)
+	if err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	for i, s := range statuses {
+		if s.ID == id {
+			if _, err := db.Rollback(database, len(statuses)-i); err != nil {
+				t.Fatalf("rollback to %s: %v", id, err)
+			}
+			return
+		}
+	}
+	t.Fatalf("migration %s not found", id)
+}
+
+func TestBranchCNPJMigration(t *testing.T) {
+	database := dbtest.Open(t)
+	rollbackTo(t, database, "0013_branch_cnpj_null")
+
+	company := schemas.Company{Name: "ACME", CNPJ: "12345678000190"}
+	if err := database.Create(&company).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Exec("INSERT INTO branches (company_cnpj, cnpj, name) VALUES (?, ?, ?)", company.CNPJ, "", "Norte").Error; err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Migrate(database); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var branch schemas.Branch
+	if err := database.First(&branch).Error; err != nil || branch.CNPJ != nil {
+		t.Errorf("migrated branch = %+v, %v; want a NULL CNPJ", branch, err)
+	}
+	if err := database.Create(&schemas.Branch{CompanyCNPJ: company.CNPJ, Name: "Leste"}).Error; err != nil {
+		t.Errorf("second branch without CNPJ: %v", err)
+	}
+}
+
+func TestNormalizeLogDatesMigration(t *testing.T) {
+	database := dbtest.Open(t)
+	rollbackTo(t, database, "0015_normalize_log_dates")
+
+	if err := database.Create(&schemas.Company{Name: "ACME", CNPJ: "12345678000190", Timezone: "America/Sao_Paulo"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	if err := database.Create(&schemas.Employee{Email: "ana@acme.com", CompanyCNPJ: "12345678000190"}).Error; err != nil {
+		t.Fatal(err)
+	}
+	at := func(day, hour int) time.Time { return time.Date(2025, time.March, day, hour, 0, 0, 0, time.UTC) }
+	logs := []schemas.TimeLog{
+		// Punched with the server in São Paulo: local midnight
+		{LogDate: at(10, 3), EntryTime: at(10, 11), LunchExitTime: at(10, 15), Status: "incompleto", MissingHours: 8},
+		// Created by the old daily setup: midnight of the UTC day
+		{LogDate: at(10, 0)},
+		// A second log of the same day with the exit
+		{LogDate: at(10, 3), ExitTime: at(10, 20)},
+		// Set up at 22:00 in São Paulo, already the next UTC day
+		{LogDate: at(11, 0)},
+		{LogDate: at(12, 3)},
+	}
+	for i := range logs {
+		logs[i].EmployeeEmail = "ana@acme.com"
+		if err := database.Create(&logs[i]).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	punch := schemas.PunchRecord{EmployeeEmail: "ana@acme.com", TimeLogID: logs[2].ID, Punch: "saida", PunchedAt: at(10, 20)}
+	if err := database.Create(&punch).Error; err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Migrate(database); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var migrated []schemas.TimeLog
+	database.Unscoped().Order("log_date").Find(&migrated)
+	if len(migrated) != 3 {
+		t.Fatalf("time logs after migration = %+v, want 3", migrated)
+	}
+	for i, day := range []int{10, 11, 12} {
+		if !migrated[i].LogDate.Equal(at(day, 0)) {
+			t.Errorf("log %d date = %s, want midnight UTC of the %dth", i, migrated[i].LogDate, day)
+		}
+	}
+	merged := migrated[0]
+	if merged.ID != logs[0].ID || !merged.ExitTime.Equal(at(10, 20)) || merged.Status != "" || merged.MissingHours != 0 {
+		t.Errorf("merged log = %+v, want the first one with the exit and reopened", merged)
+	}
+	database.First(&punch, punch.ID)
+	if punch.TimeLogID != merged.ID {
+		t.Errorf("punch of the merged log points to %d, want %d", punch.TimeLogID, merged.ID)
+	}
+}
+
+func TestTimeLogDayUniqueMigration(t *testing.T) {
+	database := dbtest.Open(t)
+	rollbackTo(t, database, "0016_time_log_day_unique")
+
+	day := time.Date(2025, time.March, 10, 0, 0, 0, 0, time.UTC)
+	deleted := schemas.TimeLog{EmployeeEmail: "ana@acme.com", LogDate: day}
+	for _, timeLog := range []*schemas.TimeLog{&deleted, {EmployeeEmail: "ana@acme.com", LogDate: day}} {
+		if err := database.Create(timeLog).Error; err != nil {
+			t.Fatal(err)
+		}
+	}
+	database.Delete(&deleted)
+
+	if _, err := db.Migrate(database); err != nil {
+		t.Fatalf("migrate: %v", err)
+	}
+
+	var count int64
+	database.Unscoped().Model(&schemas.TimeLog{}).Count(&count)
+	if count != 1 {
+		t.Errorf("time logs after migration = %d, want the deleted one purged", count)
+	}
+	if err := database.Create(&schemas.TimeLog{EmployeeEmail: "ana@acme.com", LogDate: day}).Error; !errors.Is(err, gorm.ErrDuplicatedKey) {
+		t.Errorf("second log of the day: err = %v, want a duplicate key", err)
+	}
+}
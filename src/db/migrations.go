@@ -0,0 +1,896 @@
+package db
+
+import (
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+)
+
+// migrations is the ordered list of schema changes. New migrations are only
+// ever appended; applied IDs are stored in the schema_migrations table.
+var migrations = []Migration{
+	{
+		ID:          "0001_initial_schema",
+		Description: "Tabelas iniciais: funcionários, empresas, filiais, registros de ponto, tarefas e auditoria",
+		Up: func(tx *gorm.DB) error {
+			// Databases created by the old AutoMigrate start are adopted here:
+			// existing tables are kept and only missing columns are added.
+			return tx.AutoMigrate(initialSchema...)
+		},
+		Down: func(tx *gorm.DB) error {
+			for i := len(initialSchema) - 1; i >= 0; i-- {
+				if err := tx.Migrator().DropTable(initialSchema[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0002_recalculation_to_date",
+		Description: "Data final opcional nas tarefas de recálculo",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&recalculationTaskV2{}, "ToDate")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&recalculationTaskV2{}, "ToDate")
+		},
+	},
+	{
+		ID:          "0003_password_reset_tokens",
+		Description: "Tokens de redefinição de senha por e-mail",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&passwordResetTokenV3{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&passwordResetTokenV3{})
+		},
+	},
+	{
+		ID:          "0004_two_factor",
+		Description: "Autenticação em dois fatores: segredo TOTP, desafio de login, códigos de recuperação e exigência por empresa",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range loginV4Columns {
+				if err := tx.Migrator().AddColumn(&loginV4{}, column); err != nil {
+					return err
+				}
+			}
+			if err := tx.Migrator().AddColumn(&companyV4{}, "RequireTwoFactor"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&recoveryCodeV4{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&recoveryCodeV4{}); err != nil {
+				return err
+			}
+			if err := tx.Migrator().DropColumn(&companyV4{}, "RequireTwoFactor"); err != nil {
+				return err
+			}
+			for _, column := range loginV4Columns {
+				if err := tx.Migrator().DropColumn(&loginV4{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0005_login_attempts",
+		Description: "Proteção contra força bruta: falhas e bloqueio por conta e registro das tentativas de login",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range loginV5Columns {
+				if err := tx.Migrator().AddColumn(&loginV5{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&loginAttemptV5{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&loginAttemptV5{}); err != nil {
+				return err
+			}
+			for _, column := range loginV5Columns {
+				if err := tx.Migrator().DropColumn(&loginV5{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0006_sso",
+		Description: "Login único OpenID Connect: configuração por empresa, vínculos de identidade e estados de login",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range companyV6Columns {
+				if err := tx.Migrator().AddColumn(&companyV6{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&ssoIdentityV6{}, &ssoLoginStateV6{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&ssoLoginStateV6{}, &ssoIdentityV6{}); err != nil {
+				return err
+			}
+			for _, column := range companyV6Columns {
+				if err := tx.Migrator().DropColumn(&companyV6{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0007_kiosk",
+		Description: "Quiosque de ponto: terminais por empresa e matrícula, crachá e PIN dos funcionários",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range employeeV7Columns {
+				if err := tx.Migrator().AddColumn(&employeeV7{}, column); err != nil {
+					return err
+				}
+				if err := tx.Migrator().CreateIndex(&employeeV7{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&kioskDeviceV7{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&kioskDeviceV7{}); err != nil {
+				return err
+			}
+			// SQLite rebuilds the table to drop a column, so the indexes go first
+			for _, column := range employeeV7Columns {
+				if err := tx.Migrator().DropIndex(&employeeV7{}, column); err != nil {
+					return err
+				}
+			}
+			for _, column := range employeeV7Columns {
+				if err := tx.Migrator().DropColumn(&employeeV7{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0008_qr_code",
+		Description: "Locais de trabalho com QR code rotativo, histórico de marcações e exigência do QR code por empresa",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&companyV8{}, "RequireQRCode"); err != nil {
+				return err
+			}
+			return tx.Migrator().CreateTable(&workplaceV8{}, &punchRecordV8{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&punchRecordV8{}, &workplaceV8{}); err != nil {
+				return err
+			}
+			return tx.Migrator().DropColumn(&companyV8{}, "RequireQRCode")
+		},
+	},
+	{
+		ID:          "0009_geofences",
+		Description: "Cercas virtuais dos locais de trabalho, política por empresa e localização das marcações",
+		Up: func(tx *gorm.DB) error {
+			if err := tx.Migrator().AddColumn(&companyV9{}, "GeofencePolicy"); err != nil {
+				return err
+			}
+			for _, column := range punchRecordV9Columns {
+				if err := tx.Migrator().AddColumn(&punchRecordV9{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateTable(&geofenceV9{})
+		},
+		Down: func(tx *gorm.DB) error {
+			if err := tx.Migrator().DropTable(&geofenceV9{}); err != nil {
+				return err
+			}
+			for _, column := range punchRecordV9Columns {
+				if err := tx.Migrator().DropColumn(&punchRecordV9{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().DropColumn(&companyV9{}, "GeofencePolicy")
+		},
+	},
+	{
+		ID:          "0010_punch_metadata",
+		Description: "Origem, IP, navegador e dispositivo de cada marcação",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range punchRecordV10Columns {
+				if err := tx.Migrator().AddColumn(&punchRecordV10{}, column); err != nil {
+					return err
+				}
+			}
+			for _, column := range punchRecordV10Indexes {
+				if err := tx.Migrator().CreateIndex(&punchRecordV10{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+		Down: func(tx *gorm.DB) error {
+			// SQLite rebuilds the table to drop a column, so the indexes go first
+			for _, column := range punchRecordV10Indexes {
+				if err := tx.Migrator().DropIndex(&punchRecordV10{}, column); err != nil {
+					return err
+				}
+			}
+			for _, column := range punchRecordV10Columns {
+				if err := tx.Migrator().DropColumn(&punchRecordV10{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0011_offline_punches",
+		Description: "Marcações feitas sem conexão, com o horário do dispositivo e chave de idempotência",
+		Up: func(tx *gorm.DB) error {
+			for _, column := range punchRecordV11Columns {
+				if err := tx.Migrator().AddColumn(&punchRecordV11{}, column); err != nil {
+					return err
+				}
+			}
+			return tx.Migrator().CreateIndex(&punchRecordV11{}, "idx_punch_records_idempotency")
+		},
+		Down: func(tx *gorm.DB) error {
+			// SQLite rebuilds the table to drop a column, so the index goes first
+			if err := tx.Migrator().DropIndex(&punchRecordV11{}, "idx_punch_records_idempotency"); err != nil {
+				return err
+			}
+			for _, column := range punchRecordV11Columns {
+				if err := tx.Migrator().DropColumn(&punchRecordV11{}, column); err != nil {
+					return err
+				}
+			}
+			return nil
+		},
+	},
+	{
+		ID:          "0012_sessions",
+		Description: "Sessões abertas no login, que autorizam as rotas de gerentes e administradores",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&sessionV12{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&sessionV12{})
+		},
+	},
+	{
+		ID:          "0013_branch_cnpj_null",
+		Description: "Filiais sem CNPJ próprio guardam NULL, para não colidirem no índice único",
+		Up: func(tx *gorm.DB) error {
+			return tx.Table("branches").Where("cnpj = ?", "").Update("cnpj", nil).Error
+		},
+		Down: func(tx *gorm.DB) error {
+			// Nothing to undo: the column was already nullable, and the
+			// previous code reads NULL as an empty CNPJ
+			return nil
+		},
+	},
+	{
+		ID:          "0014_work_rules",
+		Description: "Versões da jornada dos funcionários e da tolerância das empresas, por data de vigência",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().CreateTable(&workRuleV14{})
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropTable(&workRuleV14{})
+		},
+	},
+	{
+		ID:          "0015_normalize_log_dates",
+		Description: "Registros de ponto gravados com o dia em UTC ou no fuso do servidor passam a usar a meia-noite UTC do dia local, unindo os duplicados",
+		Up:          normalizeLogDates,
+		Down: func(tx *gorm.DB) error {
+			// One-way: the original dates and the merged duplicates cannot
+			// be restored. Rolling back only unmarks the migration, which
+			// is safe as the previous code reads the normalized dates.
+			log.Warn().Msg("Migration 0015_normalize_log_dates is irreversible, the normalized dates are kept")
+			return nil
+		},
+	},
+	{
+		ID:          "0016_time_log_day_unique",
+		Description: "Um único registro de ponto por funcionário e dia; registros excluídos deixam de ser mantidos",
+		Up: func(tx *gorm.DB) error {
+			// Deleted logs would hold the day in the unique index
+			if err := tx.Unscoped().Where("deleted_at IS NOT NULL").Delete(&timeLogV16{}).Error; err != nil {
+				return err
+			}
+			return tx.Migrator().CreateIndex(&timeLogV16{}, "idx_time_log_day")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropIndex(&timeLogV16{}, "idx_time_log_day")
+		},
+	},
+	{
+		ID:          "0017_recalculation_heartbeat",
+		Description: "Recálculos em execução renovam um sinal de vida, e só são retomados quando ele para",
+		Up: func(tx *gorm.DB) error {
+			return tx.Migrator().AddColumn(&recalculationTaskV17{}, "HeartbeatAt")
+		},
+		Down: func(tx *gorm.DB) error {
+			return tx.Migrator().DropColumn(&recalculationTaskV17{}, "HeartbeatAt")
+		},
+	},
+}
+
+// Schema as of 0001_initial_schema.
+
+var initialSchema = []interface{}{
+	&companyV1{},
+	&employeeV1{},
+	&loginV1{},
+	&timeLogV1{},
+	&pontoSolicitacaoV1{},
+	&departmentV1{},
+	&branchV1{},
+	&holidayV1{},
+	&jobRunV1{},
+	&recalculationTaskV1{},
+	&auditLogV1{},
+}
+
+type employeeV1 struct {
+	gorm.Model
+	Name         string
+	CPF          string
+	RG           string
+	Email        string `gorm:"type:varchar(255);unique"`
+	Age          int
+	Active       bool
+	Workload     float32
+	IsManager    bool
+	IsAdmin      bool      `gorm:"default:false"`
+	CompanyCNPJ  string    `gorm:"type:varchar(20);not null"`
+	Company      companyV1 `gorm:"foreignKey:CompanyCNPJ;references:CNPJ;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
+	DepartmentID *uint
+	BranchID     *uint
+	Login        loginV1     `gorm:"foreignKey:Email;references:Email;constraint:OnDelete:CASCADE"`
+	TimeLogs     []timeLogV1 `gorm:"foreignKey:EmployeeEmail;references:Email"`
+}
+
+func (employeeV1) TableName() string { return "employees" }
+
+type pontoSolicitacaoV1 struct {
+	gorm.Model
+	FuncionarioEmail  string `gorm:"type:varchar(255);not null"`
+	DataSolicitada    time.Time
+	Motivo            string `gorm:"type:text"`
+	Status            string `gorm:"type:varchar(20);default:'pendente'"`
+	GerenteEmail      string `gorm:"type:varchar(255)"`
+	ComentarioGerente string `gorm:"type:text"`
+	ProcessadoEm      time.Time
+}
+
+func (pontoSolicitacaoV1) TableName() string { return "ponto_solicitacaos" }
+
+type departmentV1 struct {
+	gorm.Model
+	Name         string `gorm:"not null"`
+	CompanyCNPJ  string `gorm:"type:varchar(20);not null;index"`
+	ParentID     *uint
+	ManagerEmail string `gorm:"type:varchar(255);index"`
+}
+
+func (departmentV1) TableName() string { return "departments" }
+
+type companyV1 struct {
+	gorm.Model
+	Name             string
+	CNPJ             string `gorm:"type:varchar(20);unique;not null"`
+	Email            string
+	Fone             string
+	Active           bool
+	Timezone         string       `gorm:"type:varchar(64);default:'America/Sao_Paulo'"`
+	Employees        []employeeV1 `gorm:"foreignKey:CompanyCNPJ;references:CNPJ"`
+	Branches         []branchV1   `gorm:"foreignKey:CompanyCNPJ;references:CNPJ"`
+	ToleranceMinutes int
+}
+
+func (companyV1) TableName() string { return "companies" }
+
+type branchV1 struct {
+	gorm.Model
+	CompanyCNPJ         string `gorm:"type:varchar(20);not null;index"`
+	CNPJ                string `gorm:"type:varchar(20);unique"`
+	Name                string `gorm:"not null"`
+	Address             string
+	City                string
+	State               string `gorm:"type:varchar(2)"`
+	Timezone            string
+	Active              bool
+	ScheduleEntry       string
+	ScheduleLunchExit   string
+	ScheduleLunchReturn string
+	ScheduleExit        string
+	WorkDays            string `gorm:"type:varchar(20);default:'1,2,3,4,5'"`
+}
+
+func (branchV1) TableName() string { return "branches" }
+
+type holidayV1 struct {
+	gorm.Model
+	CompanyCNPJ string    `gorm:"type:varchar(20);not null;index"`
+	BranchID    *uint     `gorm:"index"`
+	Date        time.Time `gorm:"not null"`
+	Name        string
+}
+
+func (holidayV1) TableName() string { return "holidays" }
+
+type timeLogV1 struct {
+	gorm.Model
+	EmployeeEmail     string    `gorm:"type:varchar(255);not null"`
+	LogDate           time.Time `gorm:"not null"`
+	EntryTime         time.Time
+	LunchExitTime     time.Time
+	LunchReturnTime   time.Time
+	ExitTime          time.Time
+	ExtraHours        float32 `gorm:"default:0"`
+	MissingHours      float32 `gorm:"default:0"`
+	Balance           float32 `gorm:"default:0"`
+	Status            string  `gorm:"type:varchar(20);index"`
+	EditadoPorGerente string  `gorm:"type:varchar(255)"`
+	EditadoEm         time.Time
+	MotivoEdicao      string `gorm:"type:text"`
+}
+
+func (timeLogV1) TableName() string { return "time_logs" }
+
+type loginV1 struct {
+	gorm.Model
+	Email    string `gorm:"type:varchar(255);unique;not null"`
+	Password string `gorm:"not null"`
+}
+
+func (loginV1) TableName() string { return "logins" }
+
+type jobRunV1 struct {
+	gorm.Model
+	JobName      string    `gorm:"type:varchar(100);not null;uniqueIndex:idx_job_run_slot"`
+	ScheduledFor time.Time `gorm:"not null;uniqueIndex:idx_job_run_slot"`
+	TriggeredBy  string    `gorm:"type:varchar(20)"`
+	Status       string    `gorm:"type:varchar(20)"`
+	Instance     string    `gorm:"type:varchar(255)"`
+	StartedAt    time.Time
+	FinishedAt   time.Time
+	LeaseUntil   time.Time
+	Error        string `gorm:"type:text"`
+}
+
+func (jobRunV1) TableName() string { return "job_runs" }
+
+type recalculationTaskV1 struct {
+	gorm.Model
+	CompanyCNPJ   string `gorm:"type:varchar(20);not null;index"`
+	BranchID      *uint
+	EmployeeEmail string `gorm:"type:varchar(255)"`
+	FromDate      time.Time
+	Reason        string `gorm:"type:text"`
+	RequestedBy   string `gorm:"type:varchar(255)"`
+	Status        string `gorm:"type:varchar(20);index"`
+	Total         int
+	Processed     int
+	Changed       int
+	StartedAt     time.Time
+	FinishedAt    time.Time
+	Error         string `gorm:"type:text"`
+}
+
+func (recalculationTaskV1) TableName() string { return "recalculation_tasks" }
+
+type auditLogV1 struct {
+	gorm.Model
+	Entity   string `gorm:"type:varchar(50);index:idx_audit_entity"`
+	EntityID uint   `gorm:"index:idx_audit_entity"`
+	Action   string `gorm:"type:varchar(50)"`
+	Actor    string `gorm:"type:varchar(255)"`
+	Details  string `gorm:"type:text"`
+}
+
+func (auditLogV1) TableName() string { return "audit_logs" }
+
+// Schema changes as of 0002_recalculation_to_date.
+
+type recalculationTaskV2 struct {
+	ToDate time.Time
+}
+
+func (recalculationTaskV2) TableName() string { return "recalculation_tasks" }
+
+// Schema changes as of 0003_password_reset_tokens.
+
+type passwordResetTokenV3 struct {
+	gorm.Model
+	Email     string `gorm:"type:varchar(255);not null;index"`
+	TokenHash string `gorm:"type:varchar(64);unique;not null"`
+	ExpiresAt time.Time
+	UsedAt    time.Time
+}
+
+func (passwordResetTokenV3) TableName() string { return "password_reset_tokens" }
+
+// Schema changes as of 0004_two_factor.
+
+var loginV4Columns = []string{"TOTPSecret", "TOTPEnabled", "TOTPLastStep", "ChallengeHash", "ChallengeExpiresAt"}
+
+type loginV4 struct {
+	TOTPSecret         string `gorm:"type:varchar(64)"`
+	TOTPEnabled        bool
+	TOTPLastStep       int64
+	ChallengeHash      string `gorm:"type:varchar(64)"`
+	ChallengeExpiresAt time.Time
+}
+
+func (loginV4) TableName() string { return "logins" }
+
+type companyV4 struct {
+	RequireTwoFactor bool
+}
+
+func (companyV4) TableName() string { return "companies" }
+
+type recoveryCodeV4 struct {
+	gorm.Model
+	Email    string `gorm:"type:varchar(255);not null;index"`
+	CodeHash string `gorm:"type:varchar(64);not null"`
+	UsedAt   time.Time
+}
+
+func (recoveryCodeV4) TableName() string { return "recovery_codes" }
+
+// Schema changes as of 0005_login_attempts.
+
+var loginV5Columns = []string{"FailedAttempts", "LockedUntil"}
+
+type loginV5 struct {
+	FailedAttempts int
+	LockedUntil    time.Time
+}
+
+func (loginV5) TableName() string { return "logins" }
+
+type loginAttemptV5 struct {
+	gorm.Model
+	Email     string `gorm:"type:varchar(255);index"`
+	IP        string `gorm:"type:varchar(64);index"`
+	UserAgent string `gorm:"type:varchar(512)"`
+	Success   bool
+	Reason    string `gorm:"type:varchar(50)"`
+}
+
+func (loginAttemptV5) TableName() string { return "login_attempts" }
+
+// Schema changes as of 0006_sso.
+
+var companyV6Columns = []string{"SSOIssuer", "SSOClientID", "SSOClientSecret", "SSOEmailClaim"}
+
+type companyV6 struct {
+	SSOIssuer       string `gorm:"type:varchar(255)"`
+	SSOClientID     string `gorm:"type:varchar(255)"`
+	SSOClientSecret string `gorm:"type:varchar(255)"`
+	SSOEmailClaim   string `gorm:"type:varchar(100)"`
+}
+
+func (companyV6) TableName() string { return "companies" }
+
+type ssoIdentityV6 struct {
+	gorm.Model
+	Issuer  string `gorm:"type:varchar(255);not null;uniqueIndex:idx_sso_identity"`
+	Subject string `gorm:"type:varchar(255);not null;uniqueIndex:idx_sso_identity"`
+	Email   string `gorm:"type:varchar(255);not null;index"`
+}
+
+func (ssoIdentityV6) TableName() string { return "sso_identities" }
+
+type ssoLoginStateV6 struct {
+	gorm.Model
+	StateHash   string    `gorm:"type:varchar(64);unique;not null"`
+	CompanyCNPJ string    `gorm:"type:varchar(20);not null"`
+	Nonce       string    `gorm:"type:varchar(64);not null"`
+	Verifier    string    `gorm:"type:varchar(128);not null"`
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+func (ssoLoginStateV6) TableName() string { return "sso_login_states" }
+
+// Schema changes as of 0007_kiosk.
+
+var employeeV7Columns = []string{"Matricula", "BadgeNumber", "KioskPINHash"}
+
+type employeeV7 struct {
+	Matricula    string `gorm:"type:varchar(50);index"`
+	BadgeNumber  string `gorm:"type:varchar(50);index"`
+	KioskPINHash string `gorm:"type:varchar(64);index"`
+}
+
+func (employeeV7) TableName() string { return "employees" }
+
+type kioskDeviceV7 struct {
+	gorm.Model
+	Name        string `gorm:"not null"`
+	CompanyCNPJ string `gorm:"type:varchar(20);not null;index"`
+	KeyHash     string `gorm:"type:varchar(64);unique;not null"`
+	Active      bool
+	LastSeenAt  time.Time
+}
+
+func (kioskDeviceV7) TableName() string { return "kiosk_devices" }
+
+// Schema changes as of 0008_qr_code.
+
+type companyV8 struct {
+	RequireQRCode bool
+}
+
+func (companyV8) TableName() string { return "companies" }
+
+type workplaceV8 struct {
+	gorm.Model
+	CompanyCNPJ string `gorm:"type:varchar(20);not null;index"`
+	BranchID    *uint
+	Name        string `gorm:"not null"`
+	QRSecret    string `gorm:"type:varchar(64);not null"`
+	Active      bool
+}
+
+func (workplaceV8) TableName() string { return "workplaces" }
+
+type punchRecordV8 struct {
+	gorm.Model
+	EmployeeEmail string    `gorm:"type:varchar(255);not null;index"`
+	TimeLogID     uint      `gorm:"index"`
+	Punch         string    `gorm:"type:varchar(20)"`
+	PunchedAt     time.Time `gorm:"index"`
+	WorkplaceID   *uint
+}
+
+func (punchRecordV8) TableName() string { return "punch_records" }
+
+// Schema changes as of 0009_geofences.
+
+type companyV9 struct {
+	GeofencePolicy string `gorm:"type:varchar(20)"`
+}
+
+func (companyV9) TableName() string { return "companies" }
+
+var punchRecordV9Columns = []string{"Latitude", "Longitude", "Accuracy", "GeofenceStatus"}
+
+type punchRecordV9 struct {
+	Latitude       *float64
+	Longitude      *float64
+	Accuracy       *float64
+	GeofenceStatus string `gorm:"type:varchar(20)"`
+}
+
+func (punchRecordV9) TableName() string { return "punch_records" }
+
+type geofenceV9 struct {
+	gorm.Model
+	CompanyCNPJ  string `gorm:"type:varchar(20);not null;index"`
+	WorkplaceID  uint   `gorm:"index"`
+	Name         string
+	Kind         string `gorm:"type:varchar(10);not null"`
+	Latitude     float64
+	Longitude    float64
+	RadiusMeters float64
+	Polygon      string `gorm:"type:text"`
+	Active       bool
+}
+
+func (geofenceV9) TableName() string { return "geofences" }
+
+// Schema changes as of 0010_punch_metadata.
+
+var (
+	punchRecordV10Columns = []string{"Source", "ClientIP", "UserAgent", "DeviceID"}
+	punchRecordV10Indexes = []string{"Source", "ClientIP", "DeviceID"}
+)
+
+type punchRecordV10 struct {
+	Source    string `gorm:"type:varchar(30);index"`
+	ClientIP  string `gorm:"type:varchar(45);index"`
+	UserAgent string `gorm:"type:varchar(255)"`
+	DeviceID  string `gorm:"type:varchar(100);index"`
+}
+
+func (punchRecordV10) TableName() string { return "punch_records" }
+
+// Schema changes as of 0011_offline_punches.
+
+var punchRecordV11Columns = []string{"Offline", "DeviceTime", "IdempotencyKey"}
+
+type punchRecordV11 struct {
+	EmployeeEmail  string `gorm:"type:varchar(255);uniqueIndex:idx_punch_records_idempotency,priority:1"`
+	Offline        bool
+	DeviceTime     *time.Time
+	IdempotencyKey *string `gorm:"type:varchar(100);uniqueIndex:idx_punch_records_idempotency,priority:2"`
+}
+
+func (punchRecordV11) TableName() string { return "punch_records" }
+
+// Schema changes as of 0012_sessions.
+
+type sessionV12 struct {
+	gorm.Model
+	EmployeeEmail string    `gorm:"type:varchar(255);not null;index"`
+	TokenHash     string    `gorm:"type:varchar(64);unique;not null"`
+	ExpiresAt     time.Time `gorm:"index"`
+}
+
+func (sessionV12) TableName() string { return "sessions" }
+
+// Schema changes as of 0014_work_rules.
+
+type workRuleV14 struct {
+	gorm.Model
+	CompanyCNPJ   string `gorm:"type:varchar(20);not null;index"`
+	EmployeeEmail string `gorm:"type:varchar(255);index"`
+	Kind          string `gorm:"type:varchar(20);not null"`
+	Value         float32
+	EffectiveFrom time.Time
+}
+
+func (workRuleV14) TableName() string { return "work_rules" }
+
+// Data changes of 0015_normalize_log_dates.
+
+// logDateTimezoneV15 names the timezone each employee works in, the one of
+// their branch or else of their company.
+type logDateTimezoneV15 struct {
+	Email           string
+	BranchTimezone  *string
+	CompanyTimezone *string
+}
+
+// normalizeLogDates moves every time log to midnight UTC of its day in the
+// employee's timezone. Logs written by the old daily setup hold midnight UTC
+// of the UTC day and those written by the old punch hold midnight in the
+// server zone, so the day is taken from the entry punch when there is one,
+// and otherwise from the local day of the stored date. Logs that end up on
+// the same day are merged into the one with the most punches: its empty
+// punches are filled from the others, their punch history moves to it and
+// they are deleted. A log that gains punches is reopened without hours, to
+// be classified and recalculated again.
+func normalizeLogDates(tx *gorm.DB) error {
+	var timezones []logDateTimezoneV15
+	if err := tx.Table("employees").
+		Select("employees.email, branches.timezone AS branch_timezone, companies.timezone AS company_timezone").
+		Joins("LEFT JOIN branches ON branches.id = employees.branch_id").
+		Joins("LEFT JOIN companies ON companies.cnpj = employees.company_cnpj").
+		Scan(&timezones).Error; err != nil {
+		return err
+	}
+	locations := map[string]*time.Location{}
+	for _, tz := range timezones {
+		name := "America/Sao_Paulo"
+		if tz.BranchTimezone != nil && *tz.BranchTimezone != "" {
+			name = *tz.BranchTimezone
+		} else if tz.CompanyTimezone != nil && *tz.CompanyTimezone != "" {
+			name = *tz.CompanyTimezone
+		}
+		loc, err := time.LoadLocation(name)
+		if err != nil {
+			loc = time.UTC
+		}
+		locations[tz.Email] = loc
+	}
+
+	var timeLogs []timeLogV1
+	if err := tx.Order("id").Find(&timeLogs).Error; err != nil {
+		return err
+	}
+
+	type dayKey struct {
+		email string
+		day   time.Time
+	}
+	days := map[dayKey][]timeLogV1{}
+	var keys []dayKey
+	for _, timeLog := range timeLogs {
+		loc := locations[timeLog.EmployeeEmail]
+		if loc == nil {
+			loc = time.UTC
+		}
+		day := timeLog.LogDate.UTC()
+		switch {
+		case !timeLog.EntryTime.IsZero():
+			day = localDay(timeLog.EntryTime, loc)
+		case day != day.Truncate(24*time.Hour):
+			day = localDay(day, loc)
+		}
+		key := dayKey{timeLog.EmployeeEmail, day}
+		if days[key] == nil {
+			keys = append(keys, key)
+		}
+		days[key] = append(days[key], timeLog)
+	}
+
+	for _, key := range keys {
+		logs := days[key]
+		kept := 0
+		for i, timeLog := range logs {
+			if punchCount(timeLog) > punchCount(logs[kept]) {
+				kept = i
+			}
+		}
+		target := logs[kept]
+		changed := !target.LogDate.Equal(key.day)
+		target.LogDate = key.day
+
+		for i, duplicate := range logs {
+			if i == kept {
+				continue
+			}
+			for _, punch := range []struct{ into, from *time.Time }{
+				{&target.EntryTime, &duplicate.EntryTime},
+				{&target.LunchExitTime, &duplicate.LunchExitTime},
+				{&target.LunchReturnTime, &duplicate.LunchReturnTime},
+				{&target.ExitTime, &duplicate.ExitTime},
+			} {
+				if punch.into.IsZero() && !punch.from.IsZero() {
+					*punch.into = *punch.from
+					target.Status, target.ExtraHours, target.MissingHours, target.Balance = "", 0, 0, 0
+				}
+			}
+			if err := tx.Table("punch_records").Where("time_log_id = ?", duplicate.ID).Update("time_log_id", target.ID).Error; err != nil {
+				return err
+			}
+			if err := tx.Unscoped().Delete(&timeLogV1{}, duplicate.ID).Error; err != nil {
+				return err
+			}
+			changed = true
+		}
+
+		if changed {
+			if err := tx.Save(&target).Error; err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// localDay is the calendar day of t in loc as midnight UTC.
+func localDay(t time.Time, loc *time.Location) time.Time {
+	year, month, day := t.In(loc).Date()
+	return time.Date(year, month, day, 0, 0, 0, 0, time.UTC)
+}
+
+// punchCount counts the punches registered in the time log.
+func punchCount(timeLog timeLogV1) int {
+	count := 0
+	for _, punch := range []time.Time{timeLog.EntryTime, timeLog.LunchExitTime, timeLog.LunchReturnTime, timeLog.ExitTime} {
+		if !punch.IsZero() {
+			count++
+		}
+	}
+	return count
+}
+
+// Schema changes as of 0016_time_log_day_unique.
+
+type timeLogV16 struct {
+	ID            uint
+	EmployeeEmail string    `gorm:"type:varchar(255);not null;uniqueIndex:idx_time_log_day"`
+	LogDate       time.Time `gorm:"not null;uniqueIndex:idx_time_log_day"`
+	DeletedAt     gorm.DeletedAt
+}
+
+func (timeLogV16) TableName() string { return "time_logs" }
+
+// Schema changes as of 0017_recalculation_heartbeat.
+
+type recalculationTaskV17 struct {
+	HeartbeatAt time.Time
+}
+
+func (recalculationTaskV17) TableName() string { return "recalculation_tasks" }
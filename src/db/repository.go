@@ -0,0 +1,1071 @@
+package db
+
+import (
+	"errors"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
+)
+
+// ErrNotFound is returned by the repositories when no record matches.
+var ErrNotFound = errors.New("record not found")
+
+// EmployeeFilter narrows EmployeeRepository.List. Zero values match any
+// employee; a non nil, empty slice matches none.
+type EmployeeFilter struct {
+	Emails        []string
+	CompanyCNPJ   string
+	BranchID      *uint
+	DepartmentIDs []uint
+	Active        *bool
+	IsManager     *bool
+	IsAdmin       *bool
+	// Identification at the kiosk
+	Matricula   string
+	BadgeNumber string
+}
+
+type EmployeeRepository interface {
+	Create(employee *schemas.Employee) error
+	Get(id uint) (schemas.Employee, error)
+	GetByEmail(email string) (schemas.Employee, error)
+	// List returns the matching employees ordered by ID.
+	List(filter EmployeeFilter) ([]schemas.Employee, error)
+	Update(employee *schemas.Employee) error
+	Delete(employee *schemas.Employee) error
+	SetBranch(emails []string, branchID uint) error
+	SetDepartment(emails []string, departmentID uint) error
+}
+
+type CompanyRepository interface {
+	Create(company *schemas.Company) error
+	GetByCNPJ(cnpj string) (schemas.Company, error)
+	List(withEmployees bool) ([]schemas.Company, error)
+	Update(company *schemas.Company) error
+}
+
+// TimeLogFilter narrows TimeLogRepository.List. From is inclusive and To
+// exclusive; zero dates leave the period open.
+type TimeLogFilter struct {
+	Emails   []string
+	From     time.Time
+	To       time.Time
+	Statuses []string
+	// Complete keeps only the logs with all four punches
+	Complete bool
+	// Descending orders by log date, newest first
+	Descending bool
+}
+
+type TimeLogRepository interface {
+	// Create returns ErrDuplicate when the employee already has a log for
+	// the day, as when a concurrent request created it first. So does Update
+	// of a log without ID.
+	Create(timeLog *schemas.TimeLog) error
+	Get(id uint) (schemas.TimeLog, error)
+	GetByDate(email string, logDate time.Time) (schemas.TimeLog, error)
+	// LockByDate is GetByDate that also locks the log until the transaction
+	// ends, so concurrent punches of the day are applied one after the other.
+	LockByDate(email string, logDate time.Time) (schemas.TimeLog, error)
+	// List returns the matching logs ordered by log date and email.
+	List(filter TimeLogFilter) ([]schemas.TimeLog, error)
+	Update(timeLog *schemas.TimeLog) error
+	// Delete removes the log for good, so the day can be recorded again.
+	Delete(timeLog *schemas.TimeLog) error
+}
+
+type RequestRepository interface {
+	Create(request *schemas.PontoSolicitacao) error
+	Get(id uint) (schemas.PontoSolicitacao, error)
+	// ListByEmployees returns the requests of the employees, newest first.
+	ListByEmployees(emails []string) ([]schemas.PontoSolicitacao, error)
+	Update(request *schemas.PontoSolicitacao) error
+}
+
+type LoginRepository interface {
+	Create(login *schemas.Login) error
+	GetByEmail(email string) (schemas.Login, error)
+	// GetByChallenge finds the login with a pending second step.
+	GetByChallenge(challengeHash string) (schemas.Login, error)
+	Update(login *schemas.Login) error
+}
+
+// LoginAttemptFilter narrows LoginAttemptRepository.List. Since is inclusive
+// and Until exclusive; zero values match any attempt.
+type LoginAttemptFilter struct {
+	Email   string
+	IP      string
+	Success *bool
+	Since   time.Time
+	Until   time.Time
+	Limit   int
+}
+
+type LoginAttemptRepository interface {
+	Create(attempt *schemas.LoginAttempt) error
+	// List returns the matching attempts, newest first.
+	List(filter LoginAttemptFilter) ([]schemas.LoginAttempt, error)
+}
+
+// PunchFilter narrows PunchRepository.List. From is inclusive and To
+// exclusive on the punch time; zero values match any punch.
+type PunchFilter struct {
+	Emails    []string
+	TimeLogID uint
+	From      time.Time
+	To        time.Time
+	Sources   []string
+	ClientIP  string
+	DeviceID  string
+	// IdempotencyKey finds the punch sent with the key
+	IdempotencyKey string
+}
+
+type PunchRepository interface {
+	// Create returns ErrDuplicate when the employee already used the
+	// idempotency key of the punch.
+	Create(punch *schemas.PunchRecord) error
+	// List returns the matching punches in the order they happened.
+	List(filter PunchFilter) ([]schemas.PunchRecord, error)
+	// Relabel changes which punch of the day the record is, as when an
+	// earlier punch is inserted before it.
+	Relabel(id uint, punch string) error
+}
+
+type BranchRepository interface {
+	Create(branch *schemas.Branch) error
+	Get(id uint) (schemas.Branch, error)
+	// ListByCompany returns the branches of the company ordered by name.
+	ListByCompany(cnpj string) ([]schemas.Branch, error)
+	Update(branch *schemas.Branch) error
+}
+
+type DepartmentRepository interface {
+	Create(department *schemas.Department) error
+	Get(id uint) (schemas.Department, error)
+	// ListByCompany returns the departments of the company ordered by name.
+	ListByCompany(cnpj string) ([]schemas.Department, error)
+	Update(department *schemas.Department) error
+	Delete(department *schemas.Department) error
+}
+
+// HolidayFilter narrows HolidayRepository.List. With BranchID only the
+// company-wide holidays and those of the branch match; a zero Date matches
+// any day.
+type HolidayFilter struct {
+	CompanyCNPJ string
+	BranchID    *uint
+	Date        time.Time
+}
+
+type HolidayRepository interface {
+	Create(holiday *schemas.Holiday) error
+	Get(id uint) (schemas.Holiday, error)
+	// List returns the matching holidays ordered by date.
+	List(filter HolidayFilter) ([]schemas.Holiday, error)
+	Delete(holiday *schemas.Holiday) error
+}
+
+type WorkplaceRepository interface {
+	Create(workplace *schemas.Workplace) error
+	Get(id uint) (schemas.Workplace, error)
+	// List returns the workplaces of the company, or of every company when
+	// cnpj is empty, ordered by ID.
+	List(cnpj string) ([]schemas.Workplace, error)
+	Update(workplace *schemas.Workplace) error
+}
+
+// GeofenceFilter narrows GeofenceRepository.List; zero values match any
+// geofence.
+type GeofenceFilter struct {
+	CompanyCNPJ string
+	WorkplaceID uint
+	Active      *bool
+}
+
+type GeofenceRepository interface {
+	Create(fence *schemas.Geofence) error
+	Get(id uint) (schemas.Geofence, error)
+	// List returns the matching geofences ordered by ID.
+	List(filter GeofenceFilter) ([]schemas.Geofence, error)
+	Delete(fence *schemas.Geofence) error
+}
+
+type KioskDeviceRepository interface {
+	Create(device *schemas.KioskDevice) error
+	Get(id uint) (schemas.KioskDevice, error)
+	GetByKeyHash(keyHash string) (schemas.KioskDevice, error)
+	// List returns the kiosks of the company, or of every company when cnpj
+	// is empty, ordered by ID.
+	List(cnpj string) ([]schemas.KioskDevice, error)
+	Update(device *schemas.KioskDevice) error
+}
+
+type SSOStateRepository interface {
+	Create(state *schemas.SSOLoginState) error
+	// Take returns the state and deletes it, so it is used only once.
+	Take(stateHash string) (schemas.SSOLoginState, error)
+	// DeleteExpired removes the states that expired before now.
+	DeleteExpired(now time.Time) error
+}
+
+type SSOIdentityRepository interface {
+	Create(identity *schemas.SSOIdentity) error
+	Get(issuer, subject string) (schemas.SSOIdentity, error)
+}
+
+type PasswordResetRepository interface {
+	Create(token *schemas.PasswordResetToken) error
+	GetByHash(tokenHash string) (schemas.PasswordResetToken, error)
+	// Use marks the token used at the given time. It reports false when the
+	// token was already used, so only one of two concurrent calls succeeds.
+	Use(id uint, at time.Time) (bool, error)
+	// Revoke marks every unused token of the e-mail used.
+	Revoke(email string, at time.Time) error
+}
+
+type SessionRepository interface {
+	Create(session *schemas.Session) error
+	GetByHash(tokenHash string) (schemas.Session, error)
+	// Delete ends the session with the token hash, if any.
+	Delete(tokenHash string) error
+	// DeleteByEmail ends every session of the employee but the one with
+	// exceptHash, when set.
+	DeleteByEmail(email, exceptHash string) error
+	DeleteExpired(now time.Time) error
+}
+
+type RecoveryCodeRepository interface {
+	// Replace deletes the codes of the e-mail and stores the new hashes.
+	Replace(email string, codeHashes []string) error
+	// Use marks the unused code used, reporting false when there is none.
+	Use(email, codeHash string, at time.Time) (bool, error)
+	Delete(email string) error
+}
+
+// RecalculationFilter narrows RecalculationRepository.List; zero values match
+// any task.
+type RecalculationFilter struct {
+	CompanyCNPJ string
+	Status      string
+	Limit       int
+}
+
+type RecalculationRepository interface {
+	Create(task *schemas.RecalculationTask) error
+	Get(id uint) (schemas.RecalculationTask, error)
+	// List returns the matching tasks, newest first.
+	List(filter RecalculationFilter) ([]schemas.RecalculationTask, error)
+	Update(task *schemas.RecalculationTask) error
+	// NextPending returns the oldest pending task.
+	NextPending() (schemas.RecalculationTask, error)
+	// Claim moves the pending task to running. It reports false when another
+	// instance claimed it first.
+	Claim(id uint, startedAt time.Time) (bool, error)
+	// RequeueStale makes pending again the running tasks whose last
+	// heartbeat is before the given time.
+	RequeueStale(before time.Time) error
+}
+
+// WorkRuleFilter narrows WorkRuleRepository.List; zero values match any rule.
+type WorkRuleFilter struct {
+	CompanyCNPJ   string
+	EmployeeEmail string
+	Kind          string
+}
+
+type WorkRuleRepository interface {
+	// Save stores the version, replacing the one of the same company,
+	// employee and kind that applies from the same date.
+	Save(rule *schemas.WorkRule) error
+	// List returns the matching versions ordered by EffectiveFrom.
+	List(filter WorkRuleFilter) ([]schemas.WorkRule, error)
+}
+
+// AuditLogFilter narrows AuditLogRepository.List; zero values match any entry.
+type AuditLogFilter struct {
+	Entity   string
+	EntityID *uint
+	Limit    int
+}
+
+type AuditLogRepository interface {
+	Create(entry *schemas.AuditLog) error
+	// List returns the matching entries, newest first.
+	List(filter AuditLogFilter) ([]schemas.AuditLog, error)
+}
+
+// Repositories groups the data access used by the handlers.
+type Repositories struct {
+	Employees EmployeeRepository
+	Companies CompanyRepository
+	TimeLogs  TimeLogRepository
+	Requests  RequestRepository
+	Logins    LoginRepository
+	// LoginAttempts records every login for the admins and the brute-force
+	// protection
+	LoginAttempts LoginAttemptRepository
+	// Punches is the history of every punch behind the time logs
+	Punches PunchRepository
+
+	Branches      BranchRepository
+	Departments   DepartmentRepository
+	Holidays      HolidayRepository
+	Workplaces    WorkplaceRepository
+	Geofences     GeofenceRepository
+	KioskDevices  KioskDeviceRepository
+	SSOStates     SSOStateRepository
+	SSOIdentities SSOIdentityRepository
+	// PasswordResets and RecoveryCodes keep only the hashes of the tokens
+	PasswordResets PasswordResetRepository
+	RecoveryCodes  RecoveryCodeRepository
+	Sessions       SessionRepository
+	Recalculations RecalculationRepository
+	AuditLogs      AuditLogRepository
+	// WorkRules keeps every version of the workloads and tolerances
+	WorkRules WorkRuleRepository
+
+	transaction func(fn func(Repositories) error) error
+}
+
+// Transaction runs fn with repositories bound to a single transaction, which
+// is rolled back when fn returns an error.
+func (r Repositories) Transaction(fn func(Repositories) error) error {
+	if r.transaction == nil {
+		return fn(r)
+	}
+	return r.transaction(fn)
+}
+
+// NewRepositories returns the GORM implementation of the repositories.
+func NewRepositories(db *gorm.DB) Repositories {
+	return Repositories{
+		Employees: gormEmployees{db},
+		Companies: gormCompanies{db},
+		TimeLogs:  gormTimeLogs{db},
+		Requests:  gormRequests{db},
+		Logins:    gormLogins{db},
+
+		LoginAttempts: gormLoginAttempts{db},
+		Punches:       gormPunches{db},
+
+		Branches:       gormBranches{db},
+		Departments:    gormDepartments{db},
+		Holidays:       gormHolidays{db},
+		Workplaces:     gormWorkplaces{db},
+		Geofences:      gormGeofences{db},
+		KioskDevices:   gormKioskDevices{db},
+		SSOStates:      gormSSOStates{db},
+		SSOIdentities:  gormSSOIdentities{db},
+		PasswordResets: gormPasswordResets{db},
+		RecoveryCodes:  gormRecoveryCodes{db},
+		Sessions:       gormSessions{db},
+		Recalculations: gormRecalculations{db},
+		AuditLogs:      gormAuditLogs{db},
+		WorkRules:      gormWorkRules{db},
+		transaction: func(fn func(Repositories) error) error {
+			return db.Transaction(func(tx *gorm.DB) error {
+				return fn(NewRepositories(tx))
+			})
+		},
+	}
+}
+
+func notFound(err error) error {
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return ErrNotFound
+	}
+	return err
+}
+
+// duplicate reports a unique violation as ErrDuplicate, like the in-memory
+// repositories do.
+func duplicate(err error) error {
+	if errors.Is(err, gorm.ErrDuplicatedKey) {
+		return ErrDuplicate
+	}
+	return err
+}
+
+type gormEmployees struct{ db *gorm.DB }
+
+func (r gormEmployees) Create(employee *schemas.Employee) error {
+	return r.db.Create(employee).Error
+}
+
+func (r gormEmployees) Get(id uint) (schemas.Employee, error) {
+	var employee schemas.Employee
+	err := r.db.First(&employee, id).Error
+	return employee, notFound(err)
+}
+
+func (r gormEmployees) GetByEmail(email string) (schemas.Employee, error) {
+	var employee schemas.Employee
+	err := r.db.Where("email = ?", email).First(&employee).Error
+	return employee, notFound(err)
+}
+
+func (r gormEmployees) List(filter EmployeeFilter) ([]schemas.Employee, error) {
+	employees := []schemas.Employee{}
+	query := r.db.Order("id")
+	if filter.Emails != nil {
+		if len(filter.Emails) == 0 {
+			return employees, nil
+		}
+		query = query.Where("email IN ?", filter.Emails)
+	}
+	if filter.CompanyCNPJ != "" {
+		query = query.Where("company_cnpj = ?", filter.CompanyCNPJ)
+	}
+	if filter.BranchID != nil {
+		query = query.Where("branch_id = ?", *filter.BranchID)
+	}
+	if filter.DepartmentIDs != nil {
+		if len(filter.DepartmentIDs) == 0 {
+			return employees, nil
+		}
+		query = query.Where("department_id IN ?", filter.DepartmentIDs)
+	}
+	if filter.Active != nil {
+		query = query.Where("active = ?", *filter.Active)
+	}
+	if filter.IsManager != nil {
+		query = query.Where("is_manager = ?", *filter.IsManager)
+	}
+	if filter.IsAdmin != nil {
+		query = query.Where("is_admin = ?", *filter.IsAdmin)
+	}
+	if filter.Matricula != "" {
+		query = query.Where("matricula = ?", filter.Matricula)
+	}
+	if filter.BadgeNumber != "" {
+		query = query.Where("badge_number = ?", filter.BadgeNumber)
+	}
+	err := query.Find(&employees).Error
+	return employees, err
+}
+
+func (r gormEmployees) Update(employee *schemas.Employee) error {
+	return r.db.Save(employee).Error
+}
+
+func (r gormEmployees) Delete(employee *schemas.Employee) error {
+	return r.db.Delete(employee).Error
+}
+
+func (r gormEmployees) SetBranch(emails []string, branchID uint) error {
+	return r.db.Model(&schemas.Employee{}).Where("email IN ?", emails).Update("branch_id", branchID).Error
+}
+
+func (r gormEmployees) SetDepartment(emails []string, departmentID uint) error {
+	return r.db.Model(&schemas.Employee{}).Where("email IN ?", emails).Update("department_id", departmentID).Error
+}
+
+type gormCompanies struct{ db *gorm.DB }
+
+func (r gormCompanies) Create(company *schemas.Company) error {
+	return r.db.Create(company).Error
+}
+
+func (r gormCompanies) GetByCNPJ(cnpj string) (schemas.Company, error) {
+	var company schemas.Company
+	err := r.db.Where("cnpj = ?", cnpj).First(&company).Error
+	return company, notFound(err)
+}
+
+func (r gormCompanies) List(withEmployees bool) ([]schemas.Company, error) {
+	companies := []schemas.Company{}
+	query := r.db.Order("id")
+	if withEmployees {
+		query = query.Preload("Employees")
+	}
+	err := query.Find(&companies).Error
+	return companies, err
+}
+
+func (r gormCompanies) Update(company *schemas.Company) error {
+	return r.db.Save(company).Error
+}
+
+type gormTimeLogs struct{ db *gorm.DB }
+
+func (r gormTimeLogs) Create(timeLog *schemas.TimeLog) error {
+	return duplicate(r.db.Create(timeLog).Error)
+}
+
+func (r gormTimeLogs) Get(id uint) (schemas.TimeLog, error) {
+	var timeLog schemas.TimeLog
+	err := r.db.First(&timeLog, id).Error
+	return timeLog, notFound(err)
+}
+
+func (r gormTimeLogs) GetByDate(email string, logDate time.Time) (schemas.TimeLog, error) {
+	return r.getByDate(r.db, email, logDate)
+}
+
+// LockByDate takes the row lock with SELECT ... FOR UPDATE; SQLite ignores
+// the clause, its writes are serialized anyway.
+func (r gormTimeLogs) LockByDate(email string, logDate time.Time) (schemas.TimeLog, error) {
+	return r.getByDate(r.db.Clauses(clause.Locking{Strength: "UPDATE"}), email, logDate)
+}
+
+func (r gormTimeLogs) getByDate(db *gorm.DB, email string, logDate time.Time) (schemas.TimeLog, error) {
+	var timeLogs []schemas.TimeLog
+	if err := db.Where("employee_email = ? AND log_date = ?", email, logDate).Limit(1).Find(&timeLogs).Error; err != nil {
+		return schemas.TimeLog{}, err
+	}
+	if len(timeLogs) == 0 {
+		return schemas.TimeLog{}, ErrNotFound
+	}
+	return timeLogs[0], nil
+}
+
+func (r gormTimeLogs) List(filter TimeLogFilter) ([]schemas.TimeLog, error) {
+	timeLogs := []schemas.TimeLog{}
+	query := r.db
+	if filter.Emails != nil {
+		if len(filter.Emails) == 0 {
+			return timeLogs, nil
+		}
+		query = query.Where("employee_email IN ?", filter.Emails)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("log_date >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("log_date < ?", filter.To)
+	}
+	if len(filter.Statuses) > 0 {
+		query = query.Where("status IN ?", filter.Statuses)
+	}
+	if filter.Complete {
+		zero := time.Time{}
+		query = query.Where("entry_time != ? AND lunch_exit_time != ? AND lunch_return_time != ? AND exit_time != ?", zero, zero, zero, zero)
+	}
+	if filter.Descending {
+		query = query.Order("log_date DESC, employee_email")
+	} else {
+		query = query.Order("log_date, employee_email")
+	}
+	err := query.Find(&timeLogs).Error
+	return timeLogs, err
+}
+
+func (r gormTimeLogs) Update(timeLog *schemas.TimeLog) error {
+	return duplicate(r.db.Save(timeLog).Error)
+}
+
+func (r gormTimeLogs) Delete(timeLog *schemas.TimeLog) error {
+	return r.db.Unscoped().Delete(timeLog).Error
+}
+
+type gormRequests struct{ db *gorm.DB }
+
+func (r gormRequests) Create(request *schemas.PontoSolicitacao) error {
+	return r.db.Create(request).Error
+}
+
+func (r gormRequests) Get(id uint) (schemas.PontoSolicitacao, error) {
+	var request schemas.PontoSolicitacao
+	err := r.db.First(&request, id).Error
+	return request, notFound(err)
+}
+
+func (r gormRequests) ListByEmployees(emails []string) ([]schemas.PontoSolicitacao, error) {
+	requests := []schemas.PontoSolicitacao{}
+	if len(emails) == 0 {
+		return requests, nil
+	}
+	err := r.db.Where("funcionario_email IN ?", emails).Order("created_at DESC, id DESC").Find(&requests).Error
+	return requests, err
+}
+
+func (r gormRequests) Update(request *schemas.PontoSolicitacao) error {
+	return r.db.Save(request).Error
+}
+
+type gormLogins struct{ db *gorm.DB }
+
+func (r gormLogins) Create(login *schemas.Login) error {
+	return r.db.Create(login).Error
+}
+
+func (r gormLogins) GetByEmail(email string) (schemas.Login, error) {
+	var login schemas.Login
+	err := r.db.Where("email = ?", email).First(&login).Error
+	return login, notFound(err)
+}
+
+func (r gormLogins) GetByChallenge(challengeHash string) (schemas.Login, error) {
+	var login schemas.Login
+	err := r.db.Where("challenge_hash = ?", challengeHash).First(&login).Error
+	return login, notFound(err)
+}
+
+func (r gormLogins) Update(login *schemas.Login) error {
+	return r.db.Save(login).Error
+}
+
+type gormLoginAttempts struct{ db *gorm.DB }
+
+func (r gormLoginAttempts) Create(attempt *schemas.LoginAttempt) error {
+	return r.db.Create(attempt).Error
+}
+
+func (r gormLoginAttempts) List(filter LoginAttemptFilter) ([]schemas.LoginAttempt, error) {
+	query := r.db.Order("created_at DESC, id DESC")
+	if filter.Email != "" {
+		query = query.Where("email = ?", filter.Email)
+	}
+	if filter.IP != "" {
+		query = query.Where("ip = ?", filter.IP)
+	}
+	if filter.Success != nil {
+		query = query.Where("success = ?", *filter.Success)
+	}
+	if !filter.Since.IsZero() {
+		query = query.Where("created_at >= ?", filter.Since)
+	}
+	if !filter.Until.IsZero() {
+		query = query.Where("created_at < ?", filter.Until)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	var attempts []schemas.LoginAttempt
+	err := query.Find(&attempts).Error
+	return attempts, err
+}
+
+type gormPunches struct{ db *gorm.DB }
+
+func (r gormPunches) Create(punch *schemas.PunchRecord) error {
+	return duplicate(r.db.Create(punch).Error)
+}
+
+func (r gormPunches) Relabel(id uint, punch string) error {
+	return r.db.Model(&schemas.PunchRecord{}).Where("id = ?", id).Update("punch", punch).Error
+}
+
+func (r gormPunches) List(filter PunchFilter) ([]schemas.PunchRecord, error) {
+	punches := []schemas.PunchRecord{}
+	query := r.db.Order("punched_at, id")
+	if filter.Emails != nil {
+		if len(filter.Emails) == 0 {
+			return punches, nil
+		}
+		query = query.Where("employee_email IN ?", filter.Emails)
+	}
+	if filter.TimeLogID != 0 {
+		query = query.Where("time_log_id = ?", filter.TimeLogID)
+	}
+	if !filter.From.IsZero() {
+		query = query.Where("punched_at >= ?", filter.From)
+	}
+	if !filter.To.IsZero() {
+		query = query.Where("punched_at < ?", filter.To)
+	}
+	if len(filter.Sources) > 0 {
+		query = query.Where("source IN ?", filter.Sources)
+	}
+	if filter.ClientIP != "" {
+		query = query.Where("client_ip = ?", filter.ClientIP)
+	}
+	if filter.DeviceID != "" {
+		query = query.Where("device_id = ?", filter.DeviceID)
+	}
+	if filter.IdempotencyKey != "" {
+		query = query.Where("idempotency_key = ?", filter.IdempotencyKey)
+	}
+	err := query.Find(&punches).Error
+	return punches, err
+}
+
+type gormBranches struct{ db *gorm.DB }
+
+func (r gormBranches) Create(branch *schemas.Branch) error {
+	return duplicate(r.db.Create(branch).Error)
+}
+
+func (r gormBranches) Get(id uint) (schemas.Branch, error) {
+	var branch schemas.Branch
+	err := r.db.First(&branch, id).Error
+	return branch, notFound(err)
+}
+
+func (r gormBranches) ListByCompany(cnpj string) ([]schemas.Branch, error) {
+	branches := []schemas.Branch{}
+	err := r.db.Where("company_cnpj = ?", cnpj).Order("name, id").Find(&branches).Error
+	return branches, err
+}
+
+func (r gormBranches) Update(branch *schemas.Branch) error {
+	return duplicate(r.db.Save(branch).Error)
+}
+
+type gormDepartments struct{ db *gorm.DB }
+
+func (r gormDepartments) Create(department *schemas.Department) error {
+	return r.db.Create(department).Error
+}
+
+func (r gormDepartments) Get(id uint) (schemas.Department, error) {
+	var department schemas.Department
+	err := r.db.First(&department, id).Error
+	return department, notFound(err)
+}
+
+func (r gormDepartments) ListByCompany(cnpj string) ([]schemas.Department, error) {
+	departments := []schemas.Department{}
+	err := r.db.Where("company_cnpj = ?", cnpj).Order("name, id").Find(&departments).Error
+	return departments, err
+}
+
+func (r gormDepartments) Update(department *schemas.Department) error {
+	return r.db.Save(department).Error
+}
+
+func (r gormDepartments) Delete(department *schemas.Department) error {
+	return r.db.Delete(department).Error
+}
+
+type gormHolidays struct{ db *gorm.DB }
+
+func (r gormHolidays) Create(holiday *schemas.Holiday) error {
+	return r.db.Create(holiday).Error
+}
+
+func (r gormHolidays) Get(id uint) (schemas.Holiday, error) {
+	var holiday schemas.Holiday
+	err := r.db.First(&holiday, id).Error
+	return holiday, notFound(err)
+}
+
+func (r gormHolidays) List(filter HolidayFilter) ([]schemas.Holiday, error) {
+	holidays := []schemas.Holiday{}
+	query := r.db.Order("date, id")
+	if filter.CompanyCNPJ != "" {
+		query = query.Where("company_cnpj = ?", filter.CompanyCNPJ)
+	}
+	if filter.BranchID != nil {
+		query = query.Where("branch_id IS NULL OR branch_id = ?", *filter.BranchID)
+	}
+	if !filter.Date.IsZero() {
+		query = query.Where("date = ?", filter.Date)
+	}
+	err := query.Find(&holidays).Error
+	return holidays, err
+}
+
+func (r gormHolidays) Delete(holiday *schemas.Holiday) error {
+	return r.db.Delete(holiday).Error
+}
+
+type gormWorkplaces struct{ db *gorm.DB }
+
+func (r gormWorkplaces) Create(workplace *schemas.Workplace) error {
+	return r.db.Create(workplace).Error
+}
+
+func (r gormWorkplaces) Get(id uint) (schemas.Workplace, error) {
+	var workplace schemas.Workplace
+	err := r.db.First(&workplace, id).Error
+	return workplace, notFound(err)
+}
+
+func (r gormWorkplaces) List(cnpj string) ([]schemas.Workplace, error) {
+	workplaces := []schemas.Workplace{}
+	query := r.db.Order("id")
+	if cnpj != "" {
+		query = query.Where("company_cnpj = ?", cnpj)
+	}
+	err := query.Find(&workplaces).Error
+	return workplaces, err
+}
+
+func (r gormWorkplaces) Update(workplace *schemas.Workplace) error {
+	return r.db.Save(workplace).Error
+}
+
+type gormGeofences struct{ db *gorm.DB }
+
+func (r gormGeofences) Create(fence *schemas.Geofence) error {
+	return r.db.Create(fence).Error
+}
+
+func (r gormGeofences) Get(id uint) (schemas.Geofence, error) {
+	var fence schemas.Geofence
+	err := r.db.First(&fence, id).Error
+	return fence, notFound(err)
+}
+
+func (r gormGeofences) List(filter GeofenceFilter) ([]schemas.Geofence, error) {
+	fences := []schemas.Geofence{}
+	query := r.db.Order("id")
+	if filter.CompanyCNPJ != "" {
+		query = query.Where("company_cnpj = ?", filter.CompanyCNPJ)
+	}
+	if filter.WorkplaceID != 0 {
+		query = query.Where("workplace_id = ?", filter.WorkplaceID)
+	}
+	if filter.Active != nil {
+		query = query.Where("active = ?", *filter.Active)
+	}
+	err := query.Find(&fences).Error
+	return fences, err
+}
+
+func (r gormGeofences) Delete(fence *schemas.Geofence) error {
+	return r.db.Delete(fence).Error
+}
+
+type gormKioskDevices struct{ db *gorm.DB }
+
+func (r gormKioskDevices) Create(device *schemas.KioskDevice) error {
+	return r.db.Create(device).Error
+}
+
+func (r gormKioskDevices) Get(id uint) (schemas.KioskDevice, error) {
+	var device schemas.KioskDevice
+	err := r.db.First(&device, id).Error
+	return device, notFound(err)
+}
+
+func (r gormKioskDevices) GetByKeyHash(keyHash string) (schemas.KioskDevice, error) {
+	var device schemas.KioskDevice
+	err := r.db.Where("key_hash = ?", keyHash).First(&device).Error
+	return device, notFound(err)
+}
+
+func (r gormKioskDevices) List(cnpj string) ([]schemas.KioskDevice, error) {
+	devices := []schemas.KioskDevice{}
+	query := r.db.Order("id")
+	if cnpj != "" {
+		query = query.Where("company_cnpj = ?", cnpj)
+	}
+	err := query.Find(&devices).Error
+	return devices, err
+}
+
+func (r gormKioskDevices) Update(device *schemas.KioskDevice) error {
+	return r.db.Save(device).Error
+}
+
+type gormSSOStates struct{ db *gorm.DB }
+
+func (r gormSSOStates) Create(state *schemas.SSOLoginState) error {
+	return r.db.Create(state).Error
+}
+
+func (r gormSSOStates) Take(stateHash string) (schemas.SSOLoginState, error) {
+	var state schemas.SSOLoginState
+	if err := r.db.Where("state_hash = ?", stateHash).First(&state).Error; err != nil {
+		return state, notFound(err)
+	}
+	result := r.db.Unscoped().Delete(&state)
+	if result.Error != nil {
+		return state, result.Error
+	}
+	if result.RowsAffected == 0 {
+		// taken by a concurrent callback
+		return schemas.SSOLoginState{}, ErrNotFound
+	}
+	return state, nil
+}
+
+func (r gormSSOStates) DeleteExpired(now time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", now).Delete(&schemas.SSOLoginState{}).Error
+}
+
+type gormSSOIdentities struct{ db *gorm.DB }
+
+func (r gormSSOIdentities) Create(identity *schemas.SSOIdentity) error {
+	return r.db.Create(identity).Error
+}
+
+func (r gormSSOIdentities) Get(issuer, subject string) (schemas.SSOIdentity, error) {
+	var identity schemas.SSOIdentity
+	err := r.db.Where("issuer = ? AND subject = ?", issuer, subject).First(&identity).Error
+	return identity, notFound(err)
+}
+
+type gormPasswordResets struct{ db *gorm.DB }
+
+func (r gormPasswordResets) Create(token *schemas.PasswordResetToken) error {
+	return r.db.Create(token).Error
+}
+
+func (r gormPasswordResets) GetByHash(tokenHash string) (schemas.PasswordResetToken, error) {
+	var token schemas.PasswordResetToken
+	err := r.db.Where("token_hash = ?", tokenHash).First(&token).Error
+	return token, notFound(err)
+}
+
+func (r gormPasswordResets) Use(id uint, at time.Time) (bool, error) {
+	result := r.db.Model(&schemas.PasswordResetToken{}).
+		Where("id = ? AND used_at = ?", id, time.Time{}).
+		Update("used_at", at)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r gormPasswordResets) Revoke(email string, at time.Time) error {
+	return r.db.Model(&schemas.PasswordResetToken{}).
+		Where("email = ? AND used_at = ?", email, time.Time{}).
+		Update("used_at", at).Error
+}
+
+type gormSessions struct{ db *gorm.DB }
+
+func (r gormSessions) Create(session *schemas.Session) error {
+	return r.db.Create(session).Error
+}
+
+func (r gormSessions) GetByHash(tokenHash string) (schemas.Session, error) {
+	var session schemas.Session
+	err := r.db.Where("token_hash = ?", tokenHash).First(&session).Error
+	return session, notFound(err)
+}
+
+func (r gormSessions) Delete(tokenHash string) error {
+	return r.db.Unscoped().Where("token_hash = ?", tokenHash).Delete(&schemas.Session{}).Error
+}
+
+func (r gormSessions) DeleteByEmail(email, exceptHash string) error {
+	return r.db.Unscoped().Where("employee_email = ? AND token_hash <> ?", email, exceptHash).Delete(&schemas.Session{}).Error
+}
+
+func (r gormSessions) DeleteExpired(now time.Time) error {
+	return r.db.Unscoped().Where("expires_at < ?", now).Delete(&schemas.Session{}).Error
+}
+
+type gormRecoveryCodes struct{ db *gorm.DB }
+
+func (r gormRecoveryCodes) Replace(email string, codeHashes []string) error {
+	if err := r.Delete(email); err != nil {
+		return err
+	}
+	for _, hash := range codeHashes {
+		if err := r.db.Create(&schemas.RecoveryCode{Email: email, CodeHash: hash}).Error; err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r gormRecoveryCodes) Use(email, codeHash string, at time.Time) (bool, error) {
+	result := r.db.Model(&schemas.RecoveryCode{}).
+		Where("email = ? AND code_hash = ? AND used_at = ?", email, codeHash, time.Time{}).
+		Update("used_at", at)
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r gormRecoveryCodes) Delete(email string) error {
+	return r.db.Where("email = ?", email).Delete(&schemas.RecoveryCode{}).Error
+}
+
+type gormRecalculations struct{ db *gorm.DB }
+
+func (r gormRecalculations) Create(task *schemas.RecalculationTask) error {
+	return r.db.Create(task).Error
+}
+
+func (r gormRecalculations) Get(id uint) (schemas.RecalculationTask, error) {
+	var task schemas.RecalculationTask
+	err := r.db.First(&task, id).Error
+	return task, notFound(err)
+}
+
+func (r gormRecalculations) List(filter RecalculationFilter) ([]schemas.RecalculationTask, error) {
+	tasks := []schemas.RecalculationTask{}
+	query := r.db.Order("id DESC")
+	if filter.CompanyCNPJ != "" {
+		query = query.Where("company_cnpj = ?", filter.CompanyCNPJ)
+	}
+	if filter.Status != "" {
+		query = query.Where("status = ?", filter.Status)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	err := query.Find(&tasks).Error
+	return tasks, err
+}
+
+func (r gormRecalculations) Update(task *schemas.RecalculationTask) error {
+	return r.db.Save(task).Error
+}
+
+func (r gormRecalculations) NextPending() (schemas.RecalculationTask, error) {
+	var task schemas.RecalculationTask
+	err := r.db.Where("status = ?", "pendente").Order("id").First(&task).Error
+	return task, notFound(err)
+}
+
+func (r gormRecalculations) Claim(id uint, startedAt time.Time) (bool, error) {
+	result := r.db.Model(&schemas.RecalculationTask{}).
+		Where("id = ? AND status = ?", id, "pendente").
+		Updates(map[string]interface{}{"status": "executando", "started_at": startedAt, "heartbeat_at": startedAt})
+	return result.RowsAffected > 0, result.Error
+}
+
+func (r gormRecalculations) RequeueStale(before time.Time) error {
+	return r.db.Model(&schemas.RecalculationTask{}).
+		Where("status = ? AND heartbeat_at < ?", "executando", before).
+		Update("status", "pendente").Error
+}
+
+type gormAuditLogs struct{ db *gorm.DB }
+
+func (r gormAuditLogs) Create(entry *schemas.AuditLog) error {
+	return r.db.Create(entry).Error
+}
+
+func (r gormAuditLogs) List(filter AuditLogFilter) ([]schemas.AuditLog, error) {
+	entries := []schemas.AuditLog{}
+	query := r.db.Order("id DESC")
+	if filter.Entity != "" {
+		query = query.Where("entity = ?", filter.Entity)
+	}
+	if filter.EntityID != nil {
+		query = query.Where("entity_id = ?", *filter.EntityID)
+	}
+	if filter.Limit > 0 {
+		query = query.Limit(filter.Limit)
+	}
+	err := query.Find(&entries).Error
+	return entries, err
+}
+
+type gormWorkRules struct{ db *gorm.DB }
+
+func (r gormWorkRules) Save(rule *schemas.WorkRule) error {
+	var existing schemas.WorkRule
+	err := r.db.Where("company_cnpj = ? AND employee_email = ? AND kind = ? AND effective_from = ?",
+		rule.CompanyCNPJ, rule.EmployeeEmail, rule.Kind, rule.EffectiveFrom).Limit(1).Find(&existing).Error
+	if err != nil {
+		return err
+	}
+	if existing.ID == 0 {
+		return r.db.Create(rule).Error
+	}
+	rule.Model = existing.Model
+	return r.db.Save(rule).Error
+}
+
+func (r gormWorkRules) List(filter WorkRuleFilter) ([]schemas.WorkRule, error) {
+	rules := []schemas.WorkRule{}
+	query := r.db.Order("effective_from, id")
+	if filter.CompanyCNPJ != "" {
+		query = query.Where("company_cnpj = ?", filter.CompanyCNPJ)
+	}
+	if filter.EmployeeEmail != "" {
+		query = query.Where("employee_email = ?", filter.EmployeeEmail)
+	}
+	if filter.Kind != "" {
+		query = query.Where("kind = ?", filter.Kind)
+	}
+	err := query.Find(&rules).Error
+	return rules, err
+}
@@ -0,0 +1,407 @@
+package db_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/db"
+	"github.com/MWismeck/marca-tempo/src/db/dbtest"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+)
+
+// The in-memory fake must behave like the GORM repositories, so both run the
+// same checks.
+func TestRepositories(t *testing.T) {
+	implementations := map[string]func(t *testing.T) db.Repositories{
+		"gorm":   func(t *testing.T) db.Repositories { return db.NewRepositories(dbtest.Open(t)) },
+		"memory": func(t *testing.T) db.Repositories { return db.NewMemoryRepositories() },
+	}
+	for name, open := range implementations {
+		t.Run(name, func(t *testing.T) {
+			testRepositories(t, open(t))
+		})
+	}
+}
+
+func testRepositories(t *testing.T, repos db.Repositories) {
+	company := schemas.Company{Name: "ACME", CNPJ: "12345678000190"}
+	if err := repos.Companies.Create(&company); err != nil {
+		t.Fatalf("create company: %v", err)
+	}
+	if _, err := repos.Companies.GetByCNPJ("00000000000000"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("missing company: err = %v, want ErrNotFound", err)
+	}
+
+	department := uint(7)
+	for _, e := range []schemas.Employee{
+		{Name: "Ana", Email: "ana@acme.com", Active: true, CompanyCNPJ: company.CNPJ, DepartmentID: &department, Matricula: "0042", BadgeNumber: "B-1"},
+		{Name: "Bob", Email: "bob@acme.com", Active: false, IsAdmin: true, CompanyCNPJ: company.CNPJ},
+		{Name: "Carla", Email: "carla@acme.com", Active: true, IsManager: true, CompanyCNPJ: company.CNPJ},
+	} {
+		if err := repos.Employees.Create(&e); err != nil {
+			t.Fatalf("create employee %s: %v", e.Email, err)
+		}
+	}
+
+	active := true
+	for _, tc := range []struct {
+		name   string
+		filter db.EmployeeFilter
+		want   []string
+	}{
+		{"all", db.EmployeeFilter{}, []string{"ana@acme.com", "bob@acme.com", "carla@acme.com"}},
+		{"active", db.EmployeeFilter{Active: &active}, []string{"ana@acme.com", "carla@acme.com"}},
+		{"managers", db.EmployeeFilter{IsManager: &active}, []string{"carla@acme.com"}},
+		{"admins", db.EmployeeFilter{IsAdmin: &active}, []string{"bob@acme.com"}},
+		{"department", db.EmployeeFilter{DepartmentIDs: []uint{department}}, []string{"ana@acme.com"}},
+		{"no emails", db.EmployeeFilter{Emails: []string{}}, nil},
+		{"emails", db.EmployeeFilter{Emails: []string{"bob@acme.com", "zoe@acme.com"}}, []string{"bob@acme.com"}},
+		{"matricula", db.EmployeeFilter{CompanyCNPJ: company.CNPJ, Matricula: "0042"}, []string{"ana@acme.com"}},
+		{"badge", db.EmployeeFilter{BadgeNumber: "B-2"}, nil},
+	} {
+		employees, err := repos.Employees.List(tc.filter)
+		if err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		var got []string
+		for _, e := range employees {
+			got = append(got, e.Email)
+		}
+		if len(got) != len(tc.want) {
+			t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != tc.want[i] {
+				t.Errorf("%s: got %v, want %v", tc.name, got, tc.want)
+				break
+			}
+		}
+	}
+
+	if err := repos.Employees.SetBranch([]string{"bob@acme.com"}, 3); err != nil {
+		t.Fatalf("set branch: %v", err)
+	}
+	bob, err := repos.Employees.GetByEmail("bob@acme.com")
+	if err != nil || bob.BranchID == nil || *bob.BranchID != 3 {
+		t.Errorf("bob after SetBranch = %+v, %v", bob.BranchID, err)
+	}
+
+	day := func(d int) time.Time { return time.Date(2025, time.March, d, 0, 0, 0, 0, time.UTC) }
+	punch := time.Date(2025, time.March, 10, 12, 0, 0, 0, time.UTC)
+	for _, tl := range []schemas.TimeLog{
+		{EmployeeEmail: "ana@acme.com", LogDate: day(11), Status: "falta"},
+		{EmployeeEmail: "ana@acme.com", LogDate: day(10), EntryTime: punch, LunchExitTime: punch, LunchReturnTime: punch, ExitTime: punch},
+		{EmployeeEmail: "bob@acme.com", LogDate: day(12)},
+	} {
+		if err := repos.TimeLogs.Create(&tl); err != nil {
+			t.Fatalf("create time log: %v", err)
+		}
+	}
+
+	timeLogs, err := repos.TimeLogs.List(db.TimeLogFilter{Emails: []string{"ana@acme.com"}})
+	if err != nil || len(timeLogs) != 2 || !timeLogs[0].LogDate.Equal(day(10)) {
+		t.Errorf("ana's logs = %v, %v; want days 10 and 11 in order", timeLogs, err)
+	}
+	if timeLogs, _ := repos.TimeLogs.List(db.TimeLogFilter{From: day(11), To: day(12)}); len(timeLogs) != 1 {
+		t.Errorf("period [11, 12) returned %d logs, want 1", len(timeLogs))
+	}
+	if timeLogs, _ := repos.TimeLogs.List(db.TimeLogFilter{Complete: true}); len(timeLogs) != 1 || !timeLogs[0].LogDate.Equal(day(10)) {
+		t.Errorf("complete logs = %v, want only day 10", timeLogs)
+	}
+	if timeLogs, _ := repos.TimeLogs.List(db.TimeLogFilter{Statuses: []string{"falta"}}); len(timeLogs) != 1 {
+		t.Errorf("absences = %d, want 1", len(timeLogs))
+	}
+	if timeLogs, _ := repos.TimeLogs.List(db.TimeLogFilter{Descending: true}); len(timeLogs) != 3 || !timeLogs[0].LogDate.Equal(day(12)) {
+		t.Errorf("descending logs start with %v, want day 12", timeLogs)
+	}
+
+	timeLog, err := repos.TimeLogs.GetByDate("ana@acme.com", day(11))
+	if err != nil {
+		t.Fatalf("get by date: %v", err)
+	}
+	timeLog.Status = "completo"
+	if err := repos.TimeLogs.Update(&timeLog); err != nil {
+		t.Fatalf("update time log: %v", err)
+	}
+	if got, _ := repos.TimeLogs.Get(timeLog.ID); got.Status != "completo" {
+		t.Errorf("status after update = %q", got.Status)
+	}
+	if _, err := repos.TimeLogs.GetByDate("ana@acme.com", day(20)); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("missing day: err = %v, want ErrNotFound", err)
+	}
+	err = repos.Transaction(func(repos db.Repositories) error {
+		locked, err := repos.TimeLogs.LockByDate("ana@acme.com", day(11))
+		if err != nil || locked.ID != timeLog.ID {
+			t.Errorf("locked log = %+v, %v; want day 11", locked, err)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Errorf("transaction: %v", err)
+	}
+	if err := repos.TimeLogs.Create(&schemas.TimeLog{EmployeeEmail: "ana@acme.com", LogDate: day(11)}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("second log of the day: err = %v, want ErrDuplicate", err)
+	}
+	if err := repos.TimeLogs.Delete(&timeLog); err != nil {
+		t.Fatalf("delete time log: %v", err)
+	}
+	if err := repos.TimeLogs.Create(&schemas.TimeLog{EmployeeEmail: "ana@acme.com", LogDate: day(11)}); err != nil {
+		t.Errorf("log of a deleted day: %v", err)
+	}
+
+	start := time.Date(2025, 3, 10, 12, 0, 0, 0, time.UTC)
+	for i, a := range []schemas.LoginAttempt{
+		{Email: "ana@acme.com", IP: "10.0.0.1", Success: false, Reason: "senha_incorreta"},
+		{Email: "ana@acme.com", IP: "10.0.0.2", Success: true},
+		{Email: "bob@acme.com", IP: "10.0.0.1", Success: false, Reason: "senha_incorreta"},
+	} {
+		a.CreatedAt = start.Add(time.Duration(i) * time.Minute)
+		if err := repos.LoginAttempts.Create(&a); err != nil {
+			t.Fatalf("create login attempt: %v", err)
+		}
+	}
+	failed := false
+	attempts, err := repos.LoginAttempts.List(db.LoginAttemptFilter{IP: "10.0.0.1", Success: &failed})
+	if err != nil || len(attempts) != 2 || attempts[0].Email != "bob@acme.com" {
+		t.Errorf("failures from 10.0.0.1 = %v, %v; want bob's then ana's", attempts, err)
+	}
+	if attempts, _ := repos.LoginAttempts.List(db.LoginAttemptFilter{Email: "ana@acme.com", Since: start.Add(time.Minute)}); len(attempts) != 1 || !attempts[0].Success {
+		t.Errorf("ana's attempts since the first = %v, want the successful one", attempts)
+	}
+	if attempts, _ := repos.LoginAttempts.List(db.LoginAttemptFilter{Until: start.Add(2 * time.Minute), Limit: 1}); len(attempts) != 1 || attempts[0].IP != "10.0.0.2" {
+		t.Errorf("latest attempt before the third = %v", attempts)
+	}
+
+	// Punches come back in the order they happened, not of creation
+	key := "5f2b7c1e"
+	for _, p := range []schemas.PunchRecord{
+		{EmployeeEmail: "ana@acme.com", TimeLogID: timeLog.ID, Punch: "saida_almoco", PunchedAt: start.Add(4 * time.Hour), Source: "web", ClientIP: "10.0.0.1"},
+		{EmployeeEmail: "ana@acme.com", TimeLogID: timeLog.ID, Punch: "entrada", PunchedAt: start, Source: "quiosque", DeviceID: "quiosque-1"},
+		{EmployeeEmail: "bob@acme.com", Punch: "entrada", PunchedAt: start.Add(time.Minute), Source: "web", ClientIP: "10.0.0.2", IdempotencyKey: &key},
+	} {
+		if err := repos.Punches.Create(&p); err != nil {
+			t.Fatalf("create punch: %v", err)
+		}
+	}
+	punches, err := repos.Punches.List(db.PunchFilter{TimeLogID: timeLog.ID})
+	if err != nil || len(punches) != 2 || punches[0].Punch != "entrada" {
+		t.Errorf("punches of the log = %v, %v; want entrada then saida_almoco", punches, err)
+	}
+	if punches, _ := repos.Punches.List(db.PunchFilter{Emails: []string{"ana@acme.com", "bob@acme.com"}, From: start.Add(time.Minute), To: start.Add(time.Hour)}); len(punches) != 1 || punches[0].EmployeeEmail != "bob@acme.com" {
+		t.Errorf("punches in the first hour after the entry = %v", punches)
+	}
+	if punches, _ := repos.Punches.List(db.PunchFilter{Sources: []string{"web"}, ClientIP: "10.0.0.1"}); len(punches) != 1 || punches[0].Punch != "saida_almoco" {
+		t.Errorf("web punches from 10.0.0.1 = %v", punches)
+	}
+	if punches, _ := repos.Punches.List(db.PunchFilter{DeviceID: "quiosque-1"}); len(punches) != 1 || punches[0].Source != "quiosque" {
+		t.Errorf("punches of the kiosk = %v", punches)
+	}
+	if punches, _ := repos.Punches.List(db.PunchFilter{Emails: []string{"bob@acme.com"}, IdempotencyKey: key}); len(punches) != 1 {
+		t.Errorf("punch with the idempotency key = %v", punches)
+	}
+	if err := repos.Punches.Create(&schemas.PunchRecord{EmployeeEmail: "bob@acme.com", Punch: "saida", IdempotencyKey: &key}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("punch with a used idempotency key: err = %v, want ErrDuplicate", err)
+	}
+	if err := repos.Punches.Create(&schemas.PunchRecord{EmployeeEmail: "ana@acme.com", Punch: "saida", IdempotencyKey: &key}); err != nil {
+		t.Errorf("key of another employee: %v", err)
+	}
+
+	// Branches without a CNPJ of their own do not collide
+	southCNPJ := "12345678000271"
+	for _, b := range []schemas.Branch{
+		{CompanyCNPJ: company.CNPJ, CNPJ: &southCNPJ, Name: "Sul"},
+		{CompanyCNPJ: company.CNPJ, Name: "Norte"},
+		{CompanyCNPJ: company.CNPJ, Name: "Leste"},
+	} {
+		if err := repos.Branches.Create(&b); err != nil {
+			t.Fatalf("create branch %s: %v", b.Name, err)
+		}
+	}
+	if err := repos.Branches.Create(&schemas.Branch{CompanyCNPJ: company.CNPJ, CNPJ: &southCNPJ, Name: "Oeste"}); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("branch with a taken CNPJ: err = %v, want ErrDuplicate", err)
+	}
+	branches, err := repos.Branches.ListByCompany(company.CNPJ)
+	if err != nil || len(branches) != 3 || branches[0].Name != "Leste" || branches[1].Name != "Norte" {
+		t.Errorf("branches = %v, %v; want Leste, Norte and Sul", branches, err)
+	}
+	branches[0].CNPJ = &southCNPJ
+	if err := repos.Branches.Update(&branches[0]); !errors.Is(err, db.ErrDuplicate) {
+		t.Errorf("update to a taken CNPJ: err = %v, want ErrDuplicate", err)
+	}
+	if _, err := repos.Branches.Get(999); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("missing branch: err = %v, want ErrNotFound", err)
+	}
+
+	// A holiday of a branch applies to that branch only
+	south := branches[2].ID
+	for _, h := range []schemas.Holiday{
+		{CompanyCNPJ: company.CNPJ, Date: day(21), Name: "Nacional"},
+		{CompanyCNPJ: company.CNPJ, BranchID: &south, Date: day(20), Name: "Municipal"},
+		{CompanyCNPJ: company.CNPJ, BranchID: &branches[0].ID, Date: day(22), Name: "Outra filial"},
+	} {
+		if err := repos.Holidays.Create(&h); err != nil {
+			t.Fatalf("create holiday: %v", err)
+		}
+	}
+	if holidays, _ := repos.Holidays.List(db.HolidayFilter{CompanyCNPJ: company.CNPJ, BranchID: &south}); len(holidays) != 2 || holidays[0].Name != "Municipal" {
+		t.Errorf("holidays of the branch = %v, want Municipal then Nacional", holidays)
+	}
+	if holidays, _ := repos.Holidays.List(db.HolidayFilter{CompanyCNPJ: company.CNPJ, Date: day(21)}); len(holidays) != 1 {
+		t.Errorf("holidays on day 21 = %v", holidays)
+	}
+
+	inactive := false
+	for _, f := range []schemas.Geofence{
+		{CompanyCNPJ: company.CNPJ, WorkplaceID: 1, Kind: "circulo", Active: true},
+		{CompanyCNPJ: company.CNPJ, WorkplaceID: 2, Kind: "circulo", Active: false},
+	} {
+		if err := repos.Geofences.Create(&f); err != nil {
+			t.Fatalf("create geofence: %v", err)
+		}
+	}
+	if fences, _ := repos.Geofences.List(db.GeofenceFilter{CompanyCNPJ: company.CNPJ, Active: &inactive}); len(fences) != 1 || fences[0].WorkplaceID != 2 {
+		t.Errorf("inactive geofences = %v", fences)
+	}
+
+	device := schemas.KioskDevice{Name: "Portaria", CompanyCNPJ: company.CNPJ, KeyHash: "abc", Active: true}
+	if err := repos.KioskDevices.Create(&device); err != nil {
+		t.Fatalf("create kiosk: %v", err)
+	}
+	if got, err := repos.KioskDevices.GetByKeyHash("abc"); err != nil || got.ID != device.ID {
+		t.Errorf("kiosk by key = %v, %v", got, err)
+	}
+
+	// SSO states and reset tokens work only once
+	state := schemas.SSOLoginState{StateHash: "s1", CompanyCNPJ: company.CNPJ, Nonce: "n", Verifier: "v", ExpiresAt: start.Add(time.Hour)}
+	if err := repos.SSOStates.Create(&state); err != nil {
+		t.Fatalf("create sso state: %v", err)
+	}
+	if _, err := repos.SSOStates.Take("s1"); err != nil {
+		t.Errorf("take sso state: %v", err)
+	}
+	if _, err := repos.SSOStates.Take("s1"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("second take: err = %v, want ErrNotFound", err)
+	}
+
+	reset := schemas.PasswordResetToken{Email: "ana@acme.com", TokenHash: "t1", ExpiresAt: start.Add(time.Hour)}
+	if err := repos.PasswordResets.Create(&reset); err != nil {
+		t.Fatalf("create reset token: %v", err)
+	}
+	if used, err := repos.PasswordResets.Use(reset.ID, start); err != nil || !used {
+		t.Errorf("first use = %t, %v", used, err)
+	}
+	if used, _ := repos.PasswordResets.Use(reset.ID, start); used {
+		t.Error("reset token used twice")
+	}
+
+	session := schemas.Session{EmployeeEmail: "ana@acme.com", TokenHash: "s1", ExpiresAt: start.Add(time.Hour)}
+	if err := repos.Sessions.Create(&session); err != nil {
+		t.Fatalf("create session: %v", err)
+	}
+	if got, err := repos.Sessions.GetByHash("s1"); err != nil || got.EmployeeEmail != "ana@acme.com" {
+		t.Errorf("get session = %+v, %v", got, err)
+	}
+	if err := repos.Sessions.DeleteExpired(start.Add(2 * time.Hour)); err != nil {
+		t.Fatalf("delete expired sessions: %v", err)
+	}
+	if _, err := repos.Sessions.GetByHash("s1"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("expired session: err = %v, want ErrNotFound", err)
+	}
+	for _, hash := range []string{"s2", "s3"} {
+		if err := repos.Sessions.Create(&schemas.Session{EmployeeEmail: "ana@acme.com", TokenHash: hash, ExpiresAt: start.Add(3 * time.Hour)}); err != nil {
+			t.Fatalf("create session: %v", err)
+		}
+	}
+	if err := repos.Sessions.DeleteByEmail("ana@acme.com", "s3"); err != nil {
+		t.Fatalf("delete sessions by e-mail: %v", err)
+	}
+	if _, err := repos.Sessions.GetByHash("s2"); !errors.Is(err, db.ErrNotFound) {
+		t.Errorf("other session: err = %v, want ErrNotFound", err)
+	}
+	if _, err := repos.Sessions.GetByHash("s3"); err != nil {
+		t.Errorf("kept session: %v", err)
+	}
+
+	if err := repos.RecoveryCodes.Replace("ana@acme.com", []string{"c1", "c2"}); err != nil {
+		t.Fatalf("replace recovery codes: %v", err)
+	}
+	if used, _ := repos.RecoveryCodes.Use("ana@acme.com", "c1", start); !used {
+		t.Error("recovery code not accepted")
+	}
+	if used, _ := repos.RecoveryCodes.Use("ana@acme.com", "c1", start); used {
+		t.Error("recovery code accepted twice")
+	}
+
+	// Only one instance claims a pending recalculation
+	task := schemas.RecalculationTask{CompanyCNPJ: company.CNPJ, Status: "pendente"}
+	if err := repos.Recalculations.Create(&task); err != nil {
+		t.Fatalf("create recalculation: %v", err)
+	}
+	if next, err := repos.Recalculations.NextPending(); err != nil || next.ID != task.ID {
+		t.Errorf("next pending = %v, %v", next, err)
+	}
+	if claimed, err := repos.Recalculations.Claim(task.ID, start); err != nil || !claimed {
+		t.Errorf("first claim = %t, %v", claimed, err)
+	}
+	if claimed, _ := repos.Recalculations.Claim(task.ID, start); claimed {
+		t.Error("recalculation claimed twice")
+	}
+	// A task that renewed its heartbeat is not requeued
+	running, _ := repos.Recalculations.List(db.RecalculationFilter{Status: "executando"})
+	if len(running) != 1 || !running[0].HeartbeatAt.Equal(start) {
+		t.Fatalf("running tasks = %v, want the claimed one with its heartbeat", running)
+	}
+	running[0].HeartbeatAt = start.Add(2 * time.Minute)
+	if err := repos.Recalculations.Update(&running[0]); err != nil {
+		t.Fatalf("update recalculation: %v", err)
+	}
+	if err := repos.Recalculations.RequeueStale(start.Add(time.Minute)); err != nil {
+		t.Fatalf("requeue stale: %v", err)
+	}
+	if tasks, _ := repos.Recalculations.List(db.RecalculationFilter{Status: "pendente"}); len(tasks) != 0 {
+		t.Errorf("pending after requeue with a recent heartbeat = %v", tasks)
+	}
+	if err := repos.Recalculations.RequeueStale(start.Add(3 * time.Minute)); err != nil {
+		t.Fatalf("requeue stale: %v", err)
+	}
+	if tasks, _ := repos.Recalculations.List(db.RecalculationFilter{Status: "pendente"}); len(tasks) != 1 {
+		t.Errorf("pending after requeue = %v", tasks)
+	}
+
+	for _, entity := range []string{"employee", "time_log", "employee"} {
+		if err := repos.AuditLogs.Create(&schemas.AuditLog{Entity: entity, EntityID: 1}); err != nil {
+			t.Fatalf("create audit log: %v", err)
+		}
+	}
+	if entries, _ := repos.AuditLogs.List(db.AuditLogFilter{Entity: "employee", Limit: 1}); len(entries) != 1 || entries[0].ID < 3 {
+		t.Errorf("latest employee audit = %v", entries)
+	}
+
+	// Versions are listed by date and saving the same date replaces it
+	effective := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for _, rule := range []schemas.WorkRule{
+		{CompanyCNPJ: company.CNPJ, EmployeeEmail: "ana@acme.com", Kind: "jornada", Value: 30, EffectiveFrom: effective},
+		{CompanyCNPJ: company.CNPJ, EmployeeEmail: "ana@acme.com", Kind: "jornada", Value: 40},
+		{CompanyCNPJ: company.CNPJ, EmployeeEmail: "ana@acme.com", Kind: "jornada", Value: 20, EffectiveFrom: effective},
+		{CompanyCNPJ: company.CNPJ, Kind: "tolerancia", Value: 10, EffectiveFrom: effective},
+	} {
+		if err := repos.WorkRules.Save(&rule); err != nil {
+			t.Fatalf("save work rule: %v", err)
+		}
+	}
+	rules, err := repos.WorkRules.List(db.WorkRuleFilter{EmployeeEmail: "ana@acme.com", Kind: "jornada"})
+	if err != nil || len(rules) != 2 || rules[0].Value != 40 || rules[1].Value != 20 || !rules[1].EffectiveFrom.Equal(effective) {
+		t.Errorf("workload versions = %v, %v", rules, err)
+	}
+
+	// A failed transaction is rolled back in the GORM implementation; both
+	// must return the error unchanged
+	failure := errors.New("boom")
+	if err := repos.Transaction(func(tx db.Repositories) error {
+		return failure
+	}); !errors.Is(err, failure) {
+		t.Errorf("transaction error = %v, want %v", err, failure)
+	}
+}
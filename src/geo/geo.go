@@ -0,0 +1,91 @@
+// Package geo evaluates punch locations against geofences: circles around a
+// point or polygons, both in WGS 84 latitude and longitude.
+package geo
+
+import (
+	"errors"
+	"math"
+)
+
+// earthRadius is the mean radius of the Earth in meters.
+const earthRadius = 6371008.8
+
+var ErrInvalidPoint = errors.New("invalid coordinates")
+
+// Point is a position in decimal degrees.
+type Point struct {
+	Lat float64 `json:"lat"`
+	Lng float64 `json:"lng"`
+}
+
+// Valid reports whether the point is a position on Earth.
+func (p Point) Valid() bool {
+	return !math.IsNaN(p.Lat) && !math.IsNaN(p.Lng) &&
+		p.Lat >= -90 && p.Lat <= 90 && p.Lng >= -180 && p.Lng <= 180
+}
+
+// Distance is the great-circle distance between a and b in meters.
+func Distance(a, b Point) float64 {
+	lat1, lat2 := radians(a.Lat), radians(b.Lat)
+	dLat := lat2 - lat1
+	dLng := radians(b.Lng - a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return 2 * earthRadius * math.Asin(math.Min(1, math.Sqrt(h)))
+}
+
+// InCircle reports whether p is at most radius meters from center. The
+// accuracy of the reading is given the benefit of the doubt: a point whose
+// uncertainty circle touches the fence counts as inside.
+func InCircle(p Point, accuracy float64, center Point, radius float64) bool {
+	return Distance(p, center) <= radius+math.Max(accuracy, 0)
+}
+
+// InPolygon reports whether p is inside the polygon, by ray casting. The
+// polygon is given by its vertices, closed implicitly. Polygons are assumed
+// small enough for latitude and longitude to be treated as plane
+// coordinates, and not to cross the antimeridian.
+func InPolygon(p Point, polygon []Point) bool {
+	if len(polygon) < 3 {
+		return false
+	}
+	inside := false
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		a, b := polygon[i], polygon[j]
+		if (a.Lat > p.Lat) != (b.Lat > p.Lat) &&
+			p.Lng < (b.Lng-a.Lng)*(p.Lat-a.Lat)/(b.Lat-a.Lat)+a.Lng {
+			inside = !inside
+		}
+	}
+	return inside
+}
+
+// DistanceToPolygon is the distance in meters from p to the nearest edge of
+// the polygon, or 0 when p is inside it.
+func DistanceToPolygon(p Point, polygon []Point) float64 {
+	if InPolygon(p, polygon) {
+		return 0
+	}
+	nearest := math.Inf(1)
+	for i, j := 0, len(polygon)-1; i < len(polygon); j, i = i, i+1 {
+		nearest = math.Min(nearest, distanceToSegment(p, polygon[j], polygon[i]))
+	}
+	return nearest
+}
+
+// distanceToSegment projects the points on a local equirectangular plane
+// around p, which is accurate at the scale of a building.
+func distanceToSegment(p, a, b Point) float64 {
+	scale := math.Cos(radians(p.Lat))
+	ax, ay := radians(a.Lng-p.Lng)*scale*earthRadius, radians(a.Lat-p.Lat)*earthRadius
+	bx, by := radians(b.Lng-p.Lng)*scale*earthRadius, radians(b.Lat-p.Lat)*earthRadius
+	dx, dy := bx-ax, by-ay
+	t := 0.0
+	if length := dx*dx + dy*dy; length > 0 {
+		t = math.Max(0, math.Min(1, -(ax*dx+ay*dy)/length))
+	}
+	return math.Hypot(ax+t*dx, ay+t*dy)
+}
+
+func radians(degrees float64) float64 {
+	return degrees * math.Pi / 180
+}
@@ -0,0 +1,75 @@
+package geo
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistance(t *testing.T) {
+	// Praça da Sé to Avenida Paulista (MASP), São Paulo
+	se := Point{Lat: -23.550520, Lng: -46.633308}
+	masp := Point{Lat: -23.561414, Lng: -46.655881}
+	if d := Distance(se, masp); math.Abs(d-2600) > 10 {
+		t.Errorf("Distance = %.0f m, want about 2600 m", d)
+	}
+	if d := Distance(se, se); d != 0 {
+		t.Errorf("Distance to itself = %f", d)
+	}
+}
+
+func TestInCircle(t *testing.T) {
+	center := Point{Lat: -23.0, Lng: -51.0}
+	// 0.001° of latitude is about 111 m
+	p := Point{Lat: -23.001, Lng: -51.0}
+	for _, tc := range []struct {
+		radius, accuracy float64
+		want             bool
+	}{
+		{150, 0, true},
+		{100, 0, false},
+		{100, 20, true},
+		{100, -5, false},
+	} {
+		if got := InCircle(p, tc.accuracy, center, tc.radius); got != tc.want {
+			t.Errorf("InCircle(radius %v, accuracy %v) = %t, want %t", tc.radius, tc.accuracy, got, tc.want)
+		}
+	}
+}
+
+func TestInPolygon(t *testing.T) {
+	square := []Point{{-23.0, -51.0}, {-23.0, -50.99}, {-23.01, -50.99}, {-23.01, -51.0}}
+	if !InPolygon(Point{-23.005, -50.995}, square) {
+		t.Error("center of the square should be inside")
+	}
+	outside := Point{-23.005, -50.98}
+	if InPolygon(outside, square) {
+		t.Error("point east of the square should be outside")
+	}
+	if InPolygon(Point{-23.005, -50.995}, square[:2]) {
+		t.Error("a polygon needs at least three vertices")
+	}
+
+	if d := DistanceToPolygon(Point{-23.005, -50.995}, square); d != 0 {
+		t.Errorf("DistanceToPolygon inside = %f", d)
+	}
+	// 0.01° of longitude at 23°S is about 1024 m
+	if d := DistanceToPolygon(outside, square); math.Abs(d-1024) > 10 {
+		t.Errorf("DistanceToPolygon = %.0f m, want about 1024 m", d)
+	}
+}
+
+func TestValid(t *testing.T) {
+	for _, tc := range []struct {
+		p    Point
+		want bool
+	}{
+		{Point{-23.3, -51.1}, true},
+		{Point{91, 0}, false},
+		{Point{0, -181}, false},
+		{Point{math.NaN(), 0}, false},
+	} {
+		if got := tc.p.Valid(); got != tc.want {
+			t.Errorf("%v.Valid() = %t, want %t", tc.p, got, tc.want)
+		}
+	}
+}
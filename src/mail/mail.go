@@ -0,0 +1,90 @@
+// Package mail sends the e-mails of the server, such as password reset links,
+// through a pluggable Mailer: SMTP in production or a mail catcher like
+// Mailpit in development, only the log when no server is configured.
+package mail
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"net"
+	"net/smtp"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// Message is a plain text e-mail.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// Config selects how e-mails are sent. It is loaded by the config package.
+// Without a host the messages are not sent, only logged without their body.
+type Config struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
+}
+
+// New returns the mailer for the configuration.
+func New(config Config) Mailer {
+	if config.Host == "" {
+		return Log{}
+	}
+	return SMTP{Config: config}
+}
+
+// SMTP sends messages through an SMTP server, authenticating when a username
+// is configured. STARTTLS is used whenever the server offers it.
+type SMTP struct {
+	Config Config
+}
+
+func (s SMTP) Send(msg Message) error {
+	addr := net.JoinHostPort(s.Config.Host, strconv.Itoa(s.Config.Port))
+
+	var auth smtp.Auth
+	if s.Config.Username != "" {
+		auth = smtp.PlainAuth("", s.Config.Username, s.Config.Password, s.Config.Host)
+	}
+
+	if err := smtp.SendMail(addr, auth, s.Config.From, []string{msg.To}, compose(s.Config.From, msg)); err != nil {
+		return fmt.Errorf("send mail to %s: %w", msg.To, err)
+	}
+	return nil
+}
+
+// compose renders the message headers and body.
+func compose(from string, msg Message) []byte {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "From: %s\r\n", from)
+	fmt.Fprintf(&buf, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", msg.Subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	buf.WriteString("MIME-Version: 1.0\r\n")
+	buf.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	buf.WriteString("Content-Transfer-Encoding: 8bit\r\n\r\n")
+	buf.WriteString(msg.Body)
+	return buf.Bytes()
+}
+
+// Log records the recipient and subject of the messages instead of sending
+// them, for development without a mail server. The body is left out, as it
+// may carry secrets such as password reset links.
+type Log struct{}
+
+func (Log) Send(msg Message) error {
+	log.Warn().Str("to", msg.To).Str("subject", msg.Subject).Msg("[mail] Servidor SMTP não configurado, mensagem não enviada")
+	return nil
+}
@@ -0,0 +1,98 @@
+package mail
+
+import (
+	"bufio"
+	"bytes"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// catcher is a minimal SMTP server that records the DATA of one message.
+func catcher(t *testing.T) (Config, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	data := make(chan string, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+		reply := func(s string) { conn.Write([]byte(s + "\r\n")) }
+
+		reply("220 catcher")
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch cmd := strings.ToUpper(strings.TrimSpace(line)); {
+			case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+				reply("250 catcher")
+			case cmd == "DATA":
+				reply("354 go ahead")
+				var body strings.Builder
+				for {
+					l, err := r.ReadString('\n')
+					if err != nil || l == ".\r\n" {
+						break
+					}
+					body.WriteString(l)
+				}
+				data <- body.String()
+				reply("250 ok")
+			case cmd == "QUIT":
+				reply("221 bye")
+				return
+			default:
+				reply("250 ok")
+			}
+		}
+	}()
+
+	host, port, _ := net.SplitHostPort(ln.Addr().String())
+	p, _ := strconv.Atoi(port)
+	return Config{Host: host, Port: p, From: "ponto@acme.com"}, data
+}
+
+func TestSMTPSendsMessage(t *testing.T) {
+	config, data := catcher(t)
+
+	err := New(config).Send(Message{To: "ana@acme.com", Subject: "Redefinição de senha", Body: "Acesse o link"})
+	if err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	got := <-data
+	for _, want := range []string{"From: ponto@acme.com", "To: ana@acme.com", "Subject: =?utf-8?q?Redefini=C3=A7=C3=A3o_de_senha?=", "\r\n\r\nAcesse o link"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("message does not contain %q:\n%s", want, got)
+		}
+	}
+}
+
+func TestLogOmitsBody(t *testing.T) {
+	var buf bytes.Buffer
+	logger := log.Logger
+	log.Logger = zerolog.New(&buf)
+	t.Cleanup(func() { log.Logger = logger })
+
+	if err := (Log{}).Send(Message{To: "ana@acme.com", Subject: "Redefinição de senha", Body: "Acesse /reset?token=secreto"}); err != nil {
+		t.Fatalf("send: %v", err)
+	}
+
+	if got := buf.String(); !strings.Contains(got, "ana@acme.com") || strings.Contains(got, "secreto") {
+		t.Errorf("log should name the recipient without the body: %s", got)
+	}
+}
@@ -0,0 +1,114 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/oidc"
+	"github.com/MWismeck/marca-tempo/src/oidc/oidctest"
+)
+
+func startProvider(t *testing.T) (*oidctest.Provider, *oidc.Provider) {
+	t.Helper()
+	mock := oidctest.New("marca-tempo")
+	server := httptest.NewServer(mock)
+	t.Cleanup(server.Close)
+	mock.Issuer = server.URL
+
+	provider, err := oidc.Discover(context.Background(), server.Client(), server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mock, provider
+}
+
+func TestAuthorizationCodeFlow(t *testing.T) {
+	mock, provider := startProvider(t)
+	mock.ClientSecret = "segredo"
+	mock.SetClaims(map[string]interface{}{"sub": "42", "email": "ana@acme.com"})
+	client := oidc.Client{ID: "marca-tempo", Secret: "segredo", RedirectURL: "http://localhost:8080/callback"}
+
+	verifier, _ := oidc.RandomString()
+	noRedirect := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	resp, err := noRedirect.Get(provider.AuthCodeURL(client, "estado", "nonce-1", verifier))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	location, _ := url.Parse(resp.Header.Get("Location"))
+	if location.Query().Get("state") != "estado" || location.Query().Get("code") == "" {
+		t.Fatalf("redirect to %s", location)
+	}
+	code := location.Query().Get("code")
+
+	if _, err := provider.Exchange(context.Background(), client, code, "outro-verificador"); err == nil {
+		t.Errorf("exchange accepted a wrong PKCE verifier")
+	}
+	resp, _ = noRedirect.Get(provider.AuthCodeURL(client, "estado", "nonce-1", verifier))
+	resp.Body.Close()
+	location, _ = url.Parse(resp.Header.Get("Location"))
+	idToken, err := provider.Exchange(context.Background(), client, location.Query().Get("code"), verifier)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	claims, err := provider.Verify(context.Background(), idToken, "marca-tempo", "nonce-1", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if claims["sub"] != "42" || claims["email"] != "ana@acme.com" {
+		t.Errorf("claims = %v", claims)
+	}
+}
+
+func TestVerifyRejectsInvalidTokens(t *testing.T) {
+	mock, provider := startProvider(t)
+	now := time.Now()
+	valid := func() map[string]interface{} {
+		return map[string]interface{}{"iss": mock.Issuer, "aud": "marca-tempo", "sub": "42", "nonce": "n", "exp": now.Add(time.Minute).Unix()}
+	}
+	with := func(key string, value interface{}) string {
+		claims := valid()
+		claims[key] = value
+		return mock.Sign(claims)
+	}
+
+	if _, err := provider.Verify(context.Background(), with("aud", []string{"outro", "marca-tempo"}), "marca-tempo", "n", now); err != nil {
+		t.Errorf("audience list including the client: %v", err)
+	}
+	tampered := mock.Sign(valid())
+	parts := strings.Split(tampered, ".")
+	tampered = parts[0] + "." + strings.Split(with("sub", "43"), ".")[1] + "." + parts[2]
+
+	for name, token := range map[string]string{
+		"wrong issuer":   with("iss", "https://evil.example"),
+		"wrong audience": with("aud", "outro"),
+		"wrong azp":      with("azp", "outro"),
+		"expired":        with("exp", now.Add(-oidc.Leeway-time.Second).Unix()),
+		"wrong nonce":    with("nonce", "m"),
+		"no subject":     with("sub", ""),
+		"tampered":       tampered,
+		"malformed":      "a.b",
+	} {
+		if _, err := provider.Verify(context.Background(), token, "marca-tempo", "n", now); !errors.Is(err, oidc.ErrInvalidToken) {
+			t.Errorf("%s: err = %v, want ErrInvalidToken", name, err)
+		}
+	}
+}
+
+func TestDiscoverChecksIssuer(t *testing.T) {
+	mock := oidctest.New("marca-tempo")
+	server := httptest.NewServer(mock)
+	defer server.Close()
+	mock.Issuer = "https://outro.example"
+
+	if _, err := oidc.Discover(context.Background(), server.Client(), server.URL); err == nil {
+		t.Errorf("discovery accepted a document for another issuer")
+	}
+}
@@ -0,0 +1,101 @@
+// Package qrtoken generates and verifies the codes displayed as rotating QR
+// codes at a workplace. A code is the HMAC-SHA256 of the company, the
+// workplace and a 30 second time window, so it only proves that the employee
+// was in front of the screen while it was displayed.
+package qrtoken
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Period is how long each code is displayed.
+const Period = 30 * time.Second
+
+var (
+	ErrMalformed = errors.New("malformed code")
+	ErrExpired   = errors.New("expired code")
+	ErrInvalid   = errors.New("invalid code")
+)
+
+// NewSecret returns a random 256 bit secret, hex encoded.
+func NewSecret() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(raw), nil
+}
+
+// Window is the number of the time window of t.
+func Window(t time.Time) int64 {
+	return t.Unix() / int64(Period/time.Second)
+}
+
+// WindowEnd is when the code of the window stops being displayed.
+func WindowEnd(window int64) time.Time {
+	return time.Unix((window+1)*int64(Period/time.Second), 0).UTC()
+}
+
+// Generate returns the code of the location for the window, in the form
+// "<location>.<window>.<mac>".
+func Generate(secret, company string, location uint, window int64) string {
+	return fmt.Sprintf("%d.%d.%s", location, window, mac(secret, company, location, window))
+}
+
+// Location returns the location a code claims to be from, so the caller can
+// look up its secret.
+func Location(code string) (uint, error) {
+	location, _, _, err := parse(code)
+	return location, err
+}
+
+// Verify checks the code of the location at now. The code of the previous
+// window is still accepted, covering the time the phone takes to scan and send
+// it.
+func Verify(secret, company, code string, now time.Time) error {
+	location, window, sum, err := parse(code)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal([]byte(sum), []byte(mac(secret, company, location, window))) {
+		return ErrInvalid
+	}
+	current := Window(now)
+	if window > current {
+		return ErrInvalid
+	}
+	if window < current-1 {
+		return ErrExpired
+	}
+	return nil
+}
+
+func mac(secret, company string, location uint, window int64) string {
+	h := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(h, "%s|%d|%d", company, location, window)
+	return base64.RawURLEncoding.EncodeToString(h.Sum(nil)[:16])
+}
+
+func parse(code string) (location uint, window int64, sum string, err error) {
+	parts := strings.Split(strings.TrimSpace(code), ".")
+	if len(parts) != 3 || parts[2] == "" {
+		return 0, 0, "", ErrMalformed
+	}
+	id, err := strconv.ParseUint(parts[0], 10, 0)
+	if err != nil {
+		return 0, 0, "", ErrMalformed
+	}
+	if window, err = strconv.ParseInt(parts[1], 10, 64); err != nil {
+		return 0, 0, "", ErrMalformed
+	}
+	return uint(id), window, parts[2], nil
+}
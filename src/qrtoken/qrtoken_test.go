@@ -0,0 +1,47 @@
+package qrtoken
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestVerify(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	shown := time.Date(2025, time.March, 10, 11, 0, 5, 0, time.UTC)
+	code := Generate(secret, "12345678000190", 7, Window(shown))
+
+	if location, err := Location(code); err != nil || location != 7 {
+		t.Fatalf("Location(%q) = %d, %v", code, location, err)
+	}
+	if !WindowEnd(Window(shown)).Equal(shown.Add(25 * time.Second)) {
+		t.Errorf("WindowEnd = %s", WindowEnd(Window(shown)))
+	}
+
+	other, _ := NewSecret()
+	for _, tc := range []struct {
+		name    string
+		secret  string
+		company string
+		code    string
+		at      time.Time
+		want    error
+	}{
+		{"same window", secret, "12345678000190", code, shown, nil},
+		{"next window", secret, "12345678000190", code, shown.Add(Period), nil},
+		{"two windows later", secret, "12345678000190", code, shown.Add(2 * Period), ErrExpired},
+		{"before it was shown", secret, "12345678000190", code, shown.Add(-Period), ErrInvalid},
+		{"other company", secret, "98765432000110", code, shown, ErrInvalid},
+		{"other secret", other, "12345678000190", code, shown, ErrInvalid},
+		{"other location", secret, "12345678000190", "8" + strings.TrimPrefix(code, "7"), shown, ErrInvalid},
+		{"malformed", secret, "12345678000190", "7." + code, shown, ErrMalformed},
+	} {
+		if err := Verify(tc.secret, tc.company, tc.code, tc.at); !errors.Is(err, tc.want) {
+			t.Errorf("%s: Verify = %v, want %v", tc.name, err, tc.want)
+		}
+	}
+}
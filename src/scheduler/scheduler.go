@@ -0,0 +1,391 @@
+// Package scheduler runs the server's periodic jobs from cron expressions.
+// Every execution is persisted in schemas.JobRun, which makes runs idempotent,
+// lets a restarted server catch up on slots missed while it was down and
+// prevents several instances sharing the database from running the same slot.
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/clock"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/robfig/cron/v3"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
+)
+
+const (
+	StatusRunning = "executando"
+	StatusSuccess = "sucesso"
+	StatusFailed  = "falha"
+
+	TriggerSchedule = "agendado"
+	TriggerCatchUp  = "recuperacao"
+	TriggerManual   = "manual"
+)
+
+var (
+	ErrUnknownJob     = errors.New("tarefa não encontrada")
+	ErrAlreadyRunning = errors.New("tarefa já está em execução")
+)
+
+// Job is a unit of periodic work.
+type Job struct {
+	Name string
+	// Schedule is a standard 5 field cron expression, evaluated in UTC unless
+	// prefixed with CRON_TZ=<zone>. An empty schedule means the job only runs
+	// when triggered manually.
+	Schedule string
+	Run      func(ctx context.Context) error
+}
+
+// JobInfo describes a registered job and its most recent execution.
+type JobInfo struct {
+	Name     string          `json:"name"`
+	Schedule string          `json:"schedule"`
+	NextRun  *time.Time      `json:"next_run"`
+	LastRun  *schemas.JobRun `json:"last_run"`
+}
+
+type registeredJob struct {
+	Job
+	schedule cron.Schedule
+}
+
+type Scheduler struct {
+	db       *gorm.DB
+	clock    clock.Clock
+	instance string
+	interval time.Duration
+	lease    time.Duration
+
+	mu   sync.Mutex
+	jobs map[string]*registeredJob
+	ctx  context.Context
+	wg   sync.WaitGroup
+}
+
+// Options tunes how often the scheduler looks for due jobs and how long a
+// running job holds its slot before another instance may take it over. The
+// lease is renewed while the job runs, so it only expires when the instance
+// running it stops.
+type Options struct {
+	Interval time.Duration
+	Lease    time.Duration
+}
+
+// DefaultOptions checks for due jobs every 30 seconds with a one hour lease.
+func DefaultOptions() Options {
+	return Options{Interval: 30 * time.Second, Lease: time.Hour}
+}
+
+// New creates a scheduler storing its runs in db, with the default options.
+func New(db *gorm.DB, clk clock.Clock) *Scheduler {
+	return NewWithOptions(db, clk, DefaultOptions())
+}
+
+// NewWithOptions creates a scheduler storing its runs in db.
+func NewWithOptions(db *gorm.DB, clk clock.Clock, options Options) *Scheduler {
+	host, _ := os.Hostname()
+	return &Scheduler{
+		db:       db,
+		clock:    clk,
+		instance: fmt.Sprintf("%s-%d", host, os.Getpid()),
+		interval: options.Interval,
+		lease:    options.Lease,
+		jobs:     map[string]*registeredJob{},
+		ctx:      context.Background(),
+	}
+}
+
+// Register adds a job, validating its cron expression.
+func (s *Scheduler) Register(job Job) error {
+	rj := &registeredJob{Job: job}
+	if job.Schedule != "" {
+		schedule, err := cron.ParseStandard(job.Schedule)
+		if err != nil {
+			return fmt.Errorf("expressão cron inválida para %s: %w", job.Name, err)
+		}
+		rj.schedule = schedule
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.jobs[job.Name] = rj
+	return nil
+}
+
+// Start checks for due jobs right away, catching up on anything missed while
+// the server was down, and then periodically until ctx is cancelled. It returns
+// immediately; jobs triggered from then on run with ctx as well. The returned
+// channel is closed once the scheduler stopped and running jobs finished.
+func (s *Scheduler) Start(ctx context.Context) <-chan struct{} {
+	log.Info().Str("instance", s.instance).Msg("[scheduler] Iniciando agendador")
+
+	s.mu.Lock()
+	s.ctx = ctx
+	s.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+
+		for {
+			s.RunDue(ctx)
+			select {
+			case <-ctx.Done():
+				s.wg.Wait()
+				log.Info().Msg("[scheduler] Agendador finalizado")
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+	return done
+}
+
+// RunDue runs, synchronously, every scheduled job whose most recent slot has
+// not been executed yet. Only the latest slot is run when several were missed.
+func (s *Scheduler) RunDue(ctx context.Context) {
+	now := s.clock.Now().UTC()
+
+	for _, job := range s.sortedJobs() {
+		if job.schedule == nil {
+			continue
+		}
+
+		// Without any previous run only the most recent slot of the last day
+		// is considered, so a new job does not replay its whole history.
+		var last schemas.JobRun
+		after, firstRun := now.Add(-24*time.Hour), true
+		if err := s.db.Where("job_name = ? AND triggered_by <> ?", job.Name, TriggerManual).
+			Order("scheduled_for DESC").First(&last).Error; err == nil {
+			after, firstRun = last.ScheduledFor, false
+		}
+
+		slot, missed := latestSlot(job.schedule, after, now)
+		if slot.IsZero() {
+			continue
+		}
+
+		trigger := TriggerSchedule
+		if missed > 1 && !firstRun {
+			trigger = TriggerCatchUp
+			log.Warn().
+				Str("job", job.Name).
+				Int("missedSlots", missed).
+				Time("slot", slot).
+				Msg("[scheduler] Execuções perdidas, executando apenas a mais recente")
+		}
+
+		run, ok := s.claim(job.Name, slot, trigger)
+		if !ok {
+			continue
+		}
+		s.execute(ctx, job, run)
+	}
+}
+
+// Trigger starts a manual run of the job in the background and returns the
+// claimed run record. The run uses the scheduler's context, not the caller's.
+func (s *Scheduler) Trigger(name string) (schemas.JobRun, error) {
+	s.mu.Lock()
+	job, ok := s.jobs[name]
+	ctx := s.ctx
+	s.mu.Unlock()
+	if !ok {
+		return schemas.JobRun{}, ErrUnknownJob
+	}
+
+	now := s.clock.Now().UTC()
+	var running int64
+	s.db.Model(&schemas.JobRun{}).
+		Where("job_name = ? AND status = ? AND lease_until > ?", name, StatusRunning, now).
+		Count(&running)
+	if running > 0 {
+		return schemas.JobRun{}, ErrAlreadyRunning
+	}
+
+	run, ok := s.claim(name, now.Truncate(time.Second), TriggerManual)
+	if !ok {
+		return schemas.JobRun{}, ErrAlreadyRunning
+	}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		s.execute(ctx, job, run)
+	}()
+	return run, nil
+}
+
+// Jobs lists the registered jobs with their next and last runs.
+func (s *Scheduler) Jobs() []JobInfo {
+	now := s.clock.Now().UTC()
+
+	var infos []JobInfo
+	for _, job := range s.sortedJobs() {
+		info := JobInfo{Name: job.Name, Schedule: job.Schedule}
+		if job.schedule != nil {
+			next := job.schedule.Next(now)
+			info.NextRun = &next
+		}
+		var last schemas.JobRun
+		if err := s.db.Where("job_name = ?", job.Name).Order("started_at DESC").First(&last).Error; err == nil {
+			info.LastRun = &last
+		}
+		infos = append(infos, info)
+	}
+	return infos
+}
+
+// Runs returns the most recent runs of a job.
+func (s *Scheduler) Runs(name string, limit int) ([]schemas.JobRun, error) {
+	var runs []schemas.JobRun
+	err := s.db.Where("job_name = ?", name).Order("started_at DESC").Limit(limit).Find(&runs).Error
+	return runs, err
+}
+
+// Wait blocks until manually triggered runs have finished.
+func (s *Scheduler) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Scheduler) sortedJobs() []*registeredJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]*registeredJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		jobs = append(jobs, job)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs
+}
+
+// claim records the run for the slot. The unique index on job and slot makes
+// the insert fail when another instance already claimed it; a run left
+// "running" by a crashed instance can be taken over once its lease expires.
+func (s *Scheduler) claim(name string, slot time.Time, trigger string) (schemas.JobRun, bool) {
+	now := s.clock.Now().UTC()
+	run := schemas.JobRun{
+		JobName:      name,
+		ScheduledFor: slot,
+		TriggeredBy:  trigger,
+		Status:       StatusRunning,
+		Instance:     s.instance,
+		StartedAt:    now,
+		LeaseUntil:   now.Add(s.lease),
+	}
+	// Conflicts are expected here, so the insert is not logged as an error
+	quiet := s.db.Session(&gorm.Session{Logger: s.db.Logger.LogMode(logger.Silent)})
+	if err := quiet.Create(&run).Error; err == nil {
+		return run, true
+	}
+
+	result := s.db.Model(&schemas.JobRun{}).
+		Where("job_name = ? AND scheduled_for = ? AND status = ? AND lease_until < ?", name, slot, StatusRunning, now).
+		Updates(map[string]interface{}{
+			"instance":    s.instance,
+			"started_at":  now,
+			"lease_until": now.Add(s.lease),
+		})
+	if result.Error != nil || result.RowsAffected == 0 {
+		return run, false
+	}
+
+	log.Warn().Str("job", name).Time("slot", slot).Msg("[scheduler] Assumindo execução abandonada")
+	if err := s.db.Where("job_name = ? AND scheduled_for = ?", name, slot).First(&run).Error; err != nil {
+		return run, false
+	}
+	return run, true
+}
+
+func (s *Scheduler) execute(ctx context.Context, job *registeredJob, run schemas.JobRun) {
+	log.Info().Str("job", job.Name).Str("trigger", run.TriggeredBy).Time("slot", run.ScheduledFor).Msg("[scheduler] Executando tarefa")
+
+	stop := make(chan struct{})
+	renewed := make(chan struct{})
+	go func() {
+		defer close(renewed)
+		s.renewLease(job.Name, run.ID, stop)
+	}()
+
+	err := func() (err error) {
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+			}
+		}()
+		return job.Run(ctx)
+	}()
+	close(stop)
+	<-renewed
+
+	updates := map[string]interface{}{
+		"status":      StatusSuccess,
+		"finished_at": s.clock.Now().UTC(),
+		"error":       "",
+	}
+	if err != nil {
+		updates["status"] = StatusFailed
+		updates["error"] = err.Error()
+		log.Error().Err(err).Str("job", job.Name).Msg("[scheduler] Tarefa falhou")
+	} else {
+		log.Info().Str("job", job.Name).Msg("[scheduler] Tarefa concluída")
+	}
+
+	if err := s.db.Model(&schemas.JobRun{}).Where("id = ?", run.ID).Updates(updates).Error; err != nil {
+		log.Error().Err(err).Str("job", job.Name).Msg("[scheduler] Erro ao registrar resultado da tarefa")
+	}
+}
+
+// renewLease extends the lease of the run every third of the lease until stop
+// is closed, so a job running longer than the lease is not taken over by
+// another instance. Renewing stops if the run was taken over anyway.
+func (s *Scheduler) renewLease(name string, id uint, stop <-chan struct{}) {
+	ticker := time.NewTicker(s.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		result := s.db.Model(&schemas.JobRun{}).
+			Where("id = ? AND status = ? AND instance = ?", id, StatusRunning, s.instance).
+			Update("lease_until", s.clock.Now().UTC().Add(s.lease))
+		if result.Error != nil {
+			log.Error().Err(result.Error).Str("job", name).Msg("[scheduler] Erro ao renovar execução da tarefa")
+			continue
+		}
+		if result.RowsAffected == 0 {
+			log.Warn().Str("job", name).Msg("[scheduler] Execução assumida por outra instância")
+			return
+		}
+	}
+}
+
+// latestSlot returns the most recent activation of schedule after `after` and
+// not later than now, together with how many activations fell in that range.
+func latestSlot(schedule cron.Schedule, after, now time.Time) (time.Time, int) {
+	var slot time.Time
+	count := 0
+	for t := schedule.Next(after); !t.After(now); t = schedule.Next(t) {
+		slot = t
+		count++
+	}
+	return slot, count
+}
@@ -0,0 +1,205 @@
+package scheduler
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/MWismeck/marca-tempo/src/clock"
+	"github.com/MWismeck/marca-tempo/src/db/dbtest"
+	"github.com/MWismeck/marca-tempo/src/schemas"
+	"github.com/rs/zerolog"
+	"gorm.io/gorm"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.Disabled)
+}
+
+func hourlyJob(counter *int32) Job {
+	return Job{Name: "hourly", Schedule: "0 * * * *", Run: func(ctx context.Context) error {
+		atomic.AddInt32(counter, 1)
+		return nil
+	}}
+}
+
+func runs(t *testing.T, database *gorm.DB) []schemas.JobRun {
+	t.Helper()
+	var runs []schemas.JobRun
+	database.Order("scheduled_for").Find(&runs)
+	return runs
+}
+
+func TestRunDueRunsEachSlotOnce(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+	s := New(database, fake)
+
+	var count int32
+	s.Register(hourlyJob(&count))
+
+	s.RunDue(context.Background())
+	s.RunDue(context.Background())
+	if count != 1 {
+		t.Fatalf("job ran %d times in the same slot, want 1", count)
+	}
+
+	fake.Advance(time.Hour)
+	s.RunDue(context.Background())
+	if count != 2 {
+		t.Fatalf("job ran %d times after next slot, want 2", count)
+	}
+
+	got := runs(t, database)
+	if got[1].Status != StatusSuccess || !got[1].ScheduledFor.Equal(time.Date(2025, 3, 10, 11, 0, 0, 0, time.UTC)) {
+		t.Errorf("second run = %s at %s", got[1].Status, got[1].ScheduledFor)
+	}
+}
+
+func TestRunDueCatchesUpOnlyLatestSlot(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+	s := New(database, fake)
+
+	var count int32
+	s.Register(hourlyJob(&count))
+	s.RunDue(context.Background())
+
+	// Server down for five hours
+	fake.Advance(5 * time.Hour)
+	s.RunDue(context.Background())
+
+	got := runs(t, database)
+	if count != 2 || len(got) != 2 {
+		t.Fatalf("count=%d runs=%d, want 2 and 2", count, len(got))
+	}
+	if got[1].TriggeredBy != TriggerCatchUp || !got[1].ScheduledFor.Equal(time.Date(2025, 3, 10, 15, 0, 0, 0, time.UTC)) {
+		t.Errorf("catch-up run = %s at %s", got[1].TriggeredBy, got[1].ScheduledFor)
+	}
+}
+
+func TestInstancesDoNotDoubleRun(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+
+	var count int32
+	first, second := New(database, fake), New(database, fake)
+	first.instance, second.instance = "a", "b"
+	first.Register(hourlyJob(&count))
+	second.Register(hourlyJob(&count))
+
+	first.RunDue(context.Background())
+	second.RunDue(context.Background())
+
+	if count != 1 {
+		t.Fatalf("job ran %d times across instances, want 1", count)
+	}
+}
+
+func TestManualJobOnlyRunsWhenTriggered(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+	s := New(database, fake)
+
+	var count int32
+	s.Register(Job{Name: "manual", Run: func(ctx context.Context) error {
+		atomic.AddInt32(&count, 1)
+		return fmt.Errorf("boom")
+	}})
+
+	s.RunDue(context.Background())
+	if count != 0 {
+		t.Fatalf("manual job ran on schedule")
+	}
+
+	if _, err := s.Trigger("manual"); err != nil {
+		t.Fatalf("trigger: %v", err)
+	}
+	s.Wait()
+
+	got := runs(t, database)
+	if count != 1 || len(got) != 1 || got[0].Status != StatusFailed || got[0].Error != "boom" {
+		t.Fatalf("count=%d runs=%+v", count, got)
+	}
+
+	if _, err := s.Trigger("missing"); err != ErrUnknownJob {
+		t.Errorf("trigger unknown job: %v", err)
+	}
+}
+
+func TestCancellingStartStopsRunningJobs(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+	s := New(database, fake)
+
+	started := make(chan struct{})
+	s.Register(Job{Name: "long", Run: func(ctx context.Context) error {
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := s.Start(ctx)
+	if _, err := s.Trigger("long"); err != nil {
+		t.Fatalf("trigger: %v", err)
+	}
+	<-started
+	cancel()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("scheduler did not stop")
+	}
+	if got := runs(t, database); len(got) != 1 || got[0].Status != StatusFailed || got[0].Error != context.Canceled.Error() {
+		t.Errorf("runs = %+v", got)
+	}
+}
+
+func TestLeaseIsRenewedWhileJobRuns(t *testing.T) {
+	database := dbtest.Open(t)
+	fake := clock.NewFake(time.Date(2025, 3, 10, 10, 5, 0, 0, time.UTC))
+	options := Options{Interval: time.Hour, Lease: 30 * time.Millisecond}
+
+	var count int32
+	release := make(chan struct{})
+	first, second := NewWithOptions(database, fake, options), NewWithOptions(database, fake, options)
+	first.instance, second.instance = "a", "b"
+	first.Register(Job{Name: "hourly", Schedule: "0 * * * *", Run: func(ctx context.Context) error {
+		atomic.AddInt32(&count, 1)
+		<-release
+		return nil
+	}})
+	second.Register(hourlyJob(&count))
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		first.RunDue(context.Background())
+	}()
+
+	// The job outlives its original lease; the renewed one keeps the slot
+	fake.Advance(time.Minute)
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := runs(t, database)
+		if len(got) == 1 && got[0].LeaseUntil.After(fake.Now()) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("lease was not renewed: %+v", got)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	second.RunDue(context.Background())
+	close(release)
+	<-done
+
+	if got := runs(t, database); count != 1 || len(got) != 1 || got[0].Instance != "a" || got[0].Status != StatusSuccess {
+		t.Errorf("count=%d runs=%+v", count, got)
+	}
+}
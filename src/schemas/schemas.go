@@ -3,6 +3,7 @@ package schemas
 import (
 	"time"
 
+	"github.com/MWismeck/marca-tempo/src/geo"
 	"gorm.io/gorm"
 )
 
@@ -20,7 +21,18 @@ type Employee struct {
 
 	// Referência à empresa pelo CNPJ
 	CompanyCNPJ string  `json:"company_cnpj" gorm:"type:varchar(20);not null"` // FK
-	Company     Company `gorm:"foreignKey:CompanyCNPJ;references:CNPJ;constraint:OnUpdate:CASCADE,OnDelete:SET NULL;"`
+	Company     Company `gorm:"foreignKey:CompanyCNPJ;references:CNPJ;constraint:OnUpdate:CASCADE,OnDelete:RESTRICT;"`
+
+	// Departamento/equipe ao qual o funcionário pertence (opcional)
+	DepartmentID *uint `json:"department_id"`
+	// Filial onde o funcionário trabalha (opcional, nil = matriz)
+	BranchID *uint `json:"branch_id"`
+
+	// Identificação no quiosque de ponto: matrícula e número do crachá, únicos
+	// dentro da empresa, e o PIN que os confirma (apenas o hash bcrypt)
+	Matricula    string `json:"matricula" gorm:"type:varchar(50);index"`
+	BadgeNumber  string `json:"badge_number" gorm:"type:varchar(50);index"`
+	KioskPINHash string `json:"-" gorm:"type:varchar(64);index"`
 
 	Login    Login     `gorm:"foreignKey:Email;references:Email;constraint:OnDelete:CASCADE"`
 	TimeLogs []TimeLog `gorm:"foreignKey:EmployeeEmail;references:Email"`
@@ -31,20 +43,93 @@ type PontoSolicitacao struct {
 	FuncionarioEmail  string    `json:"funcionario_email" gorm:"type:varchar(255);not null"`
 	DataSolicitada    time.Time `json:"data_solicitada"`
 	Motivo            string    `json:"motivo" gorm:"type:text"`
-	Status            string    `json:"status" gorm:"default:'pendente'"` // pendente, aprovado, rejeitado
+	Status            string    `json:"status" gorm:"type:varchar(20);default:'pendente'"` // pendente, aprovado, rejeitado
 	GerenteEmail      string    `json:"gerente_email" gorm:"type:varchar(255)"`
 	ComentarioGerente string    `json:"comentario_gerente" gorm:"type:text"`
 	ProcessadoEm      time.Time `json:"processado_em"`
 }
 
+// Department representa um departamento ou equipe dentro de uma empresa.
+// Departamentos podem ser aninhados através de ParentID; o gerente indicado em
+// ManagerEmail responde pelos funcionários do departamento e de todos os
+// departamentos abaixo dele.
+type Department struct {
+	gorm.Model
+	Name         string `json:"name" gorm:"not null"`
+	CompanyCNPJ  string `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	ParentID     *uint  `json:"parent_id"`
+	ManagerEmail string `json:"manager_email" gorm:"type:varchar(255);index"`
+}
+
 type Company struct {
 	gorm.Model
 	Name      string     `json:"name"`
-	CNPJ      string     `json:"cnpj" gorm:"unique;not null"` // CNPJ como chave única
+	CNPJ      string     `json:"cnpj" gorm:"type:varchar(20);unique;not null"` // CNPJ como chave única
 	Email     string     `json:"email"`
 	Fone      string     `json:"fone"`
 	Active    bool       `json:"active"`
-	Employees []Employee `gorm:"foreignKey:CompanyCNPJ;references:CNPJ"` // One-to-many via CNPJ
+	Timezone  string     `json:"timezone" gorm:"type:varchar(64);default:'America/Sao_Paulo'"` // Nome IANA usado nos cálculos de data
+	Employees []Employee `gorm:"foreignKey:CompanyCNPJ;references:CNPJ"`                       // One-to-many via CNPJ
+	Branches  []Branch   `json:"branches,omitempty" gorm:"foreignKey:CompanyCNPJ;references:CNPJ"`
+
+	// Tolerância diária em minutos (CLT art. 58 §1º): diferenças até este
+	// limite não geram horas extras nem faltantes
+	ToleranceMinutes int `json:"tolerance_minutes"`
+
+	// Exige autenticação em dois fatores de gerentes e administradores
+	RequireTwoFactor bool `json:"require_two_factor"`
+
+	// Login único (OpenID Connect) com o provedor de identidade da empresa.
+	// SSOEmailClaim é a claim do token com o email do funcionário (padrão
+	// "email"); o segredo é opcional, clientes públicos usam apenas PKCE.
+	SSOIssuer       string `json:"sso_issuer" gorm:"type:varchar(255)"`
+	SSOClientID     string `json:"sso_client_id" gorm:"type:varchar(255)"`
+	SSOClientSecret string `json:"-" gorm:"type:varchar(255)"`
+	SSOEmailClaim   string `json:"sso_email_claim" gorm:"type:varchar(100)"`
+
+	// Exige a leitura do QR code de um local de trabalho para registrar o
+	// ponto pela web (os quiosques já ficam no local)
+	RequireQRCode bool `json:"require_qr_code"`
+
+	// O que fazer com marcações fora das cercas virtuais da empresa:
+	// "aceitar" (padrão, não verifica), "sinalizar" (aceita e marca como fora
+	// da cerca) ou "rejeitar" (recusa, inclusive sem localização)
+	GeofencePolicy string `json:"geofence_policy" gorm:"type:varchar(20)"`
+}
+
+// Branch representa uma filial da empresa. Todas as filiais compartilham a raiz
+// do CNPJ da matriz e podem ter endereço, fuso horário, calendário de feriados
+// e jornada padrão próprios.
+type Branch struct {
+	gorm.Model
+	CompanyCNPJ string `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	// CNPJ próprio da filial; nil quando ela usa o da empresa, para que
+	// várias filiais sem CNPJ não colidam no índice único
+	CNPJ     *string `json:"cnpj" gorm:"type:varchar(20);unique"`
+	Name     string  `json:"name" gorm:"not null"`
+	Address  string  `json:"address"`
+	City     string  `json:"city"`
+	State    string  `json:"state" gorm:"type:varchar(2)"`
+	Timezone string  `json:"timezone"` // Nome IANA, ex.: America/Sao_Paulo
+	Active   bool    `json:"active"`
+
+	// Jornada padrão da filial no formato HH:MM
+	ScheduleEntry       string `json:"schedule_entry"`
+	ScheduleLunchExit   string `json:"schedule_lunch_exit"`
+	ScheduleLunchReturn string `json:"schedule_lunch_return"`
+	ScheduleExit        string `json:"schedule_exit"`
+	// Dias úteis separados por vírgula (0 = domingo ... 6 = sábado)
+	WorkDays string `json:"work_days" gorm:"type:varchar(20);default:'1,2,3,4,5'"`
+}
+
+// Holiday é um feriado da empresa. Quando BranchID é nil o feriado vale para
+// todas as filiais; caso contrário apenas para a filial indicada.
+type Holiday struct {
+	gorm.Model
+	CompanyCNPJ string    `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	BranchID    *uint     `json:"branch_id" gorm:"index"`
+	Date        time.Time `json:"date" gorm:"not null"`
+	Name        string    `json:"name"`
 }
 
 type EmployeeResponse struct {
@@ -87,8 +172,8 @@ func NewResponse(employees []Employee) []EmployeeResponse {
 
 type TimeLog struct {
 	gorm.Model
-	EmployeeEmail     string    `json:"employee_email" gorm:"type:varchar(255);not null"`
-	LogDate           time.Time `json:"log_date" gorm:"not null"`
+	EmployeeEmail     string    `json:"employee_email" gorm:"type:varchar(255);not null;uniqueIndex:idx_time_log_day"`
+	LogDate           time.Time `json:"log_date" gorm:"not null;uniqueIndex:idx_time_log_day"` // Dia no fuso da empresa, gravado como meia-noite UTC
 	EntryTime         time.Time `json:"entry_time,omitempty"`
 	LunchExitTime     time.Time `json:"lunch_exit_time,omitempty"`
 	LunchReturnTime   time.Time `json:"lunch_return_time,omitempty"`
@@ -96,14 +181,231 @@ type TimeLog struct {
 	ExtraHours        float32   `json:"extra_hours" gorm:"default:0"`
 	MissingHours      float32   `json:"missing_hours" gorm:"default:0"`
 	Balance           float32   `json:"balance" gorm:"default:0"`
+	Status            string    `json:"status" gorm:"type:varchar(20);index"` // Após o fechamento do dia: completo, incompleto, falta, folga ou feriado
 	CreatedAt         time.Time `json:"created_at" gorm:"autoCreateTime"`
 	EditadoPorGerente string    `json:"editado_por_gerente" gorm:"type:varchar(255)"`
 	EditadoEm         time.Time `json:"editado_em"`
 	MotivoEdicao      string    `json:"motivo_edicao" gorm:"type:text"`
 }
 
+// PunchRecord é cada marcação de ponto, na ordem em que aconteceu. O TimeLog
+// do dia guarda apenas os quatro horários; a origem de cada marcação fica
+// aqui.
+type PunchRecord struct {
+	gorm.Model
+	EmployeeEmail string    `json:"employee_email" gorm:"type:varchar(255);not null;index;uniqueIndex:idx_punch_records_idempotency,priority:1"`
+	TimeLogID     uint      `json:"time_log_id" gorm:"index"`
+	Punch         string    `json:"punch" gorm:"type:varchar(20)"` // entrada, saida_almoco, retorno_almoco ou saida
+	PunchedAt     time.Time `json:"punched_at" gorm:"index"`
+	// Local de trabalho confirmado pelo QR code lido na marcação
+	WorkplaceID *uint `json:"workplace_id"`
+
+	// Localização informada pelo dispositivo (graus decimais, precisão em
+	// metros) e o resultado da verificação das cercas virtuais: "dentro",
+	// "fora", "sem_localizacao" ou vazio quando a empresa não verifica
+	Latitude       *float64 `json:"latitude"`
+	Longitude      *float64 `json:"longitude"`
+	Accuracy       *float64 `json:"accuracy"`
+	GeofenceStatus string   `json:"geofence_status" gorm:"type:varchar(20)"`
+
+	// Origem da marcação (web, mobile, quiosque, edicao_manual, importacao ou
+	// solicitacao_aprovada) e de onde veio a requisição, para apurar
+	// contestações
+	Source    string `json:"source" gorm:"type:varchar(30);index"`
+	ClientIP  string `json:"client_ip" gorm:"type:varchar(45);index"`
+	UserAgent string `json:"user_agent" gorm:"type:varchar(255)"`
+	DeviceID  string `json:"device_id" gorm:"type:varchar(100);index"`
+
+	// Marcação feita sem conexão e sincronizada depois. DeviceTime é o
+	// horário no relógio do dispositivo; PunchedAt já vem corrigido pela
+	// diferença entre o relógio do dispositivo e o do servidor
+	Offline    bool       `json:"offline"`
+	DeviceTime *time.Time `json:"device_time"`
+	// Chave enviada pelo cliente, única por funcionário, para que o reenvio
+	// da mesma marcação não a registre de novo
+	IdempotencyKey *string `json:"idempotency_key" gorm:"type:varchar(100);uniqueIndex:idx_punch_records_idempotency,priority:2"`
+}
+
+// Workplace é um local de trabalho da empresa, opcionalmente de uma filial.
+// Uma tela no local exibe um QR code que muda a cada 30 segundos, gerado com
+// o segredo do local, e o celular do funcionário o envia junto com o ponto.
+type Workplace struct {
+	gorm.Model
+	CompanyCNPJ string `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	BranchID    *uint  `json:"branch_id"`
+	Name        string `json:"name" gorm:"not null"`
+	QRSecret    string `json:"-" gorm:"type:varchar(64);not null"`
+	Active      bool   `json:"active"`
+}
+
+// Geofence é uma cerca virtual de um local de trabalho: um círculo de raio
+// RadiusMeters em volta de Latitude/Longitude ou um polígono. Uma marcação
+// está dentro quando cai em qualquer cerca ativa da empresa.
+type Geofence struct {
+	gorm.Model
+	CompanyCNPJ  string      `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	WorkplaceID  uint        `json:"workplace_id" gorm:"index"`
+	Name         string      `json:"name"`
+	Kind         string      `json:"kind" gorm:"type:varchar(10);not null"` // circulo ou poligono
+	Latitude     float64     `json:"latitude"`
+	Longitude    float64     `json:"longitude"`
+	RadiusMeters float64     `json:"radius_meters"`
+	Polygon      []geo.Point `json:"polygon,omitempty" gorm:"type:text;serializer:json"`
+	Active       bool        `json:"active"`
+}
+
 type Login struct {
 	gorm.Model
 	Email    string `json:"email" gorm:"type:varchar(255);unique;not null"`
 	Password string `json:"password" gorm:"not null"`
+
+	// Autenticação em dois fatores (TOTP). O segredo gerado no cadastro só
+	// passa a ser exigido depois de confirmado com um código (TOTPEnabled);
+	// TOTPLastStep impede que o mesmo código seja usado duas vezes.
+	TOTPSecret   string `json:"-" gorm:"type:varchar(64)"`
+	TOTPEnabled  bool   `json:"totp_enabled"`
+	TOTPLastStep int64  `json:"-"`
+	// Desafio pendente do segundo passo do login (hash SHA-256)
+	ChallengeHash      string    `json:"-" gorm:"type:varchar(64)"`
+	ChallengeExpiresAt time.Time `json:"-"`
+
+	// Proteção contra força bruta: falhas consecutivas de senha ou código e
+	// o instante até o qual novas tentativas são recusadas
+	FailedAttempts int       `json:"failed_attempts"`
+	LockedUntil    time.Time `json:"locked_until"`
+}
+
+// KioskDevice é um terminal compartilhado (quiosque) de uma empresa, onde os
+// funcionários registram o ponto pelo crachá ou pela matrícula. O terminal se
+// autentica com uma chave, da qual apenas o hash é guardado.
+type KioskDevice struct {
+	gorm.Model
+	Name        string    `json:"name" gorm:"not null"`
+	CompanyCNPJ string    `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	KeyHash     string    `json:"-" gorm:"type:varchar(64);unique;not null"`
+	Active      bool      `json:"active"`
+	LastSeenAt  time.Time `json:"last_seen_at"`
+}
+
+// SSOIdentity vincula a identidade no provedor (issuer e sub) ao email do
+// funcionário, encontrado pela claim de email no primeiro login único. Os
+// logins seguintes usam o vínculo, mesmo que o email no provedor mude.
+type SSOIdentity struct {
+	gorm.Model
+	Issuer  string `json:"issuer" gorm:"type:varchar(255);not null;uniqueIndex:idx_sso_identity"`
+	Subject string `json:"subject" gorm:"type:varchar(255);not null;uniqueIndex:idx_sso_identity"`
+	Email   string `json:"email" gorm:"type:varchar(255);not null;index"`
+}
+
+// SSOLoginState guarda, entre o redirecionamento ao provedor e o retorno, o
+// state (apenas o hash), o nonce e o verificador PKCE de um login único.
+type SSOLoginState struct {
+	gorm.Model
+	StateHash   string    `gorm:"type:varchar(64);unique;not null"`
+	CompanyCNPJ string    `gorm:"type:varchar(20);not null"`
+	Nonce       string    `gorm:"type:varchar(64);not null"`
+	Verifier    string    `gorm:"type:varchar(128);not null"`
+	ExpiresAt   time.Time `gorm:"index"`
+}
+
+// LoginAttempt registra cada tentativa de login, bem-sucedida ou não, para
+// consulta dos administradores e para limitar as falhas por IP.
+type LoginAttempt struct {
+	gorm.Model
+	Email     string `json:"email" gorm:"type:varchar(255);index"`
+	IP        string `json:"ip" gorm:"type:varchar(64);index"`
+	UserAgent string `json:"user_agent" gorm:"type:varchar(512)"`
+	Success   bool   `json:"success"`
+	Reason    string `json:"reason" gorm:"type:varchar(50)"` // motivo da falha
+}
+
+// RecoveryCode é um código de recuperação de uso único, que substitui o código
+// TOTP quando o funcionário perde o celular. Apenas o hash é guardado.
+type RecoveryCode struct {
+	gorm.Model
+	Email    string    `json:"email" gorm:"type:varchar(255);not null;index"`
+	CodeHash string    `json:"-" gorm:"type:varchar(64);not null"`
+	UsedAt   time.Time `json:"used_at"`
+}
+
+// PasswordResetToken é um pedido de redefinição de senha. Apenas o hash SHA-256
+// do token enviado por e-mail é guardado; ele vale uma única vez, até
+// ExpiresAt.
+type PasswordResetToken struct {
+	gorm.Model
+	Email     string    `json:"email" gorm:"type:varchar(255);not null;index"`
+	TokenHash string    `json:"-" gorm:"type:varchar(64);unique;not null"`
+	ExpiresAt time.Time `json:"expires_at"`
+	UsedAt    time.Time `json:"used_at"` // zero enquanto não utilizado
+}
+
+// Session é o acesso aberto por um login concluído. Só o hash do token é
+// guardado; o cliente o envia no cabeçalho Authorization.
+type Session struct {
+	gorm.Model
+	EmployeeEmail string    `json:"employee_email" gorm:"type:varchar(255);not null;index"`
+	TokenHash     string    `json:"-" gorm:"type:varchar(64);unique;not null"`
+	ExpiresAt     time.Time `json:"expires_at" gorm:"index"`
+}
+
+// JobRun registra cada execução de uma tarefa agendada. O índice único por
+// tarefa e horário agendado garante que cada execução aconteça uma única vez,
+// mesmo com várias instâncias do servidor usando o mesmo banco.
+type JobRun struct {
+	gorm.Model
+	JobName      string    `json:"job_name" gorm:"type:varchar(100);not null;uniqueIndex:idx_job_run_slot"`
+	ScheduledFor time.Time `json:"scheduled_for" gorm:"not null;uniqueIndex:idx_job_run_slot"`
+	TriggeredBy  string    `json:"triggered_by" gorm:"type:varchar(20)"` // agendado, recuperacao, manual
+	Status       string    `json:"status" gorm:"type:varchar(20)"`       // executando, sucesso, falha
+	Instance     string    `json:"instance" gorm:"type:varchar(255)"`
+	StartedAt    time.Time `json:"started_at"`
+	FinishedAt   time.Time `json:"finished_at"`
+	LeaseUntil   time.Time `json:"lease_until"`
+	Error        string    `json:"error" gorm:"type:text"`
+}
+
+// RecalculationTask é um recálculo de horas disparado por uma mudança de
+// jornada, filial ou regra da empresa. Apenas os registros a partir de
+// FromDate (e até ToDate, quando informada) dos funcionários no escopo
+// (empresa, filial ou funcionário) são recalculados, em segundo plano.
+type RecalculationTask struct {
+	gorm.Model
+	CompanyCNPJ   string    `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	BranchID      *uint     `json:"branch_id"`
+	EmployeeEmail string    `json:"employee_email" gorm:"type:varchar(255)"`
+	FromDate      time.Time `json:"from_date"`
+	ToDate        time.Time `json:"to_date"` // inclusiva; zero = sem limite
+	Reason        string    `json:"reason" gorm:"type:text"`
+	RequestedBy   string    `json:"requested_by" gorm:"type:varchar(255)"`
+	Status        string    `json:"status" gorm:"type:varchar(20);index"` // pendente, executando, concluido, falha
+	Total         int       `json:"total"`
+	Processed     int       `json:"processed"`
+	Changed       int       `json:"changed"`
+	StartedAt     time.Time `json:"started_at"`
+	HeartbeatAt   time.Time `json:"heartbeat_at"` // renovado durante o processamento
+	FinishedAt    time.Time `json:"finished_at"`
+	Error         string    `json:"error" gorm:"type:text"`
+}
+
+// WorkRule é uma versão da jornada semanal de um funcionário ou da tolerância
+// de uma empresa, válida de EffectiveFrom até a versão seguinte. Cada registro
+// de ponto é calculado com as versões válidas no seu dia.
+type WorkRule struct {
+	gorm.Model
+	CompanyCNPJ   string    `json:"company_cnpj" gorm:"type:varchar(20);not null;index"`
+	EmployeeEmail string    `json:"employee_email" gorm:"type:varchar(255);index"` // vazio nas regras da empresa
+	Kind          string    `json:"kind" gorm:"type:varchar(20);not null"`         // jornada, tolerancia
+	Value         float32   `json:"value"`
+	EffectiveFrom time.Time `json:"effective_from"`
+}
+
+// AuditLog é o histórico de auditoria: cada alteração relevante em uma
+// entidade, quem a fez e os detalhes da mudança.
+type AuditLog struct {
+	gorm.Model
+	Entity   string `json:"entity" gorm:"type:varchar(50);index:idx_audit_entity"`
+	EntityID uint   `json:"entity_id" gorm:"index:idx_audit_entity"`
+	Action   string `json:"action" gorm:"type:varchar(50)"`
+	Actor    string `json:"actor" gorm:"type:varchar(255)"`
+	Details  string `json:"details" gorm:"type:text"`
 }
@@ -0,0 +1,44 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B, SHA1 with the secret "12345678901234567890".
+func TestCodeMatchesRFCVectors(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	for unix, want := range map[int64]string{
+		59:          "287082",
+		1111111109:  "081804",
+		1234567890:  "005924",
+		20000000000: "353130",
+	} {
+		got, err := Code(secret, Step(time.Unix(unix, 0)))
+		if err != nil || got != want {
+			t.Errorf("code at %d = %s, %v, want %s", unix, got, err, want)
+		}
+	}
+}
+
+func TestValidateAcceptsSkewAndRejectsReplay(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Date(2025, 3, 10, 9, 0, 0, 0, time.UTC)
+	previous, _ := Code(secret, Step(now)-1)
+
+	step, ok := Validate(secret, previous, now, 0)
+	if !ok || step != Step(now)-1 {
+		t.Fatalf("previous step code rejected")
+	}
+	if _, ok := Validate(secret, previous, now, step); ok {
+		t.Errorf("code accepted twice")
+	}
+	old, _ := Code(secret, Step(now)-3)
+	if _, ok := Validate(secret, old, now, 0); ok {
+		t.Errorf("code from 90 seconds ago accepted")
+	}
+}